@@ -78,6 +78,12 @@ type Action struct {
 // that all actions are really small and atomic.
 type Pipeline struct {
 	actions []*Action
+
+	// The action that failed in the last execution, if any.
+	failed *Action
+
+	// mutex for the failed action
+	fMutex sync.Mutex
 }
 
 // NewPipeline creates a new pipeline instance with the given list of actions.
@@ -92,6 +98,23 @@ func (p *Pipeline) Result() Result {
 	return action.result
 }
 
+// FailedAction returns the name of the action whose Forward failed in the last
+// execution of the pipeline, or an empty string if it did not fail.
+func (p *Pipeline) FailedAction() string {
+	p.fMutex.Lock()
+	defer p.fMutex.Unlock()
+	if p.failed == nil {
+		return ""
+	}
+	return p.failed.Name
+}
+
+func (p *Pipeline) setFailed(a *Action) {
+	p.fMutex.Lock()
+	defer p.fMutex.Unlock()
+	p.failed = a
+}
+
 // Execute executes the pipeline.
 //
 // The execution starts in the forward phase, calling the Forward function of
@@ -112,6 +135,7 @@ func (p *Pipeline) Execute(params ...interface{}) error {
 	if len(p.actions) == 0 {
 		return errors.New("No actions to execute.")
 	}
+	p.setFailed(nil)
 	fwCtx := FWContext{Params: params}
 	for i, a := range p.actions {
 		log.Debugf("[pipeline] running the Forward for the %s action", a.Name)
@@ -128,6 +152,7 @@ func (p *Pipeline) Execute(params ...interface{}) error {
 		}
 		if err != nil {
 			log.Debugf("[pipeline] error running the Forward for the %s action - %s", a.Name, err)
+			p.setFailed(a)
 			p.rollback(i-1, params)
 			return err
 		}
@@ -50,6 +50,17 @@ func (s *S) TestRollback(c *gocheck.C) {
 	c.Assert(err.Error(), gocheck.Equals, "Failed to execute.")
 }
 
+func (s *S) TestFailedAction(c *gocheck.C) {
+	pipeline := NewPipeline(&helloAction, &errorAction)
+	err := pipeline.Execute("hello")
+	c.Assert(err, gocheck.NotNil)
+	c.Assert(pipeline.FailedAction(), gocheck.Equals, "error")
+	pipeline = NewPipeline(&helloAction)
+	err = pipeline.Execute("hello")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(pipeline.FailedAction(), gocheck.Equals, "")
+}
+
 func (s *S) TestRollbackUnrollbackableAction(c *gocheck.C) {
 	actions := []*Action{
 		&helloAction,
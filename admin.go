@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// The content type of the Prometheus text format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// adminHandler returns the handler of the admin listener, which is meant for
+// the load balancers and the monitoring, not for the clients of the API:
+//
+//	/healthz answers 200 as long as the server runs
+//	/readyz answers 200 if the database can serve requests, 503 otherwise
+//	/metrics returns the metrics in the Prometheus text format
+//
+// The answers are plain text, and there is no authentication: the admin
+// listener must not be reachable from the outside.
+func adminHandler(db DB, mt *Metrics) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := db.Ping(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "the database is not available: %s\n", err)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", metricsContentType)
+		// The write only fails if the client is gone
+		mt.write(w, db)
+	})
+	return mux
+}
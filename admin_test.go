@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+
+	"launchpad.net/gocheck"
+)
+
+func (s *S) TestAdminHandler(c *gocheck.C) {
+	db, err := openFileDB(filepath.Join(c.MkDir(), "albums.db"))
+	c.Assert(err, gocheck.IsNil)
+	h := adminHandler(db, &Metrics{})
+	get := func(path string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/healthz")
+	c.Assert(w.Code, gocheck.Equals, http.StatusOK)
+	c.Assert(w.Body.String(), gocheck.Equals, "ok\n")
+	c.Assert(get("/readyz").Code, gocheck.Equals, http.StatusOK)
+	w = get("/metrics")
+	c.Assert(w.Code, gocheck.Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Content-Type"), gocheck.Equals, metricsContentType)
+	c.Assert(strings.Contains(w.Body.String(), "\njindou_albums 0\n"), gocheck.Equals, true)
+
+	// A closed database is not ready, but the server is still alive
+	c.Assert(db.Close(), gocheck.IsNil)
+	w = get("/readyz")
+	c.Assert(w.Code, gocheck.Equals, http.StatusServiceUnavailable)
+	c.Assert(w.Body.String(), gocheck.Matches, "the database is not available: .*\n")
+	c.Assert(get("/healthz").Code, gocheck.Equals, http.StatusOK)
+}
@@ -2,101 +2,203 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/codegangsta/martini"
 )
 
-// GetAlbums returns the list of albums (possibly filtered).
-func GetAlbums(r *http.Request, enc Encoder, db DB) string {
+// GetAlbums returns a page of the list of albums (possibly filtered and sorted).
+// The pagination metadata is part of the encoded page, and is also sent in the
+// X-Total-Count and Link headers. The page is streamed to the response rather
+// than returned as a string.
+func GetAlbums(w http.ResponseWriter, r *http.Request, enc Encoder, fail Fail, db DB, t *Token) {
 	// Get the query string arguments, if any
 	qs := r.URL.Query()
-	band, title, yrs := qs.Get("band"), qs.Get("title"), qs.Get("year")
-	yri, err := strconv.Atoi(yrs)
+	q, err := parseQuery(qs, t.UserId)
 	if err != nil {
-		// If year is not a valid integer, ignore it
-		yri = 0
+		writeError(w, fail, err)
+		return
 	}
-	if band != "" || title != "" || yri != 0 {
-		// At least one filter, use Find()
-		return Must(enc.Encode(toIface(db.Find(band, title, yri))...))
+	p := q.Apply(db.GetAll())
+	p.SetLinks(qs)
+	setPageHeaders(w, p)
+	// The Last-Modified header of the page does not account for deleted albums,
+	// so only its ETag is used to answer conditional requests.
+	etag := pageETag(p)
+	w.Header().Set("ETag", etag)
+	var mod time.Time
+	for _, a := range p.Albums {
+		if a.Updated.After(mod) {
+			mod = a.Updated
+		}
 	}
-	// Otherwise, return all albums
-	return Must(enc.Encode(toIface(db.GetAll())...))
+	if !mod.IsZero() {
+		w.Header().Set("Last-Modified", mod.Format(http.TimeFormat))
+	}
+	if notModified(r, etag, time.Time{}) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	Stream(w, http.StatusOK, enc, p)
 }
 
-// GetAlbum returns the requested album.
-func GetAlbum(enc Encoder, db DB, parms martini.Params) (int, string) {
+// Sends the pagination metadata of the page in the X-Total-Count and Link
+// headers.
+func setPageHeaders(w http.ResponseWriter, p *Page) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(p.Total))
+	var links []string
+	if p.Next != "" {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, p.Next))
+	}
+	if p.Prev != "" {
+		links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, p.Prev))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
+
+// GetAlbum returns the requested album, or a 304 if it matches the validators
+// of a conditional request.
+func GetAlbum(w http.ResponseWriter, r *http.Request, enc Encoder, fail Fail, db DB, parms martini.Params) (int, string) {
 	id, err := strconv.Atoi(parms["id"])
 	al := db.Get(id)
 	if err != nil || al == nil {
 		// Invalid id, or does not exist
-		return http.StatusNotFound, Must(enc.Encode(
-			NewError(ErrCodeNotExist, fmt.Sprintf("the album with id %s does not exist", parms["id"]))))
+		return fail(NewError(ErrCodeNotExist, fmt.Sprintf("the album with id %s does not exist", parms["id"])))
+	}
+	setAlbumValidators(w, al)
+	if notModified(r, albumETag(al), al.Updated) {
+		return http.StatusNotModified, ""
 	}
 	return http.StatusOK, Must(enc.Encode(al))
 }
 
-// AddAlbum creates the posted album.
-func AddAlbum(w http.ResponseWriter, r *http.Request, enc Encoder, db DB) (int, string) {
-	al := getPostAlbum(r)
+// AddAlbum creates the posted album, owned by the authenticated user.
+func AddAlbum(w http.ResponseWriter, r *http.Request, enc Encoder, fail Fail, db DB, t *Token) (int, string) {
+	al, err := getPostAlbum(r)
+	if err != nil {
+		return fail(err)
+	}
+	al.Owner = t.UserId
 	id, err := db.Add(al)
 	switch err {
 	case ErrAlreadyExists:
 		// Duplicate
-		return http.StatusConflict, Must(enc.Encode(
-			NewError(ErrCodeAlreadyExists, fmt.Sprintf("the album '%s' from '%s' already exists", al.Title, al.Band))))
+		return fail(NewError(ErrCodeAlreadyExists, fmt.Sprintf("the album '%s' from '%s' already exists", al.Title, al.Band)))
 	case nil:
 		// TODO : Location is expected to be an absolute URI, as per the RFC2616
 		w.Header().Set("Location", fmt.Sprintf("/albums/%d", id))
+		setAlbumValidators(w, al)
 		return http.StatusCreated, Must(enc.Encode(al))
 	default:
 		panic(err)
 	}
 }
 
-// UpdateAlbum changes the specified album.
-func UpdateAlbum(r *http.Request, enc Encoder, db DB, parms martini.Params) (int, string) {
-	al, err := getPutAlbum(r, parms)
+// UpdateAlbum changes the specified album, if the authenticated user owns it or
+// is an admin. If the request has an If-Match header, the album is changed only
+// if its current version matches. The owner of the album is kept.
+func UpdateAlbum(w http.ResponseWriter, r *http.Request, enc Encoder, fail Fail, db DB, udb UserDB, t *Token, parms martini.Params) (int, string) {
+	id, err := strconv.Atoi(parms["id"])
 	if err != nil {
 		// Invalid id, 404
-		return http.StatusNotFound, Must(enc.Encode(
-			NewError(ErrCodeNotExist, fmt.Sprintf("the album with id %s does not exist", parms["id"]))))
+		return fail(NewError(ErrCodeNotExist, fmt.Sprintf("the album with id %s does not exist", parms["id"])))
 	}
-	err = db.Update(al)
+	al, err := getPutAlbum(r, id)
+	if err != nil {
+		return fail(err)
+	}
+	al, err = db.Modify(id, func(cur *Album) (*Album, error) {
+		if !canModify(udb, t, cur) {
+			return nil, ErrForbidden
+		}
+		if !ifMatch(r, cur) {
+			return nil, ErrPreconditionFailed
+		}
+		al.Owner = cur.Owner
+		return al, nil
+	})
 	switch err {
+	case ErrNotExist:
+		return fail(NewError(ErrCodeNotExist, fmt.Sprintf("the album with id %s does not exist", parms["id"])))
+	case ErrForbidden:
+		return fail(albumForbidden(parms["id"]))
+	case ErrPreconditionFailed:
+		return fail(NewError(ErrCodePreconditionFailed, fmt.Sprintf("the album with id %s has been modified", parms["id"])))
 	case ErrAlreadyExists:
-		return http.StatusConflict, Must(enc.Encode(
-			NewError(ErrCodeAlreadyExists, fmt.Sprintf("the album '%s' from '%s' already exists", al.Title, al.Band))))
+		return fail(NewError(ErrCodeAlreadyExists, "the updated album already exists"))
 	case nil:
+		setAlbumValidators(w, al)
 		return http.StatusOK, Must(enc.Encode(al))
 	default:
 		panic(err)
 	}
 }
 
-// Parse the request body, load into an Album structure.
-func getPostAlbum(r *http.Request) *Album {
-	band, title, yrs := r.FormValue("band"), r.FormValue("title"), r.FormValue("year")
-	yri, err := strconv.Atoi(yrs)
+// PatchAlbum applies the JSON Merge Patch (RFC 7396) or JSON Patch (RFC 6902)
+// of the request body to the specified album. The patch is applied atomically,
+// and the patched album must be valid and unique. As with UpdateAlbum, an
+// If-Match header makes the patch conditional on the current version, and only
+// the owner of the album or an admin can patch it.
+func PatchAlbum(w http.ResponseWriter, r *http.Request, enc Encoder, fail Fail, db DB, udb UserDB, t *Token, parms martini.Params) (int, string) {
+	id, err := strconv.Atoi(parms["id"])
 	if err != nil {
-		yri = 0 // Year is optional, set to 0 if invalid/unspecified
+		return fail(NewError(ErrCodeNotExist, fmt.Sprintf("the album with id %s does not exist", parms["id"])))
 	}
-	return &Album{
-		Band:  band,
-		Title: title,
-		Year:  yri,
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		panic(err)
+	}
+	p, err := parsePatch(mt, b)
+	if err != nil {
+		return fail(err)
 	}
+	al, err := db.Modify(id, func(a *Album) (*Album, error) {
+		if !canModify(udb, t, a) {
+			return nil, ErrForbidden
+		}
+		if !ifMatch(r, a) {
+			return nil, ErrPreconditionFailed
+		}
+		return applyPatch(a, p)
+	})
+	switch err {
+	case ErrNotExist:
+		return fail(NewError(ErrCodeNotExist, fmt.Sprintf("the album with id %s does not exist", parms["id"])))
+	case ErrForbidden:
+		return fail(albumForbidden(parms["id"]))
+	case ErrPreconditionFailed:
+		return fail(NewError(ErrCodePreconditionFailed, fmt.Sprintf("the album with id %s has been modified", parms["id"])))
+	case ErrAlreadyExists:
+		return fail(NewError(ErrCodeAlreadyExists, "the patched album already exists"))
+	case nil:
+		setAlbumValidators(w, al)
+		return http.StatusOK, Must(enc.Encode(al))
+	}
+	if e, ok := err.(*Error); ok {
+		// The patch is well-formed, but cannot be applied to this album
+		return fail(e.WithStatus(http.StatusUnprocessableEntity))
+	}
+	panic(err)
 }
 
-// Like getPostAlbum, but additionnally, parse and store the `id` query string.
-func getPutAlbum(r *http.Request, parms martini.Params) (*Album, error) {
-	al := getPostAlbum(r)
-	id, err := strconv.Atoi(parms["id"])
+// Like getPostAlbum, but additionnally, set the id of the album to the one
+// specified in the URL. The body may repeat the id, but not change it.
+func getPutAlbum(r *http.Request, id int) (*Album, error) {
+	al, err := getPostAlbum(r)
 	if err != nil {
 		return nil, err
 	}
+	if al.Id != 0 && al.Id != id {
+		return nil, invalidAlbum(&FieldError{Field: "id", Message: "does not match the id of the URL"})
+	}
 	al.Id = id
 	return al, nil
 }
@@ -105,16 +207,41 @@ func getPutAlbum(r *http.Request, parms martini.Params) (*Album, error) {
 // status code. Delete is an idempotent action, but this does not mean it should
 // always return 204 - No content, idempotence relates to the state of the server
 // after the request, not the returned status code. So I return a 404 - Not found
-// if the id does not exist.
-func DeleteAlbum(enc Encoder, db DB, parms martini.Params) (int, string) {
+// if the id does not exist, a 403 - Forbidden if the authenticated user neither
+// owns the album nor is an admin, and a 412 - Precondition failed if the If-Match
+// header does not match the current version. The HTML views get a 303 - See
+// other to the albums instead of the 204, as a browser stays on the page of the
+// form otherwise.
+func DeleteAlbum(w http.ResponseWriter, r *http.Request, enc Encoder, fail Fail, db DB, udb UserDB, t *Token, parms martini.Params) (int, string) {
 	id, err := strconv.Atoi(parms["id"])
-	al := db.Get(id)
-	if err != nil || al == nil {
-		return http.StatusNotFound, Must(enc.Encode(
-			NewError(ErrCodeNotExist, fmt.Sprintf("the album with id %s does not exist", parms["id"]))))
+	if err != nil {
+		return fail(NewError(ErrCodeNotExist, fmt.Sprintf("the album with id %s does not exist", parms["id"])))
+	}
+	err = db.DeleteIf(id, func(a *Album) error {
+		if !canModify(udb, t, a) {
+			return ErrForbidden
+		}
+		if !ifMatch(r, a) {
+			return ErrPreconditionFailed
+		}
+		return nil
+	})
+	switch err {
+	case ErrNotExist:
+		return fail(NewError(ErrCodeNotExist, fmt.Sprintf("the album with id %s does not exist", parms["id"])))
+	case ErrForbidden:
+		return fail(albumForbidden(parms["id"]))
+	case ErrPreconditionFailed:
+		return fail(NewError(ErrCodePreconditionFailed, fmt.Sprintf("the album with id %s has been modified", parms["id"])))
+	case nil:
+		if _, ok := enc.(htmlEncoder); ok {
+			w.Header().Set("Location", "/albums.html")
+			return http.StatusSeeOther, ""
+		}
+		return http.StatusNoContent, ""
+	default:
+		panic(err)
 	}
-	db.Delete(id)
-	return http.StatusNoContent, ""
 }
 
 func toIface(v []*Album) []interface{} {
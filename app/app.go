@@ -53,6 +53,7 @@ type App struct {
 	Owner    string
 	State    string
 	Deploys  uint
+	Lock     *AppLock `bson:",omitempty"`
 	quota.Quota
 
 	hr hookRunner
@@ -231,11 +232,21 @@ func (app *App) AddUnit(u *Unit) {
 }
 
 // AddUnits creates n new units within the provisioner, saves new units in the
-// database and enqueues the apprc serialization.
+// database and enqueues the apprc serialization. It holds the lock of the app,
+// and reloads the app once it has it, as another operation may have changed
+// the units in the meantime.
 func (app *App) AddUnits(n uint) error {
 	if n == 0 {
 		return stderr.New("Cannot add zero units.")
 	}
+	lock, err := lockApp(app.Name, "add-units")
+	if err != nil {
+		return err
+	}
+	defer unlockApp(app.Name, lock)
+	if err := app.Get(); err != nil {
+		return err
+	}
 	return action.NewPipeline(
 		&reserveUnitsToAdd,
 		&provisionAddUnits,
@@ -318,18 +329,27 @@ func (app *App) removeUnits(indices []int) {
 //     2. Unbind units from service instances bound to the app
 //     3. Remove units from the app list
 //     4. Update the app in the database
+//
+// It holds the lock of the app, and reloads the app once it has it, so that the
+// number of units is checked against the current ones.
 func (app *App) RemoveUnits(n uint) error {
 	if n == 0 {
 		return stderr.New("Cannot remove zero units.")
-	} else if l := uint(len(app.Units)); l == n {
+	}
+	lock, err := lockApp(app.Name, "remove-units")
+	if err != nil {
+		return err
+	}
+	defer unlockApp(app.Name, lock)
+	if err := app.Get(); err != nil {
+		return err
+	}
+	if l := uint(len(app.Units)); l == n {
 		return stderr.New("Cannot remove all units from an app.")
 	} else if n > l {
 		return fmt.Errorf("Cannot remove %d units from this app, it has only %d units.", n, l)
 	}
-	var (
-		removed []int
-		err     error
-	)
+	var removed []int
 	units := UnitSlice(app.Units)
 	sort.Sort(units)
 	for i := 0; i < int(n); i++ {
@@ -605,32 +625,156 @@ func (app *App) GetDeploys() uint {
 	return app.Deploys
 }
 
+// The statuses of a deploy. A deploy is queued, then running, then it either
+// succeeds or fails. A succeeded deploy is rolled back when a rollback
+// replaces it with an earlier version.
+const (
+	DeployQueued     = "queued"
+	DeployRunning    = "running"
+	DeploySucceeded  = "succeeded"
+	DeployFailed     = "failed"
+	DeployRolledBack = "rolled-back"
+)
+
+// The statuses a deploy can move to, by status.
+var deployTransitions = map[string][]string{
+	DeployQueued:    {DeployRunning, DeployFailed},
+	DeployRunning:   {DeploySucceeded, DeployFailed},
+	DeploySucceeded: {DeployRolledBack},
+}
+
+// Deploy is a record of the deploy history of an app: which version was
+// deployed, by whom, how it went and the end of its output. Every attempt is
+// recorded, and a rollback is recorded as a deploy of the version it
+// restores. When a deploy fails, Action is the name of the action of the
+// pipeline that failed. A blue/green deploy is recorded in the history of the
+// live app, with the name of its Standby app, see BlueGreenDeploy.
 type Deploy struct {
-	App       string
-	Timestamp time.Time
-	Duration  time.Duration
+	ID          bson.ObjectId `bson:"_id,omitempty"`
+	App         string
+	Timestamp   time.Time
+	Duration    time.Duration
+	Version     string
+	User        string
+	Status      string
+	Action      string
+	Error       string
+	Log         string
+	Rollback    bool
+	Standby     string `bson:",omitempty"`
+	SwappedBack bool   `bson:",omitempty"`
+}
+
+// setStatus moves the deploy to the status, with the other changes of its
+// record. It fails if the transition is not allowed, or if the deploy has been
+// moved to another status in the meantime.
+func (d *Deploy) setStatus(conn *db.Storage, status string, changes bson.M) error {
+	allowed := false
+	for _, to := range deployTransitions[d.Status] {
+		allowed = allowed || to == status
+	}
+	if !allowed {
+		return fmt.Errorf("Cannot move a deploy from %q to %q.", d.Status, status)
+	}
+	if changes == nil {
+		changes = bson.M{}
+	}
+	changes["status"] = status
+	err := conn.Deploys().Update(bson.M{"_id": d.ID, "status": d.Status}, bson.M{"$set": changes})
+	if err == mgo.ErrNotFound {
+		return fmt.Errorf("The deploy is no longer %q.", d.Status)
+	}
+	if err != nil {
+		return err
+	}
+	d.Status = status
+	return nil
+}
+
+// fail moves the deploy to DeployFailed, recording err along with the changes,
+// and returns err. The error of the deploy matters more than the one of its
+// record, which is ignored, so that no deploy is left queued or running by an
+// error of deployApp.
+func (d *Deploy) fail(conn *db.Storage, err error, changes bson.M) error {
+	if changes == nil {
+		changes = bson.M{}
+	}
+	changes["error"] = err.Error()
+	d.setStatus(conn, DeployFailed, changes)
+	return err
+}
+
+// DeployFilter selects the deploys listed by ListDeploys. The zero value of
+// each field matches any deploy, and a zero Limit lists them all.
+type DeployFilter struct {
+	App     string
+	Status  string
+	User    string
+	Version string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+func (f *DeployFilter) query() bson.M {
+	q := bson.M{}
+	if f.App != "" {
+		q["app"] = f.App
+	}
+	if f.Status != "" {
+		q["status"] = f.Status
+	}
+	if f.User != "" {
+		q["user"] = f.User
+	}
+	if f.Version != "" {
+		q["version"] = f.Version
+	}
+	if !f.Since.IsZero() || !f.Until.IsZero() {
+		ts := bson.M{}
+		if !f.Since.IsZero() {
+			ts["$gte"] = f.Since
+		}
+		if !f.Until.IsZero() {
+			ts["$lt"] = f.Until
+		}
+		q["timestamp"] = ts
+	}
+	return q
 }
 
-func (app *App) ListDeploys() ([]Deploy, error) {
-	return listDeploys(app)
+// ListDeploys returns the deploys of the app that match the filter, which may
+// be nil, most recent first.
+func (app *App) ListDeploys(filter *DeployFilter) ([]Deploy, error) {
+	f := DeployFilter{}
+	if filter != nil {
+		f = *filter
+	}
+	f.App = app.Name
+	return listDeploys(&f)
 }
 
-func ListDeploys() ([]Deploy, error) {
-	return listDeploys(nil)
+// ListDeploys returns the deploys of all apps that match the filter, which
+// may be nil, most recent first.
+func ListDeploys(filter *DeployFilter) ([]Deploy, error) {
+	if filter == nil {
+		filter = &DeployFilter{}
+	}
+	return listDeploys(filter)
 }
 
-func listDeploys(app *App) ([]Deploy, error) {
+func listDeploys(filter *DeployFilter) ([]Deploy, error) {
 	var list []Deploy
 	conn, err := db.Conn()
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
-	var qr interface{}
-	if app != nil {
-		qr = bson.M{"app": app.Name}
+	query := conn.Deploys().Find(filter.query()).Sort("-timestamp")
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
 	}
-	if err := conn.Deploys().Find(qr).Sort("-timestamp").All(&list); err != nil {
+	if err := query.All(&list); err != nil {
 		return nil, err
 	}
 	return list, err
@@ -880,40 +1024,136 @@ func List(u *auth.User) ([]App, error) {
 	return apps, nil
 }
 
-// Swap calls the Provisioner.Swap.
+// Swap calls the Provisioner.Swap. See BlueGreenDeploy for a swap that checks
+// the health of the standby app first.
 func Swap(app1, app2 *App) error {
 	return Provisioner.Swap(app1, app2)
 }
 
-// DeployApp calls the Provisioner.Deploy
-func DeployApp(app *App, version string, writer io.Writer) error {
-	start := time.Now()
-	pipeline := Provisioner.DeployPipeline()
-	if pipeline == nil {
-		actions := []*action.Action{&ProvisionerDeploy, &IncrementDeploy}
-		pipeline = action.NewPipeline(actions...)
+// DeployApp calls the Provisioner.Deploy. Every deploy is recorded in the
+// history of the app, with its status, see Deploy. The deploy is queued until
+// it gets the lock of the app, and fails if it cannot get it.
+func DeployApp(app *App, version, user string, writer io.Writer) error {
+	return deployApp(app, version, user, writer, false)
+}
+
+// Rollback deploys again a version that has been successfully deployed
+// before, using the same pipeline as DeployApp. The rollback is recorded as a
+// deploy of that version, and the deploy it replaces is rolled back. The
+// blue/green deploys recorded in the history of the app are not considered,
+// their version has been deployed to the standby app.
+func (app *App) Rollback(version, user string, writer io.Writer) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	n, err := conn.Deploys().Find(bson.M{
+		"app":     app.Name,
+		"version": version,
+		"status":  bson.M{"$in": []string{DeploySucceeded, DeployRolledBack}},
+		"standby": bson.M{"$exists": false},
+	}).Count()
+	if err != nil {
+		return err
+	}
+	if version == "" || n == 0 {
+		return fmt.Errorf("The version %q has never been deployed to the app %q.", version, app.Name)
 	}
-	logWriter := LogWriter{App: app, Writer: writer}
-	err := pipeline.Execute(app, version, &logWriter)
+	return deployApp(app, version, user, writer, true)
+}
+
+func deployApp(app *App, version, user string, writer io.Writer, rollback bool) error {
+	conn, err := db.Conn()
 	if err != nil {
 		return err
 	}
-	elapsed := time.Since(start)
-	return saveDeployData(app.Name, elapsed)
+	defer conn.Close()
+	deploy, err := queueDeploy(conn, app, version, user, rollback)
+	if err != nil {
+		return err
+	}
+	lock, err := lockApp(app.Name, "deploy")
+	if err != nil {
+		return deploy.fail(conn, err, nil)
+	}
+	defer unlockApp(app.Name, lock)
+	return deploy.run(conn, app, writer)
 }
 
-func saveDeployData(appName string, duration time.Duration) error {
+// deployLockedApp is DeployApp for the callers that already hold the lock of
+// the app, such as BlueGreenDeploy.
+func deployLockedApp(app *App, version, user string, writer io.Writer) error {
 	conn, err := db.Conn()
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
+	deploy, err := queueDeploy(conn, app, version, user, false)
+	if err != nil {
+		return err
+	}
+	return deploy.run(conn, app, writer)
+}
+
+// queueDeploy records a queued deploy of the version to the app.
+func queueDeploy(conn *db.Storage, app *App, version, user string, rollback bool) (*Deploy, error) {
 	deploy := Deploy{
-		App:       appName,
+		ID:        bson.NewObjectId(),
+		App:       app.Name,
 		Timestamp: time.Now(),
-		Duration:  duration,
+		Version:   version,
+		User:      user,
+		Status:    DeployQueued,
+		Rollback:  rollback,
+	}
+	if err := conn.Deploys().Insert(deploy); err != nil {
+		return nil, err
+	}
+	return &deploy, nil
+}
+
+// run runs the deploy pipeline of the app and records its outcome in the
+// deploy. The caller must hold the lock of the app.
+func (d *Deploy) run(conn *db.Storage, app *App, writer io.Writer) error {
+	var current []Deploy
+	if d.Rollback {
+		err := conn.Deploys().Find(bson.M{
+			"app":     app.Name,
+			"status":  DeploySucceeded,
+			"standby": bson.M{"$exists": false},
+		}).Sort("-timestamp").Limit(1).All(&current)
+		if err != nil {
+			return d.fail(conn, err, nil)
+		}
+	}
+	if err := d.setStatus(conn, DeployRunning, nil); err != nil {
+		return d.fail(conn, err, nil)
 	}
-	return conn.Deploys().Insert(deploy)
+	pipeline := Provisioner.DeployPipeline()
+	if pipeline == nil {
+		actions := []*action.Action{&ProvisionerDeploy, &IncrementDeploy}
+		pipeline = action.NewPipeline(actions...)
+	}
+	excerpt := tailWriter{max: deployLogExcerptSize}
+	logWriter := LogWriter{App: app, Writer: io.MultiWriter(writer, &excerpt)}
+	err := pipeline.Execute(app, d.Version, &logWriter)
+	changes := bson.M{"duration": time.Since(d.Timestamp), "log": excerpt.String()}
+	if err != nil {
+		changes["action"] = pipeline.FailedAction()
+		return d.fail(conn, err, changes)
+	}
+	if err := d.setStatus(conn, DeploySucceeded, changes); err != nil {
+		return d.fail(conn, err, changes)
+	}
+	if len(current) > 0 {
+		// The rollback succeeded, even if the deploy it replaces cannot be
+		// marked as rolled back
+		if err := current[0].setStatus(conn, DeployRolledBack, nil); err != nil {
+			log.Errorf("Failed to mark the deploy of the version %q of the app %q as rolled back: %s", current[0].Version, app.Name, err)
+		}
+	}
+	return nil
 }
 
 func incrementDeploy(app *App) error {
@@ -1828,13 +1828,14 @@ func (s *S) TestListAppDeploys(c *gocheck.C) {
 	s.conn.Deploys().Insert(insert...)
 	defer s.conn.Deploys().RemoveAll(bson.M{"app": a.Name})
 	expected := []Deploy{insert[1].(Deploy), insert[0].(Deploy)}
-	deploys, err := a.ListDeploys()
+	deploys, err := a.ListDeploys(nil)
 	c.Assert(err, gocheck.IsNil)
 	for i := 0; i < 2; i++ {
 		ts := expected[i].Timestamp
 		expected[i].Timestamp = time.Date(ts.Year(), ts.Month(), ts.Day(), ts.Hour(), ts.Minute(), ts.Second(), 0, time.UTC)
 		ts = deploys[i].Timestamp
 		deploys[i].Timestamp = time.Date(ts.Year(), ts.Month(), ts.Day(), ts.Hour(), ts.Minute(), ts.Second(), 0, time.UTC)
+		deploys[i].ID = ""
 	}
 	c.Assert(deploys, gocheck.DeepEquals, expected)
 }
@@ -1848,13 +1849,14 @@ func (s *S) TestListAllDeploys(c *gocheck.C) {
 	s.conn.Deploys().Insert(insert...)
 	defer s.conn.Deploys().RemoveAll(nil)
 	expected := []Deploy{insert[1].(Deploy), insert[0].(Deploy)}
-	deploys, err := ListDeploys()
+	deploys, err := ListDeploys(nil)
 	c.Assert(err, gocheck.IsNil)
 	for i := 0; i < 2; i++ {
 		ts := expected[i].Timestamp
 		expected[i].Timestamp = time.Date(ts.Year(), ts.Month(), ts.Day(), ts.Hour(), ts.Minute(), ts.Second(), 0, time.UTC)
 		ts = deploys[i].Timestamp
 		deploys[i].Timestamp = time.Date(ts.Year(), ts.Month(), ts.Day(), ts.Hour(), ts.Minute(), ts.Second(), 0, time.UTC)
+		deploys[i].ID = ""
 	}
 	c.Assert(deploys, gocheck.DeepEquals, expected)
 }
@@ -1913,7 +1915,7 @@ func (s *S) TestDeployApp(c *gocheck.C) {
 	s.provisioner.Provision(&a)
 	defer s.provisioner.Destroy(&a)
 	writer := &bytes.Buffer{}
-	err = DeployApp(&a, "version", writer)
+	err = DeployApp(&a, "version", "admin@tsuru.io", writer)
 	c.Assert(err, gocheck.IsNil)
 	logs := writer.String()
 	c.Assert(logs, gocheck.Equals, "Deploy called")
@@ -1932,7 +1934,7 @@ func (s *S) TestDeployAppIncrementDeployNumber(c *gocheck.C) {
 	s.provisioner.Provision(&a)
 	defer s.provisioner.Destroy(&a)
 	writer := &bytes.Buffer{}
-	err = DeployApp(&a, "version", writer)
+	err = DeployApp(&a, "version", "admin@tsuru.io", writer)
 	c.Assert(err, gocheck.IsNil)
 	s.conn.Apps().Find(bson.M{"name": a.Name}).One(&a)
 	c.Assert(a.Deploys, gocheck.Equals, uint(1))
@@ -1951,7 +1953,7 @@ func (s *S) TestDeployAppSaveDeployData(c *gocheck.C) {
 	s.provisioner.Provision(&a)
 	defer s.provisioner.Destroy(&a)
 	writer := &bytes.Buffer{}
-	err = DeployApp(&a, "version", writer)
+	err = DeployApp(&a, "version", "admin@tsuru.io", writer)
 	c.Assert(err, gocheck.IsNil)
 	s.conn.Apps().Find(bson.M{"name": a.Name}).One(&a)
 	c.Assert(a.Deploys, gocheck.Equals, uint(1))
@@ -1962,6 +1964,218 @@ func (s *S) TestDeployAppSaveDeployData(c *gocheck.C) {
 	diff := now.Sub(result["timestamp"].(time.Time))
 	c.Assert(diff < 60*time.Second, gocheck.Equals, true)
 	c.Assert(result["duration"], gocheck.Not(gocheck.Equals), 0)
+	c.Assert(result["version"], gocheck.Equals, "version")
+	c.Assert(result["user"], gocheck.Equals, "admin@tsuru.io")
+	c.Assert(result["status"], gocheck.Equals, DeploySucceeded)
+	c.Assert(result["action"], gocheck.Equals, "")
+	c.Assert(result["error"], gocheck.Equals, "")
+	c.Assert(result["log"], gocheck.Equals, "Deploy called")
+	c.Assert(result["rollback"], gocheck.Equals, false)
+}
+
+func (s *S) TestDeployAppSaveFailedDeploy(c *gocheck.C) {
+	a := App{
+		Name:     "otherapp",
+		Platform: "zend",
+		Teams:    []string{s.team.Name},
+		Units:    []Unit{{Name: "i-0800", State: "started"}},
+	}
+	err := s.conn.Apps().Insert(a)
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	defer s.conn.Deploys().RemoveAll(bson.M{"app": a.Name})
+	s.provisioner.Provision(&a)
+	defer s.provisioner.Destroy(&a)
+	s.provisioner.PrepareFailure("Deploy", stderr.New("exit status 1"))
+	writer := &bytes.Buffer{}
+	err = DeployApp(&a, "version", "admin@tsuru.io", writer)
+	c.Assert(err, gocheck.ErrorMatches, "exit status 1")
+	s.conn.Apps().Find(bson.M{"name": a.Name}).One(&a)
+	c.Assert(a.Deploys, gocheck.Equals, uint(0))
+	deploys, err := a.ListDeploys(nil)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(deploys, gocheck.HasLen, 1)
+	c.Assert(deploys[0].Version, gocheck.Equals, "version")
+	c.Assert(deploys[0].User, gocheck.Equals, "admin@tsuru.io")
+	c.Assert(deploys[0].Status, gocheck.Equals, DeployFailed)
+	c.Assert(deploys[0].Action, gocheck.Equals, "provisioner-deploy")
+	c.Assert(deploys[0].Error, gocheck.Equals, "exit status 1")
+}
+
+func (s *S) TestDeployFail(c *gocheck.C) {
+	d := Deploy{ID: bson.NewObjectId(), App: "otherapp", Status: DeployQueued, Timestamp: time.Now()}
+	err := s.conn.Deploys().Insert(d)
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Deploys().RemoveAll(bson.M{"app": d.App})
+	want := stderr.New("connection reset")
+	err = d.fail(s.conn, want, nil)
+	c.Assert(err, gocheck.Equals, want)
+	var stored Deploy
+	err = s.conn.Deploys().FindId(d.ID).One(&stored)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(stored.Status, gocheck.Equals, DeployFailed)
+	c.Assert(stored.Error, gocheck.Equals, "connection reset")
+	// A deploy that can no longer fail still returns the error
+	err = d.fail(s.conn, want, bson.M{"log": "..."})
+	c.Assert(err, gocheck.Equals, want)
+}
+
+func (s *S) TestDeployStatusTransitions(c *gocheck.C) {
+	d := Deploy{ID: bson.NewObjectId(), App: "otherapp", Status: DeployQueued, Timestamp: time.Now()}
+	err := s.conn.Deploys().Insert(d)
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Deploys().RemoveAll(bson.M{"app": d.App})
+	err = d.setStatus(s.conn, DeploySucceeded, nil)
+	c.Assert(err, gocheck.ErrorMatches, `Cannot move a deploy from "queued" to "succeeded".`)
+	err = d.setStatus(s.conn, DeployRunning, nil)
+	c.Assert(err, gocheck.IsNil)
+	err = d.setStatus(s.conn, DeployFailed, bson.M{"error": "exit status 1"})
+	c.Assert(err, gocheck.IsNil)
+	var stored Deploy
+	err = s.conn.Deploys().FindId(d.ID).One(&stored)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(stored.Status, gocheck.Equals, DeployFailed)
+	c.Assert(stored.Error, gocheck.Equals, "exit status 1")
+	err = d.setStatus(s.conn, DeployRolledBack, nil)
+	c.Assert(err, gocheck.ErrorMatches, `Cannot move a deploy from "failed" to "rolled-back".`)
+	// Another process moved the deploy
+	other := Deploy{ID: d.ID, Status: DeployRunning}
+	err = other.setStatus(s.conn, DeploySucceeded, nil)
+	c.Assert(err, gocheck.ErrorMatches, `The deploy is no longer "running".`)
+}
+
+func (s *S) TestListDeploysFilter(c *gocheck.C) {
+	s.conn.Deploys().RemoveAll(nil)
+	defer s.conn.Deploys().RemoveAll(nil)
+	now := time.Now()
+	s.conn.Deploys().Insert(
+		Deploy{App: "g1", Version: "v1", User: "a@tsuru.io", Status: DeploySucceeded, Timestamp: now.Add(-2 * time.Hour)},
+		Deploy{App: "g1", Version: "v2", User: "b@tsuru.io", Status: DeployFailed, Timestamp: now.Add(-time.Hour)},
+		Deploy{App: "ge", Version: "v1", User: "a@tsuru.io", Status: DeploySucceeded, Timestamp: now},
+	)
+	versions := func(filter *DeployFilter) []string {
+		deploys, err := ListDeploys(filter)
+		c.Assert(err, gocheck.IsNil)
+		var vs []string
+		for _, d := range deploys {
+			vs = append(vs, d.App+"/"+d.Version)
+		}
+		return vs
+	}
+	c.Assert(versions(nil), gocheck.DeepEquals, []string{"ge/v1", "g1/v2", "g1/v1"})
+	c.Assert(versions(&DeployFilter{Status: DeploySucceeded}), gocheck.DeepEquals, []string{"ge/v1", "g1/v1"})
+	c.Assert(versions(&DeployFilter{User: "b@tsuru.io"}), gocheck.DeepEquals, []string{"g1/v2"})
+	c.Assert(versions(&DeployFilter{Version: "v1", Limit: 1}), gocheck.DeepEquals, []string{"ge/v1"})
+	c.Assert(versions(&DeployFilter{Since: now.Add(-90 * time.Minute), Until: now.Add(-time.Minute)}), gocheck.DeepEquals, []string{"g1/v2"})
+	a := App{Name: "g1"}
+	deploys, err := a.ListDeploys(&DeployFilter{App: "ge", Status: DeploySucceeded})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(deploys, gocheck.HasLen, 1)
+	c.Assert(deploys[0].Version, gocheck.Equals, "v1")
+	c.Assert(deploys[0].App, gocheck.Equals, "g1")
+}
+
+func (s *S) TestRollback(c *gocheck.C) {
+	a := App{
+		Name:     "otherapp",
+		Platform: "zend",
+		Teams:    []string{s.team.Name},
+		Units:    []Unit{{Name: "i-0800", State: "started"}},
+	}
+	err := s.conn.Apps().Insert(a)
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	defer s.conn.Deploys().RemoveAll(bson.M{"app": a.Name})
+	s.provisioner.Provision(&a)
+	defer s.provisioner.Destroy(&a)
+	writer := &bytes.Buffer{}
+	err = DeployApp(&a, "v1", "admin@tsuru.io", writer)
+	c.Assert(err, gocheck.IsNil)
+	err = DeployApp(&a, "v2", "admin@tsuru.io", writer)
+	c.Assert(err, gocheck.IsNil)
+	blueGreen := Deploy{ID: bson.NewObjectId(), App: a.Name, Version: "v3", Status: DeploySucceeded, Standby: "green", Timestamp: time.Now()}
+	err = s.conn.Deploys().Insert(blueGreen)
+	c.Assert(err, gocheck.IsNil)
+	err = a.Rollback("v1", "ops@tsuru.io", writer)
+	c.Assert(err, gocheck.IsNil)
+	s.conn.Apps().Find(bson.M{"name": a.Name}).One(&a)
+	c.Assert(a.Deploys, gocheck.Equals, uint(3))
+	deploys, err := a.ListDeploys(nil)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(deploys, gocheck.HasLen, 4)
+	var deploy Deploy
+	err = s.conn.Deploys().Find(bson.M{"app": a.Name, "rollback": true}).One(&deploy)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(deploy.Version, gocheck.Equals, "v1")
+	c.Assert(deploy.User, gocheck.Equals, "ops@tsuru.io")
+	c.Assert(deploy.Status, gocheck.Equals, DeploySucceeded)
+	// The deploy of v2 has been rolled back
+	deploys, err = a.ListDeploys(&DeployFilter{Status: DeployRolledBack})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(deploys, gocheck.HasLen, 1)
+	c.Assert(deploys[0].Version, gocheck.Equals, "v2")
+	// The blue/green deploy is left alone
+	err = s.conn.Deploys().FindId(blueGreen.ID).One(&deploy)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(deploy.Status, gocheck.Equals, DeploySucceeded)
+}
+
+// A writer that calls hook before the first write.
+type hookWriter struct {
+	bytes.Buffer
+	hook func()
+}
+
+func (w *hookWriter) Write(p []byte) (int, error) {
+	if w.hook != nil {
+		w.hook()
+		w.hook = nil
+	}
+	return w.Buffer.Write(p)
+}
+
+func (s *S) TestRollbackReplacedDeployMoved(c *gocheck.C) {
+	a := App{
+		Name:     "otherapp",
+		Platform: "zend",
+		Teams:    []string{s.team.Name},
+		Units:    []Unit{{Name: "i-0800", State: "started"}},
+	}
+	err := s.conn.Apps().Insert(a)
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	defer s.conn.Deploys().RemoveAll(bson.M{"app": a.Name})
+	s.provisioner.Provision(&a)
+	defer s.provisioner.Destroy(&a)
+	err = DeployApp(&a, "v1", "admin@tsuru.io", &bytes.Buffer{})
+	c.Assert(err, gocheck.IsNil)
+	err = DeployApp(&a, "v2", "admin@tsuru.io", &bytes.Buffer{})
+	c.Assert(err, gocheck.IsNil)
+	// The deploy of v2 is removed while the rollback runs
+	writer := &hookWriter{hook: func() {
+		s.conn.Deploys().RemoveAll(bson.M{"app": a.Name, "version": "v2"})
+	}}
+	err = a.Rollback("v1", "ops@tsuru.io", writer)
+	c.Assert(err, gocheck.IsNil)
+	var deploy Deploy
+	err = s.conn.Deploys().Find(bson.M{"app": a.Name, "rollback": true}).One(&deploy)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(deploy.Status, gocheck.Equals, DeploySucceeded)
+}
+
+func (s *S) TestRollbackUnknownVersion(c *gocheck.C) {
+	a := App{Name: "otherapp", Platform: "zend", Teams: []string{s.team.Name}}
+	defer s.conn.Deploys().RemoveAll(bson.M{"app": a.Name})
+	s.conn.Deploys().Insert(Deploy{App: a.Name, Version: "v1", Status: DeployFailed, Timestamp: time.Now()})
+	s.conn.Deploys().Insert(Deploy{App: "anotherapp", Version: "v2", Status: DeploySucceeded, Timestamp: time.Now()})
+	s.conn.Deploys().Insert(Deploy{App: a.Name, Version: "v4", Status: DeploySucceeded, Standby: "green", Timestamp: time.Now()})
+	writer := &bytes.Buffer{}
+	// v1 failed, v2 belongs to another app, v4 only ran on the standby app
+	for _, v := range []string{"v1", "v2", "v3", "v4", ""} {
+		err := a.Rollback(v, "ops@tsuru.io", writer)
+		c.Assert(err, gocheck.ErrorMatches, `The version "`+v+`" has never been deployed to the app "otherapp".`)
+	}
+	c.Assert(writer.Len(), gocheck.Equals, 0)
 }
 
 func (s *S) TestDeployCustomPipeline(c *gocheck.C) {
@@ -1977,11 +2191,11 @@ func (s *S) TestDeployCustomPipeline(c *gocheck.C) {
 	s.provisioner.Provision(&a)
 	defer s.provisioner.Destroy(&a)
 	writer := &bytes.Buffer{}
-	err = DeployApp(&a, "version", writer)
+	err = DeployApp(&a, "version", "admin@tsuru.io", writer)
 	c.Assert(err, gocheck.IsNil)
 	c.Assert(s.provisioner.ExecutedPipeline(), gocheck.Equals, false)
 	s.provisioner.CustomPipeline = true
-	err = DeployApp(&a, "version", writer)
+	err = DeployApp(&a, "version", "admin@tsuru.io", writer)
 	c.Assert(err, gocheck.IsNil)
 	c.Assert(s.provisioner.ExecutedPipeline(), gocheck.Equals, true)
 }
@@ -0,0 +1,200 @@
+// Copyright 2013 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"fmt"
+	"github.com/globocom/config"
+	"github.com/xbee/jindou/db"
+	"io"
+	"labix.org/v2/mgo/bson"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// How often the units of the standby app are checked after the swap.
+var healthCheckInterval = 5 * time.Second
+
+// The actions of a blue/green deploy, recorded in its Deploy when it fails.
+const (
+	blueGreenLock          = "lock"
+	blueGreenDeployStandby = "deploy-standby"
+	blueGreenHealthCheck   = "health-check"
+	blueGreenSwap          = "swap"
+	blueGreenPostSwapCheck = "post-swap-check"
+)
+
+// BlueGreenDeploy deploys the version to the standby app, checks the health
+// of its units, and swaps it with the live app, so that the standby app gets
+// the traffic of the live one. The units are checked again for
+// blue-green:swap-back-window seconds after the swap (60 by default), and the
+// apps are swapped back if a check fails.
+//
+// The deploy of the standby app is recorded in its history, as any deploy.
+// The blue/green deploy is recorded in the history of the live app, with the
+// name of the standby app, and the action that failed if it fails. Its
+// progress is written to writer and to the log of the live app.
+//
+// Both apps are locked for the whole blue/green deploy, so that no other
+// operation changes the standby app between its deploy and the swap.
+func BlueGreenDeploy(live, standby *App, version, user string, writer io.Writer) error {
+	if live.Name == standby.Name {
+		return fmt.Errorf("Cannot swap the app %q with itself.", live.Name)
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deploy := Deploy{
+		ID:        bson.NewObjectId(),
+		App:       live.Name,
+		Timestamp: time.Now(),
+		Version:   version,
+		User:      user,
+		Status:    DeployQueued,
+		Standby:   standby.Name,
+	}
+	if err := conn.Deploys().Insert(deploy); err != nil {
+		return err
+	}
+	excerpt := tailWriter{max: deployLogExcerptSize}
+	logWriter := LogWriter{App: live, Writer: io.MultiWriter(writer, &excerpt)}
+	fail := func(action string, err error) error {
+		changes := bson.M{
+			"duration": time.Since(deploy.Timestamp),
+			"log":      excerpt.String(),
+			"action":   action,
+			"error":    err.Error(),
+		}
+		// The error of the deploy matters more than the one of its record
+		deploy.setStatus(conn, DeployFailed, changes)
+		return err
+	}
+	unlock, err := lockApps("blue-green-deploy", live, standby)
+	if err != nil {
+		return fail(blueGreenLock, err)
+	}
+	defer unlock()
+	if err := deploy.setStatus(conn, DeployRunning, nil); err != nil {
+		return deploy.fail(conn, err, nil)
+	}
+	fmt.Fprintf(&logWriter, "\n ---> Deploying version %s to the standby app %s\n\n", version, standby.Name)
+	if err := deployLockedApp(standby, version, user, writer); err != nil {
+		return fail(blueGreenDeployStandby, err)
+	}
+	fmt.Fprintf(&logWriter, "\n ---> Checking the units of %s\n\n", standby.Name)
+	if err := checkUnits(standby); err != nil {
+		fmt.Fprintf(&logWriter, " ---> Health check failed: %s\n", err)
+		return fail(blueGreenHealthCheck, err)
+	}
+	fmt.Fprintf(&logWriter, " ---> Swapping %s and %s\n", live.Name, standby.Name)
+	if err := Provisioner.Swap(live, standby); err != nil {
+		return fail(blueGreenSwap, err)
+	}
+	window := secondsConfig("blue-green:swap-back-window", 60)
+	if err := watchUnits(standby, window); err != nil {
+		fmt.Fprintf(&logWriter, " ---> Health check failed after the swap: %s\n", err)
+		fmt.Fprintf(&logWriter, " ---> Swapping back %s and %s\n", live.Name, standby.Name)
+		if serr := Provisioner.Swap(live, standby); serr != nil {
+			err = fmt.Errorf("%s Failed to swap back: %s", err, serr)
+		} else {
+			deploy.SwappedBack = true
+		}
+		deploy.setStatus(conn, DeployFailed, bson.M{
+			"duration":    time.Since(deploy.Timestamp),
+			"log":         excerpt.String(),
+			"action":      blueGreenPostSwapCheck,
+			"error":       err.Error(),
+			"swappedback": deploy.SwappedBack,
+		})
+		return err
+	}
+	fmt.Fprintf(&logWriter, " ---> %s now serves the version %s\n", standby.Name, version)
+	return deploy.setStatus(conn, DeploySucceeded, bson.M{
+		"duration": time.Since(deploy.Timestamp),
+		"log":      excerpt.String(),
+	})
+}
+
+// lockApps gets the locks of the apps, in the order of their names so that
+// two operations on the same apps cannot wait for each other, and returns the
+// function that releases them.
+func lockApps(operation string, apps ...*App) (func(), error) {
+	names := make([]string, len(apps))
+	for i, a := range apps {
+		names[i] = a.Name
+	}
+	sort.Strings(names)
+	var locks []*AppLock
+	unlock := func() {
+		for i, lock := range locks {
+			unlockApp(names[i], lock)
+		}
+	}
+	for _, name := range names {
+		lock, err := lockApp(name, operation)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		locks = append(locks, lock)
+	}
+	return unlock, nil
+}
+
+// checkUnits checks that the app has units, that they are all available and
+// have an address, and that they answer a GET of blue-green:health-check-path
+// (/ by default) with a status below 400 within
+// blue-green:health-check-timeout seconds (10 by default).
+func checkUnits(app *App) error {
+	if err := app.Get(); err != nil {
+		return err
+	}
+	if len(app.Units) == 0 {
+		return fmt.Errorf("The app %q has no units.", app.Name)
+	}
+	path, err := config.GetString("blue-green:health-check-path")
+	if err != nil {
+		path = "/"
+	}
+	client := http.Client{
+		Timeout: secondsConfig("blue-green:health-check-timeout", 10),
+	}
+	for _, unit := range app.Units {
+		if !unit.Available() {
+			return fmt.Errorf("The unit %q is %s.", unit.Name, unit.State)
+		}
+		if unit.Ip == "" {
+			// A unit that cannot be probed cannot be trusted with the traffic
+			return fmt.Errorf("The unit %q has no address to check.", unit.Name)
+		}
+		resp, err := client.Get("http://" + unit.Ip + path)
+		if err != nil {
+			return fmt.Errorf("The unit %q is unreachable: %s", unit.Name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("The unit %q answered %s.", unit.Name, resp.Status)
+		}
+	}
+	return nil
+}
+
+// watchUnits checks the units of the app every healthCheckInterval for the
+// duration of the window, and at least once.
+func watchUnits(app *App, window time.Duration) error {
+	deadline := time.Now().Add(window)
+	for {
+		if err := checkUnits(app); err != nil {
+			return err
+		}
+		if !time.Now().Before(deadline) {
+			return nil
+		}
+		time.Sleep(healthCheckInterval)
+	}
+}
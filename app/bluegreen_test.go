@@ -0,0 +1,199 @@
+// Copyright 2013 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"bytes"
+	"github.com/globocom/config"
+	"labix.org/v2/mgo/bson"
+	"launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Creates the live and standby apps, with a unit of the standby app served by
+// the handler, and returns the function that removes them.
+func (s *S) createBlueGreenApps(c *gocheck.C, h http.Handler) (*App, *App, func()) {
+	server := httptest.NewServer(h)
+	live := App{Name: "blue", Platform: "python", Teams: []string{s.team.Name}}
+	standby := App{
+		Name:     "green",
+		Platform: "python",
+		Teams:    []string{s.team.Name},
+		Units: []Unit{{
+			Name:  "green/0",
+			State: "started",
+			Ip:    strings.TrimPrefix(server.URL, "http://"),
+		}},
+	}
+	err := s.conn.Apps().Insert(live, standby)
+	c.Assert(err, gocheck.IsNil)
+	s.provisioner.Provision(&live)
+	s.provisioner.Provision(&standby)
+	config.Set("blue-green:swap-back-window", 0)
+	return &live, &standby, func() {
+		config.Unset("blue-green:swap-back-window")
+		s.provisioner.Destroy(&live)
+		s.provisioner.Destroy(&standby)
+		s.conn.Apps().RemoveAll(bson.M{"name": bson.M{"$in": []string{live.Name, standby.Name}}})
+		s.conn.Deploys().RemoveAll(bson.M{"app": bson.M{"$in": []string{live.Name, standby.Name}}})
+		server.Close()
+	}
+}
+
+func (s *S) TestBlueGreenDeploy(c *gocheck.C) {
+	var checks int32
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&checks, 1)
+		c.Check(r.URL.Path, gocheck.Equals, "/")
+	})
+	live, standby, cleanup := s.createBlueGreenApps(c, h)
+	defer cleanup()
+	writer := &bytes.Buffer{}
+	err := BlueGreenDeploy(live, standby, "version", "admin@tsuru.io", writer)
+	c.Assert(err, gocheck.IsNil)
+	// Once before the swap, once after
+	c.Assert(atomic.LoadInt32(&checks), gocheck.Equals, int32(2))
+	c.Assert(writer.String(), gocheck.Matches, `(?s).*Swapping blue and green.*green now serves the version version.*`)
+	deploys, err := live.ListDeploys(nil)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(deploys, gocheck.HasLen, 1)
+	c.Assert(deploys[0].Status, gocheck.Equals, DeploySucceeded)
+	c.Assert(deploys[0].Standby, gocheck.Equals, "green")
+	c.Assert(deploys[0].Version, gocheck.Equals, "version")
+	c.Assert(deploys[0].User, gocheck.Equals, "admin@tsuru.io")
+	c.Assert(deploys[0].SwappedBack, gocheck.Equals, false)
+	c.Assert(deploys[0].Log, gocheck.Matches, `(?s).*Swapping blue and green.*`)
+	deploys, err = standby.ListDeploys(nil)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(deploys, gocheck.HasLen, 1)
+	c.Assert(deploys[0].Status, gocheck.Equals, DeploySucceeded)
+	logs, err := live.LastLogs(10, "tsuru")
+	c.Assert(err, gocheck.IsNil)
+	var messages []string
+	for _, l := range logs {
+		messages = append(messages, l.Message)
+	}
+	c.Assert(strings.Join(messages, "\n"), gocheck.Matches, `(?s).*Swapping blue and green.*`)
+	// The apps are unlocked
+	c.Assert(live.Get(), gocheck.IsNil)
+	c.Assert(live.Lock, gocheck.IsNil)
+	c.Assert(standby.Get(), gocheck.IsNil)
+	c.Assert(standby.Lock, gocheck.IsNil)
+}
+
+func (s *S) TestBlueGreenDeployHealthCheckFails(c *gocheck.C) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	live, standby, cleanup := s.createBlueGreenApps(c, h)
+	defer cleanup()
+	err := BlueGreenDeploy(live, standby, "version", "admin@tsuru.io", &bytes.Buffer{})
+	c.Assert(err, gocheck.ErrorMatches, `The unit "green/0" answered 503 Service Unavailable\.`)
+	deploys, err := live.ListDeploys(nil)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(deploys, gocheck.HasLen, 1)
+	c.Assert(deploys[0].Status, gocheck.Equals, DeployFailed)
+	c.Assert(deploys[0].Action, gocheck.Equals, "health-check")
+	c.Assert(deploys[0].SwappedBack, gocheck.Equals, false)
+}
+
+func (s *S) TestBlueGreenDeploySwapsBack(c *gocheck.C) {
+	old := healthCheckInterval
+	healthCheckInterval = 10 * time.Millisecond
+	defer func() { healthCheckInterval = old }()
+	var checks int32
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&checks, 1) > 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	live, standby, cleanup := s.createBlueGreenApps(c, h)
+	defer cleanup()
+	config.Set("blue-green:swap-back-window", 5)
+	writer := &bytes.Buffer{}
+	err := BlueGreenDeploy(live, standby, "version", "admin@tsuru.io", writer)
+	c.Assert(err, gocheck.ErrorMatches, `The unit "green/0" answered 500 Internal Server Error\.`)
+	c.Assert(writer.String(), gocheck.Matches, `(?s).*Swapping back blue and green.*`)
+	deploys, err := live.ListDeploys(nil)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(deploys, gocheck.HasLen, 1)
+	c.Assert(deploys[0].Status, gocheck.Equals, DeployFailed)
+	c.Assert(deploys[0].Action, gocheck.Equals, "post-swap-check")
+	c.Assert(deploys[0].SwappedBack, gocheck.Equals, true)
+}
+
+func (s *S) TestBlueGreenDeployLocked(c *gocheck.C) {
+	live, standby, cleanup := s.createBlueGreenApps(c, http.NotFoundHandler())
+	defer cleanup()
+	lock, err := lockApp(live.Name, "add-units")
+	c.Assert(err, gocheck.IsNil)
+	defer unlockApp(live.Name, lock)
+	err = BlueGreenDeploy(live, standby, "version", "admin@tsuru.io", &bytes.Buffer{})
+	c.Assert(err, gocheck.FitsTypeOf, &AppLockedError{})
+	deploys, err := live.ListDeploys(nil)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(deploys, gocheck.HasLen, 1)
+	c.Assert(deploys[0].Status, gocheck.Equals, DeployFailed)
+	c.Assert(deploys[0].Action, gocheck.Equals, "lock")
+	// The standby app is not deployed, nor left locked
+	deploys, err = standby.ListDeploys(nil)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(deploys, gocheck.HasLen, 0)
+	c.Assert(standby.Get(), gocheck.IsNil)
+	c.Assert(standby.Lock, gocheck.IsNil)
+}
+
+func (s *S) TestBlueGreenDeployStandbyLocked(c *gocheck.C) {
+	live, standby, cleanup := s.createBlueGreenApps(c, http.NotFoundHandler())
+	defer cleanup()
+	lock, err := lockApp(standby.Name, "remove-units")
+	c.Assert(err, gocheck.IsNil)
+	defer unlockApp(standby.Name, lock)
+	err = BlueGreenDeploy(live, standby, "version", "admin@tsuru.io", &bytes.Buffer{})
+	c.Assert(err, gocheck.FitsTypeOf, &AppLockedError{})
+	deploys, err := standby.ListDeploys(nil)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(deploys, gocheck.HasLen, 0)
+	// The live app is not left locked
+	c.Assert(live.Get(), gocheck.IsNil)
+	c.Assert(live.Lock, gocheck.IsNil)
+}
+
+func (s *S) TestBlueGreenDeploySameApp(c *gocheck.C) {
+	a := App{Name: "blue"}
+	err := BlueGreenDeploy(&a, &a, "version", "admin@tsuru.io", &bytes.Buffer{})
+	c.Assert(err, gocheck.ErrorMatches, `Cannot swap the app "blue" with itself\.`)
+}
+
+func (s *S) TestCheckUnitsNotAvailable(c *gocheck.C) {
+	a := App{Name: "green", Units: []Unit{{Name: "green/0", State: "stopped"}}}
+	err := s.conn.Apps().Insert(a)
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	err = checkUnits(&a)
+	c.Assert(err, gocheck.ErrorMatches, `The unit "green/0" is stopped\.`)
+}
+
+func (s *S) TestCheckUnitsNoAddress(c *gocheck.C) {
+	a := App{Name: "green", Units: []Unit{{Name: "green/0", State: "started"}}}
+	err := s.conn.Apps().Insert(a)
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	err = checkUnits(&a)
+	c.Assert(err, gocheck.ErrorMatches, `The unit "green/0" has no address to check\.`)
+}
+
+func (s *S) TestCheckUnitsNoUnits(c *gocheck.C) {
+	a := App{Name: "green"}
+	err := s.conn.Apps().Insert(a)
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	err = checkUnits(&a)
+	c.Assert(err, gocheck.ErrorMatches, `The app "green" has no units\.`)
+}
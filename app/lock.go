@@ -0,0 +1,170 @@
+// Copyright 2013 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"fmt"
+	"github.com/globocom/config"
+	"github.com/xbee/jindou/db"
+	"github.com/xbee/jindou/log"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"os"
+	"time"
+)
+
+// How often a waiting operation tries to get the lock again.
+const appLockPollInterval = time.Second
+
+// The default of app-lock:expire-timeout, in seconds.
+const appLockExpireTimeout = 1800
+
+// AppLock is the lock of the operations that change the units of an app
+// (deploys, addition and removal of units). It is stored in the document of
+// the app, so that it works across all the API processes, unlike
+// safe.MultiLocker. While the lock is held, its AcquireDate is refreshed by a
+// heartbeat, so that it only expires when its holder is gone.
+type AppLock struct {
+	ID          string
+	Owner       string
+	Operation   string
+	AcquireDate time.Time
+	stop        chan struct{} `bson:"-"`
+}
+
+// AppLockedError is the error returned when an operation cannot get the lock
+// of the app, because another operation holds it.
+type AppLockedError struct {
+	App  string
+	Lock AppLock
+}
+
+func (e *AppLockedError) Error() string {
+	return fmt.Sprintf("The app %q is locked by another operation: %s, started by %s at %s.",
+		e.App, e.Lock.Operation, e.Lock.Owner, e.Lock.AcquireDate.Format(time.RFC3339))
+}
+
+// lockApp gets the lock of the app for the operation. If another operation
+// holds it, lockApp waits for it for at most app-lock:wait-timeout seconds (0
+// by default, i.e. the operation is rejected right away), and then returns an
+// *AppLockedError. A lock that has not been refreshed for more than
+// app-lock:expire-timeout seconds (1800 by default, and when it is not
+// positive) is considered abandoned by a crashed process, and is taken over. The lock is refreshed every third of
+// that time until unlockApp releases it.
+func lockApp(appName, operation string) (*AppLock, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	host, _ := os.Hostname()
+	lock := AppLock{
+		ID:        bson.NewObjectId().Hex(),
+		Owner:     fmt.Sprintf("%s:%d", host, os.Getpid()),
+		Operation: operation,
+	}
+	deadline := time.Now().Add(secondsConfig("app-lock:wait-timeout", 0))
+	expire := secondsConfig("app-lock:expire-timeout", appLockExpireTimeout)
+	if expire <= 0 {
+		// Every lock would be taken over at once, nothing would be serialised
+		expire = appLockExpireTimeout * time.Second
+	}
+	for {
+		lock.AcquireDate = time.Now().In(time.UTC)
+		expired := lock.AcquireDate.Add(-expire)
+		err := conn.Apps().Update(bson.M{
+			"name": appName,
+			"$or": []bson.M{
+				{"lock": bson.M{"$exists": false}},
+				{"lock.acquiredate": bson.M{"$lt": expired}},
+			},
+		}, bson.M{"$set": bson.M{"lock": lock}})
+		if err == nil {
+			lock.stop = make(chan struct{})
+			go heartbeat(appName, lock.ID, expire/3, lock.stop)
+			return &lock, nil
+		}
+		if err != mgo.ErrNotFound {
+			return nil, err
+		}
+		var app App
+		err = conn.Apps().Find(bson.M{"name": appName}).One(&app)
+		if err == mgo.ErrNotFound {
+			return nil, ErrAppNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		if app.Lock == nil {
+			// Released in the meantime
+			continue
+		}
+		if !time.Now().Before(deadline) {
+			return nil, &AppLockedError{App: appName, Lock: *app.Lock}
+		}
+		time.Sleep(appLockPollInterval)
+	}
+}
+
+// heartbeat refreshes the acquire date of the lock every period until stop is
+// closed. It gives up if the lock has been taken over by another operation.
+func heartbeat(appName, lockID string, every time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		conn, err := db.Conn()
+		if err != nil {
+			log.Errorf("Failed to refresh the lock of the app %q: %s", appName, err)
+			continue
+		}
+		err = conn.Apps().Update(
+			bson.M{"name": appName, "lock.id": lockID},
+			bson.M{"$set": bson.M{"lock.acquiredate": time.Now().In(time.UTC)}},
+		)
+		conn.Close()
+		if err == mgo.ErrNotFound {
+			log.Errorf("The lock of the app %q has been taken over by another operation.", appName)
+			return
+		}
+		if err != nil {
+			log.Errorf("Failed to refresh the lock of the app %q: %s", appName, err)
+		}
+	}
+}
+
+// unlockApp stops the heartbeat of the lock and releases it, unless it has
+// expired and been taken over by another operation.
+func unlockApp(appName string, lock *AppLock) {
+	if lock.stop != nil {
+		close(lock.stop)
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		log.Errorf("Failed to release the lock of the app %q: %s", appName, err)
+		return
+	}
+	defer conn.Close()
+	err = conn.Apps().Update(
+		bson.M{"name": appName, "lock.id": lock.ID},
+		bson.M{"$unset": bson.M{"lock": ""}},
+	)
+	if err != nil {
+		log.Errorf("Failed to release the lock of the app %q: %s", appName, err)
+	}
+}
+
+// Returns the duration in seconds of the config key, or the default.
+func secondsConfig(key string, def int) time.Duration {
+	n, err := config.GetInt(key)
+	if err != nil || n < 0 {
+		n = def
+	}
+	return time.Duration(n) * time.Second
+}
@@ -0,0 +1,204 @@
+// Copyright 2013 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"bytes"
+	"github.com/globocom/config"
+	"github.com/xbee/jindou/quota"
+	"labix.org/v2/mgo/bson"
+	"launchpad.net/gocheck"
+	"time"
+)
+
+func (s *S) TestLockApp(c *gocheck.C) {
+	a := App{Name: "locked"}
+	err := s.conn.Apps().Insert(a)
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	lock, err := lockApp(a.Name, "deploy")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(lock.Operation, gocheck.Equals, "deploy")
+	err = a.Get()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(a.Lock, gocheck.NotNil)
+	c.Assert(a.Lock.ID, gocheck.Equals, lock.ID)
+	_, err = lockApp(a.Name, "add-units")
+	e, ok := err.(*AppLockedError)
+	c.Assert(ok, gocheck.Equals, true)
+	c.Assert(e.Lock.ID, gocheck.Equals, lock.ID)
+	c.Assert(e.Lock.Operation, gocheck.Equals, "deploy")
+	c.Assert(err, gocheck.ErrorMatches, `The app "locked" is locked by another operation: deploy, started by .* at .*\.`)
+	unlockApp(a.Name, lock)
+	other, err := lockApp(a.Name, "add-units")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(other.ID, gocheck.Not(gocheck.Equals), lock.ID)
+	unlockApp(a.Name, other)
+}
+
+func (s *S) TestLockAppNotFound(c *gocheck.C) {
+	_, err := lockApp("unknown", "deploy")
+	c.Assert(err, gocheck.Equals, ErrAppNotFound)
+}
+
+func (s *S) TestLockAppExpired(c *gocheck.C) {
+	stale := AppLock{ID: "stale", Owner: "crashed:42", Operation: "deploy", AcquireDate: time.Now().Add(-time.Hour)}
+	a := App{Name: "locked", Lock: &stale}
+	err := s.conn.Apps().Insert(a)
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	config.Set("app-lock:expire-timeout", 7200)
+	_, err = lockApp(a.Name, "deploy")
+	c.Assert(err, gocheck.FitsTypeOf, &AppLockedError{})
+	config.Unset("app-lock:expire-timeout")
+	lock, err := lockApp(a.Name, "deploy")
+	c.Assert(err, gocheck.IsNil)
+	defer unlockApp(a.Name, lock)
+	// The crashed holder does not release the new lock
+	unlockApp(a.Name, &stale)
+	err = a.Get()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(a.Lock.ID, gocheck.Equals, lock.ID)
+}
+
+func (s *S) TestLockAppExpireTimeoutNotPositive(c *gocheck.C) {
+	a := App{Name: "locked"}
+	err := s.conn.Apps().Insert(a)
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	config.Set("app-lock:expire-timeout", 0)
+	defer config.Unset("app-lock:expire-timeout")
+	lock, err := lockApp(a.Name, "deploy")
+	c.Assert(err, gocheck.IsNil)
+	defer unlockApp(a.Name, lock)
+	// The lock does not expire at once
+	_, err = lockApp(a.Name, "add-units")
+	c.Assert(err, gocheck.FitsTypeOf, &AppLockedError{})
+}
+
+func (s *S) TestLockAppWaits(c *gocheck.C) {
+	a := App{Name: "locked"}
+	err := s.conn.Apps().Insert(a)
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	config.Set("app-lock:wait-timeout", 5)
+	defer config.Unset("app-lock:wait-timeout")
+	lock, err := lockApp(a.Name, "deploy")
+	c.Assert(err, gocheck.IsNil)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		unlockApp(a.Name, lock)
+	}()
+	other, err := lockApp(a.Name, "remove-units")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(other.Operation, gocheck.Equals, "remove-units")
+}
+
+func (s *S) TestLockAppHeartbeat(c *gocheck.C) {
+	a := App{Name: "locked"}
+	err := s.conn.Apps().Insert(a)
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	config.Set("app-lock:expire-timeout", 1)
+	defer config.Unset("app-lock:expire-timeout")
+	lock, err := lockApp(a.Name, "deploy")
+	c.Assert(err, gocheck.IsNil)
+	// Held for longer than the expiry, the lock is still refreshed
+	time.Sleep(1500 * time.Millisecond)
+	_, err = lockApp(a.Name, "add-units")
+	c.Assert(err, gocheck.FitsTypeOf, &AppLockedError{})
+	err = a.Get()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(a.Lock.ID, gocheck.Equals, lock.ID)
+	c.Assert(a.Lock.AcquireDate.After(lock.AcquireDate), gocheck.Equals, true)
+	unlockApp(a.Name, lock)
+	err = a.Get()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(a.Lock, gocheck.IsNil)
+}
+
+func (s *S) TestDeployAppLocked(c *gocheck.C) {
+	a := App{
+		Name:     "otherapp",
+		Platform: "zend",
+		Teams:    []string{s.team.Name},
+		Units:    []Unit{{Name: "i-0800", State: "started"}},
+	}
+	err := s.conn.Apps().Insert(a)
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	defer s.conn.Deploys().RemoveAll(bson.M{"app": a.Name})
+	s.provisioner.Provision(&a)
+	defer s.provisioner.Destroy(&a)
+	lock, err := lockApp(a.Name, "remove-units")
+	c.Assert(err, gocheck.IsNil)
+	writer := &bytes.Buffer{}
+	err = DeployApp(&a, "version", "admin@tsuru.io", writer)
+	c.Assert(err, gocheck.FitsTypeOf, &AppLockedError{})
+	c.Assert(writer.Len(), gocheck.Equals, 0)
+	deploys, err := a.ListDeploys(nil)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(deploys, gocheck.HasLen, 1)
+	c.Assert(deploys[0].Status, gocheck.Equals, DeployFailed)
+	c.Assert(deploys[0].Error, gocheck.Matches, `The app "otherapp" is locked by another operation: remove-units, .*`)
+	unlockApp(a.Name, lock)
+	err = DeployApp(&a, "version", "admin@tsuru.io", writer)
+	c.Assert(err, gocheck.IsNil)
+	// The deploy released the lock
+	err = a.Get()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(a.Lock, gocheck.IsNil)
+}
+
+func (s *S) TestAddUnitsLocked(c *gocheck.C) {
+	a := App{Name: "warpaint", Platform: "ruby"}
+	err := s.conn.Apps().Insert(a)
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	s.provisioner.Provision(&a)
+	defer s.provisioner.Destroy(&a)
+	lock, err := lockApp(a.Name, "deploy")
+	c.Assert(err, gocheck.IsNil)
+	defer unlockApp(a.Name, lock)
+	err = a.AddUnits(1)
+	c.Assert(err, gocheck.FitsTypeOf, &AppLockedError{})
+	units := s.provisioner.GetUnits(&a)
+	c.Assert(units, gocheck.HasLen, 1)
+}
+
+func (s *S) TestRemoveUnitsReloadsTheApp(c *gocheck.C) {
+	a := App{
+		Name:     "chemistry",
+		Platform: "python",
+		Quota:    quota.Unlimited,
+		Units: []Unit{
+			{Name: "chemistry/0"},
+			{Name: "chemistry/1"},
+			{Name: "chemistry/2"},
+			{Name: "chemistry/3"},
+		},
+	}
+	err := s.conn.Apps().Insert(a)
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	s.provisioner.Provision(&a)
+	defer s.provisioner.Destroy(&a)
+	s.provisioner.AddUnits(&a, 4)
+	// Two requests loaded the app before either removed a unit
+	first, second := a, a
+	first.Units = append([]Unit(nil), a.Units...)
+	second.Units = append([]Unit(nil), a.Units...)
+	err = first.RemoveUnits(2)
+	c.Assert(err, gocheck.IsNil)
+	err = second.RemoveUnits(2)
+	c.Assert(err, gocheck.ErrorMatches, "Cannot remove all units from an app.")
+	err = a.Get()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(a.Units, gocheck.HasLen, 2)
+	c.Assert(a.Units[0].Name, gocheck.Equals, "chemistry/2")
+	c.Assert(a.Units[1].Name, gocheck.Equals, "chemistry/3")
+	c.Assert(a.Quota.InUse, gocheck.Equals, 2)
+	c.Assert(a.Lock, gocheck.IsNil)
+}
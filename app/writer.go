@@ -25,3 +25,25 @@ func (w *LogWriter) Write(data []byte) (int, error) {
 	}
 	return w.Writer.Write(data)
 }
+
+// The size of the excerpt of the output of a deploy kept in its record, in
+// bytes.
+const deployLogExcerptSize = 4096
+
+// tailWriter keeps the last max bytes written to it.
+type tailWriter struct {
+	max int
+	buf []byte
+}
+
+func (w *tailWriter) Write(data []byte) (int, error) {
+	w.buf = append(w.buf, data...)
+	if len(w.buf) > w.max {
+		w.buf = w.buf[len(w.buf)-w.max:]
+	}
+	return len(data), nil
+}
+
+func (w *tailWriter) String() string {
+	return string(w.buf)
+}
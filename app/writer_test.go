@@ -62,3 +62,15 @@ func (s *WriterSuite) TestLogWriterShouldReturnTheDataSize(c *gocheck.C) {
 	c.Assert(err, gocheck.IsNil)
 	c.Assert(n, gocheck.Equals, len(data))
 }
+
+func (s *WriterSuite) TestTailWriterKeepsTheEnd(c *gocheck.C) {
+	w := tailWriter{max: 5}
+	n, err := w.Write([]byte("abc"))
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(n, gocheck.Equals, 3)
+	c.Assert(w.String(), gocheck.Equals, "abc")
+	w.Write([]byte("defg"))
+	c.Assert(w.String(), gocheck.Equals, "cdefg")
+	w.Write([]byte("0123456789"))
+	c.Assert(w.String(), gocheck.Equals, "56789")
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codegangsta/martini"
+)
+
+var (
+	ErrForbidden = errors.New("album belongs to another user")
+)
+
+// The realm of the WWW-Authenticate challenges.
+const authRealm = "albums"
+
+// The cookie that holds the bearer token of the browsers, which cannot send an
+// Authorization header with the links and forms of the HTML views. Requests
+// authenticated by the cookie are protected by the CSRF middleware.
+const tokenCookie = "token"
+
+// The path of the login form, whose posts are protected by the CSRF middleware
+// even though they are not authenticated, so that another site cannot sign a
+// browser in with its own account.
+const loginPath = "/login"
+
+// Authorize returns a handler that requires a valid bearer token allowing the
+// scope, sent in the Authorization header as defined by RFC 6750, or in the
+// token cookie. The *Token is
+// mapped in the request context for the following handlers. Requests without a
+// valid token are answered with a 401, and those with a token that does not
+// allow the scope with a 403, both answered with the request's Fail.
+func Authorize(scope Scope) martini.Handler {
+	return func(c martini.Context, w http.ResponseWriter, r *http.Request, fail Fail, tdb TokenDB) {
+		if t := authorize(w, r, fail, tdb, scope); t != nil {
+			c.Map(t)
+		}
+	}
+}
+
+// Returns the valid token of the request, or answers the request and returns nil.
+func authorize(w http.ResponseWriter, r *http.Request, fail Fail, tdb TokenDB, scope Scope) *Token {
+	v := bearerToken(r)
+	if v == "" && r.Header.Get("Authorization") == "" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s"`, authRealm))
+		writeError(w, fail, NewError(ErrCodeUnauthorized, "a bearer token is required"))
+		return nil
+	}
+	var t *Token
+	if v != "" {
+		t = tdb.Get(v)
+	}
+	var msg string
+	switch {
+	case t == nil:
+		msg = "the token is invalid"
+	case t.Revoked:
+		msg = "the token has been revoked"
+	case !t.Valid():
+		msg = "the token has expired"
+	case !t.Scope.Allows(scope):
+		w.Header().Set("WWW-Authenticate",
+			fmt.Sprintf(`Bearer realm="%s", error="insufficient_scope", scope="%s"`, authRealm, scope))
+		writeError(w, fail, NewError(ErrCodeForbidden, fmt.Sprintf("the token does not have the %s scope", scope)))
+		return nil
+	default:
+		return t
+	}
+	w.Header().Set("WWW-Authenticate",
+		fmt.Sprintf(`Bearer realm="%s", error="invalid_token", error_description="%s"`, authRealm, msg))
+	writeError(w, fail, NewError(ErrCodeUnauthorized, msg))
+	return nil
+}
+
+// Returns the value of the bearer token of the Authorization header, or of the
+// token cookie if there is no such header, or an empty string if there is none.
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if h == "" {
+		if ck, err := r.Cookie(tokenCookie); err == nil {
+			return ck.Value
+		}
+		return ""
+	}
+	if i := strings.IndexByte(h, ' '); i > 0 && strings.EqualFold(h[:i], "bearer") {
+		return strings.TrimSpace(h[i+1:])
+	}
+	return ""
+}
+
+// The form fields accepted in token requests.
+var tokenFormFields = map[string]bool{"email": true, "password": true, "scope": true, "ttl": true}
+
+// The body of a token request: the credentials of the user, and the scope and
+// lifetime (in seconds) of the token, which default to read and tokenTTL.
+type tokenBody struct {
+	XMLName      xml.Name   `json:"-" xml:"token"`
+	Email        *string    `json:"email" xml:"email"`
+	Password     *string    `json:"password" xml:"password"`
+	Scope        *string    `json:"scope" xml:"scope"`
+	TTL          *int       `json:"ttl" xml:"ttl"`
+	UnknownElems []xml.Name `json:"-" xml:",any"`
+	UnknownAttrs []xml.Attr `json:"-" xml:",any,attr"`
+}
+
+// The hash checked when the email of a token request is not registered, so
+// that the response time does not tell whether it is.
+var unknownUser struct {
+	once sync.Once
+	u    User
+}
+
+// CreateToken issues a token to the user whose email and password are posted.
+// Wrong credentials are answered with a 401, without telling whether the email
+// is registered.
+func CreateToken(w http.ResponseWriter, r *http.Request, enc Encoder, fail Fail, udb UserDB, tdb TokenDB) (int, string) {
+	body, err := getPostToken(r)
+	if err != nil {
+		return fail(err)
+	}
+	t, err := issueToken(udb, tdb, body)
+	if err != nil {
+		if e, ok := err.(*Error); ok && e.Code == ErrCodeUnauthorized {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s"`, authRealm))
+		}
+		return fail(err)
+	}
+	return http.StatusCreated, Must(enc.Encode(t))
+}
+
+// Checks the credentials of the validated body and issues the token, or
+// returns an *Error if they are wrong.
+func issueToken(udb UserDB, tdb TokenDB, body *tokenBody) (*Token, error) {
+	u := udb.GetByEmail(*body.Email)
+	if u == nil {
+		unknownUser.once.Do(func() {
+			if err := unknownUser.u.SetPassword("not a password"); err != nil {
+				panic(err)
+			}
+		})
+		unknownUser.u.CheckPassword(*body.Password)
+		return nil, NewError(ErrCodeUnauthorized, "the email or the password is invalid")
+	}
+	if !u.CheckPassword(*body.Password) {
+		return nil, NewError(ErrCodeUnauthorized, "the email or the password is invalid")
+	}
+	t, err := tdb.Issue(u.Id, Scope(*body.Scope), time.Duration(*body.TTL)*time.Second)
+	if err != nil {
+		panic(err)
+	}
+	return t, nil
+}
+
+func invalidTokenRequest(fields ...*FieldError) *Error {
+	e := NewError(ErrCodeInvalidTokenRequest, "the token request is invalid")
+	e.Fields = fields
+	return e
+}
+
+// getPostToken reads the token request from the body, in the same formats as
+// getPostUser, and validates it. The scope and the ttl are set to their
+// default if they are missing.
+func getPostToken(r *http.Request) (*tokenBody, error) {
+	mt, e := bodyMediaType(r)
+	if e != nil {
+		return nil, e
+	}
+	var body tokenBody
+	switch mt {
+	case "application/json":
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&body); err != nil {
+			return nil, NewError(ErrCodeInvalidTokenRequest, fmt.Sprintf("malformed JSON body: %s", err))
+		}
+	case "application/xml", "text/xml":
+		if err := xml.NewDecoder(r.Body).Decode(&body); err != nil {
+			return nil, NewError(ErrCodeInvalidTokenRequest, fmt.Sprintf("malformed XML body: %s", err))
+		}
+		var fields []*FieldError
+		for _, n := range body.UnknownElems {
+			fields = append(fields, &FieldError{Field: n.Local, Message: "unknown field"})
+		}
+		for _, a := range body.UnknownAttrs {
+			fields = append(fields, &FieldError{Field: a.Name.Local, Message: "unknown field"})
+		}
+		if len(fields) > 0 {
+			return nil, invalidTokenRequest(fields...)
+		}
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+			return nil, NewError(ErrCodeInvalidTokenRequest, fmt.Sprintf("malformed form body: %s", err))
+		}
+		if f := tokenFormBody(r, &body); len(f) > 0 {
+			return nil, invalidTokenRequest(f...)
+		}
+	default:
+		return nil, unsupportedMediaType(r.Header.Get("Content-Type"))
+	}
+	if f := body.validate(); len(f) > 0 {
+		return nil, invalidTokenRequest(f...)
+	}
+	return &body, nil
+}
+
+// Sets the fields of the body from the parsed form of the request, and
+// returns the errors of its unknown or invalid fields.
+func tokenFormBody(r *http.Request, body *tokenBody) []*FieldError {
+	var fields []*FieldError
+	for k := range r.PostForm {
+		if !tokenFormFields[k] {
+			fields = append(fields, &FieldError{Field: k, Message: "unknown field"})
+		}
+	}
+	if len(fields) > 0 {
+		sort.Sort(byField(fields))
+		return fields
+	}
+	str := func(k string) *string {
+		if _, ok := r.Form[k]; !ok {
+			return nil
+		}
+		v := r.Form.Get(k)
+		return &v
+	}
+	body.Email, body.Password, body.Scope = str("email"), str("password"), str("scope")
+	if v := str("ttl"); v != nil && *v != "" {
+		n, err := strconv.Atoi(*v)
+		if err != nil {
+			return []*FieldError{{Field: "ttl", Message: "must be an integer"}}
+		}
+		body.TTL = &n
+	}
+	return nil
+}
+
+// Checks the fields of the body, and sets the defaults of the scope and the
+// ttl.
+func (b *tokenBody) validate() []*FieldError {
+	var fields []*FieldError
+	if b.Email == nil || strings.TrimSpace(*b.Email) == "" {
+		fields = append(fields, &FieldError{Field: "email", Message: "is required"})
+	} else {
+		email := strings.TrimSpace(*b.Email)
+		b.Email = &email
+	}
+	if b.Password == nil || *b.Password == "" {
+		fields = append(fields, &FieldError{Field: "password", Message: "is required"})
+	}
+	switch {
+	case b.Scope == nil || *b.Scope == "":
+		scope := string(ScopeRead)
+		b.Scope = &scope
+	case Scope(*b.Scope) != ScopeRead && Scope(*b.Scope) != ScopeReadWrite:
+		fields = append(fields, &FieldError{Field: "scope",
+			Message: fmt.Sprintf("must be %s or %s", ScopeRead, ScopeReadWrite)})
+	}
+	maxTTL := int(tokenTTL / time.Second)
+	switch {
+	case b.TTL == nil:
+		b.TTL = &maxTTL
+	case *b.TTL < 1 || *b.TTL > maxTTL:
+		fields = append(fields, &FieldError{Field: "ttl", Message: fmt.Sprintf("must be between 1 and %d", maxTTL)})
+	}
+	return fields
+}
+
+// RevokeToken revokes one of the tokens of the authenticated user. Tokens of
+// other users are reported as not existing.
+func RevokeToken(fail Fail, tdb TokenDB, t *Token, parms martini.Params) (int, string) {
+	if rt := tdb.Get(parms["token"]); rt == nil || rt.UserId != t.UserId {
+		return fail(NewError(ErrCodeNotExist, "the token does not exist"))
+	}
+	if err := tdb.Revoke(parms["token"]); err != nil && err != ErrTokenNotExist {
+		panic(err)
+	}
+	return http.StatusNoContent, ""
+}
+
+// The login form of the HTML views, see htmlEncoder.
+type loginForm struct{}
+
+// LoginForm returns the form that signs a browser in. It is only available in
+// HTML.
+func LoginForm(enc Encoder, fail Fail) (int, string) {
+	if _, ok := enc.(htmlEncoder); !ok {
+		return fail(NewError(ErrCodeNotAcceptable, "the login form is only available in HTML, use /login.html"))
+	}
+	return http.StatusOK, Must(enc.Encode(&loginForm{}))
+}
+
+// Login signs a browser in: it issues a token to the user whose email and
+// password are posted in a form, as CreateToken does, sets it in the token
+// cookie and redirects to the albums. The scope of the token defaults to
+// read-write. The cookie is HttpOnly, SameSite, Secure under TLS, and expires
+// with the token.
+func Login(w http.ResponseWriter, r *http.Request, fail Fail, udb UserDB, tdb TokenDB) (int, string) {
+	mt, e := bodyMediaType(r)
+	if e != nil {
+		return fail(e)
+	}
+	if mt != "application/x-www-form-urlencoded" && mt != "multipart/form-data" {
+		return fail(NewError(ErrCodeUnsupportedMediaType, fmt.Sprintf(
+			"unsupported content type '%s', use application/x-www-form-urlencoded or multipart/form-data", r.Header.Get("Content-Type"))))
+	}
+	if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+		return fail(NewError(ErrCodeInvalidTokenRequest, fmt.Sprintf("malformed form body: %s", err)))
+	}
+	var body tokenBody
+	if f := tokenFormBody(r, &body); len(f) > 0 {
+		return fail(invalidTokenRequest(f...))
+	}
+	if body.Scope == nil || *body.Scope == "" {
+		scope := string(ScopeReadWrite)
+		body.Scope = &scope
+	}
+	if f := body.validate(); len(f) > 0 {
+		return fail(invalidTokenRequest(f...))
+	}
+	t, err := issueToken(udb, tdb, &body)
+	if err != nil {
+		return fail(err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     tokenCookie,
+		Value:    t.Value,
+		Path:     "/",
+		Expires:  t.Expires,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set("Location", "/albums.html")
+	return http.StatusSeeOther, ""
+}
+
+// Logout signs a browser out: it revokes the token of the request, clears the
+// token cookie and redirects to the login form.
+func Logout(w http.ResponseWriter, r *http.Request, tdb TokenDB, t *Token) (int, string) {
+	if err := tdb.Revoke(t.Value); err != nil && err != ErrTokenNotExist {
+		panic(err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     tokenCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set("Location", loginPath+".html")
+	return http.StatusSeeOther, ""
+}
+
+// canModify reports whether the owner of the token can modify or delete the
+// album, i.e. if the user owns the album or is an admin.
+func canModify(udb UserDB, t *Token, a *Album) bool {
+	if a.Owner != 0 && a.Owner == t.UserId {
+		return true
+	}
+	u := udb.Get(t.UserId)
+	return u != nil && u.Admin
+}
+
+func albumForbidden(id string) *Error {
+	return NewError(ErrCodeForbidden, fmt.Sprintf("the album with id %s belongs to another user", id))
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"launchpad.net/gocheck"
+)
+
+func (s *TokenSuite) authorize(c *gocheck.C, header string, scope Scope) (*Token, *httptest.ResponseRecorder) {
+	r, err := http.NewRequest("GET", "/albums", nil)
+	c.Assert(err, gocheck.IsNil)
+	if header != "" {
+		r.Header.Set("Authorization", header)
+	}
+	w := httptest.NewRecorder()
+	return authorize(w, r, testFail(w, r), s.db, scope), w
+}
+
+func (s *TokenSuite) TestAuthorize(c *gocheck.C) {
+	t, _ := s.db.Issue(1, ScopeReadWrite, time.Hour)
+	got, w := s.authorize(c, "Bearer "+t.Value, ScopeReadWrite)
+	c.Assert(got, gocheck.DeepEquals, t)
+	c.Assert(w.Body.Len(), gocheck.Equals, 0)
+	got, _ = s.authorize(c, "bearer "+t.Value, ScopeRead)
+	c.Assert(got, gocheck.DeepEquals, t)
+}
+
+func (s *TokenSuite) TestAuthorizeMissing(c *gocheck.C) {
+	got, w := s.authorize(c, "", ScopeRead)
+	c.Assert(got, gocheck.IsNil)
+	c.Assert(w.Code, gocheck.Equals, http.StatusUnauthorized)
+	c.Assert(w.Header().Get("WWW-Authenticate"), gocheck.Equals, `Bearer realm="albums"`)
+	assertProblem(c, w.Body.String(), ErrCodeUnauthorized, "a bearer token is required")
+}
+
+func (s *TokenSuite) TestAuthorizeInvalid(c *gocheck.C) {
+	t, _ := s.db.Issue(1, ScopeRead, time.Hour)
+	revoked, _ := s.db.Issue(1, ScopeRead, time.Hour)
+	s.db.Revoke(revoked.Value)
+	cases := map[string]string{
+		"Bearer nope":             "the token is invalid",
+		"Basic " + t.Value:        "the token is invalid",
+		"Bearer " + revoked.Value: "the token has been revoked",
+	}
+	for h, msg := range cases {
+		got, w := s.authorize(c, h, ScopeRead)
+		c.Assert(got, gocheck.IsNil)
+		c.Assert(w.Code, gocheck.Equals, http.StatusUnauthorized)
+		c.Assert(w.Header().Get("WWW-Authenticate"), gocheck.Equals,
+			`Bearer realm="albums", error="invalid_token", error_description="`+msg+`"`)
+		assertProblem(c, w.Body.String(), ErrCodeUnauthorized, msg)
+	}
+	base := now()
+	now = func() time.Time { return base.Add(2 * time.Hour) }
+	got, w := s.authorize(c, "Bearer "+t.Value, ScopeRead)
+	c.Assert(got, gocheck.IsNil)
+	assertProblem(c, w.Body.String(), ErrCodeUnauthorized, "the token has expired")
+}
+
+func (s *TokenSuite) TestAuthorizeCookie(c *gocheck.C) {
+	t, _ := s.db.Issue(1, ScopeRead, time.Hour)
+	r, _ := http.NewRequest("GET", "/albums.html", nil)
+	r.AddCookie(&http.Cookie{Name: tokenCookie, Value: t.Value})
+	w := httptest.NewRecorder()
+	c.Assert(authorize(w, r, testFail(w, r), s.db, ScopeRead), gocheck.DeepEquals, t)
+	// The Authorization header takes precedence
+	r.Header.Set("Authorization", "Bearer nope")
+	w = httptest.NewRecorder()
+	c.Assert(authorize(w, r, testFail(w, r), s.db, ScopeRead), gocheck.IsNil)
+	assertProblem(c, w.Body.String(), ErrCodeUnauthorized, "the token is invalid")
+}
+
+func (s *TokenSuite) TestAuthorizeScope(c *gocheck.C) {
+	t, _ := s.db.Issue(1, ScopeRead, time.Hour)
+	got, w := s.authorize(c, "Bearer "+t.Value, ScopeReadWrite)
+	c.Assert(got, gocheck.IsNil)
+	c.Assert(w.Code, gocheck.Equals, http.StatusForbidden)
+	c.Assert(w.Header().Get("WWW-Authenticate"), gocheck.Equals,
+		`Bearer realm="albums", error="insufficient_scope", scope="read-write"`)
+	assertProblem(c, w.Body.String(), ErrCodeForbidden, "the token does not have the read-write scope")
+}
+
+func (s *TokenSuite) TestRevokeToken(c *gocheck.C) {
+	t, _ := s.db.Issue(1, ScopeRead, time.Hour)
+	other, _ := s.db.Issue(2, ScopeRead, time.Hour)
+	status, _ := RevokeToken(testFail(nil, nil), s.db, t, map[string]string{"token": other.Value})
+	c.Assert(status, gocheck.Equals, http.StatusNotFound)
+	c.Assert(s.db.Get(other.Value).Valid(), gocheck.Equals, true)
+	status, _ = RevokeToken(testFail(nil, nil), s.db, t, map[string]string{"token": t.Value})
+	c.Assert(status, gocheck.Equals, http.StatusNoContent)
+	c.Assert(s.db.Get(t.Value).Valid(), gocheck.Equals, false)
+}
+
+func (s *TokenSuite) TestCanModify(c *gocheck.C) {
+	udb := &usersDB{m: make(map[int]*User)}
+	owner, _ := udb.Add(&User{Email: "kerry@example.com"})
+	other, _ := udb.Add(&User{Email: "jeff@example.com"})
+	admin, _ := udb.Add(&User{Email: "admin@example.com", Admin: true})
+	al := &Album{Id: 1, Band: "Slayer", Title: "Reign In Blood", Owner: owner}
+	c.Assert(canModify(udb, &Token{UserId: owner}, al), gocheck.Equals, true)
+	c.Assert(canModify(udb, &Token{UserId: other}, al), gocheck.Equals, false)
+	c.Assert(canModify(udb, &Token{UserId: admin}, al), gocheck.Equals, true)
+	// Albums without owner can only be modified by admins
+	al.Owner = 0
+	c.Assert(canModify(udb, &Token{UserId: owner}, al), gocheck.Equals, false)
+	c.Assert(canModify(udb, &Token{UserId: admin}, al), gocheck.Equals, true)
+}
+
+// Registers a user that claims the admin token.
+func (s *UserSuite) postAdmin(c *gocheck.C, body, token string) (int, string) {
+	r := newBodyRequest(c, "application/json", body)
+	r.Header.Set(adminTokenHeader, token)
+	return CreateUser(httptest.NewRecorder(), r, jsonEncoder{}, testFail(nil, r), s.db)
+}
+
+// Registrations are never admins, unless they claim the admin token, which
+// only works once.
+func (s *UserSuite) TestCreateUserNeverAdmin(c *gocheck.C) {
+	status, _ := s.post(c, "application/json", `{"email":"kerry@example.com","password":"reign in blood"}`)
+	c.Assert(status, gocheck.Equals, http.StatusCreated)
+	c.Assert(s.db.GetByEmail("kerry@example.com").Admin, gocheck.Equals, false)
+	status, _ = s.post(c, "application/json", `{"email":"jeff@example.com","password":"reign in blood","admin":true}`)
+	c.Assert(status, gocheck.Equals, http.StatusBadRequest)
+	// Without a token drawn, no header makes an admin
+	defer func(orig string) { adminToken.value = orig }(adminToken.value)
+	adminToken.value = ""
+	status, _ = s.postAdmin(c, `{"email":"dave@example.com","password":"reign in blood"}`, "")
+	c.Assert(status, gocheck.Equals, http.StatusCreated)
+	c.Assert(s.db.GetByEmail("dave@example.com").Admin, gocheck.Equals, false)
+
+	token := adminToken.reset()
+	status, _ = s.postAdmin(c, `{"email":"tom@example.com","password":"reign in blood"}`, "wrong")
+	c.Assert(status, gocheck.Equals, http.StatusCreated)
+	c.Assert(s.db.GetByEmail("tom@example.com").Admin, gocheck.Equals, false)
+	// A failed registration does not use the token up
+	status, _ = s.postAdmin(c, `{"email":"kerry@example.com","password":"reign in blood"}`, token)
+	c.Assert(status, gocheck.Equals, http.StatusConflict)
+	status, body := s.postAdmin(c, `{"email":"gary@example.com","password":"reign in blood"}`, token)
+	c.Assert(status, gocheck.Equals, http.StatusCreated)
+	c.Assert(strings.Contains(body, `"admin":true`), gocheck.Equals, true)
+	c.Assert(s.db.GetByEmail("gary@example.com").Admin, gocheck.Equals, true)
+	status, _ = s.postAdmin(c, `{"email":"paul@example.com","password":"reign in blood"}`, token)
+	c.Assert(status, gocheck.Equals, http.StatusCreated)
+	c.Assert(s.db.GetByEmail("paul@example.com").Admin, gocheck.Equals, false)
+}
+
+// The user registered with the admin token can modify and delete the albums
+// of the other users.
+func (s *UserSuite) TestAdminModifiesAlbums(c *gocheck.C) {
+	defer func(orig string) { adminToken.value = orig }(adminToken.value)
+	token := adminToken.reset()
+	status, _ := s.post(c, "application/json", `{"email":"kerry@example.com","password":"reign in blood"}`)
+	c.Assert(status, gocheck.Equals, http.StatusCreated)
+	status, _ = s.postAdmin(c, `{"email":"admin@example.com","password":"reign in blood"}`, token)
+	c.Assert(status, gocheck.Equals, http.StatusCreated)
+	owner, admin := s.db.GetByEmail("kerry@example.com"), s.db.GetByEmail("admin@example.com")
+	c.Assert(owner.Admin, gocheck.Equals, false)
+	c.Assert(admin.Admin, gocheck.Equals, true)
+
+	adb := &albumsDB{m: make(map[int]*Album)}
+	id, _ := adb.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Owner: owner.Id})
+	parms := map[string]string{"id": "1"}
+	r := newBodyRequest(c, "application/json", `{"band":"Slayer","title":"Reign In Blood","year":1986}`)
+	status, _ = UpdateAlbum(httptest.NewRecorder(), r, jsonEncoder{}, testFail(nil, r), adb, s.db, &Token{UserId: admin.Id}, parms)
+	c.Assert(status, gocheck.Equals, http.StatusOK)
+	c.Assert(adb.Get(id).Year, gocheck.Equals, 1986)
+	c.Assert(adb.Get(id).Owner, gocheck.Equals, owner.Id)
+	r, _ = http.NewRequest("DELETE", "/albums/1", nil)
+	status, _ = DeleteAlbum(httptest.NewRecorder(), r, jsonEncoder{}, testFail(nil, r), adb, s.db, &Token{UserId: admin.Id}, parms)
+	c.Assert(status, gocheck.Equals, http.StatusNoContent)
+	c.Assert(adb.Get(id), gocheck.IsNil)
+}
+
+func (s *TokenSuite) TestDeleteAlbumForbidden(c *gocheck.C) {
+	adb := &albumsDB{m: make(map[int]*Album)}
+	udb := &usersDB{m: make(map[int]*User)}
+	id, _ := adb.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Owner: 1})
+	r, _ := http.NewRequest("DELETE", "/albums/1", nil)
+	status, body := DeleteAlbum(httptest.NewRecorder(), r, jsonEncoder{}, testFail(nil, r), adb, udb, &Token{UserId: 2}, map[string]string{"id": "1"})
+	c.Assert(status, gocheck.Equals, http.StatusForbidden)
+	assertProblem(c, body, ErrCodeForbidden, "the album with id 1 belongs to another user")
+	c.Assert(adb.Get(id), gocheck.NotNil)
+	status, _ = DeleteAlbum(httptest.NewRecorder(), r, jsonEncoder{}, testFail(nil, r), adb, udb, &Token{UserId: 1}, map[string]string{"id": "1"})
+	c.Assert(status, gocheck.Equals, http.StatusNoContent)
+	c.Assert(adb.Get(id), gocheck.IsNil)
+}
+
+// The delete form of the HTML views is redirected to the albums.
+func (s *TokenSuite) TestDeleteAlbumHTML(c *gocheck.C) {
+	adb := &albumsDB{m: make(map[int]*Album)}
+	udb := &usersDB{m: make(map[int]*User)}
+	id, _ := adb.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Owner: 1})
+	r, _ := http.NewRequest("DELETE", "/albums/1", nil)
+	w := httptest.NewRecorder()
+	status, body := DeleteAlbum(w, r, htmlEncoder{}, testFail(w, r), adb, udb, &Token{UserId: 1}, map[string]string{"id": "1"})
+	c.Assert(status, gocheck.Equals, http.StatusSeeOther)
+	c.Assert(body, gocheck.Equals, "")
+	c.Assert(w.Header().Get("Location"), gocheck.Equals, "/albums.html")
+	c.Assert(adb.Get(id), gocheck.IsNil)
+}
+
+func (s *TokenSuite) TestUpdateAlbumKeepsOwner(c *gocheck.C) {
+	adb := &albumsDB{m: make(map[int]*Album)}
+	udb := &usersDB{m: make(map[int]*User)}
+	id, _ := adb.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Owner: 1})
+	r := newBodyRequest(c, "application/json", `{"band":"Slayer","title":"Reign In Blood","year":1986,"owner":2}`)
+	status, _ := UpdateAlbum(httptest.NewRecorder(), r, jsonEncoder{}, testFail(nil, r), adb, udb, &Token{UserId: 1}, map[string]string{"id": "1"})
+	c.Assert(status, gocheck.Equals, http.StatusOK)
+	c.Assert(adb.Get(id).Owner, gocheck.Equals, 1)
+	c.Assert(adb.Get(id).Year, gocheck.Equals, 1986)
+}
+
+func (s *UserSuite) createToken(c *gocheck.C, ct, body string) (int, string, *httptest.ResponseRecorder) {
+	r := newBodyRequest(c, ct, body)
+	w := httptest.NewRecorder()
+	status, out := CreateToken(w, r, jsonEncoder{}, testFail(w, r), s.db, s.tokens)
+	return status, out, w
+}
+
+func (s *UserSuite) TestCreateToken(c *gocheck.C) {
+	base := now()
+	defer func(orig func() time.Time) { now = orig }(now)
+	now = func() time.Time { return base }
+	u := &User{Email: "kerry@example.com"}
+	u.SetPassword("reign in blood")
+	id, _ := s.db.Add(u)
+	status, out, _ := s.createToken(c, "application/json", `{"email":"Kerry@example.com","password":"reign in blood"}`)
+	c.Assert(status, gocheck.Equals, http.StatusCreated)
+	var t Token
+	c.Assert(json.Unmarshal([]byte(out), &t), gocheck.IsNil)
+	got := s.tokens.Get(t.Value)
+	c.Assert(got, gocheck.NotNil)
+	c.Assert(got.UserId, gocheck.Equals, id)
+	c.Assert(got.Scope, gocheck.Equals, ScopeRead)
+	c.Assert(got.Expires.Sub(base), gocheck.Equals, tokenTTL)
+	c.Assert(t.UserId, gocheck.Equals, id)
+
+	status, out, _ = s.createToken(c, "application/x-www-form-urlencoded", "email=kerry%40example.com&password=reign+in+blood&scope=read-write&ttl=60")
+	c.Assert(status, gocheck.Equals, http.StatusCreated)
+	c.Assert(json.Unmarshal([]byte(out), &t), gocheck.IsNil)
+	got = s.tokens.Get(t.Value)
+	c.Assert(got.Scope, gocheck.Equals, ScopeReadWrite)
+	c.Assert(got.Expires.Sub(base), gocheck.Equals, time.Minute)
+
+	status, _, _ = s.createToken(c, "application/xml",
+		`<token><email>kerry@example.com</email><password>reign in blood</password><ttl>3600</ttl></token>`)
+	c.Assert(status, gocheck.Equals, http.StatusCreated)
+}
+
+func (s *UserSuite) TestCreateTokenWrongCredentials(c *gocheck.C) {
+	u := &User{Email: "kerry@example.com"}
+	u.SetPassword("reign in blood")
+	s.db.Add(u)
+	for _, body := range []string{
+		`{"email":"kerry@example.com","password":"south of heaven"}`,
+		`{"email":"jeff@example.com","password":"reign in blood"}`,
+	} {
+		status, out, w := s.createToken(c, "application/json", body)
+		c.Assert(status, gocheck.Equals, http.StatusUnauthorized)
+		c.Assert(w.Header().Get("WWW-Authenticate"), gocheck.Equals, `Bearer realm="albums"`)
+		assertProblem(c, out, ErrCodeUnauthorized, "the email or the password is invalid")
+	}
+	c.Assert(s.tokens.m, gocheck.HasLen, 0)
+}
+
+func (s *UserSuite) TestCreateTokenInvalid(c *gocheck.C) {
+	cases := []struct {
+		ct, body string
+		fields   []string
+	}{
+		{"application/json", `{}`, []string{"email", "password"}},
+		{"application/json", `{"email":"kerry@example.com","password":"x","scope":"admin","ttl":0}`, []string{"scope", "ttl"}},
+		{"application/json", `{"email":"kerry@example.com","password":"x","ttl":86401}`, []string{"ttl"}},
+		{"application/xml", `<token remember="1"><email>kerry@example.com</email></token>`, []string{"remember"}},
+		{"application/x-www-form-urlencoded", "email=kerry%40example.com&password=x&ttl=day", []string{"ttl"}},
+		{"application/x-www-form-urlencoded", "email=kerry%40example.com&password=x&remember=1", []string{"remember"}},
+	}
+	for _, t := range cases {
+		status, out, _ := s.createToken(c, t.ct, t.body)
+		c.Assert(status, gocheck.Equals, http.StatusBadRequest, gocheck.Commentf("%s", t.body))
+		e := assertProblem(c, out, ErrCodeInvalidTokenRequest, "the token request is invalid")
+		c.Assert(e.Fields, gocheck.HasLen, len(t.fields), gocheck.Commentf("%s", t.body))
+		for i, f := range t.fields {
+			c.Check(e.Fields[i].Field, gocheck.Equals, f)
+		}
+	}
+	status, _, _ := s.createToken(c, "text/csv", "email,password\n")
+	c.Assert(status, gocheck.Equals, http.StatusUnsupportedMediaType)
+}
+
+// Goes through the whole server: a new user registers, gets a token with
+// their email and password, and lists the albums with it.
+func (s *UserSuite) TestRegisterAndListAlbums(c *gocheck.C) {
+	m.MapTo(s.db, (*UserDB)(nil))
+	m.MapTo(s.tokens, (*TokenDB)(nil))
+	defer func() {
+		m.MapTo(users, (*UserDB)(nil))
+		m.MapTo(tokens, (*TokenDB)(nil))
+	}()
+	serve := func(method, path, body, auth string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest(method, path, strings.NewReader(body))
+		c.Assert(err, gocheck.IsNil)
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Accept", "application/json")
+		if auth != "" {
+			r.Header.Set("Authorization", "Bearer "+auth)
+		}
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, r)
+		return w
+	}
+	w := serve("POST", "/users", `{"email":"kerry@example.com","password":"reign in blood"}`, "")
+	c.Assert(w.Code, gocheck.Equals, http.StatusCreated)
+	w = serve("POST", "/tokens", `{"email":"kerry@example.com","password":"south of heaven"}`, "")
+	c.Assert(w.Code, gocheck.Equals, http.StatusUnauthorized)
+	w = serve("POST", "/tokens", `{"email":"kerry@example.com","password":"reign in blood"}`, "")
+	c.Assert(w.Code, gocheck.Equals, http.StatusCreated)
+	var t Token
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &t), gocheck.IsNil)
+	c.Assert(t.Value, gocheck.Not(gocheck.Equals), "")
+
+	w = serve("GET", "/albums", "", "")
+	c.Assert(w.Code, gocheck.Equals, http.StatusUnauthorized)
+	w = serve("GET", "/albums", "", t.Value)
+	c.Assert(w.Code, gocheck.Equals, http.StatusOK)
+	var p Page
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &p), gocheck.IsNil)
+	c.Assert(p.Total, gocheck.Equals, len(db.GetAll()))
+}
+
+func (s *UserSuite) TestLoginAndPostForm(c *gocheck.C) {
+	adb := &albumsDB{m: make(map[int]*Album)}
+	m.MapTo(s.db, (*UserDB)(nil))
+	m.MapTo(s.tokens, (*TokenDB)(nil))
+	m.MapTo(adb, (*DB)(nil))
+	defer func() {
+		m.MapTo(users, (*UserDB)(nil))
+		m.MapTo(tokens, (*TokenDB)(nil))
+		m.MapTo(db, (*DB)(nil))
+	}()
+	s.post(c, "application/json", `{"email":"dave@example.com","password":"hangar eighteen"}`)
+	serve := func(method, path string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		r, err := http.NewRequest(method, path, strings.NewReader(form.Encode()))
+		c.Assert(err, gocheck.IsNil)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, ck := range cookies {
+			r.AddCookie(ck)
+		}
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, r)
+		return w
+	}
+	cookie := func(w *httptest.ResponseRecorder, name string) *http.Cookie {
+		for _, ck := range w.Result().Cookies() {
+			if ck.Name == name {
+				return ck
+			}
+		}
+		return nil
+	}
+
+	w := serve("GET", "/login.html", nil)
+	c.Assert(w.Code, gocheck.Equals, http.StatusOK)
+	csrf := cookie(w, csrfCookie)
+	c.Assert(csrf, gocheck.NotNil)
+	c.Assert(w.Body.String(), gocheck.Matches, `(?s).*name="csrf_token" value="`+csrf.Value+`".*`)
+
+	login := url.Values{"email": {"dave@example.com"}, "password": {"hangar eighteen"}}
+	w = serve("POST", "/login.html", login, csrf)
+	c.Assert(w.Code, gocheck.Equals, http.StatusForbidden)
+	login.Set(csrfField, csrf.Value)
+	w = serve("POST", "/login.html", login, csrf)
+	c.Assert(w.Code, gocheck.Equals, http.StatusSeeOther)
+	c.Assert(w.Header().Get("Location"), gocheck.Equals, "/albums.html")
+	tok := cookie(w, tokenCookie)
+	c.Assert(tok, gocheck.NotNil)
+	c.Assert(tok.HttpOnly, gocheck.Equals, true)
+	c.Assert(tok.SameSite, gocheck.Equals, http.SameSiteLaxMode)
+	c.Assert(tok.Secure, gocheck.Equals, false)
+	t := s.tokens.Get(tok.Value)
+	c.Assert(t, gocheck.NotNil)
+	c.Assert(t.Scope, gocheck.Equals, ScopeReadWrite)
+
+	album := url.Values{"band": {"Megadeth"}, "title": {"Rust in Peace"}, "year": {"1990"}}
+	w = serve("POST", "/albums.html", album, csrf, tok)
+	c.Assert(w.Code, gocheck.Equals, http.StatusForbidden)
+	album.Set(csrfField, csrf.Value)
+	w = serve("POST", "/albums.html", album, csrf, tok)
+	c.Assert(w.Code, gocheck.Equals, http.StatusCreated)
+	c.Assert(adb.GetAll(), gocheck.HasLen, 1)
+	w = serve("POST", "/albums/1.html", url.Values{"_method": {"DELETE"}, csrfField: {csrf.Value}}, csrf, tok)
+	c.Assert(w.Code, gocheck.Equals, http.StatusSeeOther)
+	c.Assert(w.Header().Get("Location"), gocheck.Equals, "/albums.html")
+	c.Assert(adb.GetAll(), gocheck.HasLen, 0)
+
+	w = serve("POST", "/logout.html", url.Values{csrfField: {csrf.Value}}, csrf, tok)
+	c.Assert(w.Code, gocheck.Equals, http.StatusSeeOther)
+	c.Assert(w.Header().Get("Location"), gocheck.Equals, "/login.html")
+	cleared := cookie(w, tokenCookie)
+	c.Assert(cleared, gocheck.NotNil)
+	c.Assert(cleared.MaxAge < 0, gocheck.Equals, true)
+	c.Assert(s.tokens.Get(tok.Value).Revoked, gocheck.Equals, true)
+	w = serve("GET", "/albums.html", nil, csrf, tok)
+	c.Assert(w.Code, gocheck.Equals, http.StatusUnauthorized)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/globocom/config"
+)
+
+// The prefix of the environment variables that override the configuration.
+const envPrefix = "JINDOU_"
+
+// A ServerConfig tells how the server listens. It is read from the
+// configuration file, with the keys given in the comments, and each key can be
+// overridden by an environment variable named after it: JINDOU_ followed by the
+// key in uppercase, with dashes and colons replaced by underscores (e.g.
+// JINDOU_TLS_CERT_FILE). The defaults are those of a server without
+// configuration file.
+type ServerConfig struct {
+	Listen          string        // listen: address of the API, ":8001"
+	UseTLS          bool          // use-tls: whether the API is served over HTTPS, true
+	CertFile        string        // tls-cert-file: "cert.pem"
+	KeyFile         string        // tls-key-file: "key.pem"
+	HTTPListen      string        // http-listen: address of the HTTP listener of an HTTPS server, ":8000", empty to disable it
+	Redirect        bool          // tls-redirect: whether the HTTP listener redirects to HTTPS instead of refusing the requests, false
+	ShutdownTimeout time.Duration // shutdown-timeout: in seconds, time given to the requests to finish on shutdown, 30
+	AdminListen     string        // admin-listen: address of the admin listener (see adminHandler), empty to disable it
+}
+
+// loadServerConfig reads the configuration file, if path is not empty, and
+// applies the overrides found with lookupEnv (os.LookupEnv outside of tests).
+func loadServerConfig(path string, lookupEnv func(string) (string, bool)) (*ServerConfig, error) {
+	if path != "" {
+		if err := config.ReadConfigFile(path); err != nil {
+			return nil, fmt.Errorf("cannot read the configuration file %s: %s", path, err)
+		}
+	}
+	cr := &configReader{path: path, lookupEnv: lookupEnv}
+	cfg := &ServerConfig{
+		Listen:      cr.string("listen", ":8001"),
+		UseTLS:      cr.bool("use-tls", true),
+		CertFile:    cr.string("tls-cert-file", "cert.pem"),
+		KeyFile:     cr.string("tls-key-file", "key.pem"),
+		HTTPListen:  cr.string("http-listen", ":8000"),
+		Redirect:    cr.bool("tls-redirect", false),
+		AdminListen: cr.string("admin-listen", ""),
+	}
+	cfg.ShutdownTimeout = time.Duration(cr.int("shutdown-timeout", 30)) * time.Second
+	if cr.err != nil {
+		return nil, cr.err
+	}
+	if cfg.Listen == "" {
+		return nil, errors.New("the listen address is required")
+	}
+	if cfg.UseTLS && (cfg.CertFile == "" || cfg.KeyFile == "") {
+		return nil, errors.New("tls-cert-file and tls-key-file are required when use-tls is true")
+	}
+	return cfg, nil
+}
+
+// Reads the values of the keys, from the environment or else from the
+// configuration file. The first invalid value is kept in err.
+type configReader struct {
+	path      string
+	lookupEnv func(string) (string, bool)
+	err       error
+}
+
+func envName(key string) string {
+	return envPrefix + strings.ToUpper(strings.NewReplacer("-", "_", ":", "_").Replace(key))
+}
+
+// Returns the text of the key, and where it comes from for the error messages,
+// or an empty source if the key is not set.
+func (cr *configReader) lookup(key string) (string, string) {
+	if v, ok := cr.lookupEnv(envName(key)); ok {
+		return v, envName(key)
+	}
+	if cr.path == "" {
+		return "", ""
+	}
+	v, err := config.Get(key)
+	if err != nil {
+		return "", ""
+	}
+	// Booleans and integers are parsed from their text, as in the environment
+	return fmt.Sprint(v), cr.path
+}
+
+func (cr *configReader) string(key, def string) string {
+	if v, src := cr.lookup(key); src != "" {
+		return v
+	}
+	return def
+}
+
+func (cr *configReader) bool(key string, def bool) bool {
+	v, src := cr.lookup(key)
+	if src == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		cr.fail(key, v, src)
+		return def
+	}
+	return b
+}
+
+func (cr *configReader) int(key string, def int) int {
+	v, src := cr.lookup(key)
+	if src == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		cr.fail(key, v, src)
+		return def
+	}
+	return n
+}
+
+func (cr *configReader) fail(key, v, src string) {
+	if cr.err == nil {
+		cr.err = fmt.Errorf("invalid value '%s' for %s in %s", v, key, src)
+	}
+}
+
+// A certLoader holds the TLS certificate of the server, which can be reloaded
+// from its files while the server runs.
+type certLoader struct {
+	certFile, keyFile string
+	mu                sync.RWMutex
+	cert              *tls.Certificate
+}
+
+func newCertLoader(certFile, keyFile string) (*certLoader, error) {
+	cl := &certLoader{certFile: certFile, keyFile: keyFile}
+	return cl, cl.reload()
+}
+
+// Reads the certificate files again. The current certificate is kept if they
+// are invalid.
+func (cl *certLoader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cl.certFile, cl.keyFile)
+	if err != nil {
+		return err
+	}
+	cl.mu.Lock()
+	cl.cert = &cert
+	cl.mu.Unlock()
+	return nil
+}
+
+// Implements tls.Config.GetCertificate.
+func (cl *certLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	return cl.cert, nil
+}
+
+// Returns the handler of the HTTP listener of an HTTPS server, which redirects
+// the requests to the same URL with the https scheme on the port of the API, or
+// refuses them.
+//
+// Refusing is the default: it is common practice to serve APIs on their own
+// servers, often on their own subdomain so that cookies are not sent with every
+// request, and a client that sent a request over HTTP may already have leaked
+// its bearer token. This could of course be done on a reverse-proxy in front of
+// this web server.
+func httpHandler(cfg *ServerConfig) http.Handler {
+	if !cfg.Redirect {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "https scheme is required", http.StatusBadRequest)
+		})
+	}
+	_, port, _ := net.SplitHostPort(cfg.Listen)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		// 301 would let clients change the method to GET
+		status := http.StatusPermanentRedirect
+		if r.Method == "GET" || r.Method == "HEAD" {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	})
+}
+
+// serve runs the server with the configuration, and the admin listener if there
+// is one, until it receives SIGTERM or SIGINT. Then it stops accepting
+// connections and waits for the requests in progress to finish, for at most
+// cfg.ShutdownTimeout. The contexts of the requests are cancelled, so that the
+// long-lived ones (change feeds) return early, with the changes so far. SIGHUP reloads the TLS
+// certificate.
+func serve(cfg *ServerConfig, h, admin http.Handler) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	servers := []*http.Server{{
+		Addr:        cfg.Listen,
+		Handler:     h,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}}
+	var cl *certLoader
+	if cfg.UseTLS {
+		var err error
+		if cl, err = newCertLoader(cfg.CertFile, cfg.KeyFile); err != nil {
+			return err
+		}
+		servers[0].TLSConfig = &tls.Config{GetCertificate: cl.getCertificate}
+		if cfg.HTTPListen != "" {
+			servers = append(servers, &http.Server{Addr: cfg.HTTPListen, Handler: httpHandler(cfg)})
+		}
+	}
+	if cfg.AdminListen != "" {
+		servers = append(servers, &http.Server{Addr: cfg.AdminListen, Handler: admin})
+	}
+	servers[0].RegisterOnShutdown(cancel)
+
+	errc := make(chan error, len(servers))
+	for i, srv := range servers {
+		go func(srv *http.Server, tls bool) {
+			var err error
+			if tls {
+				err = srv.ListenAndServeTLS("", "")
+			} else {
+				err = srv.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				errc <- err
+			}
+		}(srv, i == 0 && cfg.UseTLS)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case err := <-errc:
+			shutdown(servers, 0)
+			return err
+		case sig := <-sigs:
+			if sig != syscall.SIGHUP {
+				log.Printf("%s received, shutting down", sig)
+				return shutdown(servers, cfg.ShutdownTimeout)
+			}
+			if cl == nil {
+				continue
+			}
+			if err := cl.reload(); err != nil {
+				log.Printf("cannot reload the TLS certificate, keeping the current one: %s", err)
+			} else {
+				log.Printf("TLS certificate reloaded")
+			}
+		}
+	}
+}
+
+// Shuts the servers down, and closes their remaining connections after the
+// timeout.
+func shutdown(servers []*http.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		ferr error
+	)
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				srv.Close()
+				mu.Lock()
+				if ferr == nil {
+					ferr = err
+				}
+				mu.Unlock()
+			}
+		}(srv)
+	}
+	wg.Wait()
+	return ferr
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"time"
+
+	"launchpad.net/gocheck"
+)
+
+func envMap(env map[string]string) func(string) (string, bool) {
+	return func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	}
+}
+
+func writeConfigFile(c *gocheck.C, content string) string {
+	path := filepath.Join(c.MkDir(), "jindou.conf")
+	c.Assert(ioutil.WriteFile(path, []byte(content), 0600), gocheck.IsNil)
+	return path
+}
+
+func (s *S) TestLoadServerConfigDefaults(c *gocheck.C) {
+	cfg, err := loadServerConfig("", envMap(nil))
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(cfg, gocheck.DeepEquals, &ServerConfig{
+		Listen:          ":8001",
+		UseTLS:          true,
+		CertFile:        "cert.pem",
+		KeyFile:         "key.pem",
+		HTTPListen:      ":8000",
+		ShutdownTimeout: 30 * time.Second,
+	})
+}
+
+func (s *S) TestLoadServerConfig(c *gocheck.C) {
+	path := writeConfigFile(c, "listen: \"0.0.0.0:8443\"\nuse-tls: true\ntls-cert-file: /etc/jindou/cert.pem\n"+
+		"tls-key-file: /etc/jindou/key.pem\nhttp-listen: \"\"\nshutdown-timeout: 5\nadmin-listen: \"127.0.0.1:8888\"\n")
+	cfg, err := loadServerConfig(path, envMap(map[string]string{
+		"JINDOU_TLS_REDIRECT": "true",
+		"JINDOU_HTTP_LISTEN":  ":8080",
+		"JINDOU_LISTEN":       ":443",
+	}))
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(cfg, gocheck.DeepEquals, &ServerConfig{
+		Listen:          ":443",
+		UseTLS:          true,
+		CertFile:        "/etc/jindou/cert.pem",
+		KeyFile:         "/etc/jindou/key.pem",
+		HTTPListen:      ":8080",
+		Redirect:        true,
+		ShutdownTimeout: 5 * time.Second,
+		AdminListen:     "127.0.0.1:8888",
+	})
+	// An empty value in the environment overrides the file too
+	_, err = loadServerConfig(path, envMap(map[string]string{"JINDOU_TLS_CERT_FILE": ""}))
+	c.Assert(err, gocheck.ErrorMatches, "tls-cert-file and tls-key-file are required when use-tls is true")
+}
+
+func (s *S) TestLoadServerConfigInvalid(c *gocheck.C) {
+	path := writeConfigFile(c, "use-tls: maybe\n")
+	_, err := loadServerConfig(path, envMap(nil))
+	c.Assert(err, gocheck.ErrorMatches, "invalid value 'maybe' for use-tls in .*jindou.conf")
+	_, err = loadServerConfig("", envMap(map[string]string{"JINDOU_SHUTDOWN_TIMEOUT": "-1"}))
+	c.Assert(err, gocheck.ErrorMatches, "invalid value '-1' for shutdown-timeout in JINDOU_SHUTDOWN_TIMEOUT")
+	_, err = loadServerConfig(filepath.Join(c.MkDir(), "nope.conf"), envMap(nil))
+	c.Assert(err, gocheck.ErrorMatches, "cannot read the configuration file .*")
+}
+
+func (s *S) TestHTTPHandler(c *gocheck.C) {
+	r, _ := http.NewRequest("GET", "http://example.com:8000/albums?band=slayer", nil)
+	w := httptest.NewRecorder()
+	httpHandler(&ServerConfig{Listen: ":8001"}).ServeHTTP(w, r)
+	c.Assert(w.Code, gocheck.Equals, http.StatusBadRequest)
+
+	w = httptest.NewRecorder()
+	httpHandler(&ServerConfig{Listen: ":8001", Redirect: true}).ServeHTTP(w, r)
+	c.Assert(w.Code, gocheck.Equals, http.StatusMovedPermanently)
+	c.Assert(w.Header().Get("Location"), gocheck.Equals, "https://example.com:8001/albums?band=slayer")
+
+	r, _ = http.NewRequest("POST", "http://example.com/albums", nil)
+	w = httptest.NewRecorder()
+	httpHandler(&ServerConfig{Listen: "0.0.0.0:443", Redirect: true}).ServeHTTP(w, r)
+	c.Assert(w.Code, gocheck.Equals, http.StatusPermanentRedirect)
+	c.Assert(w.Header().Get("Location"), gocheck.Equals, "https://example.com/albums")
+}
+
+// Writes a self-signed certificate for the host, and returns the paths of the
+// certificate and key files.
+func writeCertificate(c *gocheck.C, dir, host string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, gocheck.IsNil)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	c.Assert(err, gocheck.IsNil)
+	kder, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, gocheck.IsNil)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	c.Assert(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600), gocheck.IsNil)
+	c.Assert(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600), gocheck.IsNil)
+	return certFile, keyFile
+}
+
+func (s *S) TestCertLoaderReload(c *gocheck.C) {
+	dir := c.MkDir()
+	certFile, keyFile := writeCertificate(c, dir, "old.example.com")
+	cl, err := newCertLoader(certFile, keyFile)
+	c.Assert(err, gocheck.IsNil)
+	commonName := func() string {
+		cert, err := cl.getCertificate(nil)
+		c.Assert(err, gocheck.IsNil)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		c.Assert(err, gocheck.IsNil)
+		return leaf.Subject.CommonName
+	}
+	c.Assert(commonName(), gocheck.Equals, "old.example.com")
+
+	writeCertificate(c, dir, "new.example.com")
+	c.Assert(cl.reload(), gocheck.IsNil)
+	c.Assert(commonName(), gocheck.Equals, "new.example.com")
+
+	// An invalid certificate is not loaded
+	c.Assert(ioutil.WriteFile(keyFile, []byte("nope"), 0600), gocheck.IsNil)
+	c.Assert(cl.reload(), gocheck.NotNil)
+	c.Assert(commonName(), gocheck.Equals, "new.example.com")
+
+	_, err = newCertLoader(filepath.Join(dir, "nope.pem"), keyFile)
+	c.Assert(err, gocheck.NotNil)
+}
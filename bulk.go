@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	// Highest number of albums accepted in a bulk import.
+	maxBulkItems = 10000
+	// Highest size of the body of a bulk import.
+	maxBulkSize = 16 << 20
+)
+
+// Statuses of the items of a bulk import.
+const (
+	bulkCreated  = "created"
+	bulkConflict = "conflict"
+	bulkInvalid  = "invalid"
+)
+
+// A BulkResult is the outcome of the import of one album, identified by its
+// position in the body (starting at 0). Id is set if the album is created,
+// Error if it is not.
+type BulkResult struct {
+	XMLName xml.Name `json:"-" xml:"result"`
+	Index   int      `json:"index" xml:"index,attr"`
+	Status  string   `json:"status" xml:"status,attr"`
+	Id      int      `json:"id,omitempty" xml:"id,attr,omitempty"`
+	Error   *Error   `json:"error,omitempty" xml:"error,omitempty"`
+}
+
+func (r *BulkResult) String() string {
+	switch {
+	case r.Id != 0:
+		return fmt.Sprintf("%d: %s %d", r.Index, r.Status, r.Id)
+	case r.Error != nil:
+		return fmt.Sprintf("%d: %s %s", r.Index, r.Status, r.Error)
+	}
+	return fmt.Sprintf("%d: %s", r.Index, r.Status)
+}
+
+// A BulkReport holds the results of a bulk import, in the order of the body.
+type BulkReport struct {
+	XMLName   xml.Name      `json:"-" xml:"bulk"`
+	Created   int           `json:"created" xml:"created,attr"`
+	Conflicts int           `json:"conflicts" xml:"conflicts,attr"`
+	Invalid   int           `json:"invalid" xml:"invalid,attr"`
+	Results   []*BulkResult `json:"results" xml:"result"`
+}
+
+// String renders the report as one result per line, followed by a summary line.
+func (b *BulkReport) String() string {
+	var buf bytes.Buffer
+	for _, r := range b.Results {
+		fmt.Fprintf(&buf, "%s\n", r)
+	}
+	fmt.Fprintf(&buf, "-- %d created, %d conflicts, %d invalid", b.Created, b.Conflicts, b.Invalid)
+	return buf.String()
+}
+
+// A bulkItem is one album of the body of a bulk import, or the reason why it
+// could not be decoded.
+type bulkItem struct {
+	album *Album
+	err   *Error
+}
+
+// BulkAddAlbums creates the albums of the body, owned by the authenticated
+// user. The body is a JSON array of albums, NDJSON (one JSON album per line) or
+// CSV with a header row, and the albums go through the same validation as with
+// AddAlbum; their id, owner, version and update time are ignored, so that an
+// export can be imported back.
+//
+// By default, the valid albums are created even if others are not, and the
+// report tells the outcome of each one. With the `atomic=true` query string
+// argument, no album is created unless all of them can be, and the failures are
+// reported as the fields of a 422 error.
+func BulkAddAlbums(w http.ResponseWriter, r *http.Request, enc Encoder, fail Fail, db DB, t *Token) (int, string) {
+	atomic := r.URL.Query().Get("atomic") == "true"
+	mt, e := bodyMediaType(r)
+	if e != nil {
+		return fail(e)
+	}
+	rd := http.MaxBytesReader(w, r.Body, maxBulkSize)
+	var items []*bulkItem
+	switch mt {
+	case "application/json":
+		items, e = decodeJSONBulk(rd)
+	case "application/x-ndjson", "application/jsonl":
+		items, e = decodeNDJSONBulk(rd)
+	case "text/csv":
+		items, e = decodeCSVBulk(rd)
+	default:
+		return fail(NewError(ErrCodeUnsupportedMediaType,
+			fmt.Sprintf("unsupported content type '%s', use application/json, application/x-ndjson or text/csv", r.Header.Get("Content-Type"))))
+	}
+	if e != nil {
+		return fail(e)
+	}
+
+	var albums []*Album
+	for _, it := range items {
+		if it.err == nil {
+			it.album.Owner = t.UserId
+			albums = append(albums, it.album)
+		}
+	}
+	invalid := len(items) - len(albums)
+	if atomic && invalid > 0 {
+		return fail(bulkRejected(items, nil))
+	}
+	errs := db.AddAll(albums, atomic)
+	if atomic && failed(errs) {
+		return fail(bulkRejected(items, errs))
+	}
+
+	rep := &BulkReport{Results: make([]*BulkResult, len(items))}
+	j := 0
+	for i, it := range items {
+		res := &BulkResult{Index: i}
+		rep.Results[i] = res
+		if it.err != nil {
+			res.Status, res.Error = bulkInvalid, it.err
+			rep.Invalid++
+			continue
+		}
+		switch err := errs[j]; err {
+		case nil:
+			res.Status, res.Id = bulkCreated, it.album.Id
+			rep.Created++
+		case ErrAlreadyExists:
+			res.Status, res.Error = bulkConflict, NewError(ErrCodeAlreadyExists,
+				fmt.Sprintf("the album '%s' from '%s' already exists", it.album.Title, it.album.Band))
+			rep.Conflicts++
+		default:
+			panic(err)
+		}
+		j++
+	}
+	return http.StatusOK, Must(enc.Encode(rep))
+}
+
+// Returns the error of an atomic bulk import that failed, with a field for each
+// album that is invalid or, if the albums were sent to the database, that
+// conflicts. errs holds the errors of the valid albums.
+func bulkRejected(items []*bulkItem, errs []error) *Error {
+	e := NewError(ErrCodeBulkRejected, "no album has been created")
+	j := 0
+	for i, it := range items {
+		switch {
+		case it.err != nil && len(it.err.Fields) > 0:
+			for _, f := range it.err.Fields {
+				e.Fields = append(e.Fields, &FieldError{Field: fmt.Sprintf("[%d].%s", i, f.Field), Message: f.Message})
+			}
+		case it.err != nil:
+			e.Fields = append(e.Fields, &FieldError{Field: fmt.Sprintf("[%d]", i), Message: it.err.Detail})
+		default:
+			if errs != nil && errs[j] == ErrAlreadyExists {
+				e.Fields = append(e.Fields, &FieldError{Field: fmt.Sprintf("[%d]", i), Message: "already exists"})
+			}
+			j++
+		}
+	}
+	return e
+}
+
+// Decodes a bulk body made of a JSON array of albums. Only a malformed array
+// fails the whole body, the albums are decoded and validated one by one.
+func decodeJSONBulk(rd io.Reader) ([]*bulkItem, *Error) {
+	dec := json.NewDecoder(rd)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, NewError(ErrCodeInvalidAlbum, "malformed JSON body: expected an array of albums")
+	}
+	var items []*bulkItem
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, NewError(ErrCodeInvalidAlbum, fmt.Sprintf("malformed JSON body: %s", err))
+		}
+		if len(items) == maxBulkItems {
+			return nil, tooManyItems()
+		}
+		items = append(items, jsonBulkItem(raw))
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, NewError(ErrCodeInvalidAlbum, fmt.Sprintf("malformed JSON body: %s", err))
+	}
+	return items, nil
+}
+
+// Decodes a bulk body made of one JSON album per line. Blank lines are ignored.
+func decodeNDJSONBulk(rd io.Reader) ([]*bulkItem, *Error) {
+	sc := bufio.NewScanner(rd)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	var items []*bulkItem
+	for sc.Scan() {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if len(items) == maxBulkItems {
+			return nil, tooManyItems()
+		}
+		items = append(items, jsonBulkItem(line))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, NewError(ErrCodeInvalidAlbum, fmt.Sprintf("malformed NDJSON body: %s", err))
+	}
+	return items, nil
+}
+
+func jsonBulkItem(b []byte) *bulkItem {
+	body, e := decodeJSONAlbum(bytes.NewReader(b))
+	if e != nil {
+		return &bulkItem{err: e}
+	}
+	return albumBulkItem(body)
+}
+
+// Decodes a CSV bulk body. The header row names the columns, which must be
+// fields of the albums, and empty cells are missing values. The cells of the
+// genres and tracks are decoded as form values, so that the CSV encoding of the
+// albums can be imported back.
+func decodeCSVBulk(rd io.Reader) ([]*bulkItem, *Error) {
+	cr := csv.NewReader(rd)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, NewError(ErrCodeInvalidAlbum, fmt.Sprintf("malformed CSV body: %s", err))
+	}
+	var unknown []*FieldError
+	for i, h := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(h))
+		if !albumFormFields[header[i]] {
+			unknown = append(unknown, &FieldError{Field: h, Message: "unknown field"})
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, invalidAlbum(unknown...)
+	}
+	var items []*bulkItem
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, NewError(ErrCodeInvalidAlbum, fmt.Sprintf("malformed CSV body: %s", err))
+		}
+		if len(items) == maxBulkItems {
+			return nil, tooManyItems()
+		}
+		var (
+			body   albumBody
+			fields []*FieldError
+		)
+		for i, v := range row {
+			if v == "" {
+				continue
+			}
+			if f := body.setText(header[i], []string{v}); f != nil {
+				fields = append(fields, f)
+			}
+		}
+		if len(fields) > 0 {
+			items = append(items, &bulkItem{err: invalidAlbum(fields...)})
+			continue
+		}
+		items = append(items, albumBulkItem(&body))
+	}
+	return items, nil
+}
+
+func albumBulkItem(body *albumBody) *bulkItem {
+	al, err := body.album()
+	if err != nil {
+		return &bulkItem{err: err.(*Error)}
+	}
+	return &bulkItem{album: al}
+}
+
+func tooManyItems() *Error {
+	return NewError(ErrCodeInvalidAlbum, fmt.Sprintf("too many albums, at most %d can be imported at once", maxBulkItems))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"launchpad.net/gocheck"
+)
+
+func bulkRequest(c *gocheck.C, ct, query, body string) (int, string, *albumsDB) {
+	db := &albumsDB{m: make(map[int]*Album)}
+	db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	r, err := http.NewRequest("POST", "/albums/_bulk"+query, strings.NewReader(body))
+	c.Assert(err, gocheck.IsNil)
+	r.Header.Set("Content-Type", ct)
+	w := httptest.NewRecorder()
+	status, out := BulkAddAlbums(w, r, jsonEncoder{}, testFail(w, r), db, &Token{UserId: 7})
+	return status, out, db
+}
+
+func (s *S) TestBulkAddAlbumsFormats(c *gocheck.C) {
+	bodies := map[string]string{
+		"application/json": `[{"band":"Slayer","title":"Hell Awaits","year":1985},` +
+			`{"band":"Slayer","title":"Reign In Blood"},{"band":"Slayer"}]`,
+		"application/x-ndjson": `{"band":"Slayer","title":"Hell Awaits","year":1985}` + "\n\n" +
+			`{"band":"Slayer","title":"Reign In Blood"}` + "\n" + `{"band":"Slayer"}` + "\n",
+		"text/csv": "band,title,year\nSlayer,Hell Awaits,1985\nSlayer,Reign In Blood,\nSlayer,,\n",
+	}
+	for ct, body := range bodies {
+		status, out, db := bulkRequest(c, ct, "", body)
+		c.Assert(status, gocheck.Equals, http.StatusOK, gocheck.Commentf("%s: %s", ct, out))
+		var rep BulkReport
+		c.Assert(json.Unmarshal([]byte(out), &rep), gocheck.IsNil)
+		c.Check(rep.Created, gocheck.Equals, 1)
+		c.Check(rep.Conflicts, gocheck.Equals, 1)
+		c.Check(rep.Invalid, gocheck.Equals, 1)
+		c.Assert(rep.Results, gocheck.HasLen, 3)
+		c.Check(rep.Results[0].Status, gocheck.Equals, bulkCreated)
+		c.Check(rep.Results[0].Id, gocheck.Equals, 2)
+		c.Check(rep.Results[1].Status, gocheck.Equals, bulkConflict)
+		c.Check(rep.Results[2].Status, gocheck.Equals, bulkInvalid)
+		c.Check(rep.Results[2].Error.Fields[0].Field, gocheck.Equals, "title")
+		c.Check(db.Get(2).Owner, gocheck.Equals, 7)
+	}
+}
+
+func (s *S) TestBulkAddAlbumsAtomic(c *gocheck.C) {
+	status, out, db := bulkRequest(c, "application/json", "?atomic=true",
+		`[{"band":"Slayer","title":"Hell Awaits"},{"band":"Slayer","title":"Reign In Blood"}]`)
+	c.Assert(status, gocheck.Equals, http.StatusUnprocessableEntity)
+	e := assertProblem(c, out, ErrCodeBulkRejected, "no album has been created")
+	c.Assert(e.Fields, gocheck.DeepEquals, []*FieldError{{Field: "[1]", Message: "already exists"}})
+	c.Assert(db.GetAll(), gocheck.HasLen, 1)
+
+	status, out, _ = bulkRequest(c, "text/csv", "?atomic=true", "band,title\nSlayer,Hell Awaits\n,South Of Heaven\n")
+	c.Assert(status, gocheck.Equals, http.StatusUnprocessableEntity)
+	e = assertProblem(c, out, ErrCodeBulkRejected, "no album has been created")
+	c.Assert(e.Fields, gocheck.DeepEquals, []*FieldError{{Field: "[1].band", Message: "is required"}})
+
+	status, _, db = bulkRequest(c, "application/json", "?atomic=true", `[{"band":"Slayer","title":"Hell Awaits"}]`)
+	c.Assert(status, gocheck.Equals, http.StatusOK)
+	c.Assert(db.GetAll(), gocheck.HasLen, 2)
+}
+
+func (s *S) TestBulkAddAlbumsMalformed(c *gocheck.C) {
+	cases := map[string]string{
+		"application/json": `{"band":"Slayer"}`,
+		"text/csv":         "band,producer\nSlayer,Rick Rubin\n",
+		"application/xml":  "<albums/>",
+	}
+	for ct, body := range cases {
+		status, _, db := bulkRequest(c, ct, "", body)
+		c.Check(status >= 400, gocheck.Equals, true, gocheck.Commentf("%s", ct))
+		c.Check(db.GetAll(), gocheck.HasLen, 1)
+	}
+}
+
+func (s *S) TestBulkAddAlbumsCSVDetails(c *gocheck.C) {
+	// The CSV export of an album can be imported back
+	al := &Album{Id: 2, Band: "Slayer", Title: "South Of Heaven", Year: 1988, Label: "Def Jam", Released: "1988-07-05",
+		Genres: []string{"thrash metal"}, Tracks: []*Track{{Number: 1, Title: "South Of Heaven", Duration: 298}}}
+	body, err := csvEncoder{}.Encode(al, encAlbum1)
+	c.Assert(err, gocheck.IsNil)
+	status, _, db := bulkRequest(c, "text/csv", "", body)
+	c.Assert(status, gocheck.Equals, http.StatusOK)
+	got := db.Get(2)
+	c.Assert(got, gocheck.NotNil)
+	c.Check(got.Released, gocheck.Equals, al.Released)
+	c.Check(got.Genres, gocheck.DeepEquals, al.Genres)
+	c.Check(got.Tracks, gocheck.DeepEquals, al.Tracks)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of changes kept by a feed. Older changes are dropped, and a client
+	// that has not caught up with them must reload the albums.
+	maxChanges = 1000
+	// Longest wait, in seconds, accepted for the wait query string argument.
+	maxChangesWait = 60
+	// Media type of the Server-Sent Events streams.
+	eventStreamType = "text/event-stream"
+	// Number of random bytes of the epoch of a feed.
+	changeEpochLen = 4
+)
+
+// Interval between two keep-alive comments of an idle event stream.
+var eventStreamKeepAlive = 15 * time.Second
+
+// A Change is an album that has been added, updated or deleted. Its sequence
+// number is greater than those of the previous changes. Album is the stored
+// album, it is nil for a deletion.
+type Change struct {
+	XMLName xml.Name  `json:"-" xml:"change"`
+	Seq     int       `json:"seq" xml:"seq,attr"`
+	Op      string    `json:"op" xml:"op,attr"`
+	Id      int       `json:"id" xml:"id,attr"`
+	Time    time.Time `json:"time" xml:"time,attr"`
+	Album   *Album    `json:"album,omitempty" xml:"album,omitempty"`
+}
+
+func (c *Change) String() string {
+	if c.Album == nil {
+		return fmt.Sprintf("%d: %s %d", c.Seq, c.Op, c.Id)
+	}
+	return fmt.Sprintf("%d: %s %d %s", c.Seq, c.Op, c.Id, c.Album)
+}
+
+// A ChangeList holds the changes that follow a change id. Last is the id to
+// resume from.
+type ChangeList struct {
+	XMLName xml.Name  `json:"-" xml:"changes"`
+	Last    string    `json:"last" xml:"last,attr"`
+	Changes []*Change `json:"changes" xml:"change"`
+	seq     int       // Sequence number of Last
+}
+
+// String renders the list as one change per line, followed by a summary line.
+func (l *ChangeList) String() string {
+	var buf bytes.Buffer
+	for _, c := range l.Changes {
+		fmt.Fprintf(&buf, "%s\n", c)
+	}
+	fmt.Fprintf(&buf, "-- last: %s", l.Last)
+	return buf.String()
+}
+
+// A ChangeFeed publishes the changes of a database. The zero value is an empty
+// feed, ready to use. The feed only lives in memory, its sequence numbers start
+// over when the server restarts. The changes are thus identified by the epoch
+// of the feed, drawn at random when it is first used, and their sequence
+// number: <epoch>-<seq>.
+type ChangeFeed struct {
+	mu      sync.Mutex
+	epoch   string
+	seq     int
+	changes []*Change
+	// Closed, then replaced, when a change is published
+	notify chan struct{}
+}
+
+// Publishes a change of the album identified by the id. a is copied, it is nil
+// for a deletion. The database must call it while it holds its write lock, so
+// that the changes are published in the order they are made.
+func (f *ChangeFeed) publish(op string, id int, a *Album) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq++
+	c := &Change{Seq: f.seq, Op: op, Id: id, Time: now()}
+	if a != nil {
+		cp := *a
+		c.Album, c.Time = &cp, a.Updated
+	}
+	f.changes = append(f.changes, c)
+	if len(f.changes) >= 2*maxChanges {
+		// Drop the oldest changes, copying the others so that the array does not
+		// grow forever
+		f.changes = append([]*Change(nil), f.changes[len(f.changes)-maxChanges:]...)
+	}
+	if f.notify != nil {
+		close(f.notify)
+		f.notify = nil
+	}
+}
+
+// Last returns the sequence number of the last change, 0 if there is none.
+func (f *ChangeFeed) Last() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.seq
+}
+
+// Epoch returns the epoch of the feed.
+func (f *ChangeFeed) Epoch() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.getEpoch()
+}
+
+// Returns the epoch of the feed, drawing it on the first call. The caller must
+// hold the lock.
+func (f *ChangeFeed) getEpoch() string {
+	if f.epoch == "" {
+		b := make([]byte, changeEpochLen)
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		f.epoch = hex.EncodeToString(b)
+	}
+	return f.epoch
+}
+
+// Returns the id of the change of the epoch with the sequence number.
+func changeId(epoch string, seq int) string {
+	return fmt.Sprintf("%s-%d", epoch, seq)
+}
+
+// ParseId returns the sequence number of the change id. It returns an
+// ErrCodeInvalidQuery error if id is not a change id, or an
+// ErrCodeChangesExpired error if it is the id of another epoch (e.g. because
+// the server restarted).
+func (f *ChangeFeed) ParseId(id string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	i := strings.Index(id, "-")
+	n, err := strconv.Atoi(id[i+1:])
+	if i <= 0 || err != nil || n < 0 {
+		return 0, NewError(ErrCodeInvalidQuery, fmt.Sprintf("invalid value '%s' for since", id))
+	}
+	if id[:i] != f.getEpoch() {
+		return 0, f.expired(id)
+	}
+	return n, nil
+}
+
+// Returns the error of a change id whose following changes are not available.
+// The caller must hold the lock.
+func (f *ChangeFeed) expired(id string) error {
+	return NewError(ErrCodeChangesExpired, fmt.Sprintf("the changes since %s are not available, reload the albums and resume from %s",
+		id, changeId(f.getEpoch(), f.seq)))
+}
+
+// Since returns the changes that follow the sequence number, and a channel
+// that is closed when the next change is published. It returns an
+// ErrCodeChangesExpired error if some of those changes have been dropped, or if
+// seq is unknown to the feed.
+func (f *ChangeFeed) Since(seq int) (*ChangeList, <-chan struct{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	oldest := f.seq + 1
+	if len(f.changes) > 0 {
+		oldest = f.changes[0].Seq
+	}
+	if seq < oldest-1 || seq > f.seq {
+		return nil, nil, f.expired(changeId(f.getEpoch(), seq))
+	}
+	l := &ChangeList{Last: changeId(f.getEpoch(), f.seq), Changes: []*Change{}, seq: f.seq}
+	if n := f.seq - seq; n > 0 {
+		l.Changes = append(l.Changes, f.changes[len(f.changes)-n:]...)
+	}
+	if f.notify == nil {
+		f.notify = make(chan struct{})
+	}
+	return l, f.notify, nil
+}
+
+// GetChanges returns the changes of the albums that follow the `since` query
+// string argument, a change id, or that follow the request if it is omitted.
+//
+// If there is none, the response waits for up to `wait` seconds (0 by default)
+// for the next changes (long polling), or until the server shuts down. The Last
+// member of the response is the `since` argument of the next request.
+//
+// If the request accepts text/event-stream, the changes are instead sent as a
+// Server-Sent Events stream that ends when the client disconnects. Each event
+// is a JSON-encoded change, with the change id as id and the operation as
+// event type, and a reconnecting client resumes from its Last-Event-ID header.
+func GetChanges(w http.ResponseWriter, r *http.Request, enc Encoder, fail Fail, db DB) {
+	feed := db.Changes()
+	qs := r.URL.Query()
+	stream := acceptsEventStream(r.Header.Get("Accept"))
+	s := qs.Get("since")
+	if stream && r.Header.Get("Last-Event-ID") != "" {
+		s = r.Header.Get("Last-Event-ID")
+	}
+	since := feed.Last()
+	if s != "" {
+		n, err := feed.ParseId(s)
+		if err != nil {
+			writeError(w, fail, err)
+			return
+		}
+		since = n
+	}
+	var wait int
+	if s := qs.Get("wait"); s != "" && !stream {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > maxChangesWait {
+			writeError(w, fail, NewError(ErrCodeInvalidQuery,
+				fmt.Sprintf("invalid value '%s' for wait, it must be between 0 and %d", s, maxChangesWait)))
+			return
+		}
+		wait = n
+	}
+	l, next, err := feed.Since(since)
+	if err != nil {
+		writeError(w, fail, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	if stream {
+		streamChanges(w, r, feed, l, next)
+		return
+	}
+	if len(l.Changes) == 0 && wait > 0 {
+		timer := time.NewTimer(time.Duration(wait) * time.Second)
+		defer timer.Stop()
+		select {
+		case <-next:
+		case <-timer.C:
+		case <-r.Context().Done():
+			// The server shuts down, or the client is gone. The client still
+			// gets a complete list, and resumes from its last id.
+		}
+		if l, _, err = feed.Since(since); err != nil {
+			writeError(w, fail, err)
+			return
+		}
+	}
+	Stream(w, http.StatusOK, enc, l)
+}
+
+// Sends the changes of l, then the following ones as they are published, as
+// Server-Sent Events, until the client disconnects. If the client is too slow
+// and changes are dropped before they are sent, an `expired` event carries the
+// error and ends the stream.
+func streamChanges(w http.ResponseWriter, r *http.Request, feed *ChangeFeed, l *ChangeList, next <-chan struct{}) {
+	w.Header().Set("Content-Type", eventStreamType)
+	w.WriteHeader(http.StatusOK)
+	fl, _ := w.(http.Flusher)
+	keepAlive := time.NewTicker(eventStreamKeepAlive)
+	defer keepAlive.Stop()
+	epoch := feed.Epoch()
+	for {
+		for _, c := range l.Changes {
+			b, err := json.Marshal(c)
+			if err != nil {
+				panic(err)
+			}
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", changeId(epoch, c.Seq), c.Op, b)
+		}
+		if fl != nil {
+			fl.Flush()
+		}
+		select {
+		case <-next:
+			var err error
+			if l, next, err = feed.Since(l.seq); err != nil {
+				b, _ := json.Marshal(err)
+				fmt.Fprintf(w, "event: expired\ndata: %s\n\n", b)
+				return
+			}
+		case <-keepAlive.C:
+			// Keeps proxies from closing the idle connection
+			l.Changes = nil
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Reports whether the Accept header explicitly accepts text/event-stream.
+func acceptsEventStream(accept string) bool {
+	for _, r := range parseAccept(accept) {
+		if r.match(eventStreamType) == 3 && r.q > 0 {
+			return true
+		}
+	}
+	return false
+}
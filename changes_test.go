@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"launchpad.net/gocheck"
+)
+
+func (s *S) TestChangeFeedSince(c *gocheck.C) {
+	var f ChangeFeed
+	l, next, err := f.Since(0)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(l.Changes, gocheck.HasLen, 0)
+	f.publish(opDelete, 1, nil)
+	select {
+	case <-next:
+	default:
+		c.Fatal("the waiters of the feed are not notified")
+	}
+	l, _, err = f.Since(0)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(l.Last, gocheck.Equals, f.Epoch()+"-1")
+	c.Assert(l.Changes, gocheck.HasLen, 1)
+	// An unknown sequence number
+	_, _, err = f.Since(2)
+	c.Assert(err.(*Error).Code, gocheck.Equals, ErrCodeChangesExpired)
+
+	for i := 0; i < 2*maxChanges; i++ {
+		f.publish(opDelete, i, nil)
+	}
+	_, _, err = f.Since(0)
+	c.Assert(err.(*Error).Code, gocheck.Equals, ErrCodeChangesExpired)
+	l, _, err = f.Since(f.Last() - maxChanges)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(l.Changes, gocheck.HasLen, maxChanges)
+}
+
+func (s *S) TestChangeFeedParseId(c *gocheck.C) {
+	var f, other ChangeFeed
+	c.Assert(f.Epoch(), gocheck.Not(gocheck.Equals), other.Epoch())
+	n, err := f.ParseId(f.Epoch() + "-12")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(n, gocheck.Equals, 12)
+	_, err = f.ParseId(other.Epoch() + "-0")
+	c.Assert(err.(*Error).Code, gocheck.Equals, ErrCodeChangesExpired)
+	for _, id := range []string{"", "12", "-12", f.Epoch() + "-", f.Epoch() + "--1", f.Epoch() + "-a"} {
+		_, err = f.ParseId(id)
+		c.Check(err.(*Error).Code, gocheck.Equals, ErrCodeInvalidQuery, gocheck.Commentf("%s", id))
+	}
+}
+
+func changesRequest(c *gocheck.C, qs string) *http.Request {
+	r, err := http.NewRequest("GET", "/albums/_changes"+qs, nil)
+	c.Assert(err, gocheck.IsNil)
+	return r
+}
+
+func (s *S) TestGetChangesLongPolling(c *gocheck.C) {
+	db := &albumsDB{m: make(map[int]*Album)}
+	db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	epoch := db.Changes().Epoch()
+	r := changesRequest(c, "?since="+epoch+"-0")
+	w := httptest.NewRecorder()
+	GetChanges(w, r, jsonEncoder{}, testFail(w, r), db)
+	c.Assert(w.Code, gocheck.Equals, http.StatusOK)
+	var l ChangeList
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &l), gocheck.IsNil)
+	c.Assert(l.Last, gocheck.Equals, epoch+"-1")
+	c.Assert(l.Changes[0].Album.Title, gocheck.Equals, "Reign In Blood")
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		db.Add(&Album{Band: "Slayer", Title: "South Of Heaven", Year: 1988})
+	}()
+	r = changesRequest(c, "?since="+l.Last+"&wait=5")
+	w = httptest.NewRecorder()
+	GetChanges(w, r, jsonEncoder{}, testFail(w, r), db)
+	c.Assert(w.Code, gocheck.Equals, http.StatusOK)
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &l), gocheck.IsNil)
+	c.Assert(l.Last, gocheck.Equals, epoch+"-2")
+	c.Assert(l.Changes, gocheck.HasLen, 1)
+	c.Assert(l.Changes[0].Album.Title, gocheck.Equals, "South Of Heaven")
+
+	// Without since, only the following changes are returned
+	r = changesRequest(c, "")
+	w = httptest.NewRecorder()
+	GetChanges(w, r, textEncoder{}, testFail(w, r), db)
+	c.Assert(w.Body.String(), gocheck.Equals, "-- last: "+epoch+"-2\n")
+}
+
+func (s *S) TestGetChangesShutdown(c *gocheck.C) {
+	db := &albumsDB{m: make(map[int]*Album)}
+	db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	epoch := db.Changes().Epoch()
+	// The server cancels the contexts of the requests when it shuts down
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := changesRequest(c, "?since="+epoch+"-1&wait=60").WithContext(ctx)
+	w := httptest.NewRecorder()
+	GetChanges(w, r, jsonEncoder{}, testFail(w, r), db)
+	c.Assert(w.Code, gocheck.Equals, http.StatusOK)
+	var l ChangeList
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &l), gocheck.IsNil)
+	c.Assert(l.Last, gocheck.Equals, epoch+"-1")
+	c.Assert(l.Changes, gocheck.HasLen, 0)
+}
+
+func (s *S) TestGetChangesInvalid(c *gocheck.C) {
+	db := &albumsDB{m: make(map[int]*Album)}
+	epoch := db.Changes().Epoch()
+	for qs, code := range map[string]int{
+		"?since=-1":                       ErrCodeInvalidQuery,
+		"?since=a":                        ErrCodeInvalidQuery,
+		"?since=0":                        ErrCodeInvalidQuery,
+		"?since=" + epoch + "-0&wait=120": ErrCodeInvalidQuery,
+		"?since=" + epoch + "-3":          ErrCodeChangesExpired,
+		"?since=00000000-0":               ErrCodeChangesExpired,
+	} {
+		r := changesRequest(c, qs)
+		w := httptest.NewRecorder()
+		GetChanges(w, r, jsonEncoder{}, testFail(w, r), db)
+		c.Check(w.Code, gocheck.Equals, errorKinds[code].Status, gocheck.Commentf("%s", qs))
+		c.Check(strings.Contains(w.Body.String(), errorKinds[code].Name), gocheck.Equals, true, gocheck.Commentf("%s", qs))
+	}
+}
+
+func (s *S) TestGetChangesEventStream(c *gocheck.C) {
+	db := &albumsDB{m: make(map[int]*Album)}
+	id, _ := db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	db.Delete(id)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	epoch := db.Changes().Epoch()
+	r := changesRequest(c, "?since="+epoch+"-0").WithContext(ctx)
+	r.Header.Set("Accept", "text/event-stream")
+	// The header of a reconnecting client takes precedence
+	r.Header.Set("Last-Event-ID", epoch+"-1")
+	w := httptest.NewRecorder()
+	GetChanges(w, r, jsonEncoder{}, testFail(w, r), db)
+	c.Assert(w.Code, gocheck.Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Content-Type"), gocheck.Equals, "text/event-stream")
+	c.Assert(w.Body.String(), gocheck.Matches, `id: `+epoch+`-2\nevent: delete\ndata: \{"seq":2,"op":"delete","id":1,"time":"[^"]+"\}\n\n`)
+}
+
+func (s *S) TestAcceptsEventStream(c *gocheck.C) {
+	c.Assert(acceptsEventStream("text/event-stream"), gocheck.Equals, true)
+	c.Assert(acceptsEventStream("application/json, text/event-stream;q=0.5"), gocheck.Equals, true)
+	c.Assert(acceptsEventStream("text/*"), gocheck.Equals, false)
+	c.Assert(acceptsEventStream("text/event-stream;q=0"), gocheck.Equals, false)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	ErrPreconditionFailed = errors.New("album precondition failed")
+)
+
+// albumETag returns the entity tag of an album. It is a strong tag made of the
+// version, the same for every format of the album, so that a tag received in
+// one format can be used in the If-Match header of a request in another.
+func albumETag(a *Album) string {
+	return fmt.Sprintf(`"%d"`, a.Version)
+}
+
+// pageETag returns the entity tag of a page of albums. It is a weak tag, as it
+// identifies the albums and their versions rather than an exact representation.
+func pageETag(p *Page) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d;%d;%d", p.Total, p.Offset, p.Limit)
+	for _, a := range p.Albums {
+		fmt.Fprintf(h, ";%d:%d", a.Id, a.Version)
+	}
+	return fmt.Sprintf(`W/"%x"`, h.Sum64())
+}
+
+// Returns the entity tags of an If-Match or If-None-Match header. The result
+// is nil if the header is absent, and holds "*" if any tag is allowed.
+func parseETags(h string) []string {
+	if strings.TrimSpace(h) == "" {
+		return nil
+	}
+	var tags []string
+	for _, t := range strings.Split(h, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// ifMatch reports whether the If-Match header of the request allows the
+// modification of the album. As required by RFC 7232, it uses the strong
+// comparison, so weak tags never match.
+func ifMatch(r *http.Request, a *Album) bool {
+	tags := parseETags(r.Header.Get("If-Match"))
+	if tags == nil {
+		return true
+	}
+	etag := albumETag(a)
+	for _, t := range tags {
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified reports whether a GET request can be answered with a 304, based
+// on the entity tag and the modification time of the resource. If-None-Match,
+// compared with the weak comparison, takes precedence over If-Modified-Since,
+// which is ignored if mod is the zero time.
+func notModified(r *http.Request, etag string, mod time.Time) bool {
+	if tags := parseETags(r.Header.Get("If-None-Match")); tags != nil {
+		etag = strings.TrimPrefix(etag, "W/")
+		for _, t := range tags {
+			if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if mod.IsZero() {
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !mod.After(ims)
+}
+
+// Sets the validators of an album on the response.
+func setAlbumValidators(w http.ResponseWriter, a *Album) {
+	w.Header().Set("ETag", albumETag(a))
+	if !a.Updated.IsZero() {
+		w.Header().Set("Last-Modified", a.Updated.UTC().Format(http.TimeFormat))
+	}
+}
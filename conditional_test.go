@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"launchpad.net/gocheck"
+)
+
+func newConditionalRequest(c *gocheck.C, header, value string) *http.Request {
+	r, err := http.NewRequest("GET", "/albums/1", nil)
+	c.Assert(err, gocheck.IsNil)
+	if header != "" {
+		r.Header.Set(header, value)
+	}
+	return r
+}
+
+func (s *S) TestIfMatch(c *gocheck.C) {
+	al := &Album{Id: 1, Version: 3}
+	cases := map[string]bool{
+		"":                true,
+		"*":               true,
+		`"3"`:             true,
+		`"2", "3"`:        true,
+		`"2"`:             false,
+		`W/"3"`:           false,
+		`"1", W/"3", "4"`: false,
+	}
+	for h, ok := range cases {
+		c.Check(ifMatch(newConditionalRequest(c, "If-Match", h), al), gocheck.Equals, ok, gocheck.Commentf("%s", h))
+	}
+}
+
+func (s *S) TestNotModified(c *gocheck.C) {
+	mod := time.Date(2013, 12, 1, 10, 30, 0, 0, time.UTC)
+	c.Assert(notModified(newConditionalRequest(c, "", ""), `"3"`, mod), gocheck.Equals, false)
+	c.Assert(notModified(newConditionalRequest(c, "If-None-Match", `"3"`), `"3"`, mod), gocheck.Equals, true)
+	c.Assert(notModified(newConditionalRequest(c, "If-None-Match", `W/"3"`), `"3"`, mod), gocheck.Equals, true)
+	c.Assert(notModified(newConditionalRequest(c, "If-None-Match", `"2"`), `"3"`, mod), gocheck.Equals, false)
+	c.Assert(notModified(newConditionalRequest(c, "If-Modified-Since", mod.Format(http.TimeFormat)), `"3"`, mod), gocheck.Equals, true)
+	earlier := mod.Add(-time.Second).Format(http.TimeFormat)
+	c.Assert(notModified(newConditionalRequest(c, "If-Modified-Since", earlier), `"3"`, mod), gocheck.Equals, false)
+	c.Assert(notModified(newConditionalRequest(c, "If-Modified-Since", earlier), `"3"`, time.Time{}), gocheck.Equals, false)
+	// If-None-Match takes precedence
+	r := newConditionalRequest(c, "If-None-Match", `"2"`)
+	r.Header.Set("If-Modified-Since", mod.Format(http.TimeFormat))
+	c.Assert(notModified(r, `"3"`, mod), gocheck.Equals, false)
+}
+
+func (s *S) TestPageETag(c *gocheck.C) {
+	p := &Page{Total: 2, Limit: 10, Albums: []*Album{{Id: 1, Version: 1}, {Id: 2, Version: 1}}}
+	etag := pageETag(p)
+	c.Assert(etag, gocheck.Matches, `W/"[0-9a-f]+"`)
+	p.Albums[1].Version = 2
+	c.Assert(pageETag(p), gocheck.Not(gocheck.Equals), etag)
+}
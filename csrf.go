@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/codegangsta/martini"
+)
+
+const (
+	// The cookie of the CSRF token, and the form field or header that must
+	// repeat it.
+	csrfCookie = "csrf_token"
+	csrfField  = "csrf_token"
+	csrfHeader = "X-CSRF-Token"
+	// Length of the CSRF tokens, in bytes before hex encoding.
+	csrfTokenLen = 32
+)
+
+// CSRF protects the browsers authenticated by the token cookie against
+// cross-site request forgery, with a double-submit token: the requests that
+// change something (any method but GET, HEAD and OPTIONS) and are authenticated
+// by the cookie must send the value of the csrf_token cookie in the csrf_token
+// form field or the X-CSRF-Token header, which another site cannot read. They
+// are answered with a 403 otherwise. Requests with an Authorization header are
+// not concerned, browsers do not send it on their own. The posts of the login
+// form are checked too, although they are not authenticated yet.
+//
+// The cookie is set on the HTML responses, whose forms have the token, and
+// the HTML encoder is replaced by one that knows it. It must be used after
+// MapEncoder and OverrideMethod.
+func CSRF(c martini.Context, w http.ResponseWriter, r *http.Request, f *Format, fail Fail) {
+	var tok string
+	if ck, err := r.Cookie(csrfCookie); err == nil && validCSRFToken(ck.Value) {
+		tok = ck.Value
+	}
+	if !safeMethod(r.Method) {
+		sent := r.Header.Get(csrfHeader)
+		if isFormBody(r) {
+			// The field is removed, so that the handlers do not see it
+			if v := r.FormValue(csrfField); v != "" {
+				sent = v
+			}
+			removeFormField(r, csrfField)
+		}
+		if (cookieAuthenticated(r) || r.URL.Path == loginPath) && (tok == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(tok)) != 1) {
+			writeError(w, fail, NewError(ErrCodeForbidden, "the CSRF token is missing or invalid"))
+			return
+		}
+	}
+	if _, ok := f.Encoder.(htmlEncoder); !ok {
+		return
+	}
+	if tok == "" {
+		b := make([]byte, csrfTokenLen)
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		tok = hex.EncodeToString(b)
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookie,
+			Value:    tok,
+			Path:     "/",
+			Secure:   r.TLS != nil,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+	c.MapTo(htmlEncoder{csrfToken: tok}, (*Encoder)(nil))
+}
+
+func validCSRFToken(v string) bool {
+	b, err := hex.DecodeString(v)
+	return err == nil && len(b) == csrfTokenLen
+}
+
+// Reports whether the request is authenticated by the token cookie rather than
+// by its Authorization header.
+func cookieAuthenticated(r *http.Request) bool {
+	if r.Header.Get("Authorization") != "" {
+		return false
+	}
+	_, err := r.Cookie(tokenCookie)
+	return err == nil
+}
+
+func safeMethod(m string) bool {
+	return m == "GET" || m == "HEAD" || m == "OPTIONS"
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"launchpad.net/gocheck"
+)
+
+// A martini.Context that records the Encoder mapped by a handler.
+type encoderContext struct {
+	nextContext
+	enc Encoder
+}
+
+func (c *encoderContext) MapTo(v interface{}, ifacePtr interface{}) interface{} {
+	if enc, ok := v.(Encoder); ok {
+		c.enc = enc
+	}
+	return nil
+}
+
+const testCSRFToken = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func csrf(r *http.Request, ext string) (*httptest.ResponseRecorder, *encoderContext) {
+	w := httptest.NewRecorder()
+	ctx := &encoderContext{}
+	f := FormatByExt(ext)
+	CSRF(ctx, w, r, f, newFail(w, r, f, "req-1"))
+	return w, ctx
+}
+
+func (s *S) TestCSRFSetsCookie(c *gocheck.C) {
+	r, _ := http.NewRequest("GET", "/albums", nil)
+	w, ctx := csrf(r, ".html")
+	c.Assert(w.Code, gocheck.Equals, http.StatusOK)
+	cks := w.Result().Cookies()
+	c.Assert(cks, gocheck.HasLen, 1)
+	c.Assert(cks[0].Name, gocheck.Equals, csrfCookie)
+	c.Assert(validCSRFToken(cks[0].Value), gocheck.Equals, true)
+	c.Assert(cks[0].HttpOnly, gocheck.Equals, true)
+	c.Assert(cks[0].SameSite, gocheck.Equals, http.SameSiteStrictMode)
+	c.Assert(ctx.enc, gocheck.Equals, htmlEncoder{csrfToken: cks[0].Value})
+
+	// A valid cookie is kept
+	r.AddCookie(&http.Cookie{Name: csrfCookie, Value: testCSRFToken})
+	w, ctx = csrf(r, ".html")
+	c.Assert(w.Result().Cookies(), gocheck.HasLen, 0)
+	c.Assert(ctx.enc, gocheck.Equals, htmlEncoder{csrfToken: testCSRFToken})
+
+	// Other formats do not need it
+	r, _ = http.NewRequest("GET", "/albums", nil)
+	w, ctx = csrf(r, ".json")
+	c.Assert(w.Result().Cookies(), gocheck.HasLen, 0)
+	c.Assert(ctx.enc, gocheck.IsNil)
+}
+
+func (s *S) TestCSRFCheck(c *gocheck.C) {
+	post := func(body, token string, cookies ...string) *http.Request {
+		r := newBodyRequest(c, "application/x-www-form-urlencoded", body)
+		if token != "" {
+			r.Header.Set(csrfHeader, token)
+		}
+		for i := 0; i < len(cookies); i += 2 {
+			r.AddCookie(&http.Cookie{Name: cookies[i], Value: cookies[i+1]})
+		}
+		return r
+	}
+
+	// A request authenticated by the token cookie must repeat the CSRF cookie
+	r := post("band=Slayer&csrf_token="+testCSRFToken, "", tokenCookie, "t", csrfCookie, testCSRFToken)
+	w, _ := csrf(r, ".html")
+	c.Assert(w.Code, gocheck.Equals, http.StatusOK)
+	// The field is removed for the handlers
+	c.Assert(r.PostForm.Get(csrfField), gocheck.Equals, "")
+	c.Assert(r.PostForm.Get("band"), gocheck.Equals, "Slayer")
+	w, _ = csrf(post("band=Slayer", testCSRFToken, tokenCookie, "t", csrfCookie, testCSRFToken), ".json")
+	c.Assert(w.Code, gocheck.Equals, http.StatusOK)
+
+	for _, r := range []*http.Request{
+		post("band=Slayer", "", tokenCookie, "t", csrfCookie, testCSRFToken),
+		post("band=Slayer&csrf_token="+strings.Repeat("0", len(testCSRFToken)), "", tokenCookie, "t", csrfCookie, testCSRFToken),
+		post("band=Slayer&csrf_token=nope", "", tokenCookie, "t", csrfCookie, "nope"),
+		post("band=Slayer", testCSRFToken, tokenCookie, "t"),
+	} {
+		w, _ := csrf(r, ".json")
+		c.Assert(w.Code, gocheck.Equals, http.StatusForbidden)
+		assertProblem(c, w.Body.String(), ErrCodeForbidden, "the CSRF token is missing or invalid")
+	}
+
+	// The Authorization header is not sent by the browsers on their own
+	r = post("band=Slayer", "", tokenCookie, "t")
+	r.Header.Set("Authorization", "Bearer t")
+	w, _ = csrf(r, ".json")
+	c.Assert(w.Code, gocheck.Equals, http.StatusOK)
+	// Neither are the safe methods checked
+	r, _ = http.NewRequest("GET", "/albums", nil)
+	r.AddCookie(&http.Cookie{Name: tokenCookie, Value: "t"})
+	w, _ = csrf(r, ".json")
+	c.Assert(w.Code, gocheck.Equals, http.StatusOK)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+)
+
+type csvEncoder struct{}
+
+// csvEncoder is an Encoder that produces CSV-formatted responses, with one row
+// per value and a header row made of the JSON field names of the values (all
+// the fields of a csvColumner, even those that JSON omits when empty). Values
+// that are not objects are encoded in a single `value` column, and nested lists
+// or objects are encoded as JSON in their cell. A page is encoded as its list of
+// albums (its metadata is available in the response headers).
+func (e csvEncoder) Encode(v ...interface{}) (string, error) {
+	return encodeString(e, v)
+}
+
+func (_ csvEncoder) EncodeTo(w io.Writer, v ...interface{}) error {
+	if len(v) == 1 {
+		if p, ok := v[0].(*Page); ok {
+			// Still send the header row of an empty page
+			return writeList(&csvListWriter{w: csv.NewWriter(w), zero: &Album{}}, w, toIface(p.Albums))
+		}
+	}
+	return writeList(&csvListWriter{w: csv.NewWriter(w)}, w, v)
+}
+
+// Returns the JSON object of the value, or an object with a single `value` key
+// if the value is not encoded as an object.
+func csvObject(v interface{}) (*object, error) {
+	t, err := jsonTree(v)
+	if err != nil {
+		return nil, err
+	}
+	o, ok := t.(*object)
+	if !ok {
+		o = &object{keys: []string{"value"}, vals: map[string]interface{}{"value": t}}
+	}
+	return o, nil
+}
+
+// A csvColumner has a fixed set of CSV columns, so that all the rows of a list
+// have the same columns even if the JSON encoding omits empty fields.
+type csvColumner interface {
+	csvColumns() []string
+}
+
+// Returns the columns of the header row for the value v, whose object is o.
+func csvHeader(v interface{}, o *object) []string {
+	if c, ok := v.(csvColumner); ok {
+		return c.csvColumns()
+	}
+	return o.keys
+}
+
+// Writes the values of the columns of the header, in this order.
+func csvRow(w *csv.Writer, header []string, o *object) error {
+	row := make([]string, len(header))
+	for j, k := range header {
+		var err error
+		if row[j], err = csvCell(o.vals[k]); err != nil {
+			return err
+		}
+	}
+	return w.Write(row)
+}
+
+func csvCell(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		if v {
+			return "true", nil
+		}
+		return "false", nil
+	}
+	var buf bytes.Buffer
+	err := writeJSONTree(&buf, v)
+	return buf.String(), err
+}
+
+// Writes a tree produced by jsonTree back as JSON, keeping the order of the keys.
+func writeJSONTree(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case *object:
+		buf.WriteByte('{')
+		for i, k := range v.keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeJSONTree(buf, k); err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			if err := writeJSONTree(buf, v.vals[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		return nil
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeJSONTree(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf.Write(b)
+	return nil
+}
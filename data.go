@@ -5,10 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 )
 
 var (
 	ErrAlreadyExists = errors.New("album already exists")
+	ErrNotExist      = errors.New("album does not exist")
 )
 
 // The DB interface defines methods to manipulate the albums.
@@ -16,16 +18,31 @@ type DB interface {
 	Get(id int) *Album
 	GetAll() []*Album
 	Find(band, title string, year int) []*Album
+	Search(text string) []*Album
 	Add(a *Album) (int, error)
+	AddAll(albums []*Album, atomic bool) []error
 	Update(a *Album) error
-	Delete(id int)
+	Modify(id int, fn func(a *Album) (*Album, error)) (*Album, error)
+	Delete(id int) error
+	DeleteIf(id int, cond func(a *Album) error) error
+	Changes() *ChangeFeed
+	Count() int
+	Ping() error
+}
+
+// The clock used to stamp the albums. Times are truncated to the second, the
+// precision of the Last-Modified header.
+var now = func() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
 }
 
 // Thread-safe in-memory map of albums.
 type albumsDB struct {
 	sync.RWMutex
-	m   map[int]*Album
-	seq int
+	m     map[int]*Album
+	seq   int
+	feed  ChangeFeed
+	index searchIndex
 }
 
 // The one and only database instance.
@@ -74,6 +91,19 @@ func (db *albumsDB) Find(band, title string, year int) []*Album {
 	return res
 }
 
+// Search returns the albums whose band and title match the full-text query,
+// the most relevant first. See searchIndex for the syntax of the query.
+func (db *albumsDB) Search(text string) []*Album {
+	db.RLock()
+	defer db.RUnlock()
+	ids := db.index.search(text)
+	res := make([]*Album, len(ids))
+	for i, id := range ids {
+		res[i] = db.m[id]
+	}
+	return res
+}
+
 // Get returns the album identified by the id, or nil.
 func (db *albumsDB) Get(id int) *Album {
 	db.RLock()
@@ -92,11 +122,66 @@ func (db *albumsDB) Add(a *Album) (int, error) {
 	// Get the unique ID
 	db.seq++
 	a.Id = db.seq
+	db.stamp(a)
 	// Store
-	db.m[a.Id] = a
+	db.put(a)
+	db.feed.publish(opAdd, a.Id, a)
 	return a.Id, nil
 }
 
+// AddAll creates the albums, and returns the error of each of them, nil for
+// those that are created, ErrAlreadyExists for the duplicates (of a stored
+// album or of a previous album of the list). If atomic is true, no album is
+// created unless all of them can be.
+func (db *albumsDB) AddAll(albums []*Album, atomic bool) []error {
+	db.Lock()
+	defer db.Unlock()
+	errs := db.conflicts(albums)
+	if atomic && failed(errs) {
+		return errs
+	}
+	for i, a := range albums {
+		if errs[i] == nil {
+			db.seq++
+			a.Id = db.seq
+			db.stamp(a)
+			db.put(a)
+			db.feed.publish(opAdd, a.Id, a)
+		}
+	}
+	return errs
+}
+
+// Returns ErrAlreadyExists for each album of the list that has the same band
+// and title as a stored album or a previous album of the list, nil for the
+// others. The ids of the albums are ignored. The caller must hold the lock.
+func (db *albumsDB) conflicts(albums []*Album) []error {
+	type key struct{ band, title string }
+	seen := make(map[key]bool, len(db.m)+len(albums))
+	for _, v := range db.m {
+		seen[key{v.Band, v.Title}] = true
+	}
+	errs := make([]error, len(albums))
+	for i, a := range albums {
+		k := key{a.Band, a.Title}
+		if seen[k] {
+			errs[i] = ErrAlreadyExists
+		}
+		seen[k] = true
+	}
+	return errs
+}
+
+// Reports whether one of the errors is not nil.
+func failed(errs []error) bool {
+	for _, err := range errs {
+		if err != nil {
+			return true
+		}
+	}
+	return false
+}
+
 // Update changes the album identified by the id. It returns an error if the
 // updated album is a duplicate.
 func (db *albumsDB) Update(a *Album) error {
@@ -105,16 +190,120 @@ func (db *albumsDB) Update(a *Album) error {
 	if !db.isUnique(a) {
 		return ErrAlreadyExists
 	}
-	db.m[a.Id] = a
+	db.stamp(a)
+	db.put(a)
+	db.feed.publish(opUpdate, a.Id, a)
 	return nil
 }
 
-// Delete removes the album identified by the id from the database. It is a no-op
-// if the id does not exist.
-func (db *albumsDB) Delete(id int) {
+// Modify atomically replaces the album identified by the id with the album
+// returned by fn, which receives a copy of the current one. It returns the new
+// album, or ErrNotExist if the id does not exist, ErrAlreadyExists if the new
+// album is a duplicate, or the error returned by fn.
+func (db *albumsDB) Modify(id int, fn func(a *Album) (*Album, error)) (*Album, error) {
 	db.Lock()
 	defer db.Unlock()
+	a, err := db.modified(id, fn)
+	if err != nil {
+		return nil, err
+	}
+	db.put(a)
+	db.feed.publish(opUpdate, id, a)
+	return a, nil
+}
+
+// Returns the album that fn makes of the album identified by the id, checking
+// that it is unique. The caller must hold the write lock.
+func (db *albumsDB) modified(id int, fn func(a *Album) (*Album, error)) (*Album, error) {
+	cur, ok := db.m[id]
+	if !ok {
+		return nil, ErrNotExist
+	}
+	cp := *cur
+	a, err := fn(&cp)
+	if err != nil {
+		return nil, err
+	}
+	a.Id = id
+	if !db.isUnique(a) {
+		return nil, ErrAlreadyExists
+	}
+	db.stamp(a)
+	return a, nil
+}
+
+// Stores the album and indexes it. The caller must hold the write lock.
+func (db *albumsDB) put(a *Album) {
+	db.m[a.Id] = a
+	db.index.add(a)
+}
+
+// Removes the album identified by the id, if it exists, from the map and the
+// index. The caller must hold the write lock.
+func (db *albumsDB) remove(id int) {
 	delete(db.m, id)
+	db.index.remove(id)
+}
+
+// Sets the version of the album to the next one of the stored album with the
+// same id (or to 1 if there is none), and its update time to now. The caller
+// must hold the write lock.
+func (db *albumsDB) stamp(a *Album) {
+	a.Version = 1
+	if cur, ok := db.m[a.Id]; ok {
+		a.Version = cur.Version + 1
+	}
+	a.Updated = now()
+}
+
+// Delete removes the album identified by the id from the database. It is a no-op
+// if the id does not exist. The in-memory database never returns an error.
+func (db *albumsDB) Delete(id int) error {
+	db.Lock()
+	defer db.Unlock()
+	if _, ok := db.m[id]; ok {
+		db.remove(id)
+		db.feed.publish(opDelete, id, nil)
+	}
+	return nil
+}
+
+// DeleteIf removes the album identified by the id from the database if cond,
+// called with the current album, returns nil. It returns ErrNotExist if the id
+// does not exist, or the error returned by cond.
+func (db *albumsDB) DeleteIf(id int, cond func(a *Album) error) error {
+	db.Lock()
+	defer db.Unlock()
+	cur, ok := db.m[id]
+	if !ok {
+		return ErrNotExist
+	}
+	if err := cond(cur); err != nil {
+		return err
+	}
+	db.remove(id)
+	db.feed.publish(opDelete, id, nil)
+	return nil
+}
+
+// Changes returns the feed of the changes of the albums.
+func (db *albumsDB) Changes() *ChangeFeed {
+	return &db.feed
+}
+
+// Count returns the number of albums.
+func (db *albumsDB) Count() int {
+	db.RLock()
+	defer db.RUnlock()
+	return len(db.m)
+}
+
+// Ping reports whether the database can serve requests, which the in-memory
+// database always can.
+func (db *albumsDB) Ping() error {
+	db.RLock()
+	defer db.RUnlock()
+	return nil
 }
 
 // Checks if the album already exists in the database, based on the Band and Title
@@ -129,14 +318,72 @@ func (db *albumsDB) isUnique(a *Album) bool {
 }
 
 // The Album data structure, serializable in JSON, XML and text using the Stringer interface.
+// The Version and Updated fields are maintained by the database, they change
+// each time the album is stored. Owner is the id of the user who created the
+// album, 0 if it has no owner, in which case only admins can modify it.
+//
+// Released is a date formatted as YYYY-MM-DD, in the year of the album. The
+// genres are lowercase, and the tracks are ordered by number. The Genres and
+// Tracks slices of a stored album are never modified in place, they are
+// replaced, so copies of an album can share them.
 type Album struct {
-	XMLName xml.Name `json:"-" xml:"album"`
-	Id      int      `json:"id" xml:"id,attr"`
-	Band    string   `json:"band" xml:"band"`
-	Title   string   `json:"title" xml:"title"`
-	Year    int      `json:"year" xml:"year"`
+	XMLName  xml.Name  `json:"-" xml:"album"`
+	Id       int       `json:"id" xml:"id,attr"`
+	Band     string    `json:"band" xml:"band"`
+	Title    string    `json:"title" xml:"title"`
+	Year     int       `json:"year" xml:"year"`
+	Label    string    `json:"label,omitempty" xml:"label,omitempty"`
+	Released string    `json:"released,omitempty" xml:"released,omitempty"`
+	Genres   []string  `json:"genres,omitempty" xml:"genre,omitempty"`
+	Tracks   []*Track  `json:"tracks,omitempty" xml:"track,omitempty"`
+	Artwork  *Artwork  `json:"artwork,omitempty" xml:"artwork,omitempty"`
+	Owner    int       `json:"owner" xml:"owner,attr"`
+	Version  int       `json:"version" xml:"version,attr"`
+	Updated  time.Time `json:"updated" xml:"updated,attr"`
 }
 
 func (a *Album) String() string {
 	return fmt.Sprintf("%s - %s (%d)", a.Band, a.Title, a.Year)
 }
+
+// The columns of the CSV encoding of the albums, which has all the fields,
+// including those that are omitted from the JSON encoding when they are empty.
+func (a *Album) csvColumns() []string {
+	return []string{"id", "band", "title", "year", "label", "released", "genres", "tracks", "artwork", "owner", "version", "updated"}
+}
+
+// HasGenre returns true if the album has the (lowercase) genre.
+func (a *Album) HasGenre(genre string) bool {
+	for _, g := range a.Genres {
+		if g == genre {
+			return true
+		}
+	}
+	return false
+}
+
+// The Artwork of an album is its cover image, found at the URL. The media type
+// and the size in pixels of the image are optional, the size is 0 if it is
+// unknown.
+type Artwork struct {
+	XMLName xml.Name `json:"-" xml:"artwork"`
+	URL     string   `json:"url" xml:"url,attr"`
+	Type    string   `json:"type,omitempty" xml:"type,attr,omitempty"`
+	Width   int      `json:"width,omitempty" xml:"width,attr,omitempty"`
+	Height  int      `json:"height,omitempty" xml:"height,attr,omitempty"`
+}
+
+// A Track is a song of an album. Its duration is in seconds, 0 if it is unknown.
+type Track struct {
+	XMLName  xml.Name `json:"-" xml:"track"`
+	Number   int      `json:"number" xml:"number,attr"`
+	Title    string   `json:"title" xml:"title"`
+	Duration int      `json:"duration" xml:"duration,attr,omitempty"`
+}
+
+func (t *Track) String() string {
+	if t.Duration == 0 {
+		return fmt.Sprintf("%d. %s", t.Number, t.Title)
+	}
+	return fmt.Sprintf("%d. %s (%d:%02d)", t.Number, t.Title, t.Duration/60, t.Duration%60)
+}
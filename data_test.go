@@ -0,0 +1,294 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"sort"
+
+	"launchpad.net/gocheck"
+)
+
+// DBSuite is the conformance suite that every implementation of the DB interface
+// must pass. It is registered once per implementation, with the function that
+// opens an empty database of that kind.
+type DBSuite struct {
+	open func(c *gocheck.C) DB
+	db   DB
+}
+
+var _ = gocheck.Suite(&DBSuite{open: func(c *gocheck.C) DB {
+	return &albumsDB{m: make(map[int]*Album)}
+}})
+
+var _ = gocheck.Suite(&DBSuite{open: func(c *gocheck.C) DB {
+	db, err := openFileDB(filepath.Join(c.MkDir(), "albums.db"))
+	c.Assert(err, gocheck.IsNil)
+	return db
+}})
+
+func (s *DBSuite) SetUpTest(c *gocheck.C) {
+	s.db = s.open(c)
+}
+
+func (s *DBSuite) TearDownTest(c *gocheck.C) {
+	if cl, ok := s.db.(io.Closer); ok {
+		cl.Close()
+	}
+}
+
+type byId []*Album
+
+func (b byId) Len() int           { return len(b) }
+func (b byId) Less(i, j int) bool { return b[i].Id < b[j].Id }
+func (b byId) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+func (s *DBSuite) TestAddAssignsSequentialIds(c *gocheck.C) {
+	id, err := s.db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(id, gocheck.Equals, 1)
+	al := &Album{Id: 42, Band: "Slayer", Title: "South Of Heaven", Year: 1988}
+	id, err = s.db.Add(al)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(id, gocheck.Equals, 2)
+	c.Assert(al.Id, gocheck.Equals, 2)
+}
+
+func (s *DBSuite) TestGet(c *gocheck.C) {
+	id, err := s.db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	c.Assert(err, gocheck.IsNil)
+	al := s.db.Get(id)
+	c.Assert(al, gocheck.NotNil)
+	c.Assert(al.Band, gocheck.Equals, "Slayer")
+	c.Assert(al.Title, gocheck.Equals, "Reign In Blood")
+	c.Assert(al.Year, gocheck.Equals, 1986)
+}
+
+func (s *DBSuite) TestGetNotExist(c *gocheck.C) {
+	c.Assert(s.db.Get(1), gocheck.IsNil)
+}
+
+func (s *DBSuite) TestGetAllEmpty(c *gocheck.C) {
+	c.Assert(s.db.GetAll(), gocheck.IsNil)
+}
+
+func (s *DBSuite) TestGetAll(c *gocheck.C) {
+	s.db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	s.db.Add(&Album{Band: "Slayer", Title: "Seasons In The Abyss", Year: 1990})
+	all := s.db.GetAll()
+	c.Assert(all, gocheck.HasLen, 2)
+	sort.Sort(byId(all))
+	c.Assert(all[0].Title, gocheck.Equals, "Reign In Blood")
+	c.Assert(all[1].Title, gocheck.Equals, "Seasons In The Abyss")
+}
+
+func (s *DBSuite) TestAddDuplicate(c *gocheck.C) {
+	_, err := s.db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	c.Assert(err, gocheck.IsNil)
+	_, err = s.db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 2013})
+	c.Assert(err, gocheck.Equals, ErrAlreadyExists)
+	c.Assert(s.db.GetAll(), gocheck.HasLen, 1)
+}
+
+func (s *DBSuite) TestAddSameTitleOtherBand(c *gocheck.C) {
+	_, err := s.db.Add(&Album{Band: "Slayer", Title: "Live", Year: 1984})
+	c.Assert(err, gocheck.IsNil)
+	_, err = s.db.Add(&Album{Band: "AC/DC", Title: "Live", Year: 1992})
+	c.Assert(err, gocheck.IsNil)
+}
+
+func (s *DBSuite) TestUpdate(c *gocheck.C) {
+	id, _ := s.db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	err := s.db.Update(&Album{Id: id, Band: "Slayer", Title: "Reign In Blood", Year: 1987})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(s.db.Get(id).Year, gocheck.Equals, 1987)
+}
+
+func (s *DBSuite) TestUpdateDuplicate(c *gocheck.C) {
+	s.db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	id, _ := s.db.Add(&Album{Band: "Slayer", Title: "Seasons In The Abyss", Year: 1990})
+	err := s.db.Update(&Album{Id: id, Band: "Slayer", Title: "Reign In Blood", Year: 1990})
+	c.Assert(err, gocheck.Equals, ErrAlreadyExists)
+	c.Assert(s.db.Get(id).Title, gocheck.Equals, "Seasons In The Abyss")
+}
+
+func (s *DBSuite) TestDelete(c *gocheck.C) {
+	id, _ := s.db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	s.db.Delete(id)
+	c.Assert(s.db.Get(id), gocheck.IsNil)
+	c.Assert(s.db.GetAll(), gocheck.IsNil)
+	// Deleted albums release their band-title pair, but not their id.
+	id2, err := s.db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(id2, gocheck.Equals, id+1)
+}
+
+func (s *DBSuite) TestDeleteNotExist(c *gocheck.C) {
+	s.db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	s.db.Delete(42)
+	c.Assert(s.db.GetAll(), gocheck.HasLen, 1)
+}
+
+func (s *DBSuite) TestFind(c *gocheck.C) {
+	s.db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	s.db.Add(&Album{Band: "Slayer", Title: "Seasons In The Abyss", Year: 1990})
+	s.db.Add(&Album{Band: "Bruce Springsteen", Title: "Born To Run", Year: 1975})
+	c.Assert(s.db.Find("Slayer", "", 0), gocheck.HasLen, 2)
+	c.Assert(s.db.Find("", "Born To Run", 0), gocheck.HasLen, 1)
+	c.Assert(s.db.Find("", "", 1990), gocheck.HasLen, 1)
+	c.Assert(s.db.Find("Slayer", "", 1975), gocheck.HasLen, 0)
+	c.Assert(s.db.Find("slayer", "", 0), gocheck.HasLen, 0)
+}
+
+func (s *DBSuite) TestModify(c *gocheck.C) {
+	id, _ := s.db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	al, err := s.db.Modify(id, func(a *Album) (*Album, error) {
+		a.Year = 1987
+		return a, nil
+	})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(al.Id, gocheck.Equals, id)
+	c.Assert(s.db.Get(id).Year, gocheck.Equals, 1987)
+}
+
+func (s *DBSuite) TestModifyReceivesACopy(c *gocheck.C) {
+	id, _ := s.db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	_, err := s.db.Modify(id, func(a *Album) (*Album, error) {
+		a.Year = 1987
+		return nil, ErrCorruptLog
+	})
+	c.Assert(err, gocheck.Equals, ErrCorruptLog)
+	c.Assert(s.db.Get(id).Year, gocheck.Equals, 1986)
+}
+
+func (s *DBSuite) TestModifyNotExist(c *gocheck.C) {
+	_, err := s.db.Modify(1, func(a *Album) (*Album, error) {
+		return a, nil
+	})
+	c.Assert(err, gocheck.Equals, ErrNotExist)
+}
+
+func (s *DBSuite) TestModifyDuplicate(c *gocheck.C) {
+	s.db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	id, _ := s.db.Add(&Album{Band: "Slayer", Title: "Seasons In The Abyss", Year: 1990})
+	_, err := s.db.Modify(id, func(a *Album) (*Album, error) {
+		a.Title = "Reign In Blood"
+		return a, nil
+	})
+	c.Assert(err, gocheck.Equals, ErrAlreadyExists)
+	c.Assert(s.db.Get(id).Title, gocheck.Equals, "Seasons In The Abyss")
+}
+
+func (s *DBSuite) TestVersions(c *gocheck.C) {
+	al := &Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986}
+	id, _ := s.db.Add(al)
+	c.Assert(al.Version, gocheck.Equals, 1)
+	c.Assert(al.Updated.IsZero(), gocheck.Equals, false)
+	s.db.Update(&Album{Id: id, Band: "Slayer", Title: "Reign In Blood", Year: 1987})
+	c.Assert(s.db.Get(id).Version, gocheck.Equals, 2)
+	al, err := s.db.Modify(id, func(a *Album) (*Album, error) {
+		c.Assert(a.Version, gocheck.Equals, 2)
+		a.Version = 42
+		return a, nil
+	})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(al.Version, gocheck.Equals, 3)
+	c.Assert(s.db.Get(id).Version, gocheck.Equals, 3)
+}
+
+func (s *DBSuite) TestDeleteIf(c *gocheck.C) {
+	id, _ := s.db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	err := s.db.DeleteIf(id, func(a *Album) error {
+		return ErrPreconditionFailed
+	})
+	c.Assert(err, gocheck.Equals, ErrPreconditionFailed)
+	c.Assert(s.db.Get(id), gocheck.NotNil)
+	err = s.db.DeleteIf(id, func(a *Album) error {
+		return nil
+	})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(s.db.Get(id), gocheck.IsNil)
+	err = s.db.DeleteIf(id, func(a *Album) error {
+		return nil
+	})
+	c.Assert(err, gocheck.Equals, ErrNotExist)
+}
+
+func (s *DBSuite) TestAddAll(c *gocheck.C) {
+	s.db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	albums := []*Album{
+		{Band: "Slayer", Title: "Seasons In The Abyss", Year: 1990},
+		{Band: "Slayer", Title: "Reign In Blood", Year: 1986},
+		{Band: "AC/DC", Title: "Back In Black", Year: 1980},
+		{Band: "AC/DC", Title: "Back In Black", Year: 1980},
+	}
+	errs := s.db.AddAll(albums, false)
+	c.Assert(errs, gocheck.DeepEquals, []error{nil, ErrAlreadyExists, nil, ErrAlreadyExists})
+	c.Assert(albums[0].Id, gocheck.Equals, 2)
+	c.Assert(albums[2].Id, gocheck.Equals, 3)
+	c.Assert(s.db.Get(3).Title, gocheck.Equals, "Back In Black")
+	c.Assert(s.db.GetAll(), gocheck.HasLen, 3)
+}
+
+func (s *DBSuite) TestAddAllAtomic(c *gocheck.C) {
+	s.db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	errs := s.db.AddAll([]*Album{
+		{Band: "Slayer", Title: "Seasons In The Abyss", Year: 1990},
+		{Band: "Slayer", Title: "Reign In Blood", Year: 1986},
+	}, true)
+	c.Assert(errs, gocheck.DeepEquals, []error{nil, ErrAlreadyExists})
+	c.Assert(s.db.GetAll(), gocheck.HasLen, 1)
+	errs = s.db.AddAll([]*Album{{Band: "Slayer", Title: "Seasons In The Abyss", Year: 1990}}, true)
+	c.Assert(errs, gocheck.DeepEquals, []error{nil})
+	c.Assert(s.db.GetAll(), gocheck.HasLen, 2)
+}
+
+func (s *DBSuite) TestChanges(c *gocheck.C) {
+	id, _ := s.db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	s.db.AddAll([]*Album{{Band: "Slayer", Title: "South Of Heaven", Year: 1988}, {Band: "Slayer", Title: "Reign In Blood"}}, false)
+	_, err := s.db.Modify(id, func(a *Album) (*Album, error) {
+		a.Year = 1987
+		return a, nil
+	})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(s.db.DeleteIf(id, func(a *Album) error { return nil }), gocheck.IsNil)
+	// Deleting a missing album is not a change
+	s.db.Delete(id)
+
+	l, _, err := s.db.Changes().Since(0)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(l.Last, gocheck.Equals, s.db.Changes().Epoch()+"-4")
+	c.Assert(l.Changes, gocheck.HasLen, 4)
+	var ops []string
+	for i, ch := range l.Changes {
+		c.Assert(ch.Seq, gocheck.Equals, i+1)
+		ops = append(ops, ch.Op)
+	}
+	c.Assert(ops, gocheck.DeepEquals, []string{opAdd, opAdd, opUpdate, opDelete})
+	c.Assert(l.Changes[2].Album.Year, gocheck.Equals, 1987)
+	c.Assert(l.Changes[3].Album, gocheck.IsNil)
+}
+
+func (s *DBSuite) TestCount(c *gocheck.C) {
+	c.Assert(s.db.Count(), gocheck.Equals, 0)
+	id, _ := s.db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	s.db.Add(&Album{Band: "Slayer", Title: "South Of Heaven", Year: 1988})
+	s.db.Delete(id)
+	c.Assert(s.db.Count(), gocheck.Equals, 1)
+	c.Assert(s.db.Ping(), gocheck.IsNil)
+}
+
+func (s *DBSuite) TestSearch(c *gocheck.C) {
+	id, _ := s.db.Add(&Album{Band: "Motörhead", Title: "Ace Of Spades", Year: 1980})
+	s.db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	c.Assert(s.db.Search("motorhead"), gocheck.HasLen, 1)
+	_, err := s.db.Modify(id, func(a *Album) (*Album, error) {
+		a.Title = "Overkill"
+		return a, nil
+	})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(s.db.Search("spades"), gocheck.HasLen, 0)
+	c.Assert(s.db.Search("overkill"), gocheck.HasLen, 1)
+	s.db.Delete(id)
+	c.Assert(s.db.Search("motorhead"), gocheck.HasLen, 0)
+	c.Assert(s.db.Search("blood")[0].Title, gocheck.Equals, "Reign In Blood")
+}
@@ -0,0 +1,677 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Range of accepted values for the year of an album. 0 means that the year is
+// not specified.
+const (
+	minYear = 1000
+	maxYear = 9999
+)
+
+// Limits of the other fields of an album. Lengths are in characters, and the
+// duration of a track in seconds.
+const (
+	maxLabelLen      = 200
+	maxGenres        = 10
+	maxGenreLen      = 50
+	maxTracks        = 200
+	maxTrackDuration = 24 * 60 * 60
+	maxArtworkURLLen = 2000
+	maxArtworkSize   = 10000
+)
+
+// The media types accepted for the artwork of an album.
+var artworkTypes = map[string]bool{"image/jpeg": true, "image/png": true, "image/gif": true, "image/webp": true}
+
+// The layout of the release dates.
+const releasedLayout = "2006-01-02"
+
+// The form fields accepted in album requests, which are also the fields of the
+// JSON albums.
+var albumFormFields = map[string]bool{
+	"id": true, "band": true, "title": true, "year": true, "label": true, "released": true, "genres": true,
+	"tracks": true, "artwork": true, "owner": true, "version": true, "updated": true,
+}
+
+// The fields of the JSON tracks.
+var trackJSONFields = map[string]bool{"number": true, "title": true, "duration": true}
+
+// The fields of the JSON artwork.
+var artworkJSONFields = map[string]bool{"url": true, "type": true, "width": true, "height": true}
+
+// The body of an album request, as decoded from JSON or XML. Pointers tell
+// missing fields apart from empty ones, and the catch-all fields of the XML
+// structure collect unknown elements and attributes so that they can be rejected.
+// The owner, version and update time are maintained by the server, they are
+// accepted so that clients can send back the album they received, but they are
+// ignored once their type has been checked.
+type albumBody struct {
+	XMLName      xml.Name     `json:"-" xml:"album"`
+	Id           *int         `json:"id" xml:"-"`
+	XMLId        *string      `json:"-" xml:"id,attr"`
+	Band         *string      `json:"band" xml:"band"`
+	Title        *string      `json:"title" xml:"title"`
+	Year         *string      `json:"-" xml:"year"`
+	JSONYear     *int         `json:"year" xml:"-"`
+	Label        *string      `json:"label" xml:"label"`
+	Released     *string      `json:"released" xml:"released"`
+	Genres       []string     `json:"genres" xml:"genre"`
+	Tracks       []*trackBody `json:"tracks" xml:"track"`
+	Artwork      *artworkBody `json:"artwork" xml:"artwork"`
+	Owner        *int         `json:"owner" xml:"-"`
+	Version      *int         `json:"version" xml:"-"`
+	Updated      *string      `json:"updated" xml:"-"`
+	XMLOwner     *string      `json:"-" xml:"owner,attr"`
+	XMLVersion   *string      `json:"-" xml:"version,attr"`
+	XMLUpdated   *string      `json:"-" xml:"updated,attr"`
+	UnknownElems []xml.Name   `json:"-" xml:",any"`
+	UnknownAttrs []xml.Attr   `json:"-" xml:",any,attr"`
+}
+
+// The body of a track, in an album or in a tracks request. As with albumBody,
+// its XML attributes are decoded as strings and unknown XML fields are collected.
+// A track without a number is numbered after its position in the list.
+type trackBody struct {
+	XMLName      xml.Name   `json:"-" xml:"track"`
+	Number       *int       `json:"number" xml:"-"`
+	XMLNumber    *string    `json:"-" xml:"number,attr"`
+	Title        *string    `json:"title" xml:"title"`
+	Duration     *int       `json:"duration" xml:"-"`
+	XMLDuration  *string    `json:"-" xml:"duration,attr"`
+	UnknownElems []xml.Name `json:"-" xml:",any"`
+	UnknownAttrs []xml.Attr `json:"-" xml:",any,attr"`
+}
+
+// The body of the artwork of an album. As with trackBody, its XML attributes
+// are decoded as strings and unknown XML fields are collected.
+type artworkBody struct {
+	XMLName      xml.Name   `json:"-" xml:"artwork"`
+	URL          *string    `json:"url" xml:"url,attr"`
+	Type         *string    `json:"type" xml:"type,attr"`
+	Width        *int       `json:"width" xml:"-"`
+	XMLWidth     *string    `json:"-" xml:"width,attr"`
+	Height       *int       `json:"height" xml:"-"`
+	XMLHeight    *string    `json:"-" xml:"height,attr"`
+	UnknownElems []xml.Name `json:"-" xml:",any"`
+	UnknownAttrs []xml.Attr `json:"-" xml:",any,attr"`
+}
+
+// getPostAlbum reads the album from the request body, in the format given by the
+// Content-Type header (JSON, XML, or form values if no Content-Type is set). It
+// returns an *Error if the format is not supported, if the body is malformed, or
+// if the album is not valid. Unknown fields are rejected.
+func getPostAlbum(r *http.Request) (*Album, error) {
+	mt, e := bodyMediaType(r)
+	if e != nil {
+		return nil, e
+	}
+	var (
+		body *albumBody
+		err  *Error
+	)
+	switch mt {
+	case "application/json":
+		body, err = decodeJSONAlbum(r.Body)
+	case "application/xml", "text/xml":
+		body, err = decodeXMLAlbum(r.Body)
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		body, err = decodeFormAlbum(r)
+	default:
+		return nil, unsupportedMediaType(r.Header.Get("Content-Type"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return body.album()
+}
+
+// Returns the media type of the request body, form values if no Content-Type
+// is set.
+func bodyMediaType(r *http.Request) (string, *Error) {
+	ct := r.Header.Get("Content-Type")
+	if ct == "" {
+		return "application/x-www-form-urlencoded", nil
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return "", unsupportedMediaType(ct)
+	}
+	return mt, nil
+}
+
+func unsupportedMediaType(ct string) *Error {
+	return NewError(ErrCodeUnsupportedMediaType,
+		fmt.Sprintf("unsupported content type '%s', use application/json, application/xml or application/x-www-form-urlencoded", ct))
+}
+
+func invalidAlbum(fields ...*FieldError) *Error {
+	e := NewError(ErrCodeInvalidAlbum, "the album is invalid")
+	e.Fields = fields
+	return e
+}
+
+func decodeJSONAlbum(rd io.Reader) (*albumBody, *Error) {
+	raw, e := readJSONValue(rd, "album")
+	if e != nil {
+		return nil, e
+	}
+	if fields := unknownJSONFields(raw, albumFormFields, ""); len(fields) > 0 {
+		return nil, invalidAlbum(fields...)
+	}
+	var body albumBody
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		if e, ok := err.(*json.UnmarshalTypeError); ok && e.Field != "" {
+			return nil, invalidAlbum(&FieldError{Field: e.Field, Message: "must be " + jsonTypeName(e.Type.String())})
+		}
+		return nil, NewError(ErrCodeInvalidAlbum, fmt.Sprintf("malformed JSON body: %s", err))
+	}
+	if f := checkUpdated(body.Updated); f != nil {
+		return nil, invalidAlbum(f)
+	}
+	if body.JSONYear != nil {
+		y := strconv.Itoa(*body.JSONYear)
+		body.Year = &y
+	}
+	return &body, nil
+}
+
+// Reads the single JSON value of a body, which holds an album or the tracks
+// named by what.
+func readJSONValue(rd io.Reader, what string) (json.RawMessage, *Error) {
+	var raw json.RawMessage
+	dec := json.NewDecoder(rd)
+	if err := dec.Decode(&raw); err != nil {
+		return nil, NewError(ErrCodeInvalidAlbum, fmt.Sprintf("malformed JSON body: %s", err))
+	}
+	if dec.More() {
+		return nil, NewError(ErrCodeInvalidAlbum, "malformed JSON body: unexpected data after the "+what)
+	}
+	return raw, nil
+}
+
+// Returns an error for each field of the JSON object that is not one of known,
+// sorted by name, as the XML and form decoders do. As with encoding/json, the
+// names are matched case-insensitively. The fields of the tracks and of the
+// artwork are checked too. prefix is prepended to the names of the fields in the errors. Nothing
+// is returned if data is not an object, the decoder reports it.
+func unknownJSONFields(data []byte, known map[string]bool, prefix string) []*FieldError {
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(data, &obj) != nil {
+		return nil
+	}
+	var fields []*FieldError
+	for k, v := range obj {
+		switch lk := strings.ToLower(k); {
+		case !known[lk]:
+			fields = append(fields, &FieldError{Field: prefix + k, Message: "unknown field"})
+		case lk == "tracks":
+			fields = append(fields, unknownJSONTrackFields(v, prefix+k)...)
+		case lk == "artwork":
+			fields = append(fields, unknownJSONFields(v, artworkJSONFields, prefix+k+".")...)
+		}
+	}
+	sort.Sort(byField(fields))
+	return fields
+}
+
+// Returns the errors of the unknown fields of a JSON array of tracks, named
+// prefix[i].field like the XML ones.
+func unknownJSONTrackFields(data []byte, prefix string) []*FieldError {
+	var tracks []json.RawMessage
+	if json.Unmarshal(data, &tracks) != nil {
+		return nil
+	}
+	var fields []*FieldError
+	for i, t := range tracks {
+		fields = append(fields, unknownJSONFields(t, trackJSONFields, fmt.Sprintf("%s[%d].", prefix, i))...)
+	}
+	return fields
+}
+
+// Returns the JSON description of the Go type that failed to decode.
+func jsonTypeName(t string) string {
+	switch strings.TrimPrefix(t, "*") {
+	case "int":
+		return "an integer"
+	case "string":
+		return "a string"
+	}
+	return "a " + t
+}
+
+func decodeXMLAlbum(rd io.Reader) (*albumBody, *Error) {
+	var body albumBody
+	if err := xml.NewDecoder(rd).Decode(&body); err != nil {
+		return nil, NewError(ErrCodeInvalidAlbum, fmt.Sprintf("malformed XML body: %s", err))
+	}
+	var fields []*FieldError
+	for _, n := range body.UnknownElems {
+		fields = append(fields, &FieldError{Field: n.Local, Message: "unknown field"})
+	}
+	for _, a := range body.UnknownAttrs {
+		fields = append(fields, &FieldError{Field: a.Name.Local, Message: "unknown field"})
+	}
+	for i, t := range body.Tracks {
+		fields = append(fields, t.fromXML(fmt.Sprintf("tracks[%d]", i))...)
+	}
+	if body.Artwork != nil {
+		fields = append(fields, body.Artwork.fromXML()...)
+	}
+	for _, f := range []struct {
+		name string
+		v    *string
+	}{{"owner", body.XMLOwner}, {"version", body.XMLVersion}} {
+		if f.v == nil {
+			continue
+		}
+		if _, err := strconv.Atoi(strings.TrimSpace(*f.v)); err != nil {
+			fields = append(fields, &FieldError{Field: f.name, Message: "must be an integer"})
+		}
+	}
+	if f := checkUpdated(body.XMLUpdated); f != nil {
+		fields = append(fields, f)
+	}
+	if len(fields) > 0 {
+		return nil, invalidAlbum(fields...)
+	}
+	if body.XMLId != nil {
+		id, err := strconv.Atoi(*body.XMLId)
+		if err != nil {
+			return nil, invalidAlbum(&FieldError{Field: "id", Message: "must be an integer"})
+		}
+		body.Id = &id
+	}
+	return &body, nil
+}
+
+// Checks that the update time sent back by the client, which is ignored, is a
+// valid time.
+func checkUpdated(v *string) *FieldError {
+	if v == nil {
+		return nil
+	}
+	if _, err := time.Parse(time.RFC3339, strings.TrimSpace(*v)); err != nil {
+		return &FieldError{Field: "updated", Message: "must be an RFC 3339 time"}
+	}
+	return nil
+}
+
+// Checks the XML fields of the track, and decodes its attributes. prefix is the
+// name of the track in the field errors.
+func (t *trackBody) fromXML(prefix string) []*FieldError {
+	var fields []*FieldError
+	for _, n := range t.UnknownElems {
+		fields = append(fields, &FieldError{Field: prefix + "." + n.Local, Message: "unknown field"})
+	}
+	for _, a := range t.UnknownAttrs {
+		fields = append(fields, &FieldError{Field: prefix + "." + a.Name.Local, Message: "unknown field"})
+	}
+	ints := []struct {
+		name string
+		src  *string
+		dst  **int
+	}{
+		{"number", t.XMLNumber, &t.Number},
+		{"duration", t.XMLDuration, &t.Duration},
+	}
+	for _, f := range ints {
+		if f.src == nil {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(*f.src))
+		if err != nil {
+			fields = append(fields, &FieldError{Field: prefix + "." + f.name, Message: "must be an integer"})
+			continue
+		}
+		*f.dst = &n
+	}
+	return fields
+}
+
+// Checks the XML fields of the artwork, and decodes its size.
+func (b *artworkBody) fromXML() []*FieldError {
+	var fields []*FieldError
+	for _, n := range b.UnknownElems {
+		fields = append(fields, &FieldError{Field: "artwork." + n.Local, Message: "unknown field"})
+	}
+	for _, a := range b.UnknownAttrs {
+		fields = append(fields, &FieldError{Field: "artwork." + a.Name.Local, Message: "unknown field"})
+	}
+	ints := []struct {
+		name string
+		src  *string
+		dst  **int
+	}{
+		{"width", b.XMLWidth, &b.Width},
+		{"height", b.XMLHeight, &b.Height},
+	}
+	for _, f := range ints {
+		if f.src == nil {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(*f.src))
+		if err != nil {
+			fields = append(fields, &FieldError{Field: "artwork." + f.name, Message: "must be an integer"})
+			continue
+		}
+		*f.dst = &n
+	}
+	return fields
+}
+
+func decodeFormAlbum(r *http.Request) (*albumBody, *Error) {
+	if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+		return nil, NewError(ErrCodeInvalidAlbum, fmt.Sprintf("malformed form body: %s", err))
+	}
+	var unknown []string
+	for k := range r.PostForm {
+		if !albumFormFields[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		fields := make([]*FieldError, len(unknown))
+		for i, k := range unknown {
+			fields[i] = &FieldError{Field: k, Message: "unknown field"}
+		}
+		return nil, invalidAlbum(fields...)
+	}
+	// As with r.FormValue, the values of the body take precedence over those of
+	// the query string
+	var (
+		body   albumBody
+		fields []*FieldError
+	)
+	for k, vals := range r.Form {
+		if f := body.setText(k, vals); f != nil {
+			fields = append(fields, f)
+		}
+	}
+	if len(fields) > 0 {
+		sort.Sort(byField(fields))
+		return nil, invalidAlbum(fields...)
+	}
+	if _, ok := r.Form["id"]; ok {
+		id, err := strconv.Atoi(r.Form.Get("id"))
+		if err != nil {
+			return nil, invalidAlbum(&FieldError{Field: "id", Message: "must be an integer"})
+		}
+		body.Id = &id
+	}
+	return &body, nil
+}
+
+// Sets a field of the body from its text values, as sent in a form or in a CSV
+// cell. Only the first value is used, except for the genres, which may be
+// repeated, and each value of which may be a JSON array or a comma-separated
+// list. The tracks are a JSON array and the artwork a JSON object, as in the
+// CSV encoding of the albums, or the URL of the artwork. Other fields are
+// ignored.
+func (b *albumBody) setText(k string, vals []string) *FieldError {
+	v := vals[0]
+	switch k {
+	case "band":
+		b.Band = &v
+	case "title":
+		b.Title = &v
+	case "year":
+		b.Year = &v
+	case "label":
+		b.Label = &v
+	case "released":
+		b.Released = &v
+	case "genres":
+		for _, v := range vals {
+			switch v = strings.TrimSpace(v); {
+			case v == "":
+			case strings.HasPrefix(v, "["):
+				var gs []string
+				if err := json.Unmarshal([]byte(v), &gs); err != nil {
+					return &FieldError{Field: k, Message: "must be a JSON array of strings or a comma-separated list"}
+				}
+				b.Genres = append(b.Genres, gs...)
+			default:
+				b.Genres = append(b.Genres, strings.Split(v, ",")...)
+			}
+		}
+	case "tracks":
+		if strings.TrimSpace(v) == "" {
+			return nil
+		}
+		dec := json.NewDecoder(strings.NewReader(v))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&b.Tracks); err != nil {
+			return &FieldError{Field: k, Message: "must be a JSON array of tracks"}
+		}
+	case "artwork":
+		switch v = strings.TrimSpace(v); {
+		case v == "":
+		case strings.HasPrefix(v, "{"):
+			dec := json.NewDecoder(strings.NewReader(v))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&b.Artwork); err != nil {
+				return &FieldError{Field: k, Message: "must be a URL or a JSON object"}
+			}
+		default:
+			b.Artwork = &artworkBody{URL: &v}
+		}
+	}
+	return nil
+}
+
+type byField []*FieldError
+
+func (b byField) Len() int           { return len(b) }
+func (b byField) Less(i, j int) bool { return b[i].Field < b[j].Field }
+func (b byField) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// Validates the decoded body and returns the album.
+func (b *albumBody) album() (*Album, error) {
+	var (
+		fields []*FieldError
+		al     Album
+	)
+	required := func(name string, v *string, dst *string) {
+		if v == nil || strings.TrimSpace(*v) == "" {
+			fields = append(fields, &FieldError{Field: name, Message: "is required"})
+			return
+		}
+		*dst = strings.TrimSpace(*v)
+	}
+	required("band", b.Band, &al.Band)
+	required("title", b.Title, &al.Title)
+	if b.Year != nil && strings.TrimSpace(*b.Year) != "" {
+		y, err := strconv.Atoi(strings.TrimSpace(*b.Year))
+		switch {
+		case err != nil:
+			fields = append(fields, &FieldError{Field: "year", Message: "must be an integer"})
+		case y != 0 && (y < minYear || y > maxYear):
+			fields = append(fields, &FieldError{Field: "year", Message: fmt.Sprintf("must be between %d and %d", minYear, maxYear)})
+		default:
+			al.Year = y
+		}
+	}
+	if b.Label != nil {
+		if l := strings.TrimSpace(*b.Label); utf8.RuneCountInString(l) > maxLabelLen {
+			fields = append(fields, &FieldError{Field: "label", Message: fmt.Sprintf("must be at most %d characters long", maxLabelLen)})
+		} else {
+			al.Label = l
+		}
+	}
+	if b.Released != nil && strings.TrimSpace(*b.Released) != "" {
+		t, err := time.Parse(releasedLayout, strings.TrimSpace(*b.Released))
+		switch {
+		case err != nil:
+			fields = append(fields, &FieldError{Field: "released", Message: "must be a date formatted as YYYY-MM-DD"})
+		case t.Year() < minYear:
+			fields = append(fields, &FieldError{Field: "released", Message: fmt.Sprintf("must be after the year %d", minYear)})
+		case al.Year == 0:
+			// The year, missing or 0, defaults to the year of the release date
+			al.Year = t.Year()
+			fallthrough
+		case al.Year == t.Year():
+			al.Released = t.Format(releasedLayout)
+		default:
+			fields = append(fields, &FieldError{Field: "released", Message: "must be in the year of the album"})
+		}
+	}
+	var fs []*FieldError
+	al.Genres, fs = validGenres(b.Genres)
+	fields = append(fields, fs...)
+	al.Tracks, fs = validTracks("tracks", b.Tracks)
+	fields = append(fields, fs...)
+	al.Artwork, fs = validArtwork(b.Artwork)
+	fields = append(fields, fs...)
+	if b.Id != nil {
+		al.Id = *b.Id
+	}
+	if len(fields) > 0 {
+		return nil, invalidAlbum(fields...)
+	}
+	return &al, nil
+}
+
+// Returns the genres trimmed, in lowercase and without duplicates, or nil if
+// there is none.
+func validGenres(genres []string) ([]string, []*FieldError) {
+	if len(genres) > maxGenres {
+		return nil, []*FieldError{{Field: "genres", Message: fmt.Sprintf("must hold at most %d genres", maxGenres)}}
+	}
+	var (
+		res    []string
+		fields []*FieldError
+		seen   = make(map[string]bool)
+	)
+	for i, g := range genres {
+		g = strings.ToLower(strings.TrimSpace(g))
+		switch f := fmt.Sprintf("genres[%d]", i); {
+		case g == "":
+			fields = append(fields, &FieldError{Field: f, Message: "is required"})
+		case utf8.RuneCountInString(g) > maxGenreLen:
+			fields = append(fields, &FieldError{Field: f, Message: fmt.Sprintf("must be at most %d characters long", maxGenreLen)})
+		case !seen[g]:
+			seen[g] = true
+			res = append(res, g)
+		}
+	}
+	return res, fields
+}
+
+// Returns the tracks ordered by number, or nil if there is none. prefix is the
+// name of the list in the field errors.
+func validTracks(prefix string, tracks []*trackBody) ([]*Track, []*FieldError) {
+	if len(tracks) > maxTracks {
+		return nil, []*FieldError{{Field: prefix, Message: fmt.Sprintf("must hold at most %d tracks", maxTracks)}}
+	}
+	var (
+		res    []*Track
+		fields []*FieldError
+		seen   = make(map[int]bool)
+	)
+	for i, tb := range tracks {
+		f := fmt.Sprintf("%s[%d]", prefix, i)
+		if tb == nil {
+			fields = append(fields, &FieldError{Field: f, Message: "is required"})
+			continue
+		}
+		t := &Track{Number: i + 1}
+		if tb.Number != nil {
+			t.Number = *tb.Number
+		}
+		switch {
+		case t.Number < 1:
+			fields = append(fields, &FieldError{Field: f + ".number", Message: "must be positive"})
+		case seen[t.Number]:
+			fields = append(fields, &FieldError{Field: f + ".number", Message: "is duplicated"})
+		}
+		seen[t.Number] = true
+		if tb.Title == nil || strings.TrimSpace(*tb.Title) == "" {
+			fields = append(fields, &FieldError{Field: f + ".title", Message: "is required"})
+		} else {
+			t.Title = strings.TrimSpace(*tb.Title)
+		}
+		if tb.Duration != nil {
+			if d := *tb.Duration; d < 0 || d > maxTrackDuration {
+				fields = append(fields, &FieldError{Field: f + ".duration", Message: fmt.Sprintf("must be between 0 and %d seconds", maxTrackDuration)})
+			} else {
+				t.Duration = d
+			}
+		}
+		res = append(res, t)
+	}
+	if len(fields) > 0 {
+		return nil, fields
+	}
+	sort.Sort(byTrackNumber(res))
+	return res, nil
+}
+
+// Returns the artwork, or nil if there is none. The URL must be an absolute
+// http or https URL.
+func validArtwork(b *artworkBody) (*Artwork, []*FieldError) {
+	if b == nil {
+		return nil, nil
+	}
+	var (
+		aw     Artwork
+		fields []*FieldError
+	)
+	if b.URL == nil || strings.TrimSpace(*b.URL) == "" {
+		fields = append(fields, &FieldError{Field: "artwork.url", Message: "is required"})
+	} else if u, err := url.Parse(strings.TrimSpace(*b.URL)); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fields = append(fields, &FieldError{Field: "artwork.url", Message: "must be an absolute http or https URL"})
+	} else if utf8.RuneCountInString(u.String()) > maxArtworkURLLen {
+		fields = append(fields, &FieldError{Field: "artwork.url", Message: fmt.Sprintf("must be at most %d characters long", maxArtworkURLLen)})
+	} else {
+		aw.URL = u.String()
+	}
+	if b.Type != nil && strings.TrimSpace(*b.Type) != "" {
+		if t := strings.ToLower(strings.TrimSpace(*b.Type)); !artworkTypes[t] {
+			fields = append(fields, &FieldError{Field: "artwork.type", Message: "must be image/jpeg, image/png, image/gif or image/webp"})
+		} else {
+			aw.Type = t
+		}
+	}
+	for _, f := range []struct {
+		name string
+		src  *int
+		dst  *int
+	}{{"width", b.Width, &aw.Width}, {"height", b.Height, &aw.Height}} {
+		if f.src == nil {
+			continue
+		}
+		if n := *f.src; n < 0 || n > maxArtworkSize {
+			fields = append(fields, &FieldError{Field: "artwork." + f.name, Message: fmt.Sprintf("must be between 0 and %d pixels", maxArtworkSize)})
+		} else {
+			*f.dst = n
+		}
+	}
+	if len(fields) > 0 {
+		return nil, fields
+	}
+	return &aw, nil
+}
+
+type byTrackNumber []*Track
+
+func (b byTrackNumber) Len() int           { return len(b) }
+func (b byTrackNumber) Less(i, j int) bool { return b[i].Number < b[j].Number }
+func (b byTrackNumber) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+
+	"launchpad.net/gocheck"
+)
+
+func newBodyRequest(c *gocheck.C, ct, body string) *http.Request {
+	r, err := http.NewRequest("POST", "/albums", strings.NewReader(body))
+	c.Assert(err, gocheck.IsNil)
+	if ct != "" {
+		r.Header.Set("Content-Type", ct)
+	}
+	return r
+}
+
+func assertFieldErrors(c *gocheck.C, err error, fields ...string) {
+	c.Assert(err, gocheck.FitsTypeOf, &Error{})
+	e := err.(*Error)
+	c.Assert(e.Code, gocheck.Equals, ErrCodeInvalidAlbum)
+	c.Assert(e.Fields, gocheck.HasLen, len(fields))
+	for i, f := range fields {
+		c.Check(e.Fields[i].Field, gocheck.Equals, f)
+	}
+}
+
+func (s *S) TestGetPostAlbumFormats(c *gocheck.C) {
+	bodies := map[string]string{
+		"":                                  "band=Slayer&title=Reign+In+Blood&year=1986",
+		"application/x-www-form-urlencoded": "band=Slayer&title=Reign+In+Blood&year=1986",
+		"application/json; charset=utf-8":   `{"band":"Slayer","title":"Reign In Blood","year":1986}`,
+		"application/xml":                   `<album><band>Slayer</band><title>Reign In Blood</title><year>1986</year></album>`,
+	}
+	for ct, body := range bodies {
+		r := newBodyRequest(c, ct, body)
+		if ct == "" {
+			// Without Content-Type, form values can only come from the query string
+			r, _ = http.NewRequest("POST", "/albums?"+body, nil)
+		}
+		al, err := getPostAlbum(r)
+		c.Assert(err, gocheck.IsNil, gocheck.Commentf("%s", ct))
+		c.Check(al, gocheck.DeepEquals, &Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	}
+}
+
+func (s *S) TestGetPostAlbumRoundTrip(c *gocheck.C) {
+	al := &Album{Id: 3, Band: "Bruce Springsteen", Title: "Born To Run", Year: 1975}
+	body, err := jsonEncoder{}.Encode(al)
+	c.Assert(err, gocheck.IsNil)
+	got, err := getPostAlbum(newBodyRequest(c, "application/json", body))
+	c.Assert(err, gocheck.IsNil)
+	c.Check(got, gocheck.DeepEquals, al)
+	b, err := xml.Marshal(al)
+	c.Assert(err, gocheck.IsNil)
+	got, err = getPostAlbum(newBodyRequest(c, "application/xml", string(b)))
+	c.Assert(err, gocheck.IsNil)
+	c.Check(got, gocheck.DeepEquals, al)
+}
+
+func (s *S) TestGetPostAlbumUnsupportedMediaType(c *gocheck.C) {
+	_, err := getPostAlbum(newBodyRequest(c, "text/csv", "band,title\n"))
+	c.Assert(err, gocheck.FitsTypeOf, &Error{})
+	c.Assert(err.(*Error).Code, gocheck.Equals, ErrCodeUnsupportedMediaType)
+	c.Assert(err.(*Error).Status, gocheck.Equals, http.StatusUnsupportedMediaType)
+}
+
+func (s *S) TestGetPostAlbumValidation(c *gocheck.C) {
+	_, err := getPostAlbum(newBodyRequest(c, "application/json", `{"band":" ","year":12}`))
+	assertFieldErrors(c, err, "band", "title", "year")
+	c.Assert(err.(*Error).Status, gocheck.Equals, http.StatusBadRequest)
+}
+
+func (s *S) TestGetPostAlbumMalformedYear(c *gocheck.C) {
+	_, err := getPostAlbum(newBodyRequest(c, "application/json", `{"band":"Slayer","title":"Live","year":"1984"}`))
+	assertFieldErrors(c, err, "year")
+	c.Assert(err.(*Error).Fields[0].Message, gocheck.Equals, "must be an integer")
+	_, err = getPostAlbum(newBodyRequest(c, "application/xml", `<album><band>Slayer</band><title>Live</title><year>84a</year></album>`))
+	assertFieldErrors(c, err, "year")
+	_, err = getPostAlbum(newBodyRequest(c, "application/x-www-form-urlencoded", "band=Slayer&title=Live&year=eighty"))
+	assertFieldErrors(c, err, "year")
+}
+
+func (s *S) TestGetPostAlbumUnknownFields(c *gocheck.C) {
+	_, err := getPostAlbum(newBodyRequest(c, "application/json", `{"band":"Slayer","title":"Live","producer":"Rick Rubin"}`))
+	assertFieldErrors(c, err, "producer")
+	c.Assert(err.(*Error).Fields[0].Message, gocheck.Equals, "unknown field")
+	_, err = getPostAlbum(newBodyRequest(c, "application/json",
+		`{"Band":"Slayer","title":"Live","rating":5,"tracks":[{"title":"Hell Awaits","bpm":180}],"producer":"Rick Rubin"}`))
+	assertFieldErrors(c, err, "producer", "rating", "tracks[0].bpm")
+	_, err = getPostAlbum(newBodyRequest(c, "application/xml", `<album rating="5"><band>Slayer</band><title>Live</title><producer>Rick Rubin</producer></album>`))
+	assertFieldErrors(c, err, "producer", "rating")
+	_, err = getPostAlbum(newBodyRequest(c, "application/x-www-form-urlencoded", "band=Slayer&title=Live&producer=x"))
+	assertFieldErrors(c, err, "producer")
+}
+
+func (s *S) TestGetPostAlbumServerFields(c *gocheck.C) {
+	al, err := getPostAlbum(newBodyRequest(c, "application/json",
+		`{"band":"Slayer","title":"Live","owner":3,"version":2,"updated":"2013-12-01T10:30:00.5Z"}`))
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(al.Owner, gocheck.Equals, 0)
+	c.Assert(al.Version, gocheck.Equals, 0)
+	al, err = getPostAlbum(newBodyRequest(c, "application/xml",
+		`<album owner="3" version="2" updated="2013-12-01T10:30:00Z"><band>Slayer</band><title>Live</title></album>`))
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(al.Owner, gocheck.Equals, 0)
+	_, err = getPostAlbum(newBodyRequest(c, "application/json", `{"band":"Slayer","title":"Live","version":{"x":[]}}`))
+	assertFieldErrors(c, err, "version")
+	_, err = getPostAlbum(newBodyRequest(c, "application/json", `{"band":"Slayer","title":"Live","owner":"me"}`))
+	assertFieldErrors(c, err, "owner")
+	_, err = getPostAlbum(newBodyRequest(c, "application/json", `{"band":"Slayer","title":"Live","updated":"yesterday"}`))
+	assertFieldErrors(c, err, "updated")
+	c.Assert(err.(*Error).Fields[0].Message, gocheck.Equals, "must be an RFC 3339 time")
+	_, err = getPostAlbum(newBodyRequest(c, "application/xml",
+		`<album owner="x" version="2" updated="2013"><band>Slayer</band><title>Live</title></album>`))
+	assertFieldErrors(c, err, "owner", "updated")
+}
+
+func (s *S) TestGetPostAlbumMalformed(c *gocheck.C) {
+	_, err := getPostAlbum(newBodyRequest(c, "application/json", `{"band":"Slayer"`))
+	c.Assert(err, gocheck.ErrorMatches, `\[5\] malformed JSON body: .*`)
+	_, err = getPostAlbum(newBodyRequest(c, "application/json", `{"band":"Slayer","title":"Live"} {}`))
+	c.Assert(err, gocheck.ErrorMatches, `\[5\] malformed JSON body: unexpected data after the album`)
+	_, err = getPostAlbum(newBodyRequest(c, "application/xml", `<albums></albums>`))
+	c.Assert(err, gocheck.ErrorMatches, `\[5\] malformed XML body: .*`)
+}
+
+func (s *S) TestGetPutAlbum(c *gocheck.C) {
+	al, err := getPutAlbum(newBodyRequest(c, "application/json", `{"band":"Slayer","title":"Live"}`), 4)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(al.Id, gocheck.Equals, 4)
+	al, err = getPutAlbum(newBodyRequest(c, "application/json", `{"id":4,"band":"Slayer","title":"Live"}`), 4)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(al.Id, gocheck.Equals, 4)
+	_, err = getPutAlbum(newBodyRequest(c, "application/json", `{"id":5,"band":"Slayer","title":"Live"}`), 4)
+	assertFieldErrors(c, err, "id")
+}
+
+func (s *S) TestGetPostAlbumDetails(c *gocheck.C) {
+	want := &Album{
+		Band:     "Slayer",
+		Title:    "Reign In Blood",
+		Year:     1986,
+		Label:    "Def Jam",
+		Released: "1986-10-07",
+		Genres:   []string{"thrash metal", "speed metal"},
+		Tracks:   []*Track{{Number: 1, Title: "Angel of Death", Duration: 291}, {Number: 2, Title: "Piece by Piece", Duration: 122}},
+		Artwork:  &Artwork{URL: "https://example.com/reign.jpg", Type: "image/jpeg", Width: 600},
+	}
+	bodies := map[string]string{
+		"application/json": `{"band":"Slayer","title":"Reign In Blood","label":"Def Jam","released":"1986-10-07",
+			"genres":["Thrash Metal"," speed metal","thrash metal"],
+			"tracks":[{"number":2,"title":"Piece by Piece","duration":122},{"number":1,"title":"Angel of Death","duration":291}],
+			"artwork":{"url":" https://example.com/reign.jpg","type":"Image/JPEG","width":600}}`,
+		"application/xml": `<album><band>Slayer</band><title>Reign In Blood</title><label>Def Jam</label><released>1986-10-07</released>
+			<genre>Thrash Metal</genre><genre>speed metal</genre>
+			<track duration="291"><title>Angel of Death</title></track><track duration="122"><title>Piece by Piece</title></track>
+			<artwork url="https://example.com/reign.jpg" type="image/jpeg" width="600"/></album>`,
+		"application/x-www-form-urlencoded": "band=Slayer&title=Reign+In+Blood&label=Def+Jam&released=1986-10-07&genres=thrash+metal,speed+metal" +
+			`&tracks=[{"title":"Angel of Death","duration":291},{"title":"Piece by Piece","duration":122}]` +
+			`&artwork={"url":"https://example.com/reign.jpg","type":"image/jpeg","width":600}`,
+	}
+	for ct, body := range bodies {
+		al, err := getPostAlbum(newBodyRequest(c, ct, body))
+		c.Assert(err, gocheck.IsNil, gocheck.Commentf("%s", ct))
+		c.Check(al, gocheck.DeepEquals, want, gocheck.Commentf("%s", ct))
+	}
+}
+
+func (s *S) TestGetPostAlbumDetailsRoundTrip(c *gocheck.C) {
+	al := &Album{Id: 1, Band: "Slayer", Title: "Reign In Blood", Year: 1986, Label: "Def Jam", Released: "1986-10-07",
+		Genres: []string{"thrash metal"}, Tracks: []*Track{{Number: 1, Title: "Angel of Death", Duration: 291}, {Number: 2, Title: "Piece by Piece"}},
+		Artwork: &Artwork{URL: "https://example.com/reign.jpg", Type: "image/jpeg", Width: 600, Height: 600}}
+	body, err := jsonEncoder{}.Encode(al)
+	c.Assert(err, gocheck.IsNil)
+	got, err := getPostAlbum(newBodyRequest(c, "application/json", body))
+	c.Assert(err, gocheck.IsNil)
+	c.Check(got, gocheck.DeepEquals, al)
+	b, err := xml.Marshal(al)
+	c.Assert(err, gocheck.IsNil)
+	got, err = getPostAlbum(newBodyRequest(c, "application/xml", string(b)))
+	c.Assert(err, gocheck.IsNil)
+	c.Check(got, gocheck.DeepEquals, al)
+}
+
+func (s *S) TestGetPostAlbumDetailsValidation(c *gocheck.C) {
+	_, err := getPostAlbum(newBodyRequest(c, "application/json", `{"band":"Slayer","title":"Live","year":1984,"released":"1986-10-07",
+		"genres":["metal",""],"tracks":[{"title":"Hell Awaits","duration":-1},{"number":1},null]}`))
+	assertFieldErrors(c, err, "released", "genres[1]", "tracks[0].duration", "tracks[1].number", "tracks[1].title", "tracks[2]")
+	_, err = getPostAlbum(newBodyRequest(c, "application/json", `{"band":"Slayer","title":"Live","released":"07/10/1986"}`))
+	assertFieldErrors(c, err, "released")
+	c.Assert(err.(*Error).Fields[0].Message, gocheck.Equals, "must be a date formatted as YYYY-MM-DD")
+	_, err = getPostAlbum(newBodyRequest(c, "application/xml", `<album><band>Slayer</band><title>Live</title>
+		<track number="one" length="3"><title>Hell Awaits</title><bpm>180</bpm></track></album>`))
+	assertFieldErrors(c, err, "tracks[0].bpm", "tracks[0].length", "tracks[0].number")
+	_, err = getPostAlbum(newBodyRequest(c, "application/x-www-form-urlencoded", "band=Slayer&title=Live&tracks=Hell+Awaits&genres=[metal"))
+	assertFieldErrors(c, err, "genres", "tracks")
+	// A year of 0 is a missing year, it defaults to the year of the release date
+	for ct, body := range map[string]string{
+		"application/json":                  `{"band":"Slayer","title":"Live","year":0,"released":"1986-10-07"}`,
+		"application/x-www-form-urlencoded": "band=Slayer&title=Live&year=0&released=1986-10-07",
+	} {
+		al, err := getPostAlbum(newBodyRequest(c, ct, body))
+		c.Assert(err, gocheck.IsNil, gocheck.Commentf("%s", ct))
+		c.Check(al.Year, gocheck.Equals, 1986, gocheck.Commentf("%s", ct))
+		c.Check(al.Released, gocheck.Equals, "1986-10-07", gocheck.Commentf("%s", ct))
+	}
+}
+
+func (s *S) TestGetPostAlbumArtwork(c *gocheck.C) {
+	// A form may send the URL alone
+	al, err := getPostAlbum(newBodyRequest(c, "application/x-www-form-urlencoded", "band=Slayer&title=Live&artwork=http%3A%2F%2Fexample.com%2Flive.png"))
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(al.Artwork, gocheck.DeepEquals, &Artwork{URL: "http://example.com/live.png"})
+	_, err = getPostAlbum(newBodyRequest(c, "application/json", `{"band":"Slayer","title":"Live",
+		"artwork":{"url":"ftp://example.com/live.png","type":"image/tiff","width":-1,"height":10001}}`))
+	assertFieldErrors(c, err, "artwork.url", "artwork.type", "artwork.width", "artwork.height")
+	_, err = getPostAlbum(newBodyRequest(c, "application/json", `{"band":"Slayer","title":"Live","artwork":{"type":"image/png","dpi":72}}`))
+	assertFieldErrors(c, err, "artwork.dpi")
+	_, err = getPostAlbum(newBodyRequest(c, "application/json", `{"band":"Slayer","title":"Live","artwork":{"type":"image/png"}}`))
+	assertFieldErrors(c, err, "artwork.url")
+	_, err = getPostAlbum(newBodyRequest(c, "application/xml", `<album><band>Slayer</band><title>Live</title>
+		<artwork url="/live.png" width="wide" dpi="72"/></album>`))
+	assertFieldErrors(c, err, "artwork.dpi", "artwork.width")
+	_, err = getPostAlbum(newBodyRequest(c, "application/x-www-form-urlencoded", "band=Slayer&title=Live&artwork=live.png"))
+	assertFieldErrors(c, err, "artwork.url")
+	_, err = getPostAlbum(newBodyRequest(c, "application/x-www-form-urlencoded", `band=Slayer&title=Live&artwork={"link":"x"}`))
+	assertFieldErrors(c, err, "artwork")
+}
@@ -4,7 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"encoding/xml"
-	"fmt"
+	"io"
 )
 
 // An Encoder implements an encoding format of values to be sent as response to
@@ -13,9 +13,9 @@ type Encoder interface {
 	Encode(v ...interface{}) (string, error)
 }
 
-// Because `panic`s are caught by martini's Recovery handler, it can be used
-// to return server-side errors (500). Some helpful text message should probably
-// be sent, although not the technical error (which is printed in the log).
+// Because `panic`s are caught by the Recover handler, it can be used to return
+// server-side errors (500). The client receives an internal error in the
+// negotiated format, the technical error is only printed in the log.
 func Must(data string, err error) string {
 	if err != nil {
 		panic(err)
@@ -26,51 +26,128 @@ func Must(data string, err error) string {
 type jsonEncoder struct{}
 
 // jsonEncoder is an Encoder that produces JSON-formatted responses.
-func (_ jsonEncoder) Encode(v ...interface{}) (string, error) {
-	var data interface{} = v
-	if v == nil {
-		// So that empty results produces `[]` and not `null`
-		data = []interface{}{}
-	} else if len(v) == 1 {
-		data = v[0]
-	}
-	b, err := json.Marshal(data)
-	return string(b), err
+func (e jsonEncoder) Encode(v ...interface{}) (string, error) {
+	return encodeString(e, v)
 }
 
-type xmlEncoder struct{}
-
-// xmlEncoder is an Encoder that produces XML-formatted responses.
-func (_ xmlEncoder) Encode(v ...interface{}) (string, error) {
-	var buf bytes.Buffer
-	if _, err := buf.Write([]byte(xml.Header)); err != nil {
-		return "", err
+func (_ jsonEncoder) EncodeTo(w io.Writer, v ...interface{}) error {
+	if len(v) != 1 {
+		// Empty results produce `[]` and not `null`
+		return writeList(&jsonListWriter{w: w}, w, v)
 	}
-	if _, err := buf.Write([]byte("<albums>")); err != nil {
-		return "", err
+	if p, ok := v[0].(*Page); ok {
+		// The albums are the last field of the page
+		b, err := json.Marshal(emptyPage(p))
+		if err != nil {
+			return err
+		}
+		if b, err = cutSuffix(b, "[]}"); err != nil {
+			return err
+		}
+		return streamPage(w, p, b, &jsonListWriter{w: w}, "}")
 	}
-	b, err := xml.Marshal(v)
+	b, err := json.Marshal(v[0])
 	if err != nil {
-		return "", err
+		return err
 	}
-	if _, err := buf.Write(b); err != nil {
-		return "", err
-	}
-	if _, err := buf.Write([]byte("</albums>")); err != nil {
-		return "", err
+	_, err = w.Write(b)
+	return err
+}
+
+type xmlEncoder struct{}
+
+// xmlEncoder is an Encoder that produces XML-formatted responses.
+func (e xmlEncoder) Encode(v ...interface{}) (string, error) {
+	return encodeString(e, v)
+}
+
+func (_ xmlEncoder) EncodeTo(w io.Writer, v ...interface{}) error {
+	if len(v) == 1 {
+		if p, ok := v[0].(*Page); ok {
+			// A page is its own <albums> root element, with its metadata as attributes
+			b, err := xml.Marshal(emptyPage(p))
+			if err != nil {
+				return err
+			}
+			if b, err = cutSuffix(b, "</albums>"); err != nil {
+				return err
+			}
+			return streamPage(w, p, append([]byte(xml.Header), b...), &xmlListWriter{w: w}, "</albums>")
+		}
 	}
-	return buf.String(), nil
+	return writeList(newXMLListWriter(w), w, v)
 }
 
 type textEncoder struct{}
 
 // textEncoder is an Encoder that produces plain text-formatted responses.
-func (_ textEncoder) Encode(v ...interface{}) (string, error) {
-	var buf bytes.Buffer
-	for _, v := range v {
-		if _, err := fmt.Fprintf(&buf, "%s\n", v); err != nil {
-			return "", err
+func (e textEncoder) Encode(v ...interface{}) (string, error) {
+	return encodeString(e, v)
+}
+
+func (_ textEncoder) EncodeTo(w io.Writer, v ...interface{}) error {
+	if len(v) == 1 {
+		if p, ok := v[0].(*Page); ok {
+			return streamPage(w, p, nil, &textListWriter{w: w}, p.summary()+"\n")
+		}
+	}
+	return writeList(&textListWriter{w: w}, w, v)
+}
+
+// An object is a JSON object decoded by jsonTree, with its keys in the order
+// they were encoded (i.e. the order of the struct fields).
+type object struct {
+	keys []string
+	vals map[string]interface{}
+}
+
+// jsonTree converts v to the generic tree of its JSON representation, made of
+// *object, []interface{}, string, json.Number, bool and nil values. Encoders of
+// other formats use it so that they honour the same field names and omissions
+// as the JSON encoder.
+func jsonTree(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return jsonTreeValue(dec)
+}
+
+func jsonTreeValue(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		o := &object{vals: make(map[string]interface{})}
+		for dec.More() {
+			k, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := jsonTreeValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			o.keys = append(o.keys, k.(string))
+			o.vals[k.(string)] = v
+		}
+		_, err = dec.Token()
+		return o, err
+	case json.Delim('['):
+		l := []interface{}{}
+		for dec.More() {
+			v, err := jsonTreeValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, v)
 		}
+		_, err = dec.Token()
+		return l, err
 	}
-	return buf.String(), nil
+	return tok, nil
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"time"
+
+	"launchpad.net/gocheck"
+)
+
+var (
+	encUpdated = time.Date(2013, 12, 1, 10, 30, 0, 0, time.UTC)
+	encAlbum1  = &Album{Id: 1, Band: "Slayer", Title: "Reign In Blood", Year: 1986, Version: 2, Updated: encUpdated}
+	encAlbum2  = &Album{Id: 3, Band: "Bruce Springsteen", Title: "Born To Run: \"Live\"", Year: 1975, Version: 1, Updated: encUpdated}
+)
+
+func (s *S) TestJSONEncoder(c *gocheck.C) {
+	out, err := jsonEncoder{}.Encode()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(out, gocheck.Equals, `[]`)
+	out, err = jsonEncoder{}.Encode(encAlbum1)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(out, gocheck.Equals, `{"id":1,"band":"Slayer","title":"Reign In Blood","year":1986,"owner":0,"version":2,"updated":"2013-12-01T10:30:00Z"}`)
+}
+
+func (s *S) TestCSVEncoder(c *gocheck.C) {
+	out, err := csvEncoder{}.Encode()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(out, gocheck.Equals, "")
+	out, err = csvEncoder{}.Encode(encAlbum1, encAlbum2)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(out, gocheck.Equals, "id,band,title,year,label,released,genres,tracks,artwork,owner,version,updated\n"+
+		"1,Slayer,Reign In Blood,1986,,,,,,0,2,2013-12-01T10:30:00Z\n"+
+		"3,Bruce Springsteen,\"Born To Run: \"\"Live\"\"\",1975,,,,,,0,1,2013-12-01T10:30:00Z\n")
+	out, err = csvEncoder{}.Encode(NewError(ErrCodeNotExist, "not found"))
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(out, gocheck.Equals, "type,title,status,detail,code\n/errors#not-exist,The resource does not exist,404,not found,1\n")
+}
+
+func (s *S) TestCSVEncoderPage(c *gocheck.C) {
+	out, err := csvEncoder{}.Encode(&Page{Total: 1, Limit: 10, Albums: []*Album{encAlbum1}})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(out, gocheck.Equals, "id,band,title,year,label,released,genres,tracks,artwork,owner,version,updated\n1,Slayer,Reign In Blood,1986,,,,,,0,2,2013-12-01T10:30:00Z\n")
+	out, err = csvEncoder{}.Encode(&Page{Limit: 10, Albums: []*Album{}})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(out, gocheck.Equals, "id,band,title,year,label,released,genres,tracks,artwork,owner,version,updated\n")
+}
+
+func (s *S) TestYAMLEncoder(c *gocheck.C) {
+	out, err := yamlEncoder{}.Encode()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(out, gocheck.Equals, "---\n[]\n")
+	out, err = yamlEncoder{}.Encode(encAlbum1)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(out, gocheck.Equals, "---\nid: 1\nband: Slayer\ntitle: Reign In Blood\nyear: 1986\nowner: 0\nversion: 2\nupdated: \"2013-12-01T10:30:00Z\"\n")
+	out, err = yamlEncoder{}.Encode(encAlbum1, encAlbum2)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(out, gocheck.Equals, `---
+- id: 1
+  band: Slayer
+  title: Reign In Blood
+  year: 1986
+  owner: 0
+  version: 2
+  updated: "2013-12-01T10:30:00Z"
+- id: 3
+  band: Bruce Springsteen
+  title: "Born To Run: \"Live\""
+  year: 1975
+  owner: 0
+  version: 1
+  updated: "2013-12-01T10:30:00Z"
+`)
+}
+
+func (s *S) TestYAMLEncoderPage(c *gocheck.C) {
+	out, err := yamlEncoder{}.Encode(&Page{Total: 2, Limit: 1, Next: "?limit=1&offset=1", Albums: []*Album{encAlbum1}})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(out, gocheck.Equals, `---
+total: 2
+offset: 0
+limit: 1
+next: "?limit=1&offset=1"
+albums:
+  - id: 1
+    band: Slayer
+    title: Reign In Blood
+    year: 1986
+    owner: 0
+    version: 2
+    updated: "2013-12-01T10:30:00Z"
+`)
+	out, err = yamlEncoder{}.Encode(&Page{Limit: 1, Albums: []*Album{}})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(out, gocheck.Equals, "---\ntotal: 0\noffset: 0\nlimit: 1\nalbums: []\n")
+}
+
+func (s *S) TestYAMLScalar(c *gocheck.C) {
+	c.Assert(yamlScalar("yes"), gocheck.Equals, `"yes"`)
+	c.Assert(yamlScalar("1986"), gocheck.Equals, `"1986"`)
+	c.Assert(yamlScalar(""), gocheck.Equals, `""`)
+	c.Assert(yamlScalar("a: b"), gocheck.Equals, `"a: b"`)
+	c.Assert(yamlScalar("AC/DC"), gocheck.Equals, `AC/DC`)
+}
+
+func (s *S) TestMsgpackEncoder(c *gocheck.C) {
+	out, err := msgpackEncoder{}.Encode()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(out, gocheck.Equals, "\x90")
+	out, err = msgpackEncoder{}.Encode(encAlbum1)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(out, gocheck.Equals, "\x87"+
+		"\xa2id\x01"+
+		"\xa4band\xa6Slayer"+
+		"\xa5title\xaeReign In Blood"+
+		"\xa4year\xcd\x07\xc2"+
+		"\xa5owner\x00"+
+		"\xa7version\x02"+
+		"\xa7updated\xb42013-12-01T10:30:00Z")
+	out, err = msgpackEncoder{}.Encode(encAlbum1, encAlbum1)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(out[0], gocheck.Equals, byte(0x92))
+}
+
+func (s *S) TestMsgpackInt(c *gocheck.C) {
+	cases := map[int64]string{
+		0:      "\x00",
+		127:    "\x7f",
+		-1:     "\xff",
+		-32:    "\xe0",
+		-33:    "\xd0\xdf",
+		200:    "\xcc\xc8",
+		70000:  "\xce\x00\x01\x11\x70",
+		-40000: "\xd2\xff\xff\x63\xc0",
+	}
+	for i, exp := range cases {
+		var buf bytes.Buffer
+		writeMsgpackInt(&buf, i)
+		c.Check(buf.String(), gocheck.Equals, exp, gocheck.Commentf("%d", i))
+	}
+}
+
+func (s *S) TestEncodeAlbumDetails(c *gocheck.C) {
+	al := &Album{Id: 1, Band: "Slayer", Title: "Reign In Blood", Year: 1986, Label: "Def Jam", Released: "1986-10-07",
+		Genres: []string{"thrash metal"}, Tracks: []*Track{{Number: 1, Title: "Angel of Death", Duration: 291}, {Number: 2, Title: "Piece by Piece"}},
+		Artwork: &Artwork{URL: "https://example.com/reign.jpg", Type: "image/jpeg", Width: 600, Height: 600}, Version: 2, Updated: encUpdated}
+	out, err := jsonEncoder{}.Encode(al)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(out, gocheck.Matches, `.*"artwork":\{"url":"https://example.com/reign.jpg","type":"image/jpeg","width":600,"height":600\}.*`)
+	out, err = xmlEncoder{}.Encode(al)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(out, gocheck.Equals, xml.Header+`<albums><album id="1" owner="0" version="2" updated="2013-12-01T10:30:00Z"><band>Slayer</band><title>Reign In Blood</title>`+
+		`<year>1986</year><label>Def Jam</label><released>1986-10-07</released><genre>thrash metal</genre>`+
+		`<track number="1" duration="291"><title>Angel of Death</title></track><track number="2"><title>Piece by Piece</title></track>`+
+		`<artwork url="https://example.com/reign.jpg" type="image/jpeg" width="600" height="600"></artwork></album></albums>`)
+	out, err = csvEncoder{}.Encode(al, encAlbum2)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(out, gocheck.Equals, "id,band,title,year,label,released,genres,tracks,artwork,owner,version,updated\n"+
+		`1,Slayer,Reign In Blood,1986,Def Jam,1986-10-07,"[""thrash metal""]","[{""number"":1,""title"":""Angel of Death"",""duration"":291},{""number"":2,""title"":""Piece by Piece"",""duration"":0}]","{""url"":""https://example.com/reign.jpg"",""type"":""image/jpeg"",""width"":600,""height"":600}",0,2,2013-12-01T10:30:00Z`+"\n"+
+		"3,Bruce Springsteen,\"Born To Run: \"\"Live\"\"\",1975,,,,,,0,1,2013-12-01T10:30:00Z\n")
+	out, err = textEncoder{}.Encode(al.Tracks[0], al.Tracks[1])
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(out, gocheck.Equals, "1. Angel of Death (4:51)\n2. Piece by Piece\n")
+}
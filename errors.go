@@ -3,29 +3,151 @@ package main
 import (
 	"encoding/xml"
 	"fmt"
+	"net/http"
+	"sort"
+	"strings"
 )
 
 const (
 	// Error codes
 	ErrCodeNotExist      = 1
 	ErrCodeAlreadyExists = 2
+	ErrCodeInvalidQuery  = 3
+	ErrCodeNotAcceptable = 4
+	ErrCodeInvalidAlbum  = 5
+
+	ErrCodeUnsupportedMediaType = 6
+	ErrCodeInvalidPatch         = 7
+	ErrCodePreconditionFailed   = 8
+	ErrCodeUnauthorized         = 9
+	ErrCodeForbidden            = 10
+	ErrCodeInvalidUser          = 11
+	ErrCodeInternal             = 12
+	ErrCodeBulkRejected         = 13
+	ErrCodeChangesExpired       = 14
+	ErrCodeRateLimited          = 15
+	ErrCodeInvalidTokenRequest  = 16
 )
 
-// The serializable Error structure.
-type Error struct {
-	XMLName xml.Name `json:"-" xml:"error"`
+// An ErrorKind documents an error code: its name, used to build the problem type
+// URI of the errors, a short human-readable title, and the HTTP status of the
+// responses that carry it.
+type ErrorKind struct {
+	XMLName xml.Name `json:"-" xml:"kind"`
 	Code    int      `json:"code" xml:"code,attr"`
-	Message string   `json:"message" xml:"message"`
+	Name    string   `json:"name" xml:"name,attr"`
+	Status  int      `json:"status" xml:"status,attr"`
+	Title   string   `json:"title" xml:",chardata"`
+}
+
+func (k *ErrorKind) String() string {
+	return fmt.Sprintf("%d %s (%d): %s", k.Code, k.Name, k.Status, k.Title)
+}
+
+// The catalogue of the error codes, served at /errors.
+var errorKinds = map[int]*ErrorKind{
+	ErrCodeNotExist:             {Code: ErrCodeNotExist, Name: "not-exist", Status: http.StatusNotFound, Title: "The resource does not exist"},
+	ErrCodeAlreadyExists:        {Code: ErrCodeAlreadyExists, Name: "already-exists", Status: http.StatusConflict, Title: "The resource already exists"},
+	ErrCodeInvalidQuery:         {Code: ErrCodeInvalidQuery, Name: "invalid-query", Status: http.StatusBadRequest, Title: "The query string is invalid"},
+	ErrCodeNotAcceptable:        {Code: ErrCodeNotAcceptable, Name: "not-acceptable", Status: http.StatusNotAcceptable, Title: "None of the accepted formats is available"},
+	ErrCodeInvalidAlbum:         {Code: ErrCodeInvalidAlbum, Name: "invalid-album", Status: http.StatusBadRequest, Title: "The album is invalid"},
+	ErrCodeUnsupportedMediaType: {Code: ErrCodeUnsupportedMediaType, Name: "unsupported-media-type", Status: http.StatusUnsupportedMediaType, Title: "The format of the body is not supported"},
+	ErrCodeInvalidPatch:         {Code: ErrCodeInvalidPatch, Name: "invalid-patch", Status: http.StatusBadRequest, Title: "The patch is invalid"},
+	ErrCodePreconditionFailed:   {Code: ErrCodePreconditionFailed, Name: "precondition-failed", Status: http.StatusPreconditionFailed, Title: "The resource has been modified"},
+	ErrCodeUnauthorized:         {Code: ErrCodeUnauthorized, Name: "unauthorized", Status: http.StatusUnauthorized, Title: "Authentication is required"},
+	ErrCodeForbidden:            {Code: ErrCodeForbidden, Name: "forbidden", Status: http.StatusForbidden, Title: "The request is not allowed"},
+	ErrCodeInvalidUser:          {Code: ErrCodeInvalidUser, Name: "invalid-user", Status: http.StatusBadRequest, Title: "The user is invalid"},
+	ErrCodeInternal:             {Code: ErrCodeInternal, Name: "internal", Status: http.StatusInternalServerError, Title: "An internal error occurred"},
+	ErrCodeBulkRejected:         {Code: ErrCodeBulkRejected, Name: "bulk-rejected", Status: http.StatusUnprocessableEntity, Title: "The bulk import has been rejected"},
+	ErrCodeChangesExpired:       {Code: ErrCodeChangesExpired, Name: "changes-expired", Status: http.StatusGone, Title: "The changes are no longer available"},
+	ErrCodeRateLimited:          {Code: ErrCodeRateLimited, Name: "rate-limited", Status: http.StatusTooManyRequests, Title: "Too many requests"},
+	ErrCodeInvalidTokenRequest:  {Code: ErrCodeInvalidTokenRequest, Name: "invalid-token-request", Status: http.StatusBadRequest, Title: "The token request is invalid"},
+}
+
+// ErrorKinds returns the catalogue of the error codes, ordered by code.
+func ErrorKinds() []*ErrorKind {
+	l := make([]*ErrorKind, 0, len(errorKinds))
+	for _, k := range errorKinds {
+		l = append(l, k)
+	}
+	sort.Sort(byCode(l))
+	return l
+}
+
+type byCode []*ErrorKind
+
+func (b byCode) Len() int           { return len(b) }
+func (b byCode) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byCode) Less(i, j int) bool { return b[i].Code < b[j].Code }
+
+// The serializable Error structure. Its JSON representation is a problem
+// details object as defined by RFC 7807, with the code, the request id and the
+// validation errors (Fields) as extension members. Type, Title and Status come
+// from the catalogue, Instance and RequestId are set when the error is sent.
+type Error struct {
+	XMLName   xml.Name      `json:"-" xml:"error"`
+	Type      string        `json:"type" xml:"type,attr"`
+	Title     string        `json:"title" xml:"title"`
+	Status    int           `json:"status" xml:"status,attr"`
+	Detail    string        `json:"detail" xml:"detail"`
+	Instance  string        `json:"instance,omitempty" xml:"instance,attr,omitempty"`
+	Code      int           `json:"code" xml:"code,attr"`
+	RequestId string        `json:"request_id,omitempty" xml:"request-id,attr,omitempty"`
+	Fields    []*FieldError `json:"fields,omitempty" xml:"field,omitempty"`
+}
+
+// A FieldError reports why the value of a field is invalid.
+type FieldError struct {
+	XMLName xml.Name `json:"-" xml:"field"`
+	Field   string   `json:"field" xml:"name,attr"`
+	Message string   `json:"message" xml:",chardata"`
+}
+
+func (f *FieldError) String() string {
+	return fmt.Sprintf("%s %s", f.Field, f.Message)
 }
 
 func (e *Error) Error() string {
-	return fmt.Sprintf("[%d] %s", e.Code, e.Message)
+	if len(e.Fields) == 0 {
+		return fmt.Sprintf("[%d] %s", e.Code, e.Detail)
+	}
+	fields := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		fields[i] = f.String()
+	}
+	return fmt.Sprintf("[%d] %s: %s", e.Code, e.Detail, strings.Join(fields, ", "))
 }
 
-// NewError creates an error instance with the specified code and message.
+// NewError creates an error instance with the specified code and message. Its
+// type, title and status are those of the code in the catalogue, an unknown
+// code is an internal error.
 func NewError(code int, msg string) *Error {
+	k, ok := errorKinds[code]
+	if !ok {
+		k = errorKinds[ErrCodeInternal]
+	}
 	return &Error{
-		Code:    code,
-		Message: msg,
+		Type:   "/errors#" + k.Name,
+		Title:  k.Title,
+		Status: k.Status,
+		Code:   code,
+		Detail: msg,
+	}
+}
+
+// WithStatus overrides the HTTP status of the error, for the few cases where it
+// depends on the request rather than on the code, and returns the error.
+func (e *Error) WithStatus(status int) *Error {
+	e.Status = status
+	return e
+}
+
+// ListErrors returns the catalogue of the error codes.
+func ListErrors(enc Encoder) string {
+	kinds := ErrorKinds()
+	v := make([]interface{}, len(kinds))
+	for i, k := range kinds {
+		v[i] = k
 	}
+	return Must(enc.Encode(v...))
 }
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// ExportAlbums streams the whole catalogue, ordered by id, in the negotiated
+// format. The response is always a list, even if it holds a single album.
+func ExportAlbums(w http.ResponseWriter, f *Format, db DB) {
+	albums := db.GetAll()
+	sort.Sort(byAlbumId(albums))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="albums%s"`, f.Ext))
+	StreamList(w, http.StatusOK, f.Encoder, toIface(albums), &Album{})
+}
+
+type byAlbumId []*Album
+
+func (b byAlbumId) Len() int           { return len(b) }
+func (b byAlbumId) Less(i, j int) bool { return b[i].Id < b[j].Id }
+func (b byAlbumId) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
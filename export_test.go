@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http/httptest"
+
+	"launchpad.net/gocheck"
+)
+
+func (s *S) TestExportAlbums(c *gocheck.C) {
+	db := &albumsDB{m: make(map[int]*Album)}
+	db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	w := httptest.NewRecorder()
+	ExportAlbums(w, FormatByExt(".text"), db)
+	c.Assert(w.Header().Get("Content-Disposition"), gocheck.Equals, `attachment; filename="albums.text"`)
+	c.Assert(w.Body.String(), gocheck.Equals, "Slayer - Reign In Blood (1986)\n")
+	// A single album is still exported as a list
+	w = httptest.NewRecorder()
+	ExportAlbums(w, FormatByExt(".json"), db)
+	c.Assert(w.Body.String()[0], gocheck.Equals, byte('['))
+	// An empty CSV export has its header row
+	w = httptest.NewRecorder()
+	ExportAlbums(w, FormatByExt(".csv"), &albumsDB{m: make(map[int]*Album)})
+	c.Assert(w.Body.String(), gocheck.Equals, "id,band,title,year,label,released,genres,tracks,artwork,owner,version,updated\n")
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var (
+	ErrCorruptLog = errors.New("albums log is corrupt")
+)
+
+// Number of records appended to the log before it is folded into a new snapshot.
+const snapshotEvery = 1000
+
+// Operations recorded in the append-only log.
+const (
+	opAdd    = "add"
+	opAddAll = "add-all"
+	opUpdate = "update"
+	opDelete = "delete"
+)
+
+// A record is one line of the append-only log. The albums created together by
+// AddAll are recorded in one add-all record, with an id of 0.
+type record struct {
+	Op     string   `json:"op"`
+	Id     int      `json:"id"`
+	Album  *Album   `json:"album,omitempty"`
+	Albums []*Album `json:"albums,omitempty"`
+}
+
+// The log file, an *os.File except in the tests.
+type logFile interface {
+	io.ReadWriteSeeker
+	io.Closer
+	Sync() error
+	Truncate(size int64) error
+	Stat() (os.FileInfo, error)
+}
+
+// The snapshot holds the whole state of the database at the time it was taken.
+type snapshot struct {
+	Seq    int      `json:"seq"`
+	Albums []*Album `json:"albums"`
+}
+
+// Thread-safe on-disk store of albums. It keeps the albums in memory, using the
+// same structure (and the same uniqueness rules) as albumsDB, and persists every
+// change to an append-only log before acknowledging it. The log is periodically
+// folded into a snapshot so that it does not grow forever.
+//
+// Replaying the log is idempotent, so a crash at any point leaves a state that
+// can be reloaded: a partially written trailing record is discarded, and a crash
+// between writing a snapshot and truncating the log simply replays records that
+// are already part of the snapshot.
+type fileDB struct {
+	*albumsDB
+	path string
+	f    logFile
+	n    int // Records appended since the last snapshot
+}
+
+// openFileDB loads (or creates) the database stored at path. The log is stored
+// in path itself, the snapshot in path + ".snap".
+func openFileDB(path string) (*fileDB, error) {
+	db := &fileDB{
+		albumsDB: &albumsDB{m: make(map[int]*Album)},
+		path:     path,
+	}
+	if err := db.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	db.f = f
+	if err := db.replay(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Add creates a new album and returns its id, or an error.
+func (db *fileDB) Add(a *Album) (int, error) {
+	db.Lock()
+	defer db.Unlock()
+	if !db.isUnique(a) {
+		return 0, ErrAlreadyExists
+	}
+	cp := *a
+	cp.Id = db.seq + 1
+	db.stamp(&cp)
+	if err := db.append(&record{Op: opAdd, Id: cp.Id, Album: &cp}); err != nil {
+		return 0, err
+	}
+	db.seq++
+	*a = cp
+	db.put(a)
+	db.feed.publish(opAdd, a.Id, a)
+	db.maybeSnapshot()
+	return a.Id, nil
+}
+
+// AddAll creates the albums, as albumsDB.AddAll does. The albums are appended
+// to the log as a single record, so that a crash in the middle of the write
+// persists all of them or none.
+func (db *fileDB) AddAll(albums []*Album, atomic bool) []error {
+	db.Lock()
+	defer db.Unlock()
+	errs := db.conflicts(albums)
+	if atomic && failed(errs) {
+		return errs
+	}
+	var cps []*Album
+	seq := db.seq
+	for i, a := range albums {
+		if errs[i] != nil {
+			continue
+		}
+		cp := *a
+		seq++
+		cp.Id = seq
+		db.stamp(&cp)
+		cps = append(cps, &cp)
+	}
+	if len(cps) == 0 {
+		return errs
+	}
+	if err := db.append(&record{Op: opAddAll, Albums: cps}); err != nil {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+		return errs
+	}
+	db.seq = seq
+	j := 0
+	for i, a := range albums {
+		if errs[i] == nil {
+			*a = *cps[j]
+			db.put(a)
+			db.feed.publish(opAdd, a.Id, a)
+			j++
+		}
+	}
+	db.maybeSnapshot()
+	return errs
+}
+
+// Update changes the album identified by the id. It returns an error if the
+// updated album is a duplicate.
+func (db *fileDB) Update(a *Album) error {
+	db.Lock()
+	defer db.Unlock()
+	if !db.isUnique(a) {
+		return ErrAlreadyExists
+	}
+	cp := *a
+	db.stamp(&cp)
+	if err := db.append(&record{Op: opUpdate, Id: a.Id, Album: &cp}); err != nil {
+		return err
+	}
+	*a = cp
+	db.put(a)
+	db.feed.publish(opUpdate, a.Id, a)
+	db.maybeSnapshot()
+	return nil
+}
+
+// Modify atomically replaces the album identified by the id with the album
+// returned by fn, which receives a copy of the current one. It returns the new
+// album, or ErrNotExist if the id does not exist, ErrAlreadyExists if the new
+// album is a duplicate, or the error returned by fn.
+func (db *fileDB) Modify(id int, fn func(a *Album) (*Album, error)) (*Album, error) {
+	db.Lock()
+	defer db.Unlock()
+	a, err := db.modified(id, fn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.append(&record{Op: opUpdate, Id: id, Album: a}); err != nil {
+		return nil, err
+	}
+	db.put(a)
+	db.feed.publish(opUpdate, id, a)
+	db.maybeSnapshot()
+	return a, nil
+}
+
+// Delete removes the album identified by the id from the database. It is a no-op
+// if the id does not exist. It returns an error if the deletion cannot be
+// persisted, in which case the album is kept.
+func (db *fileDB) Delete(id int) error {
+	err := db.DeleteIf(id, func(*Album) error { return nil })
+	if err == ErrNotExist {
+		return nil
+	}
+	return err
+}
+
+// DeleteIf removes the album identified by the id from the database if cond,
+// called with the current album, returns nil. It returns ErrNotExist if the id
+// does not exist, or the error returned by cond.
+func (db *fileDB) DeleteIf(id int, cond func(a *Album) error) error {
+	db.Lock()
+	defer db.Unlock()
+	cur, ok := db.m[id]
+	if !ok {
+		return ErrNotExist
+	}
+	if err := cond(cur); err != nil {
+		return err
+	}
+	if err := db.append(&record{Op: opDelete, Id: id}); err != nil {
+		return err
+	}
+	db.remove(id)
+	db.feed.publish(opDelete, id, nil)
+	db.maybeSnapshot()
+	return nil
+}
+
+// Ping reports whether the log file can still be written, i.e. it has not
+// been closed or removed.
+func (db *fileDB) Ping() error {
+	db.RLock()
+	defer db.RUnlock()
+	if _, err := db.f.Stat(); err != nil {
+		return err
+	}
+	_, err := os.Stat(db.path)
+	return err
+}
+
+// Close releases the log file. The database must not be used afterwards.
+func (db *fileDB) Close() error {
+	db.Lock()
+	defer db.Unlock()
+	return db.f.Close()
+}
+
+// Applies a record to the in-memory state. It must be idempotent, as records
+// may be replayed over a snapshot that already contains them.
+func (db *fileDB) apply(r *record) error {
+	switch r.Op {
+	case opAdd, opUpdate:
+		if r.Album == nil {
+			return ErrCorruptLog
+		}
+		r.Album.Id = r.Id
+		db.put(r.Album)
+	case opAddAll:
+		if len(r.Albums) == 0 {
+			return ErrCorruptLog
+		}
+		for _, a := range r.Albums {
+			if a == nil || a.Id <= 0 {
+				return ErrCorruptLog
+			}
+			db.put(a)
+			if a.Id > db.seq {
+				db.seq = a.Id
+			}
+		}
+	case opDelete:
+		db.remove(r.Id)
+	default:
+		return ErrCorruptLog
+	}
+	if r.Id > db.seq {
+		db.seq = r.Id
+	}
+	return nil
+}
+
+// Appends the records to the log and waits for them to reach the disk. If the
+// write or the sync fails, the log is truncated back to its previous end, so
+// that the next records do not follow torn bytes that would make it corrupt.
+func (db *fileDB) append(rs ...*record) error {
+	if len(rs) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, r := range rs {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	off, err := db.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = db.f.Write(buf.Bytes()); err == nil {
+		err = db.f.Sync()
+	}
+	if err != nil {
+		if terr := db.truncate(off); terr != nil {
+			return fmt.Errorf("%s, and the log could not be truncated: %s", err, terr)
+		}
+		return err
+	}
+	db.n += len(rs)
+	return nil
+}
+
+// Truncates the log to the offset and moves its end there.
+func (db *fileDB) truncate(off int64) error {
+	if err := db.f.Truncate(off); err != nil {
+		return err
+	}
+	_, err := db.f.Seek(off, io.SeekStart)
+	return err
+}
+
+// Reads the log from the start and applies each record. A trailing record
+// without its newline is the trace of an interrupted write, it is dropped
+// and the log is truncated to the last complete record.
+func (db *fileDB) replay() error {
+	rd := bufio.NewReader(db.f)
+	var off int64
+	for {
+		line, err := rd.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				if err := db.f.Truncate(off); err != nil {
+					return err
+				}
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			var r record
+			if err := json.Unmarshal(line, &r); err != nil {
+				return fmt.Errorf("%s: %s at offset %d", ErrCorruptLog, err, off)
+			}
+			if err := db.apply(&r); err != nil {
+				return fmt.Errorf("%s at offset %d", err, off)
+			}
+			db.n++
+		}
+		off += int64(len(line))
+	}
+	_, err := db.f.Seek(off, io.SeekStart)
+	return err
+}
+
+func (db *fileDB) snapshotPath() string {
+	return db.path + ".snap"
+}
+
+// Loads the last snapshot, if any.
+func (db *fileDB) loadSnapshot() error {
+	b, err := ioutil.ReadFile(db.snapshotPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var s snapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	db.seq = s.Seq
+	for _, a := range s.Albums {
+		db.put(a)
+	}
+	return nil
+}
+
+// Writes a new snapshot once enough records have been appended to the log. The
+// change that triggered it is already safe in the log, so a failure is only logged
+// and the snapshot is attempted again on the next change.
+func (db *fileDB) maybeSnapshot() {
+	if db.n < snapshotEvery {
+		return
+	}
+	if err := db.snapshot(); err != nil {
+		log.Printf("albums snapshot failed: %s", err)
+	}
+}
+
+// Writes the current state to a new snapshot, then empties the log. The snapshot
+// is written to a temporary file and renamed, so that the previous one stays
+// valid until the new one is complete.
+func (db *fileDB) snapshot() error {
+	s := snapshot{Seq: db.seq, Albums: make([]*Album, 0, len(db.m))}
+	for _, a := range db.m {
+		s.Albums = append(s.Albums, a)
+	}
+	b, err := json.Marshal(&s)
+	if err != nil {
+		return err
+	}
+	tmp := db.snapshotPath() + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, db.snapshotPath()); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(db.path)); err != nil {
+		return err
+	}
+	if err := db.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := db.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	db.n = 0
+	return db.f.Sync()
+}
+
+// Flushes the directory entry, so that a rename survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
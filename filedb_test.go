@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"launchpad.net/gocheck"
+)
+
+func (s *S) TestFileDBReopen(c *gocheck.C) {
+	path := filepath.Join(c.MkDir(), "albums.db")
+	db, err := openFileDB(path)
+	c.Assert(err, gocheck.IsNil)
+	db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	id, _ := db.Add(&Album{Band: "Slayer", Title: "Seasons In The Abyss", Year: 1990})
+	db.Add(&Album{Band: "Bruce Springsteen", Title: "Born To Run", Year: 1975})
+	db.Update(&Album{Id: id, Band: "Slayer", Title: "Seasons In The Abyss", Year: 1991})
+	db.Delete(1)
+	c.Assert(db.Close(), gocheck.IsNil)
+
+	db, err = openFileDB(path)
+	c.Assert(err, gocheck.IsNil)
+	defer db.Close()
+	c.Assert(db.GetAll(), gocheck.HasLen, 2)
+	c.Assert(db.Get(1), gocheck.IsNil)
+	c.Assert(db.Get(id).Year, gocheck.Equals, 1991)
+	_, err = db.Add(&Album{Band: "Bruce Springsteen", Title: "Born To Run"})
+	c.Assert(err, gocheck.Equals, ErrAlreadyExists)
+	next, err := db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(next, gocheck.Equals, 4)
+}
+
+func (s *S) TestFileDBReopenAfterSnapshot(c *gocheck.C) {
+	path := filepath.Join(c.MkDir(), "albums.db")
+	db, err := openFileDB(path)
+	c.Assert(err, gocheck.IsNil)
+	db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	db.Add(&Album{Band: "Slayer", Title: "Seasons In The Abyss", Year: 1990})
+	c.Assert(db.snapshot(), gocheck.IsNil)
+	db.Delete(1)
+	db.Close()
+	fi, err := os.Stat(path + ".snap")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(fi.Size() > 0, gocheck.Equals, true)
+
+	db, err = openFileDB(path)
+	c.Assert(err, gocheck.IsNil)
+	defer db.Close()
+	c.Assert(db.Get(1), gocheck.IsNil)
+	c.Assert(db.Get(2), gocheck.NotNil)
+	id, _ := db.Add(&Album{Band: "Slayer", Title: "Hell Awaits", Year: 1985})
+	c.Assert(id, gocheck.Equals, 3)
+}
+
+func (s *S) TestFileDBReplayOverSnapshot(c *gocheck.C) {
+	// Simulate a crash between the snapshot rename and the log truncation.
+	path := filepath.Join(c.MkDir(), "albums.db")
+	db, err := openFileDB(path)
+	c.Assert(err, gocheck.IsNil)
+	db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	db.Add(&Album{Band: "Slayer", Title: "Seasons In The Abyss", Year: 1990})
+	db.Delete(1)
+	log, err := ioutil.ReadFile(path)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(db.snapshot(), gocheck.IsNil)
+	db.Close()
+	c.Assert(ioutil.WriteFile(path, log, 0600), gocheck.IsNil)
+
+	db, err = openFileDB(path)
+	c.Assert(err, gocheck.IsNil)
+	defer db.Close()
+	c.Assert(db.GetAll(), gocheck.HasLen, 1)
+	c.Assert(db.Get(2).Title, gocheck.Equals, "Seasons In The Abyss")
+}
+
+func (s *S) TestFileDBDiscardsPartialRecord(c *gocheck.C) {
+	path := filepath.Join(c.MkDir(), "albums.db")
+	db, err := openFileDB(path)
+	c.Assert(err, gocheck.IsNil)
+	db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	db.Close()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	c.Assert(err, gocheck.IsNil)
+	f.Write([]byte(`{"op":"add","id":2,"album":{"id":2,"ba`))
+	f.Close()
+
+	db, err = openFileDB(path)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(db.GetAll(), gocheck.HasLen, 1)
+	id, err := db.Add(&Album{Band: "Slayer", Title: "Seasons In The Abyss", Year: 1990})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(id, gocheck.Equals, 2)
+	db.Close()
+
+	db, err = openFileDB(path)
+	c.Assert(err, gocheck.IsNil)
+	defer db.Close()
+	c.Assert(db.GetAll(), gocheck.HasLen, 2)
+}
+
+func (s *S) TestFileDBCorruptLog(c *gocheck.C) {
+	path := filepath.Join(c.MkDir(), "albums.db")
+	err := ioutil.WriteFile(path, []byte("not json\n{\"op\":\"delete\",\"id\":1}\n"), 0600)
+	c.Assert(err, gocheck.IsNil)
+	_, err = openFileDB(path)
+	c.Assert(err, gocheck.ErrorMatches, "albums log is corrupt: .* at offset 0")
+}
+
+func (s *S) TestFileDBAddAllPersists(c *gocheck.C) {
+	path := filepath.Join(c.MkDir(), "albums.db")
+	db, err := openFileDB(path)
+	c.Assert(err, gocheck.IsNil)
+	errs := db.AddAll([]*Album{
+		{Band: "Slayer", Title: "Reign In Blood", Year: 1986},
+		{Band: "Slayer", Title: "Reign In Blood", Year: 1986},
+		{Band: "Slayer", Title: "Seasons In The Abyss", Year: 1990},
+	}, false)
+	c.Assert(errs, gocheck.DeepEquals, []error{nil, ErrAlreadyExists, nil})
+	db.Close()
+
+	db, err = openFileDB(path)
+	c.Assert(err, gocheck.IsNil)
+	defer db.Close()
+	c.Assert(db.GetAll(), gocheck.HasLen, 2)
+	c.Assert(db.Get(2).Title, gocheck.Equals, "Seasons In The Abyss")
+}
+
+func (s *S) TestFileDBAddAllIsOneRecord(c *gocheck.C) {
+	path := filepath.Join(c.MkDir(), "albums.db")
+	db, err := openFileDB(path)
+	c.Assert(err, gocheck.IsNil)
+	db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	before, err := ioutil.ReadFile(path)
+	c.Assert(err, gocheck.IsNil)
+	errs := db.AddAll([]*Album{
+		{Band: "Slayer", Title: "Seasons In The Abyss", Year: 1990},
+		{Band: "Slayer", Title: "Hell Awaits", Year: 1985},
+	}, true)
+	c.Assert(errs, gocheck.DeepEquals, []error{nil, nil})
+	db.Close()
+	after, err := ioutil.ReadFile(path)
+	c.Assert(err, gocheck.IsNil)
+	batch := after[len(before):]
+	c.Assert(bytes.Count(batch, []byte("\n")), gocheck.Equals, 1)
+
+	db, err = openFileDB(path)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(db.GetAll(), gocheck.HasLen, 3)
+	c.Assert(db.Get(3).Title, gocheck.Equals, "Hell Awaits")
+	db.Close()
+
+	// A crash in the middle of the write persists none of the albums
+	c.Assert(ioutil.WriteFile(path, after[:len(before)+len(batch)-10], 0600), gocheck.IsNil)
+	db, err = openFileDB(path)
+	c.Assert(err, gocheck.IsNil)
+	defer db.Close()
+	c.Assert(db.GetAll(), gocheck.HasLen, 1)
+	id, err := db.Add(&Album{Band: "Slayer", Title: "Hell Awaits", Year: 1985})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(id, gocheck.Equals, 2)
+}
+
+// The change ids of a database do not survive a restart, as its change feed
+// starts over.
+func (s *S) TestFileDBReopenExpiresChanges(c *gocheck.C) {
+	path := filepath.Join(c.MkDir(), "albums.db")
+	db, err := openFileDB(path)
+	c.Assert(err, gocheck.IsNil)
+	db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	l, _, err := db.Changes().Since(0)
+	c.Assert(err, gocheck.IsNil)
+	db.Close()
+
+	db, err = openFileDB(path)
+	c.Assert(err, gocheck.IsNil)
+	defer db.Close()
+	db.Add(&Album{Band: "Slayer", Title: "Seasons In The Abyss", Year: 1990})
+	db.Add(&Album{Band: "Slayer", Title: "Hell Awaits", Year: 1985})
+	r := changesRequest(c, "?since="+l.Last)
+	w := httptest.NewRecorder()
+	GetChanges(w, r, jsonEncoder{}, testFail(w, r), db)
+	c.Assert(w.Code, gocheck.Equals, http.StatusGone)
+	assertProblem(c, w.Body.String(), ErrCodeChangesExpired, fmt.Sprintf(
+		"the changes since %s are not available, reload the albums and resume from %s-2", l.Last, db.Changes().Epoch()))
+}
+
+// A log file whose next write only writes half of the bytes and fails.
+type shortWriteFile struct {
+	logFile
+	fail bool
+}
+
+func (f *shortWriteFile) Write(b []byte) (int, error) {
+	if !f.fail {
+		return f.logFile.Write(b)
+	}
+	f.fail = false
+	n, _ := f.logFile.Write(b[:len(b)/2])
+	return n, io.ErrShortWrite
+}
+
+func (s *S) TestFileDBShortWrite(c *gocheck.C) {
+	path := filepath.Join(c.MkDir(), "albums.db")
+	db, err := openFileDB(path)
+	c.Assert(err, gocheck.IsNil)
+	db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	db.f = &shortWriteFile{logFile: db.f, fail: true}
+	_, err = db.Add(&Album{Band: "Slayer", Title: "Seasons In The Abyss", Year: 1990})
+	c.Assert(err, gocheck.Equals, io.ErrShortWrite)
+	c.Assert(db.GetAll(), gocheck.HasLen, 1)
+	// The torn bytes are gone, the next record follows the first one
+	id, err := db.Add(&Album{Band: "Slayer", Title: "Hell Awaits", Year: 1985})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(id, gocheck.Equals, 2)
+	db.Close()
+	b, err := ioutil.ReadFile(path)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(bytes.Count(b, []byte("\n")), gocheck.Equals, 2)
+
+	db, err = openFileDB(path)
+	c.Assert(err, gocheck.IsNil)
+	defer db.Close()
+	c.Assert(db.GetAll(), gocheck.HasLen, 2)
+	c.Assert(db.Get(2).Title, gocheck.Equals, "Hell Awaits")
+}
+
+func (s *S) TestFileDBDeleteFails(c *gocheck.C) {
+	path := filepath.Join(c.MkDir(), "albums.db")
+	db, err := openFileDB(path)
+	c.Assert(err, gocheck.IsNil)
+	id, _ := db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	c.Assert(db.Delete(42), gocheck.IsNil)
+	db.f.Close()
+	c.Assert(db.Delete(id), gocheck.NotNil)
+	c.Assert(db.Get(id), gocheck.NotNil)
+}
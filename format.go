@@ -0,0 +1,171 @@
+package main
+
+import (
+	"mime"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A Format is a response format that can be requested by clients, either with
+// the extension of the URL or with the Accept header.
+type Format struct {
+	Ext         string // URL extension, with the leading dot, e.g. ".json"
+	MediaType   string // Media type matched against the Accept header, e.g. "application/json"
+	ContentType string // Value of the Content-Type header of the response
+	Encoder     Encoder
+}
+
+// The registry of response formats, in order of preference of the server: when
+// the client accepts several formats with the same quality, the first registered
+// one wins, and the very first one is used when the client expresses no preference.
+var formats struct {
+	sync.RWMutex
+	list []*Format
+}
+
+func init() {
+	RegisterFormat(&Format{".json", "application/json", "application/json", jsonEncoder{}})
+	RegisterFormat(&Format{".xml", "application/xml", "application/xml", xmlEncoder{}})
+	RegisterFormat(&Format{".text", "text/plain", "text/plain; charset=utf-8", textEncoder{}})
+	RegisterFormat(&Format{".csv", "text/csv", "text/csv; charset=utf-8", csvEncoder{}})
+	RegisterFormat(&Format{".yaml", "application/yaml", "application/yaml; charset=utf-8", yamlEncoder{}})
+	RegisterFormat(&Format{".msgpack", "application/x-msgpack", "application/x-msgpack", msgpackEncoder{}})
+	RegisterFormat(&Format{".html", "text/html", "text/html; charset=utf-8", htmlEncoder{}})
+}
+
+// RegisterFormat adds a response format. A format registered with the extension
+// or the media type of an existing one replaces it, and keeps its position.
+func RegisterFormat(f *Format) {
+	formats.Lock()
+	defer formats.Unlock()
+	for i, ff := range formats.list {
+		if ff.Ext == f.Ext || ff.MediaType == f.MediaType {
+			formats.list[i] = f
+			return
+		}
+	}
+	formats.list = append(formats.list, f)
+}
+
+// Formats returns the registered response formats, in order of preference.
+func Formats() []*Format {
+	formats.RLock()
+	defer formats.RUnlock()
+	return append([]*Format(nil), formats.list...)
+}
+
+// DefaultFormat returns the format used when the client expresses no preference.
+func DefaultFormat() *Format {
+	formats.RLock()
+	defer formats.RUnlock()
+	return formats.list[0]
+}
+
+// FormatByExt returns the format registered for the extension, or nil.
+func FormatByExt(ext string) *Format {
+	formats.RLock()
+	defer formats.RUnlock()
+	for _, f := range formats.list {
+		if f.Ext == ext {
+			return f
+		}
+	}
+	return nil
+}
+
+// Splits the format extension from the path, if it is a registered one. An
+// optional trailing slash is allowed.
+func splitExt(p string) (string, *Format) {
+	trimmed := strings.TrimSuffix(p, "/")
+	f := FormatByExt(path.Ext(trimmed))
+	if f == nil {
+		return p, nil
+	}
+	return trimmed[:len(trimmed)-len(f.Ext)], f
+}
+
+// A media range of the Accept header, e.g. `text/*;q=0.5`.
+type mediaRange struct {
+	typ, sub string
+	q        float64
+}
+
+// Returns how specifically the range matches the media type: 3 for an exact
+// match, 2 for `type/*`, 1 for `*/*`, and 0 if it does not match.
+func (r *mediaRange) match(mediaType string) int {
+	typ, sub := splitMediaType(mediaType)
+	switch {
+	case r.typ == "*" && r.sub == "*":
+		return 1
+	case r.typ == typ && r.sub == "*":
+		return 2
+	case r.typ == typ && r.sub == sub:
+		return 3
+	}
+	return 0
+}
+
+func splitMediaType(mt string) (string, string) {
+	i := strings.Index(mt, "/")
+	if i < 0 {
+		return mt, ""
+	}
+	return mt[:i], mt[i+1:]
+}
+
+// Parses an Accept header. Invalid media ranges are ignored, and a missing or
+// invalid q-value counts as 1.
+func parseAccept(accept string) []*mediaRange {
+	var ranges []*mediaRange
+	for _, s := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(s))
+		if err != nil {
+			continue
+		}
+		r := &mediaRange{q: 1}
+		r.typ, r.sub = splitMediaType(mt)
+		if r.sub == "" {
+			continue
+		}
+		if qs, ok := params["q"]; ok {
+			if q, err := strconv.ParseFloat(qs, 64); err == nil && q >= 0 && q <= 1 {
+				r.q = q
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+// negotiateFormat returns the registered format that best satisfies the Accept
+// header, or nil if none is acceptable. The quality of a format is the q-value
+// of the most specific media range that matches it, and ties are resolved by
+// the order of registration. An empty (or unparseable) header accepts anything.
+func negotiateFormat(accept string) *Format {
+	if strings.TrimSpace(accept) == "" {
+		return DefaultFormat()
+	}
+	ranges := parseAccept(accept)
+	if len(ranges) == 0 {
+		return DefaultFormat()
+	}
+	var (
+		res  *Format
+		resq float64
+	)
+	for _, f := range Formats() {
+		best, q := 0, 0.0
+		for _, r := range ranges {
+			if m := r.match(f.MediaType); m > best {
+				best, q = m, r.q
+			}
+		}
+		// Strictly greater, so that the first registered format wins ties
+		if q > resq {
+			res, resq = f, q
+		}
+	}
+	return res
+}
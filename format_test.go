@@ -0,0 +1,62 @@
+package main
+
+import (
+	"launchpad.net/gocheck"
+)
+
+func (s *S) TestSplitExt(c *gocheck.C) {
+	cases := []struct {
+		path, stripped, ext string
+	}{
+		{"/albums", "/albums", ""},
+		{"/albums.xml", "/albums", ".xml"},
+		{"/albums/1.text/", "/albums/1", ".text"},
+		{"/albums/1.json", "/albums/1", ".json"},
+		{"/albums.pdf", "/albums.pdf", ""},
+	}
+	for _, cs := range cases {
+		p, f := splitExt(cs.path)
+		c.Check(p, gocheck.Equals, cs.stripped)
+		if cs.ext == "" {
+			c.Check(f, gocheck.IsNil)
+		} else {
+			c.Check(f.Ext, gocheck.Equals, cs.ext)
+		}
+	}
+}
+
+func (s *S) TestNegotiateFormat(c *gocheck.C) {
+	cases := []struct {
+		accept, ext string
+	}{
+		{"", ".json"},
+		{"*/*", ".json"},
+		{"application/xml", ".xml"},
+		{"text/*", ".text"},
+		{"text/html, application/xml;q=0.9, */*;q=0.8", ".html"},
+		{"text/html;q=0.9, application/xml", ".xml"},
+		{"application/json;q=0.5, text/plain", ".text"},
+		{"application/json;q=0.5, application/xml;q=0.5", ".json"},
+		{"*/*;q=0.1, application/json;q=0", ".xml"},
+		{"invalid", ".json"},
+		{"image/png", ""},
+		{"application/*;q=0, text/plain;q=0", ""},
+	}
+	for _, cs := range cases {
+		f := negotiateFormat(cs.accept)
+		if cs.ext == "" {
+			c.Check(f, gocheck.IsNil, gocheck.Commentf("Accept: %s", cs.accept))
+		} else if c.Check(f, gocheck.NotNil, gocheck.Commentf("Accept: %s", cs.accept)) {
+			c.Check(f.Ext, gocheck.Equals, cs.ext, gocheck.Commentf("Accept: %s", cs.accept))
+		}
+	}
+}
+
+func (s *S) TestRegisterFormatReplaces(c *gocheck.C) {
+	orig := FormatByExt(".text")
+	defer RegisterFormat(orig)
+	f := &Format{".text", "text/plain", "text/plain", textEncoder{}}
+	RegisterFormat(f)
+	c.Assert(FormatByExt(".text"), gocheck.Equals, f)
+	c.Assert(Formats()[2], gocheck.Equals, f)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// The directory of the templates of the HTML views, relative to the working
+// directory of the server.
+var templatesDir = "templates"
+
+// The form field that overrides the method of a POST form, see OverrideMethod.
+const methodField = "_method"
+
+// The templates, parsed on first use. They are never executed, each rendering
+// executes a clone with its own yield function.
+var htmlTemplates struct {
+	once sync.Once
+	t    *template.Template
+	err  error
+}
+
+func parseTemplates() (*template.Template, error) {
+	htmlTemplates.once.Do(func() {
+		htmlTemplates.t, htmlTemplates.err = template.New("").Funcs(template.FuncMap{
+			"yield": func() template.HTML { return "" },
+			"join":  strings.Join,
+			"json":  jsonString,
+		}).ParseGlob(filepath.Join(templatesDir, "*.tmpl"))
+	})
+	return htmlTemplates.t, htmlTemplates.err
+}
+
+func jsonString(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// The data of the templates. Only the fields of the rendered value are set.
+type htmlView struct {
+	CSRFToken string
+	Page      *Page
+	Albums    []*Album
+	Album     *Album
+	Error     *Error
+	Value     string // Indented JSON of any other value
+}
+
+type htmlEncoder struct {
+	// The CSRF token of the forms, set by the CSRF middleware
+	csrfToken string
+}
+
+// htmlEncoder is an Encoder that renders the responses as HTML pages, through
+// the layout template. Pages and lists of albums are rendered with
+// albums.tmpl, an album with album.tmpl, errors with error.tmpl, and the login
+// form with login.tmpl; they have the forms that create, edit and delete
+// albums. Other values are rendered as JSON by value.tmpl. All the values are
+// escaped by html/template.
+func (e htmlEncoder) Encode(v ...interface{}) (string, error) {
+	return encodeString(e, v)
+}
+
+func (e htmlEncoder) EncodeTo(w io.Writer, v ...interface{}) error {
+	view := &htmlView{CSRFToken: e.csrfToken}
+	name := "albums.tmpl"
+	switch {
+	case len(v) == 1:
+		switch x := v[0].(type) {
+		case *Page:
+			view.Page, view.Albums = x, x.Albums
+		case *Album:
+			view.Album, name = x, "album.tmpl"
+		case *Error:
+			view.Error, name = x, "error.tmpl"
+		case *loginForm:
+			name = "login.tmpl"
+		default:
+			name = "value.tmpl"
+		}
+	case allAlbums(v):
+		for _, a := range v {
+			view.Albums = append(view.Albums, a.(*Album))
+		}
+	default:
+		name = "value.tmpl"
+	}
+	if name == "value.tmpl" {
+		var val interface{} = v
+		if len(v) == 1 {
+			val = v[0]
+		}
+		b, err := json.MarshalIndent(val, "", "  ")
+		if err != nil {
+			return err
+		}
+		view.Value = string(b)
+	}
+	return renderHTML(w, name, view)
+}
+
+// Reports whether the values are albums (which is the case of an empty list).
+func allAlbums(v []interface{}) bool {
+	for _, x := range v {
+		if _, ok := x.(*Album); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Renders the template within layout.tmpl, which includes it with {{ yield }}.
+func renderHTML(w io.Writer, name string, view *htmlView) error {
+	base, err := parseTemplates()
+	if err != nil {
+		return err
+	}
+	t, err := base.Clone()
+	if err != nil {
+		return err
+	}
+	var content bytes.Buffer
+	if err := t.ExecuteTemplate(&content, name, view); err != nil {
+		return err
+	}
+	t.Funcs(template.FuncMap{"yield": func() template.HTML {
+		// The content has been rendered by html/template, so it is safe
+		return template.HTML(content.String())
+	}})
+	var buf bytes.Buffer
+	if err := t.ExecuteTemplate(&buf, "layout.tmpl", view); err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// OverrideMethod lets the HTML forms, which can only be posted, update and
+// delete albums: a POST form with a _method field of PUT or DELETE is routed
+// as a request of that method. The field is removed from the form, so that the
+// handlers do not see it. It must be used before the router and the CSRF
+// middleware.
+func OverrideMethod(r *http.Request) {
+	if r.Method != "POST" || !isFormBody(r) {
+		return
+	}
+	if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+		// The handler reports the malformed body
+		return
+	}
+	switch m := strings.ToUpper(r.PostFormValue(methodField)); m {
+	case "PUT", "DELETE":
+		r.Method = m
+	}
+	removeFormField(r, methodField)
+}
+
+// Reports whether the body of the request is a form.
+func isFormBody(r *http.Request) bool {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mt == "application/x-www-form-urlencoded" || mt == "multipart/form-data"
+}
+
+// Removes a control field of the HTML forms from the parsed form of the request.
+func removeFormField(r *http.Request, k string) {
+	delete(r.Form, k)
+	delete(r.PostForm, k)
+	if r.MultipartForm != nil {
+		delete(r.MultipartForm.Value, k)
+	}
+}
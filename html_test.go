@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"launchpad.net/gocheck"
+)
+
+func (s *S) TestHTMLEncoderPage(c *gocheck.C) {
+	p := &Page{Total: 3, Limit: 2, Next: "/albums?limit=2&offset=2", Albums: []*Album{encAlbum1,
+		{Id: 3, Band: `<script>alert("owned")</script>`, Title: "Reign In Blood", Genres: []string{"thrash", "speed & death"}}}}
+	out, err := htmlEncoder{csrfToken: "abc123"}.Encode(p)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(strings.HasPrefix(strings.TrimSpace(out), "<!DOCTYPE html>"), gocheck.Equals, true)
+	c.Assert(out, gocheck.Matches, `(?s).*2 of 3 albums.*`)
+	c.Assert(out, gocheck.Matches, `(?s).*<a href="/albums\?limit=2&amp;offset=2" rel="next">Next</a>.*`)
+	c.Assert(out, gocheck.Matches, `(?s).*<a href="/albums/3.html">Reign In Blood</a>.*`)
+	c.Assert(out, gocheck.Matches, `(?s).*<td>thrash, speed &amp; death</td>.*`)
+	c.Assert(out, gocheck.Matches, `(?s).*<td>&lt;script&gt;alert\(&#34;owned&#34;\)&lt;/script&gt;</td>.*`)
+	c.Assert(strings.Contains(out, "<script>"), gocheck.Equals, false)
+	// The creation form
+	c.Assert(out, gocheck.Matches, `(?s).*<form method="post" action="/albums.html">\s*<input type="hidden" name="csrf_token" value="abc123">.*`)
+
+	out, err = htmlEncoder{}.Encode()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(out, gocheck.Matches, `(?s).*<p>No albums.</p>.*`)
+}
+
+func (s *S) TestHTMLEncoderAlbum(c *gocheck.C) {
+	al := &Album{Id: 7, Band: "Slayer", Title: `"Reign" <In> Blood`, Year: 1986, Released: "1986-10-07",
+		Tracks: []*Track{{Number: 1, Title: "Angel of Death", Duration: 291}}, Artwork: &Artwork{URL: "https://example.com/reign.jpg", Width: 600}}
+	out, err := htmlEncoder{csrfToken: "abc123"}.Encode(al)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(out, gocheck.Matches, `(?s).*<h1>Slayer - &#34;Reign&#34; &lt;In&gt; Blood</h1>.*`)
+	c.Assert(out, gocheck.Matches, `(?s).*<li value="1">Angel of Death</li>.*`)
+	c.Assert(out, gocheck.Matches, `(?s).*<img src="https://example.com/reign.jpg" alt="Artwork" width="600">.*`)
+	// The edit form is filled with the album, the delete form only has the
+	// control fields
+	c.Assert(out, gocheck.Matches, `(?s).*<input type="hidden" name="_method" value="PUT">\s*<input type="hidden" name="csrf_token" value="abc123">.*`)
+	c.Assert(out, gocheck.Matches, `(?s).*<input name="title" value="&#34;Reign&#34; &lt;In&gt; Blood" required>.*`)
+	c.Assert(out, gocheck.Matches, `(?s).*<input name="year" type="number" value="1986">.*`)
+	c.Assert(out, gocheck.Matches, `(?s).*<textarea name="tracks">\[{&#34;number&#34;:1,&#34;title&#34;:&#34;Angel of Death&#34;,&#34;duration&#34;:291}\]</textarea>.*`)
+	c.Assert(out, gocheck.Matches, `(?s).*<textarea name="artwork">{&#34;url&#34;:&#34;https://example.com/reign.jpg&#34;,&#34;width&#34;:600}</textarea>.*`)
+	c.Assert(out, gocheck.Matches, `(?s).*<input type="hidden" name="_method" value="DELETE">.*`)
+}
+
+func (s *S) TestHTMLEncoderOtherValues(c *gocheck.C) {
+	out, err := htmlEncoder{}.Encode(NewError(ErrCodeNotExist, "the album with id <1> does not exist"))
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(out, gocheck.Matches, `(?s).*<h1>The resource does not exist</h1>\s*<p>the album with id &lt;1&gt; does not exist</p>.*`)
+
+	out, err = htmlEncoder{}.Encode(&Track{Number: 1, Title: "<b>Angel</b>"})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(out, gocheck.Matches, `(?s).*<pre>{\n  &#34;number&#34;: 1,\n  &#34;title&#34;: &#34;\\u003cb\\u003eAngel\\u003c/b\\u003e&#34;,.*`)
+}
+
+func (s *S) TestOverrideMethod(c *gocheck.C) {
+	r := newBodyRequest(c, "application/x-www-form-urlencoded", "_method=delete&band=Slayer")
+	OverrideMethod(r)
+	c.Assert(r.Method, gocheck.Equals, "DELETE")
+	c.Assert(r.Form, gocheck.DeepEquals, url.Values{"band": {"Slayer"}})
+
+	r = newBodyRequest(c, "application/x-www-form-urlencoded", "_method=GET")
+	OverrideMethod(r)
+	c.Assert(r.Method, gocheck.Equals, "POST")
+	c.Assert(r.PostForm, gocheck.HasLen, 0)
+
+	// Only the forms are considered
+	r = newBodyRequest(c, "application/json", `{"_method":"DELETE"}`)
+	OverrideMethod(r)
+	c.Assert(r.Method, gocheck.Equals, "POST")
+	c.Assert(r.Form, gocheck.IsNil)
+	r, _ = http.NewRequest("GET", "/albums?_method=DELETE", nil)
+	OverrideMethod(r)
+	c.Assert(r.Method, gocheck.Equals, "GET")
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codegangsta/martini"
+)
+
+// The upper bounds of the buckets of the request durations, in seconds.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// The route label of the requests that match no route.
+const otherRoute = "other"
+
+// The method label of the requests with a non-standard method, so that the
+// clients cannot create as many series as they like.
+const otherMethod = "other"
+
+// The standard methods, that are labels of their own.
+var standardMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true, "DELETE": true, "OPTIONS": true,
+}
+
+// When the process started, for the process_start_time_seconds metric.
+var startTime = time.Now()
+
+type requestKey struct {
+	method, route string
+	status        int
+}
+
+type routeKey struct {
+	method, route string
+}
+
+// The durations of the requests of a route, with the count of each bucket
+// (not cumulative) and one more for the durations above the last bucket.
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Metrics counts the requests and their durations, by method and route, and
+// renders them in the Prometheus text format along with the album and Go
+// runtime metrics. The zero value is ready to use.
+type Metrics struct {
+	mu        sync.Mutex
+	requests  map[requestKey]uint64
+	durations map[routeKey]*histogram
+}
+
+// The metrics of the server.
+var metrics = &Metrics{}
+
+// Handler returns the middleware that measures the requests. It must come
+// before MapEncoder, so that the requests it answers are measured too. The
+// route of a request is the pattern of apiRoutes that it matches, without its
+// format extension. The non-standard methods are all counted as otherMethod.
+func (mt *Metrics) Handler() martini.Handler {
+	return func(c martini.Context, w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		p, _ := splitExt(r.URL.Path)
+		c.Next()
+		status := http.StatusOK
+		if sw, ok := w.(interface {
+			Status() int
+		}); ok && sw.Status() != 0 {
+			status = sw.Status()
+		}
+		method := methodOf(r.Method)
+		mt.observe(method, routeOf(method, p), status, time.Since(start))
+	}
+}
+
+// Returns the method, if it is a standard one, or otherMethod.
+func methodOf(method string) string {
+	if standardMethods[method] {
+		return method
+	}
+	return otherMethod
+}
+
+// Returns the pattern of the route of the request, or otherRoute.
+func routeOf(method, path string) string {
+	for _, rt := range apiRoutes {
+		if rt.Method == method && matchPattern(rt.Pattern, path) {
+			return rt.Pattern
+		}
+	}
+	return otherRoute
+}
+
+// Records a request.
+func (mt *Metrics) observe(method, route string, status int, d time.Duration) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if mt.requests == nil {
+		mt.requests = make(map[requestKey]uint64)
+		mt.durations = make(map[routeKey]*histogram)
+	}
+	mt.requests[requestKey{method, route, status}]++
+	h, ok := mt.durations[routeKey{method, route}]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(durationBuckets)+1)}
+		mt.durations[routeKey{method, route}] = h
+	}
+	s := d.Seconds()
+	h.counts[sort.SearchFloat64s(durationBuckets, s)]++
+	h.sum += s
+	h.count++
+}
+
+// Writes the metrics in the Prometheus text format (version 0.0.4). The album
+// metrics come from db.
+func (mt *Metrics) write(w io.Writer, db DB) error {
+	var buf bytes.Buffer
+	mt.mu.Lock()
+	rks := make([]requestKey, 0, len(mt.requests))
+	for k := range mt.requests {
+		rks = append(rks, k)
+	}
+	sort.Sort(byRequestKey(rks))
+	writeMetricHeader(&buf, "jindou_http_requests_total", "counter", "Number of HTTP requests, by method, route and status.")
+	for _, k := range rks {
+		fmt.Fprintf(&buf, "jindou_http_requests_total%s %d\n",
+			promLabels("method", k.method, "route", k.route, "status", strconv.Itoa(k.status)), mt.requests[k])
+	}
+	dks := make([]requestKey, 0, len(mt.durations))
+	for k := range mt.durations {
+		dks = append(dks, requestKey{method: k.method, route: k.route})
+	}
+	sort.Sort(byRequestKey(dks))
+	writeMetricHeader(&buf, "jindou_http_request_duration_seconds", "histogram", "Duration of the HTTP requests, by method and route.")
+	for _, k := range dks {
+		h := mt.durations[routeKey{k.method, k.route}]
+		var n uint64
+		for i, c := range h.counts {
+			n += c
+			le := "+Inf"
+			if i < len(durationBuckets) {
+				le = strconv.FormatFloat(durationBuckets[i], 'g', -1, 64)
+			}
+			fmt.Fprintf(&buf, "jindou_http_request_duration_seconds_bucket%s %d\n",
+				promLabels("method", k.method, "route", k.route, "le", le), n)
+		}
+		labels := promLabels("method", k.method, "route", k.route)
+		fmt.Fprintf(&buf, "jindou_http_request_duration_seconds_sum%s %g\n", labels, h.sum)
+		fmt.Fprintf(&buf, "jindou_http_request_duration_seconds_count%s %d\n", labels, h.count)
+	}
+	mt.mu.Unlock()
+
+	writeMetricHeader(&buf, "jindou_albums", "gauge", "Number of albums.")
+	fmt.Fprintf(&buf, "jindou_albums %d\n", db.Count())
+	writeMetricHeader(&buf, "jindou_changes_last_seq", "counter", "Sequence number of the last change of the albums.")
+	fmt.Fprintf(&buf, "jindou_changes_last_seq %d\n", db.Changes().Last())
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	gauges := []struct {
+		name, typ, help string
+		v               float64
+	}{
+		{"go_goroutines", "gauge", "Number of goroutines.", float64(runtime.NumGoroutine())},
+		{"go_memstats_alloc_bytes", "gauge", "Bytes of allocated heap objects.", float64(ms.Alloc)},
+		{"go_memstats_sys_bytes", "gauge", "Bytes of memory obtained from the system.", float64(ms.Sys)},
+		{"go_memstats_heap_objects", "gauge", "Number of allocated heap objects.", float64(ms.HeapObjects)},
+		{"go_memstats_mallocs_total", "counter", "Number of heap objects allocated.", float64(ms.Mallocs)},
+		{"go_memstats_frees_total", "counter", "Number of heap objects freed.", float64(ms.Frees)},
+		{"go_gc_cycles_total", "counter", "Number of completed GC cycles.", float64(ms.NumGC)},
+		{"go_gc_pause_seconds_total", "counter", "Time spent in GC stop-the-world pauses.", float64(ms.PauseTotalNs) / 1e9},
+		{"go_memstats_last_gc_time_seconds", "gauge", "Time of the last GC, in seconds since the epoch.", float64(ms.LastGC) / 1e9},
+		{"process_start_time_seconds", "gauge", "Start time of the process, in seconds since the epoch.", float64(startTime.UnixNano()) / 1e9},
+	}
+	for _, g := range gauges {
+		writeMetricHeader(&buf, g.name, g.typ, g.help)
+		fmt.Fprintf(&buf, "%s %g\n", g.name, g.v)
+	}
+	writeMetricHeader(&buf, "go_info", "gauge", "Version of Go.")
+	fmt.Fprintf(&buf, "go_info%s 1\n", promLabels("version", runtime.Version()))
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func writeMetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// Returns the label set of the name/value pairs, with the values escaped.
+func promLabels(kv ...string) string {
+	esc := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i := 0; i < len(kv); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, `%s="%s"`, kv[i], esc.Replace(kv[i+1]))
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+type byRequestKey []requestKey
+
+func (b byRequestKey) Len() int      { return len(b) }
+func (b byRequestKey) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byRequestKey) Less(i, j int) bool {
+	if b[i].route != b[j].route {
+		return b[i].route < b[j].route
+	}
+	if b[i].method != b[j].method {
+		return b[i].method < b[j].method
+	}
+	return b[i].status < b[j].status
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"launchpad.net/gocheck"
+)
+
+func (s *S) TestRouteOf(c *gocheck.C) {
+	c.Assert(routeOf("GET", "/albums/12"), gocheck.Equals, "/albums/:id")
+	c.Assert(routeOf("GET", "/albums/_search"), gocheck.Equals, "/albums/_search")
+	c.Assert(routeOf("PUT", "/albums/12/tracks"), gocheck.Equals, "/albums/:id/tracks")
+	c.Assert(routeOf("POST", "/albums/12"), gocheck.Equals, otherRoute)
+	c.Assert(routeOf("GET", "/nope"), gocheck.Equals, otherRoute)
+}
+
+func (s *S) TestMetricsNonStandardMethod(c *gocheck.C) {
+	c.Assert(methodOf("PATCH"), gocheck.Equals, "PATCH")
+	c.Assert(methodOf("get"), gocheck.Equals, otherMethod)
+	for _, method := range []string{"FOO", "BAR", "get"} {
+		r, err := http.NewRequest(method, "/albums/12", nil)
+		c.Assert(err, gocheck.IsNil)
+		m.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	for k := range metrics.requests {
+		c.Check(standardMethods[k.method] || k.method == otherMethod, gocheck.Equals, true, gocheck.Commentf("%s", k.method))
+	}
+	c.Assert(metrics.durations[routeKey{otherMethod, otherRoute}].count >= 3, gocheck.Equals, true)
+}
+
+func (s *S) TestMetricsWrite(c *gocheck.C) {
+	mt := &Metrics{}
+	mt.observe("GET", "/albums/:id", 200, 3*time.Millisecond)
+	mt.observe("GET", "/albums/:id", 404, 30*time.Millisecond)
+	mt.observe("GET", "/albums", 200, 20*time.Second)
+	db := &albumsDB{m: make(map[int]*Album)}
+	db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+
+	var buf bytes.Buffer
+	c.Assert(mt.write(&buf, db), gocheck.IsNil)
+	out := buf.String()
+	for _, l := range []string{
+		"# TYPE jindou_http_requests_total counter",
+		`jindou_http_requests_total{method="GET",route="/albums",status="200"} 1`,
+		`jindou_http_requests_total{method="GET",route="/albums/:id",status="404"} 1`,
+		"# TYPE jindou_http_request_duration_seconds histogram",
+		`jindou_http_request_duration_seconds_bucket{method="GET",route="/albums/:id",le="0.005"} 1`,
+		`jindou_http_request_duration_seconds_bucket{method="GET",route="/albums/:id",le="0.025"} 1`,
+		`jindou_http_request_duration_seconds_bucket{method="GET",route="/albums/:id",le="0.05"} 2`,
+		`jindou_http_request_duration_seconds_bucket{method="GET",route="/albums/:id",le="+Inf"} 2`,
+		`jindou_http_request_duration_seconds_count{method="GET",route="/albums/:id"} 2`,
+		`jindou_http_request_duration_seconds_bucket{method="GET",route="/albums",le="10"} 0`,
+		`jindou_http_request_duration_seconds_bucket{method="GET",route="/albums",le="+Inf"} 1`,
+		`jindou_http_request_duration_seconds_sum{method="GET",route="/albums"} 20`,
+		"jindou_albums 1",
+		"jindou_changes_last_seq 1",
+		"# TYPE go_goroutines gauge",
+	} {
+		c.Assert(strings.Contains(out, l+"\n"), gocheck.Equals, true, gocheck.Commentf("missing %q", l))
+	}
+	// The series are sorted by route
+	c.Assert(strings.Index(out, `route="/albums",status`) < strings.Index(out, `route="/albums/:id",status`), gocheck.Equals, true)
+}
+
+func (s *S) TestPromLabels(c *gocheck.C) {
+	c.Assert(promLabels("a", "1", "b", "say \"hi\"\\\n"), gocheck.Equals, `{a="1",b="say \"hi\"\\\n"}`)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+)
+
+type msgpackEncoder struct{}
+
+// msgpackEncoder is an Encoder that produces MessagePack-encoded responses, with
+// the same structure and field names as the JSON encoder. Objects are encoded as
+// maps with string keys, and integral numbers as the smallest integer type that
+// holds them.
+func (e msgpackEncoder) Encode(v ...interface{}) (string, error) {
+	return encodeString(e, v)
+}
+
+func (_ msgpackEncoder) EncodeTo(w io.Writer, v ...interface{}) error {
+	if len(v) != 1 {
+		return writeList(&msgpackListWriter{w: w}, w, v)
+	}
+	var buf bytes.Buffer
+	p, ok := v[0].(*Page)
+	if !ok {
+		t, err := jsonTree(v[0])
+		if err != nil {
+			return err
+		}
+		if err := writeMsgpack(&buf, t); err != nil {
+			return err
+		}
+		_, err = w.Write(buf.Bytes())
+		return err
+	}
+	// The albums are the last key of the page, the empty array is replaced by
+	// the header of the array of albums, followed by the albums
+	t, err := jsonTree(emptyPage(p))
+	if err != nil {
+		return err
+	}
+	if err := writeMsgpack(&buf, t); err != nil {
+		return err
+	}
+	b, err := cutSuffix(buf.Bytes(), "\x90")
+	if err != nil {
+		return err
+	}
+	return streamPage(w, p, b, &msgpackListWriter{w: w}, "")
+}
+
+func writeMsgpack(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			writeMsgpackInt(buf, i)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+	case string:
+		writeMsgpackHeader(buf, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		buf.WriteString(v)
+	case []interface{}:
+		writeMsgpackHeader(buf, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, item := range v {
+			if err := writeMsgpack(buf, item); err != nil {
+				return err
+			}
+		}
+	case *object:
+		writeMsgpackHeader(buf, len(v.keys), 0x80, 16, 0, 0xde, 0xdf)
+		for _, k := range v.keys {
+			writeMsgpack(buf, k)
+			if err := writeMsgpack(buf, v.vals[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unexpected value of type %T", v)
+	}
+	return nil
+}
+
+// Writes the header of a string, array or map of length n: the fix type if n is
+// lower than fixMax, or else the smallest of the 8 (if the type has one), 16 and
+// 32 bits variants.
+func writeMsgpackHeader(buf *bytes.Buffer, n int, fix byte, fixMax int, b8, b16, b32 byte) {
+	switch {
+	case n < fixMax:
+		buf.WriteByte(fix | byte(n))
+	case b8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(b8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(b16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(b32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func writeMsgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i < 128:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(i))
+	case i >= 0 && i <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(i))
+	case i >= 0 && i <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(i))
+	case i >= 0 && i <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(i))
+	case i >= 0:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, uint64(i))
+	case i >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(i))
+	case i >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
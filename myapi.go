@@ -1,124 +1,285 @@
 package main
 
 import (
-    "fmt"
-    "net/http"
-    "strconv"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
-    "github.com/codegangsta/martini"
+	"github.com/codegangsta/martini"
 )
 
-// GetAlbums returns the list of albums (possibly filtered).
-func GetAlbums(r *http.Request, enc Encoder, db DB) string {
-    // Get the query string arguments, if any
-    qs := r.URL.Query()
-    band, title, yrs := qs.Get("band"), qs.Get("title"), qs.Get("year")
-    yri, err := strconv.Atoi(yrs)
-    if err != nil {
-        // If year is not a valid integer, ignore it
-        yri = 0
-    }
-    if band != "" || title != "" || yri != 0 {
-        // At least one filter, use Find()
-        return Must(enc.Encode(toIface(db.Find(band, title, yri))...))
-    }
-    // Otherwise, return all albums
-    return Must(enc.Encode(toIface(db.GetAll())...))
+// The minimum length of the passwords.
+const minPasswordLen = 8
+
+// The header of the registrations that claim the admin token.
+const adminTokenHeader = "X-Admin-Token"
+
+// The form fields accepted in user requests.
+var userFormFields = map[string]bool{"email": true, "password": true}
+
+// The body of a user request. As for albums, pointers tell missing fields apart
+// from empty ones, and unknown XML elements and attributes are collected so that
+// they can be rejected.
+type userBody struct {
+	XMLName      xml.Name   `json:"-" xml:"user"`
+	Email        *string    `json:"email" xml:"email"`
+	Password     *string    `json:"password" xml:"password"`
+	UnknownElems []xml.Name `json:"-" xml:",any"`
+	UnknownAttrs []xml.Attr `json:"-" xml:",any,attr"`
+}
+
+// A secret that can be claimed once. The admin token is drawn at startup with
+// the -admin-bootstrap command line flag and only logged, so that the first
+// admin is chosen by the operator of the server, not by whoever registers
+// first.
+type oneTimeToken struct {
+	sync.Mutex
+	value string
+}
+
+var adminToken = &oneTimeToken{}
+
+// reset draws a new value, that replaces the previous one, and returns it.
+func (t *oneTimeToken) reset() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.value = hex.EncodeToString(b)
+	return t.value
+}
+
+// claim reports whether v is the value of the token, which cannot be claimed
+// again afterwards.
+func (t *oneTimeToken) claim(v string) bool {
+	t.Lock()
+	defer t.Unlock()
+	if t.value == "" || subtle.ConstantTimeCompare([]byte(v), []byte(t.value)) != 1 {
+		return false
+	}
+	t.value = ""
+	return true
+}
+
+// CreateUser registers the posted user. The password is stored as a bcrypt
+// hash, and is never sent back. The user is an admin only if the request
+// claims the admin token in the X-Admin-Token header.
+func CreateUser(w http.ResponseWriter, r *http.Request, enc Encoder, fail Fail, udb UserDB) (int, string) {
+	u, err := getPostUser(r, true)
+	if err != nil {
+		return fail(err)
+	}
+	id, err := udb.Add(u)
+	switch err {
+	case ErrEmailExists:
+		return fail(NewError(ErrCodeAlreadyExists, fmt.Sprintf("the email '%s' is already registered", u.Email)))
+	case nil:
+		// The token is only claimed by a registration that succeeded
+		if v := r.Header.Get(adminTokenHeader); v != "" && adminToken.claim(v) {
+			u.Admin = true
+			if err := udb.Update(u); err != nil {
+				panic(err)
+			}
+		}
+		// TODO : Location is expected to be an absolute URI, as per the RFC2616
+		w.Header().Set("Location", fmt.Sprintf("/users/%d", id))
+		return http.StatusCreated, Must(enc.Encode(u))
+	default:
+		panic(err)
+	}
+}
+
+// GetUser returns the authenticated user. Other users are reported as not
+// existing.
+func GetUser(enc Encoder, fail Fail, udb UserDB, t *Token, parms martini.Params) (int, string) {
+	u := ownUser(udb, t, parms)
+	if u == nil {
+		return fail(userNotExist(parms))
+	}
+	return http.StatusOK, Must(enc.Encode(u))
+}
+
+// UpdateUser changes the email and, if one is sent, the password of the
+// authenticated user. Changing the password revokes all the tokens of the
+// user, including the one of the request.
+func UpdateUser(r *http.Request, enc Encoder, fail Fail, udb UserDB, tdb TokenDB, t *Token, parms martini.Params) (int, string) {
+	cur := ownUser(udb, t, parms)
+	if cur == nil {
+		return fail(userNotExist(parms))
+	}
+	u, err := getPostUser(r, false)
+	if err != nil {
+		return fail(err)
+	}
+	u.Id, u.Admin = cur.Id, cur.Admin
+	changed := u.Password != ""
+	if !changed {
+		u.Password = cur.Password
+	}
+	switch err = udb.Update(u); err {
+	case ErrUserNotExist:
+		return fail(userNotExist(parms))
+	case ErrEmailExists:
+		return fail(NewError(ErrCodeAlreadyExists, fmt.Sprintf("the email '%s' is already registered", u.Email)))
+	case nil:
+		if changed {
+			tdb.RevokeUser(u.Id)
+		}
+		return http.StatusOK, Must(enc.Encode(u))
+	default:
+		panic(err)
+	}
 }
 
-// GetAlbum returns the requested album.
-func GetAlbum(enc Encoder, db DB, parms martini.Params) (int, string) {
-    id, err := strconv.Atoi(parms["id"])
-    al := db.Get(id)
-    if err != nil || al == nil {
-        // Invalid id, or does not exist
-        return http.StatusNotFound, Must(enc.Encode(
-            NewError(ErrCodeNotExist, fmt.Sprintf("the album with id %s does not exist", parms["id"]))))
-    }
-    return http.StatusOK, Must(enc.Encode(al))
+// DeleteUser removes the authenticated user and revokes all of its tokens.
+func DeleteUser(fail Fail, udb UserDB, tdb TokenDB, t *Token, parms martini.Params) (int, string) {
+	u := ownUser(udb, t, parms)
+	if u == nil {
+		return fail(userNotExist(parms))
+	}
+	switch err := udb.Delete(u.Id); err {
+	case ErrUserNotExist:
+		return fail(userNotExist(parms))
+	case nil:
+		tdb.RevokeUser(u.Id)
+		return http.StatusNoContent, ""
+	default:
+		panic(err)
+	}
 }
 
-// CreateUser creates the posted user.
-func CreateUser(w http.ResponseWriter, r *http.Request, enc Encoder, db DB) (int, string) {
-    al := getPostAlbum(r)
-    id, err := db.Add(al)
-    switch err {
-    case ErrAlreadyExists:
-        // Duplicate
-        return http.StatusConflict, Must(enc.Encode(
-            NewError(ErrCodeAlreadyExists, fmt.Sprintf("the user '%s' already exists", al.Email))))
-    case nil:
-        // TODO : Location is expected to be an absolute URI, as per the RFC2616
-        w.Header().Set("Location", fmt.Sprintf("/users/%d", id))
-        return http.StatusCreated, Must(enc.Encode(al))
-    default:
-        panic(err)
-    }
+// Returns the user identified by the id of the URL if it is the owner of the
+// token, or nil.
+func ownUser(udb UserDB, t *Token, parms martini.Params) *User {
+	id, err := strconv.Atoi(parms["id"])
+	if err != nil || id != t.UserId {
+		return nil
+	}
+	return udb.Get(id)
 }
 
-// UpdateAlbum changes the specified album.
-func UpdateAlbum(r *http.Request, enc Encoder, db DB, parms martini.Params) (int, string) {
-    al, err := getPutAlbum(r, parms)
-    if err != nil {
-        // Invalid id, 404
-        return http.StatusNotFound, Must(enc.Encode(
-            NewError(ErrCodeNotExist, fmt.Sprintf("the album with id %s does not exist", parms["id"]))))
-    }
-    err = db.Update(al)
-    switch err {
-    case ErrAlreadyExists:
-        return http.StatusConflict, Must(enc.Encode(
-            NewError(ErrCodeAlreadyExists, fmt.Sprintf("the album '%s' from '%s' already exists", al.Title, al.Band))))
-    case nil:
-        return http.StatusOK, Must(enc.Encode(al))
-    default:
-        panic(err)
-    }
+func userNotExist(parms martini.Params) *Error {
+	return NewError(ErrCodeNotExist, fmt.Sprintf("the user with id %s does not exist", parms["id"]))
 }
 
-// Parse the request body, load into an Album structure.
-func getPostUser(r *http.Request) *User {
-    email, password := r.FormValue("email"), r.FormValue("password")
-    return &User{
-        Email:    email,
-        Password: password
-    }
+func invalidUser(fields ...*FieldError) *Error {
+	e := NewError(ErrCodeInvalidUser, "the user is invalid")
+	e.Fields = fields
+	return e
 }
 
-// Like getPostAlbum, but additionnally, parse and store the `id` query string.
-func getPutAlbum(r *http.Request, parms martini.Params) (*Album, error) {
-    al := getPostAlbum(r)
-    id, err := strconv.Atoi(parms["id"])
-    if err != nil {
-        return nil, err
-    }
-    al.Id = id
-    return al, nil
+// getPostUser reads the user from the request body, in the same formats as
+// getPostAlbum, and hashes its password. If passwordRequired is false, the
+// password may be omitted, in which case the Password field is left empty.
+func getPostUser(r *http.Request, passwordRequired bool) (*User, error) {
+	mt, e := bodyMediaType(r)
+	if e != nil {
+		return nil, e
+	}
+	var body userBody
+	switch mt {
+	case "application/json":
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&body); err != nil {
+			return nil, NewError(ErrCodeInvalidUser, fmt.Sprintf("malformed JSON body: %s", err))
+		}
+	case "application/xml", "text/xml":
+		if err := xml.NewDecoder(r.Body).Decode(&body); err != nil {
+			return nil, NewError(ErrCodeInvalidUser, fmt.Sprintf("malformed XML body: %s", err))
+		}
+		var fields []*FieldError
+		for _, n := range body.UnknownElems {
+			fields = append(fields, &FieldError{Field: n.Local, Message: "unknown field"})
+		}
+		for _, a := range body.UnknownAttrs {
+			fields = append(fields, &FieldError{Field: a.Name.Local, Message: "unknown field"})
+		}
+		if len(fields) > 0 {
+			return nil, invalidUser(fields...)
+		}
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+			return nil, NewError(ErrCodeInvalidUser, fmt.Sprintf("malformed form body: %s", err))
+		}
+		var unknown []string
+		for k := range r.PostForm {
+			if !userFormFields[k] {
+				unknown = append(unknown, k)
+			}
+		}
+		if len(unknown) > 0 {
+			sort.Strings(unknown)
+			fields := make([]*FieldError, len(unknown))
+			for i, k := range unknown {
+				fields[i] = &FieldError{Field: k, Message: "unknown field"}
+			}
+			return nil, invalidUser(fields...)
+		}
+		for k := range userFormFields {
+			if _, ok := r.Form[k]; ok {
+				v := r.Form.Get(k)
+				if k == "email" {
+					body.Email = &v
+				} else {
+					body.Password = &v
+				}
+			}
+		}
+	default:
+		return nil, unsupportedMediaType(r.Header.Get("Content-Type"))
+	}
+	return body.user(passwordRequired)
 }
 
-// Martini requires that 2 parameters are returned to treat the first one as the
-// status code. Delete is an idempotent action, but this does not mean it should
-// always return 204 - No content, idempotence relates to the state of the server
-// after the request, not the returned status code. So I return a 404 - Not found
-// if the id does not exist.
-func DeleteAlbum(enc Encoder, db DB, parms martini.Params) (int, string) {
-    id, err := strconv.Atoi(parms["id"])
-    al := db.Get(id)
-    if err != nil || al == nil {
-        return http.StatusNotFound, Must(enc.Encode(
-            NewError(ErrCodeNotExist, fmt.Sprintf("the album with id %s does not exist", parms["id"]))))
-    }
-    db.Delete(id)
-    return http.StatusNoContent, ""
+// Validates the decoded body and returns the user, with its password hashed.
+func (b *userBody) user(passwordRequired bool) (*User, error) {
+	var (
+		fields []*FieldError
+		u      User
+	)
+	if b.Email == nil || strings.TrimSpace(*b.Email) == "" {
+		fields = append(fields, &FieldError{Field: "email", Message: "is required"})
+	} else if u.Email = strings.TrimSpace(*b.Email); !validEmail(u.Email) {
+		fields = append(fields, &FieldError{Field: "email", Message: "is not a valid email address"})
+	}
+	switch {
+	case b.Password == nil || *b.Password == "":
+		if passwordRequired {
+			fields = append(fields, &FieldError{Field: "password", Message: "is required"})
+		}
+	case len(*b.Password) < minPasswordLen:
+		fields = append(fields, &FieldError{Field: "password",
+			Message: fmt.Sprintf("must be at least %d characters long", minPasswordLen)})
+	}
+	if len(fields) > 0 {
+		return nil, invalidUser(fields...)
+	}
+	if b.Password != nil && *b.Password != "" {
+		if err := u.SetPassword(*b.Password); err != nil {
+			panic(err)
+		}
+	}
+	return &u, nil
 }
 
-func toIface(v []*Album) []interface{} {
-    if len(v) == 0 {
-        return nil
-    }
-    ifs := make([]interface{}, len(v))
-    for i, v := range v {
-        ifs[i] = v
-    }
-    return ifs
+// Reports whether the email looks like a deliverable address: a non-empty local
+// part and a domain with at least one dot, without spaces.
+func validEmail(email string) bool {
+	i := strings.LastIndex(email, "@")
+	if i <= 0 || strings.ContainsAny(email, " \t\r\n") {
+		return false
+	}
+	dom := email[i+1:]
+	return strings.Contains(dom, ".") && !strings.HasPrefix(dom, ".") && !strings.HasSuffix(dom, ".")
 }
@@ -4,143 +4,152 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
+	"time"
+
+	"code.google.com/p/go.crypto/bcrypt"
 )
 
 var (
-	ErrAlreadyExists = errors.New("user already exists")
+	ErrEmailExists  = errors.New("email already registered")
+	ErrUserNotExist = errors.New("user does not exist")
 )
 
-// The DB interface defines methods to manipulate the albums.
-type DB interface {
-	Get(id int) *Album
-	GetAll() []*Album
-	Find(band, title string, year int) []*Album
+// The cost of the password hashes.
+var bcryptCost = bcrypt.DefaultCost
+
+// The UserDB interface defines methods to manipulate the users.
+type UserDB interface {
+	Get(id int) *User
+	GetByEmail(email string) *User
 	Add(u *User) (int, error)
 	Update(u *User) error
-	Delete(id int)
+	Delete(id int) error
 }
 
-// Thread-safe in-memory map of albums.
-type albumsDB struct {
+// Thread-safe in-memory map of users. The users are copied in and out of the
+// map, so that callers cannot modify the stored ones.
+type usersDB struct {
 	sync.RWMutex
-	m   map[int]*Album
+	m   map[int]*User
 	seq int
 }
 
-// The one and only database instance.
-var db DB
+// The one and only user database instance.
+var users UserDB = &usersDB{m: make(map[int]*User)}
 
-func init() {
-	db = &albumsDB{
-		m: make(map[int]*Album),
-	}
-	// Fill the database
-	db.Add(&Album{Id: 1, Band: "Slayer", Title: "Reign In Blood", Year: 1986})
-	db.Add(&Album{Id: 2, Band: "Slayer", Title: "Seasons In The Abyss", Year: 1990})
-	db.Add(&Album{Id: 3, Band: "Bruce Springsteen", Title: "Born To Run", Year: 1975})
-}
-
-// GetAll returns all albums from the database.
-func (db *albumsDB) GetAll() []*Album {
+// Get returns the user identified by the id, or nil.
+func (db *usersDB) Get(id int) *User {
 	db.RLock()
 	defer db.RUnlock()
-	if len(db.m) == 0 {
-		return nil
-	}
-	ar := make([]*Album, len(db.m))
-	i := 0
-	for _, v := range db.m {
-		ar[i] = v
-		i++
-	}
-	return ar
+	return db.m[id].copy()
 }
 
-// Find returns albums that match the search criteria.
-func (db *albumsDB) Find(band, title string, year int) []*Album {
+// GetByEmail returns the user registered with the email, or nil. Emails are
+// compared case-insensitively.
+func (db *usersDB) GetByEmail(email string) *User {
 	db.RLock()
 	defer db.RUnlock()
-	var res []*Album
-	for _, v := range db.m {
-		if v.Band == band || band == "" {
-			if v.Title == title || title == "" {
-				if v.Year == year || year == 0 {
-					res = append(res, v)
-				}
-			}
+	for _, u := range db.m {
+		if strings.EqualFold(u.Email, email) {
+			return u.copy()
 		}
 	}
-	return res
-}
-
-// Get returns the album identified by the id, or nil.
-func (db *albumsDB) Get(id int) *Album {
-	db.RLock()
-	defer db.RUnlock()
-	return db.m[id]
+	return nil
 }
 
-// Add creates a new album and returns its id, or an error.
-func (db *albumsDB) Add(a *Album) (int, error) {
+// Add creates a new user and returns its id, or ErrEmailExists if the email is
+// already registered.
+func (db *usersDB) Add(u *User) (int, error) {
 	db.Lock()
 	defer db.Unlock()
-	// Return an error if band-title already exists
-	if !db.isUnique(a) {
-		return 0, ErrAlreadyExists
+	u.Id = 0
+	if !db.isUnique(u) {
+		return 0, ErrEmailExists
 	}
-	// Get the unique ID
 	db.seq++
-	a.Id = db.seq
-	// Store
-	db.m[a.Id] = a
-	return a.Id, nil
+	u.Id = db.seq
+	u.Created = now()
+	db.m[u.Id] = u.copy()
+	return u.Id, nil
 }
 
-// Update changes the album identified by the id. It returns an error if the
-// updated album is a duplicate.
-func (db *albumsDB) Update(a *Album) error {
+// Update changes the user identified by the id. It returns ErrUserNotExist if
+// the id does not exist, or ErrEmailExists if the email belongs to another user.
+func (db *usersDB) Update(u *User) error {
 	db.Lock()
 	defer db.Unlock()
-	if !db.isUnique(a) {
-		return ErrAlreadyExists
+	cur, ok := db.m[u.Id]
+	if !ok {
+		return ErrUserNotExist
+	}
+	if !db.isUnique(u) {
+		return ErrEmailExists
 	}
-	db.m[a.Id] = a
+	u.Created = cur.Created
+	db.m[u.Id] = u.copy()
 	return nil
 }
 
-// Delete removes the album identified by the id from the database. It is a no-op
-// if the id does not exist.
-func (db *albumsDB) Delete(id int) {
+// Delete removes the user identified by the id, or returns ErrUserNotExist.
+func (db *usersDB) Delete(id int) error {
 	db.Lock()
 	defer db.Unlock()
+	if _, ok := db.m[id]; !ok {
+		return ErrUserNotExist
+	}
 	delete(db.m, id)
+	return nil
 }
 
-// Checks if the album already exists in the database, based on the Band and Title
-// fields.
-func (db *albumsDB) isUnique(a *Album) bool {
+// Checks that no other user is registered with the same email.
+func (db *usersDB) isUnique(u *User) bool {
 	for _, v := range db.m {
-		if v.Band == a.Band && v.Title == a.Title && v.Id != a.Id {
+		if strings.EqualFold(v.Email, u.Email) && v.Id != u.Id {
 			return false
 		}
 	}
 	return true
 }
 
-type Key struct {
-	Name    string
-	Content string
+// The User data structure, serializable in JSON, XML and text using the Stringer
+// interface. The password hash is never serialized. Admins can modify the albums
+// of every user, including those without owner. The flag cannot be set in the
+// body of a request, only the user who registers with the admin token is an
+// admin, see CreateUser.
+type User struct {
+	XMLName  xml.Name  `json:"-" xml:"user"`
+	Id       int       `json:"id" xml:"id,attr"`
+	Email    string    `json:"email" xml:"email"`
+	Password string    `json:"-" xml:"-"`
+	Admin    bool      `json:"admin" xml:"admin,attr"`
+	Created  time.Time `json:"created" xml:"created,attr"`
 }
 
-// The Album data structure, serializable in JSON, XML and text using the Stringer interface.
-type User struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
-	Keys     []Key  `json:"keys"`
-	quota.Quota
+func (u *User) String() string {
+	return fmt.Sprintf("%d - %s", u.Id, u.Email)
+}
+
+// SetPassword stores the bcrypt hash of the password.
+func (u *User) SetPassword(password string) error {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return err
+	}
+	u.Password = string(h)
+	return nil
 }
 
-func (a *User) String() string {
-	return fmt.Sprintf("%s - %s", a.Email, a.Password)
+// CheckPassword reports whether the password matches the stored hash.
+func (u *User) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) == nil
+}
+
+func (u *User) copy() *User {
+	if u == nil {
+		return nil
+	}
+	cp := *u
+	return &cp
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.crypto/bcrypt"
+	"launchpad.net/gocheck"
+)
+
+type UserSuite struct {
+	db     *usersDB
+	tokens *tokensDB
+}
+
+var _ = gocheck.Suite(&UserSuite{})
+
+func (s *UserSuite) SetUpSuite(c *gocheck.C) {
+	bcryptCost = bcrypt.MinCost
+}
+
+func (s *UserSuite) TearDownSuite(c *gocheck.C) {
+	bcryptCost = bcrypt.DefaultCost
+}
+
+func (s *UserSuite) SetUpTest(c *gocheck.C) {
+	s.db = &usersDB{m: make(map[int]*User)}
+	s.tokens = &tokensDB{m: make(map[string]*Token)}
+}
+
+func (s *UserSuite) TestAddGet(c *gocheck.C) {
+	u := &User{Email: "kerry@example.com"}
+	id, err := s.db.Add(u)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(id, gocheck.Equals, 1)
+	c.Assert(u.Created.IsZero(), gocheck.Equals, false)
+	got := s.db.Get(id)
+	c.Assert(got, gocheck.DeepEquals, u)
+	// The stored user is a copy
+	got.Email = "changed@example.com"
+	c.Assert(s.db.Get(id).Email, gocheck.Equals, "kerry@example.com")
+	c.Assert(s.db.GetByEmail("KERRY@example.com").Id, gocheck.Equals, id)
+	c.Assert(s.db.GetByEmail("nobody@example.com"), gocheck.IsNil)
+}
+
+func (s *UserSuite) TestUniqueEmail(c *gocheck.C) {
+	s.db.Add(&User{Email: "kerry@example.com"})
+	id, _ := s.db.Add(&User{Email: "jeff@example.com"})
+	_, err := s.db.Add(&User{Email: "Kerry@Example.com"})
+	c.Assert(err, gocheck.Equals, ErrEmailExists)
+	err = s.db.Update(&User{Id: id, Email: "kerry@example.com"})
+	c.Assert(err, gocheck.Equals, ErrEmailExists)
+	err = s.db.Update(&User{Id: id, Email: "jeff@example.org"})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(s.db.Update(&User{Id: 42, Email: "x@example.com"}), gocheck.Equals, ErrUserNotExist)
+}
+
+func (s *UserSuite) TestDelete(c *gocheck.C) {
+	id, _ := s.db.Add(&User{Email: "kerry@example.com"})
+	c.Assert(s.db.Delete(id), gocheck.IsNil)
+	c.Assert(s.db.Get(id), gocheck.IsNil)
+	c.Assert(s.db.Delete(id), gocheck.Equals, ErrUserNotExist)
+}
+
+func (s *UserSuite) TestPassword(c *gocheck.C) {
+	u := &User{}
+	c.Assert(u.SetPassword("correct horse"), gocheck.IsNil)
+	c.Assert(u.Password, gocheck.Not(gocheck.Equals), "correct horse")
+	c.Assert(u.CheckPassword("correct horse"), gocheck.Equals, true)
+	c.Assert(u.CheckPassword("battery staple"), gocheck.Equals, false)
+}
+
+func (s *UserSuite) post(c *gocheck.C, ct, body string) (int, string) {
+	r, err := http.NewRequest("POST", "/users", strings.NewReader(body))
+	c.Assert(err, gocheck.IsNil)
+	r.Header.Set("Content-Type", ct)
+	return CreateUser(httptest.NewRecorder(), r, jsonEncoder{}, testFail(nil, r), s.db)
+}
+
+func (s *UserSuite) TestCreateUser(c *gocheck.C) {
+	status, body := s.post(c, "application/json", `{"email":"kerry@example.com","password":"reign in blood"}`)
+	c.Assert(status, gocheck.Equals, http.StatusCreated)
+	c.Assert(strings.Contains(body, "password"), gocheck.Equals, false)
+	c.Assert(strings.Contains(body, `"email":"kerry@example.com"`), gocheck.Equals, true)
+	c.Assert(s.db.Get(1).CheckPassword("reign in blood"), gocheck.Equals, true)
+
+	status, _ = s.post(c, "application/x-www-form-urlencoded", "email=kerry%40example.com&password=12345678")
+	c.Assert(status, gocheck.Equals, http.StatusConflict)
+	status, body = s.post(c, "application/xml", `<user><email>nope</email><password>short</password></user>`)
+	c.Assert(status, gocheck.Equals, http.StatusBadRequest)
+	e := assertProblem(c, body, ErrCodeInvalidUser, "the user is invalid")
+	c.Assert(e.Fields, gocheck.DeepEquals, []*FieldError{
+		{Field: "email", Message: "is not a valid email address"},
+		{Field: "password", Message: "must be at least 8 characters long"},
+	})
+	status, _ = s.post(c, "application/json", `{"email":"jeff@example.com","password":"12345678","admin":true}`)
+	c.Assert(status, gocheck.Equals, http.StatusBadRequest)
+}
+
+func (s *UserSuite) TestUserEncoders(c *gocheck.C) {
+	u := &User{Id: 1, Email: "kerry@example.com"}
+	c.Assert(u.SetPassword("reign in blood"), gocheck.IsNil)
+	for _, f := range Formats() {
+		out, err := f.Encoder.Encode(u)
+		c.Assert(err, gocheck.IsNil)
+		c.Check(strings.Contains(out, u.Password), gocheck.Equals, false, gocheck.Commentf("%s", f.Ext))
+		c.Check(strings.Contains(out, "assword"), gocheck.Equals, false, gocheck.Commentf("%s", f.Ext))
+	}
+}
+
+func (s *UserSuite) TestOwnUser(c *gocheck.C) {
+	id, _ := s.db.Add(&User{Email: "kerry@example.com"})
+	other, _ := s.db.Add(&User{Email: "jeff@example.com"})
+	t, _ := s.tokens.Issue(id, ScopeReadWrite, time.Hour)
+	status, _ := GetUser(jsonEncoder{}, testFail(nil, nil), s.db, t, map[string]string{"id": "1"})
+	c.Assert(status, gocheck.Equals, http.StatusOK)
+	status, _ = GetUser(jsonEncoder{}, testFail(nil, nil), s.db, t, map[string]string{"id": "2"})
+	c.Assert(status, gocheck.Equals, http.StatusNotFound)
+	status, _ = DeleteUser(testFail(nil, nil), s.db, s.tokens, t, map[string]string{"id": "2"})
+	c.Assert(status, gocheck.Equals, http.StatusNotFound)
+	c.Assert(s.db.Get(other), gocheck.NotNil)
+	status, _ = DeleteUser(testFail(nil, nil), s.db, s.tokens, t, map[string]string{"id": "1"})
+	c.Assert(status, gocheck.Equals, http.StatusNoContent)
+	c.Assert(s.db.Get(id), gocheck.IsNil)
+	c.Assert(s.tokens.Get(t.Value).Valid(), gocheck.Equals, false)
+}
+
+func (s *UserSuite) TestUpdateUser(c *gocheck.C) {
+	u := &User{Email: "kerry@example.com"}
+	u.SetPassword("reign in blood")
+	id, _ := s.db.Add(u)
+	t, _ := s.tokens.Issue(id, ScopeReadWrite, time.Hour)
+	r, _ := http.NewRequest("PUT", "/users/1", strings.NewReader(`{"email":"kerry@example.org"}`))
+	r.Header.Set("Content-Type", "application/json")
+	status, _ := UpdateUser(r, jsonEncoder{}, testFail(nil, r), s.db, s.tokens, t, map[string]string{"id": "1"})
+	c.Assert(status, gocheck.Equals, http.StatusOK)
+	got := s.db.Get(id)
+	c.Assert(got.Email, gocheck.Equals, "kerry@example.org")
+	// The password is kept when it is not sent, and so are the tokens
+	c.Assert(got.CheckPassword("reign in blood"), gocheck.Equals, true)
+	c.Assert(s.tokens.Get(t.Value).Valid(), gocheck.Equals, true)
+}
+
+// A new password revokes the tokens issued before, so that a stolen token
+// does not outlive it.
+func (s *UserSuite) TestUpdateUserPasswordRevokesTokens(c *gocheck.C) {
+	m.MapTo(s.db, (*UserDB)(nil))
+	m.MapTo(s.tokens, (*TokenDB)(nil))
+	defer func() {
+		m.MapTo(users, (*UserDB)(nil))
+		m.MapTo(tokens, (*TokenDB)(nil))
+	}()
+	u := &User{Email: "kerry@example.com"}
+	u.SetPassword("reign in blood")
+	id, _ := s.db.Add(u)
+	stolen, _ := s.tokens.Issue(id, ScopeRead, time.Hour)
+	t, _ := s.tokens.Issue(id, ScopeReadWrite, time.Hour)
+	serve := func(method, body, token string) int {
+		r, err := http.NewRequest(method, "/users/1", strings.NewReader(body))
+		c.Assert(err, gocheck.IsNil)
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Accept", "application/json")
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, r)
+		return w.Code
+	}
+	c.Assert(serve("GET", "", stolen.Value), gocheck.Equals, http.StatusOK)
+	c.Assert(serve("PUT", `{"email":"kerry@example.com","password":"south of heaven"}`, t.Value), gocheck.Equals, http.StatusOK)
+	c.Assert(serve("GET", "", stolen.Value), gocheck.Equals, http.StatusUnauthorized)
+	c.Assert(serve("GET", "", t.Value), gocheck.Equals, http.StatusUnauthorized)
+	c.Assert(s.db.Get(id).CheckPassword("south of heaven"), gocheck.Equals, true)
+}
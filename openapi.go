@@ -0,0 +1,500 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The version of the API described by the OpenAPI document.
+const apiVersion = "1.0.0"
+
+// An apiRoute describes a route of the router in the OpenAPI document. The
+// test suite checks that each route of the router has exactly one apiRoute.
+type apiRoute struct {
+	Method  string
+	Pattern string // As given to the router, e.g. /albums/:id
+	Summary string
+	Scope   Scope       // Scope of the bearer token required, none if empty
+	Params  []string    // Query string arguments and headers, see apiParams
+	Bodies  []string    // Media types of the body
+	Body    interface{} // A value of the type of the body, or its jsonSchema
+	Status  int
+	Result  interface{} // A value of the type of the response, nil if there is no body
+	List    bool        // Whether the response is a list of Result
+	Errors  []int       // Codes of the errors of the route, see apiRoute.errors
+}
+
+// The media types of the album bodies.
+var albumBodyTypes = []string{"application/json", "application/xml", "application/x-www-form-urlencoded", "multipart/form-data"}
+
+// The schema of the tracks of the album and tracks requests. A track without a
+// number is numbered after its position in the list.
+var trackBodySchema = jsonSchema{
+	"type": "object",
+	"properties": map[string]jsonSchema{
+		"number":   {"type": "integer", "minimum": 1},
+		"title":    {"type": "string"},
+		"duration": {"type": "integer", "description": "In seconds", "minimum": 0, "maximum": maxTrackDuration},
+	},
+	"required":             []string{"title"},
+	"additionalProperties": false,
+}
+
+// The schema of the body of the album requests. Only the band and the title
+// are required. The id, owner, version and update time are set by the server,
+// they are accepted so that clients can send back the albums they received,
+// but they are ignored.
+var albumBodySchema = jsonSchema{
+	"type": "object",
+	"properties": map[string]jsonSchema{
+		"id":       {"type": "integer", "readOnly": true},
+		"band":     {"type": "string"},
+		"title":    {"type": "string"},
+		"year":     {"type": "integer", "description": "0 if unknown", "minimum": 0, "maximum": maxYear},
+		"label":    {"type": "string", "maxLength": maxLabelLen},
+		"released": {"type": "string", "format": "date"},
+		"genres":   {"type": "array", "maxItems": maxGenres, "items": jsonSchema{"type": "string", "maxLength": maxGenreLen}},
+		"tracks":   {"type": "array", "maxItems": maxTracks, "items": trackBodySchema},
+		"artwork": {
+			"type": "object",
+			"properties": map[string]jsonSchema{
+				"url":    {"type": "string", "format": "uri", "maxLength": maxArtworkURLLen},
+				"type":   {"type": "string", "enum": []string{"image/gif", "image/jpeg", "image/png", "image/webp"}},
+				"width":  {"type": "integer", "minimum": 0, "maximum": maxArtworkSize},
+				"height": {"type": "integer", "minimum": 0, "maximum": maxArtworkSize},
+			},
+			"required":             []string{"url"},
+			"additionalProperties": false,
+		},
+		"owner":   {"type": "integer", "readOnly": true},
+		"version": {"type": "integer", "readOnly": true},
+		"updated": {"type": "string", "format": "date-time", "readOnly": true},
+	},
+	"required":             []string{"band", "title"},
+	"additionalProperties": false,
+}
+
+// The schemas of the lists of albums and of tracks.
+var (
+	albumListBodySchema = jsonSchema{"type": "array", "maxItems": maxBulkItems, "items": albumBodySchema}
+	trackListBodySchema = jsonSchema{"type": "array", "maxItems": maxTracks, "items": trackBodySchema}
+)
+
+// The schema of the body of the user requests.
+var userBodySchema = jsonSchema{
+	"type": "object",
+	"properties": map[string]jsonSchema{
+		"email":    {"type": "string", "format": "email"},
+		"password": {"type": "string", "format": "password", "minLength": minPasswordLen},
+	},
+	"required": []string{"email"},
+}
+
+// The schema of the body of the token requests.
+var tokenBodySchema = jsonSchema{
+	"type": "object",
+	"properties": map[string]jsonSchema{
+		"email":    {"type": "string", "format": "email"},
+		"password": {"type": "string", "format": "password"},
+		"scope":    {"type": "string", "enum": []Scope{ScopeRead, ScopeReadWrite}, "default": ScopeRead},
+		"ttl": {"type": "integer", "description": "Lifetime of the token, in seconds",
+			"minimum": 1, "maximum": int(tokenTTL / time.Second), "default": int(tokenTTL / time.Second)},
+	},
+	"required": []string{"email", "password"},
+}
+
+// The schema of the body of the login form.
+var loginBodySchema = jsonSchema{
+	"type": "object",
+	"properties": map[string]jsonSchema{
+		"email":      {"type": "string", "format": "email"},
+		"password":   {"type": "string", "format": "password"},
+		"scope":      {"type": "string", "enum": []Scope{ScopeRead, ScopeReadWrite}, "default": ScopeReadWrite},
+		"ttl":        tokenBodySchema["properties"].(map[string]jsonSchema)["ttl"],
+		"csrf_token": {"type": "string", "description": "Value of the csrf_token cookie, set by the form"},
+	},
+	"required": []string{"csrf_token", "email", "password"},
+}
+
+// The routes of the API, in the order of the router.
+var apiRoutes = []*apiRoute{
+	{Method: "GET", Pattern: "/albums", Summary: "List the albums", Scope: ScopeRead,
+		Params: []string{"band", "title", "year", "year_min", "year_max", "owner", "genre", "sort", "offset", "limit", "If-None-Match"},
+		Status: http.StatusOK, Result: &Page{}, Errors: []int{ErrCodeInvalidQuery}},
+	{Method: "GET", Pattern: "/albums/_export", Summary: "Export all the albums", Scope: ScopeRead,
+		Status: http.StatusOK, Result: &Album{}, List: true},
+	{Method: "GET", Pattern: "/albums/_changes", Summary: "Follow the changes of the albums, also as a text/event-stream", Scope: ScopeRead,
+		Params: []string{"since", "wait", "Last-Event-ID"},
+		Status: http.StatusOK, Result: &ChangeList{}, Errors: []int{ErrCodeInvalidQuery, ErrCodeChangesExpired}},
+	{Method: "GET", Pattern: "/albums/_search", Summary: "Search the albums, the most relevant first", Scope: ScopeRead,
+		Params: []string{"q", "band", "title", "year", "year_min", "year_max", "owner", "genre", "sort", "offset", "limit"},
+		Status: http.StatusOK, Result: &Page{}, Errors: []int{ErrCodeInvalidQuery}},
+	{Method: "GET", Pattern: "/albums/:id", Summary: "Get an album", Scope: ScopeRead,
+		Params: []string{"If-None-Match", "If-Modified-Since"},
+		Status: http.StatusOK, Result: &Album{}, Errors: []int{ErrCodeNotExist}},
+	{Method: "POST", Pattern: "/albums", Summary: "Add an album", Scope: ScopeReadWrite,
+		Bodies: albumBodyTypes, Body: albumBodySchema,
+		Status: http.StatusCreated, Result: &Album{},
+		Errors: []int{ErrCodeInvalidAlbum, ErrCodeUnsupportedMediaType, ErrCodeAlreadyExists}},
+	{Method: "POST", Pattern: "/albums/_bulk", Summary: "Add a list of albums", Scope: ScopeReadWrite,
+		Params: []string{"atomic"}, Bodies: []string{"application/json", "application/x-ndjson", "text/csv"}, Body: albumListBodySchema,
+		Status: http.StatusOK, Result: &BulkReport{},
+		Errors: []int{ErrCodeInvalidAlbum, ErrCodeUnsupportedMediaType, ErrCodeBulkRejected}},
+	{Method: "PUT", Pattern: "/albums/:id", Summary: "Replace an album", Scope: ScopeReadWrite,
+		Params: []string{"If-Match"}, Bodies: albumBodyTypes, Body: albumBodySchema,
+		Status: http.StatusOK, Result: &Album{},
+		Errors: []int{ErrCodeNotExist, ErrCodeInvalidAlbum, ErrCodeUnsupportedMediaType, ErrCodeAlreadyExists, ErrCodePreconditionFailed}},
+	{Method: "PATCH", Pattern: "/albums/:id", Summary: "Modify an album with a merge patch or a JSON patch", Scope: ScopeReadWrite,
+		Params: []string{"If-Match"}, Bodies: []string{mergePatchType, jsonPatchType, "application/json"}, Body: jsonSchema{},
+		Status: http.StatusOK, Result: &Album{},
+		Errors: []int{ErrCodeNotExist, ErrCodeInvalidPatch, ErrCodeInvalidAlbum, ErrCodeUnsupportedMediaType, ErrCodeAlreadyExists, ErrCodePreconditionFailed}},
+	{Method: "DELETE", Pattern: "/albums/:id", Summary: "Delete an album, the HTML views are redirected to /albums.html", Scope: ScopeReadWrite,
+		Params: []string{"If-Match"},
+		Status: http.StatusNoContent, Errors: []int{ErrCodeNotExist, ErrCodePreconditionFailed}},
+	{Method: "GET", Pattern: "/albums/:id/tracks", Summary: "List the tracks of an album", Scope: ScopeRead,
+		Params: []string{"If-None-Match", "If-Modified-Since"},
+		Status: http.StatusOK, Result: &Track{}, List: true, Errors: []int{ErrCodeNotExist}},
+	{Method: "PUT", Pattern: "/albums/:id/tracks", Summary: "Replace the tracks of an album", Scope: ScopeReadWrite,
+		Params: []string{"If-Match"}, Bodies: []string{"application/json", "application/xml"}, Body: trackListBodySchema,
+		Status: http.StatusOK, Result: &Track{}, List: true,
+		Errors: []int{ErrCodeNotExist, ErrCodeInvalidAlbum, ErrCodeUnsupportedMediaType, ErrCodePreconditionFailed}},
+	{Method: "GET", Pattern: "/albums/:id/tracks/:number", Summary: "Get a track of an album", Scope: ScopeRead,
+		Status: http.StatusOK, Result: &Track{}, Errors: []int{ErrCodeNotExist}},
+
+	{Method: "POST", Pattern: "/users", Summary: "Register a user",
+		Params: []string{adminTokenHeader},
+		Bodies: []string{"application/json", "application/xml", "application/x-www-form-urlencoded"}, Body: userBodySchema,
+		Status: http.StatusCreated, Result: &User{},
+		Errors: []int{ErrCodeInvalidUser, ErrCodeUnsupportedMediaType, ErrCodeAlreadyExists}},
+	{Method: "GET", Pattern: "/users/:id", Summary: "Get the authenticated user", Scope: ScopeRead,
+		Status: http.StatusOK, Result: &User{}, Errors: []int{ErrCodeNotExist}},
+	{Method: "PUT", Pattern: "/users/:id", Summary: "Change the email or the password of the authenticated user, a new password revokes its tokens", Scope: ScopeReadWrite,
+		Bodies: []string{"application/json", "application/xml", "application/x-www-form-urlencoded"}, Body: userBodySchema,
+		Status: http.StatusOK, Result: &User{},
+		Errors: []int{ErrCodeNotExist, ErrCodeInvalidUser, ErrCodeUnsupportedMediaType, ErrCodeAlreadyExists}},
+	{Method: "DELETE", Pattern: "/users/:id", Summary: "Delete the authenticated user and revoke its tokens", Scope: ScopeReadWrite,
+		Status: http.StatusNoContent, Errors: []int{ErrCodeNotExist}},
+	{Method: "POST", Pattern: "/tokens", Summary: "Issue a token to the user with the email and the password",
+		Bodies: []string{"application/json", "application/xml", "application/x-www-form-urlencoded"}, Body: tokenBodySchema,
+		Status: http.StatusCreated, Result: &Token{},
+		Errors: []int{ErrCodeInvalidTokenRequest, ErrCodeUnsupportedMediaType, ErrCodeUnauthorized}},
+	{Method: "DELETE", Pattern: "/tokens/:token", Summary: "Revoke a token of the authenticated user", Scope: ScopeRead,
+		Status: http.StatusNoContent, Errors: []int{ErrCodeNotExist}},
+	{Method: "GET", Pattern: loginPath, Summary: "Get the login form of the HTML views, as /login.html",
+		Status: http.StatusOK},
+	{Method: "POST", Pattern: loginPath, Summary: "Sign a browser in: set a token in the token cookie and redirect to the albums",
+		Bodies: []string{"application/x-www-form-urlencoded", "multipart/form-data"}, Body: loginBodySchema,
+		Status: http.StatusSeeOther, Errors: []int{ErrCodeInvalidTokenRequest, ErrCodeUnsupportedMediaType, ErrCodeUnauthorized, ErrCodeForbidden}},
+	{Method: "POST", Pattern: "/logout", Summary: "Sign a browser out: revoke its token and clear the token cookie", Scope: ScopeRead,
+		Status: http.StatusSeeOther},
+
+	{Method: "GET", Pattern: "/errors", Summary: "List the error codes",
+		Status: http.StatusOK, Result: &ErrorKind{}, List: true},
+	{Method: "GET", Pattern: "/openapi", Summary: "Get this document, as /openapi.json or /openapi.yaml",
+		Status: http.StatusOK, Result: jsonSchema{"type": "object"}},
+}
+
+// The query string arguments and headers of the routes, by name.
+var apiParams = map[string]*openAPIParameter{
+	"band":     {In: "query", Description: "Case-insensitive partial match of the band", Schema: jsonSchema{"type": "string"}},
+	"title":    {In: "query", Description: "Case-insensitive partial match of the title", Schema: jsonSchema{"type": "string"}},
+	"year":     {In: "query", Description: "Year of the albums", Schema: jsonSchema{"type": "integer"}},
+	"year_min": {In: "query", Description: "Lowest year of the albums", Schema: jsonSchema{"type": "integer", "minimum": 0}},
+	"year_max": {In: "query", Description: "Highest year of the albums", Schema: jsonSchema{"type": "integer", "minimum": 0}},
+	"owner":    {In: "query", Description: "Id of the owner of the albums, or me", Schema: jsonSchema{"type": "string"}},
+	"genre":    {In: "query", Description: "Case-insensitive genre of the albums", Schema: jsonSchema{"type": "string"}},
+	"sort": {In: "query", Description: "Comma-separated fields to sort on, prefixed with - for a descending order",
+		Schema: jsonSchema{"type": "string", "example": "band,-year"}},
+	"offset": {In: "query", Description: "Number of albums to skip", Schema: jsonSchema{"type": "integer", "minimum": 0}},
+	"limit": {In: "query", Description: "Number of albums of the page",
+		Schema: jsonSchema{"type": "integer", "minimum": 1, "maximum": maxLimit, "default": defaultLimit}},
+	"q":      {In: "query", Description: "Words of the album band or title", Required: true, Schema: jsonSchema{"type": "string"}},
+	"since":  {In: "query", Description: "Id of the last change received, <epoch>-<seq>", Schema: jsonSchema{"type": "string"}},
+	"wait":   {In: "query", Description: "Seconds to wait for a change", Schema: jsonSchema{"type": "integer", "minimum": 0, "maximum": maxChangesWait}},
+	"atomic": {In: "query", Description: "Whether the import is rejected as a whole if an album is invalid", Schema: jsonSchema{"type": "boolean"}},
+
+	"If-None-Match":     {In: "header", Description: "ETag of the cached representation", Schema: jsonSchema{"type": "string"}},
+	"If-Modified-Since": {In: "header", Description: "Date of the cached representation", Schema: jsonSchema{"type": "string"}},
+	adminTokenHeader:    {In: "header", Description: "One-time token, logged at startup with -admin-bootstrap, that makes the user an admin", Schema: jsonSchema{"type": "string"}},
+	"If-Match":          {In: "header", Description: "ETag of the version of the album to modify", Schema: jsonSchema{"type": "string"}},
+	"Last-Event-ID":     {In: "header", Description: "Id of the last event received, <epoch>-<seq>", Schema: jsonSchema{"type": "string"}},
+}
+
+// A jsonSchema is a schema object of the OpenAPI document.
+type jsonSchema map[string]interface{}
+
+// The OpenAPI 3 document, and the objects it is made of. Only the fields used
+// by this API are defined.
+type openAPIDoc struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       *openAPIInfo                            `json:"info"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components *openAPIComponents                      `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description"`
+}
+
+type openAPIComponents struct {
+	Schemas         map[string]jsonSchema `json:"schemas"`
+	SecuritySchemes map[string]jsonSchema `json:"securitySchemes"`
+}
+
+type openAPIOperation struct {
+	Summary     string                      `json:"summary"`
+	Description string                      `json:"description,omitempty"`
+	OperationId string                      `json:"operationId"`
+	Parameters  []*openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIBody                `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+	Security    []map[string][]string       `json:"security,omitempty"`
+}
+
+type openAPIParameter struct {
+	Name        string     `json:"name"`
+	In          string     `json:"in"`
+	Description string     `json:"description,omitempty"`
+	Required    bool       `json:"required,omitempty"`
+	Schema      jsonSchema `json:"schema"`
+}
+
+type openAPIBody struct {
+	Required bool                     `json:"required"`
+	Content  map[string]*openAPIMedia `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                   `json:"description"`
+	Content     map[string]*openAPIMedia `json:"content,omitempty"`
+}
+
+type openAPIMedia struct {
+	Schema jsonSchema `json:"schema"`
+}
+
+// GetOpenAPI returns the OpenAPI document of the API, in JSON, or in YAML if
+// it is the requested format.
+func GetOpenAPI(w http.ResponseWriter, f *Format) (int, string) {
+	var enc Encoder = jsonEncoder{}
+	if f.Ext == ".yaml" {
+		enc = f.Encoder
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	return http.StatusOK, Must(enc.Encode(openAPI(apiRoutes, Formats())))
+}
+
+// Builds the OpenAPI document of the routes, which respond in the formats.
+func openAPI(routes []*apiRoute, formats []*Format) *openAPIDoc {
+	sb := &schemaBuilder{schemas: make(map[string]jsonSchema)}
+	doc := &openAPIDoc{
+		OpenAPI: "3.0.3",
+		Info: &openAPIInfo{
+			Title:   "jindou albums",
+			Version: apiVersion,
+			Description: "The response format is negotiated with the Accept header, or given by an extension " +
+				"of the path (e.g. /albums.xml). The schemas describe the JSON encoding.",
+		},
+		Paths: make(map[string]map[string]*openAPIOperation),
+		Components: &openAPIComponents{
+			Schemas:         sb.schemas,
+			SecuritySchemes: map[string]jsonSchema{"bearer": {"type": "http", "scheme": "bearer"}},
+		},
+	}
+	errSchema := sb.schema(reflect.TypeOf(Error{}))
+	for _, rt := range routes {
+		path, params := openAPIPath(rt.Pattern)
+		op := &openAPIOperation{
+			Summary:     rt.Summary,
+			OperationId: operationId(rt.Method, rt.Pattern),
+			Parameters:  params,
+			Responses:   make(map[string]*openAPIResponse),
+		}
+		for _, name := range rt.Params {
+			p := *apiParams[name]
+			p.Name = name
+			op.Parameters = append(op.Parameters, &p)
+		}
+		if rt.Scope != "" {
+			op.Description = fmt.Sprintf("Requires a bearer token with the %s scope.", rt.Scope)
+			op.Security = []map[string][]string{{"bearer": {}}}
+		}
+		if rt.Body != nil {
+			op.RequestBody = &openAPIBody{Required: true, Content: make(map[string]*openAPIMedia)}
+			s := sb.valueSchema(rt.Body, false)
+			for _, mt := range rt.Bodies {
+				op.RequestBody.Content[mt] = &openAPIMedia{s}
+			}
+		}
+		res := &openAPIResponse{Description: http.StatusText(rt.Status)}
+		if rt.Result != nil {
+			s := sb.valueSchema(rt.Result, rt.List)
+			res.Content = make(map[string]*openAPIMedia)
+			for _, f := range formats {
+				res.Content[f.MediaType] = &openAPIMedia{s}
+			}
+			if rt.Pattern == "/albums/_changes" {
+				res.Content[eventStreamType] = &openAPIMedia{jsonSchema{"type": "string"}}
+			}
+		}
+		op.Responses[fmt.Sprint(rt.Status)] = res
+		for _, p := range op.Parameters {
+			if p.Name == "If-None-Match" {
+				op.Responses["304"] = &openAPIResponse{Description: http.StatusText(http.StatusNotModified)}
+			}
+		}
+		for _, code := range rt.errors() {
+			k := errorKinds[code]
+			status := fmt.Sprint(k.Status)
+			if r, ok := op.Responses[status]; ok {
+				r.Description += "; " + k.Title
+				continue
+			}
+			r := &openAPIResponse{Description: k.Title, Content: make(map[string]*openAPIMedia)}
+			for _, f := range formats {
+				mt := f.MediaType
+				if pt, ok := problemTypes[mt]; ok {
+					mt = pt
+				}
+				r.Content[mt] = &openAPIMedia{errSchema}
+			}
+			op.Responses[status] = r
+		}
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = make(map[string]*openAPIOperation)
+		}
+		doc.Paths[path][strings.ToLower(rt.Method)] = op
+	}
+	return doc
+}
+
+// Returns the codes of the errors of the route, along with those that any
+// request can get.
+func (rt *apiRoute) errors() []int {
+	codes := append([]int(nil), rt.Errors...)
+	if rt.Scope != "" {
+		codes = append(codes, ErrCodeUnauthorized, ErrCodeForbidden)
+	}
+	return append(codes, ErrCodeNotAcceptable, ErrCodeRateLimited, ErrCodeInternal)
+}
+
+// Converts the pattern of a route to an OpenAPI path, and returns the
+// parameters of the path. The ids and numbers are integers.
+func openAPIPath(pattern string) (string, []*openAPIParameter) {
+	var params []*openAPIParameter
+	segs := strings.Split(pattern, "/")
+	for i, s := range segs {
+		if !strings.HasPrefix(s, ":") {
+			continue
+		}
+		p := &openAPIParameter{Name: s[1:], In: "path", Required: true, Schema: jsonSchema{"type": "string"}}
+		if p.Name == "id" || p.Name == "number" {
+			p.Schema = jsonSchema{"type": "integer"}
+		}
+		params = append(params, p)
+		segs[i] = "{" + p.Name + "}"
+	}
+	return strings.Join(segs, "/"), params
+}
+
+// Returns the operation id of a route, e.g. get-albums-id-tracks.
+func operationId(method, pattern string) string {
+	id := strings.ToLower(method)
+	for _, s := range strings.Split(pattern, "/") {
+		if s = strings.Trim(s, ":_"); s != "" {
+			id += "-" + s
+		}
+	}
+	return id
+}
+
+// Builds the schemas of the Go types from their JSON encoding. Structs are
+// defined once in schemas, by name, and referenced.
+type schemaBuilder struct {
+	schemas map[string]jsonSchema
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Returns the schema of the value, of a list of values if list is true. A
+// jsonSchema value is its own schema.
+func (sb *schemaBuilder) valueSchema(v interface{}, list bool) jsonSchema {
+	s, ok := v.(jsonSchema)
+	if !ok {
+		s = sb.schema(reflect.TypeOf(v))
+	}
+	if list {
+		return jsonSchema{"type": "array", "items": s}
+	}
+	return s
+}
+
+func (sb *schemaBuilder) schema(t reflect.Type) jsonSchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return jsonSchema{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return jsonSchema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonSchema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return jsonSchema{"type": "number"}
+	case reflect.String:
+		return jsonSchema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return jsonSchema{"type": "array", "items": sb.schema(t.Elem())}
+	case reflect.Map:
+		return jsonSchema{"type": "object", "additionalProperties": sb.schema(t.Elem())}
+	case reflect.Struct:
+		if _, ok := sb.schemas[t.Name()]; !ok {
+			// Defined before its fields, for the recursive types
+			sb.schemas[t.Name()] = jsonSchema{}
+			sb.schemas[t.Name()] = sb.object(t)
+		}
+		return jsonSchema{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return jsonSchema{}
+}
+
+// Returns the schema of the JSON object of the struct type. The fields that are
+// not omitted when empty are required.
+func (sb *schemaBuilder) object(t reflect.Type) jsonSchema {
+	props := make(map[string]jsonSchema)
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if f.PkgPath != "" || tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if i := strings.IndexByte(tag, ','); i >= 0 {
+			name, opts = tag[:i], tag[i:]
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = sb.schema(f.Type)
+		if !strings.Contains(opts, ",omitempty") {
+			required = append(required, name)
+		}
+	}
+	s := jsonSchema{"type": "object", "properties": props}
+	if len(required) > 0 {
+		sort.Strings(required)
+		s["required"] = required
+	}
+	return s
+}
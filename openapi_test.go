@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/codegangsta/martini"
+	"launchpad.net/gocheck"
+)
+
+// A martini.Router that records the routes added to it.
+type routeRecorder struct {
+	martini.Router
+	routes []string
+}
+
+func (rr *routeRecorder) add(method, pattern string) martini.Route {
+	rr.routes = append(rr.routes, method+" "+pattern)
+	return nil
+}
+
+func (rr *routeRecorder) Get(p string, h ...martini.Handler) martini.Route {
+	return rr.add("GET", p)
+}
+
+func (rr *routeRecorder) Post(p string, h ...martini.Handler) martini.Route {
+	return rr.add("POST", p)
+}
+
+func (rr *routeRecorder) Put(p string, h ...martini.Handler) martini.Route {
+	return rr.add("PUT", p)
+}
+
+func (rr *routeRecorder) Patch(p string, h ...martini.Handler) martini.Route {
+	return rr.add("PATCH", p)
+}
+
+func (rr *routeRecorder) Delete(p string, h ...martini.Handler) martini.Route {
+	return rr.add("DELETE", p)
+}
+
+func (s *S) TestAPIRoutesMatchRouter(c *gocheck.C) {
+	rr := &routeRecorder{}
+	addRoutes(rr)
+	var described []string
+	for _, rt := range apiRoutes {
+		described = append(described, rt.Method+" "+rt.Pattern)
+	}
+	// Same routes, in the same order
+	c.Assert(described, gocheck.DeepEquals, rr.routes)
+}
+
+func (s *S) TestAPIRoutesAreValid(c *gocheck.C) {
+	for _, rt := range apiRoutes {
+		cm := gocheck.Commentf("%s %s", rt.Method, rt.Pattern)
+		c.Check(rt.Summary, gocheck.Not(gocheck.Equals), "", cm)
+		c.Check(http.StatusText(rt.Status), gocheck.Not(gocheck.Equals), "", cm)
+		c.Check(rt.Body == nil, gocheck.Equals, len(rt.Bodies) == 0, cm)
+		for _, p := range rt.Params {
+			c.Check(apiParams[p], gocheck.NotNil, gocheck.Commentf("%s %s: %s", rt.Method, rt.Pattern, p))
+		}
+		for _, code := range rt.Errors {
+			c.Check(errorKinds[code], gocheck.NotNil, gocheck.Commentf("%s %s: %d", rt.Method, rt.Pattern, code))
+		}
+	}
+}
+
+func (s *S) TestOpenAPIPath(c *gocheck.C) {
+	path, params := openAPIPath("/albums/:id/tracks/:number")
+	c.Assert(path, gocheck.Equals, "/albums/{id}/tracks/{number}")
+	c.Assert(params, gocheck.HasLen, 2)
+	c.Assert(params[1], gocheck.DeepEquals, &openAPIParameter{Name: "number", In: "path", Required: true, Schema: jsonSchema{"type": "integer"}})
+	c.Assert(operationId("GET", "/albums/:id/tracks/:number"), gocheck.Equals, "get-albums-id-tracks-number")
+	c.Assert(operationId("POST", "/albums/_bulk"), gocheck.Equals, "post-albums-bulk")
+}
+
+func (s *S) TestGetOpenAPI(c *gocheck.C) {
+	w := httptest.NewRecorder()
+	status, body := GetOpenAPI(w, FormatByExt(".xml"))
+	c.Assert(status, gocheck.Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Content-Type"), gocheck.Equals, "application/json")
+
+	var doc struct {
+		OpenAPI string
+		Paths   map[string]map[string]struct {
+			OperationId string
+			Parameters  []struct{ Name, In string }
+			RequestBody *struct{ Content map[string]interface{} }
+			Responses   map[string]struct {
+				Content map[string]struct {
+					Schema map[string]interface{}
+				}
+			}
+		}
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]map[string]interface{}
+				Required   []string
+			}
+		}
+	}
+	c.Assert(json.Unmarshal([]byte(body), &doc), gocheck.IsNil)
+	c.Assert(doc.OpenAPI, gocheck.Equals, "3.0.3")
+	c.Assert(doc.Paths, gocheck.HasLen, 16)
+	c.Assert(doc.Paths["/tokens"]["post"].Responses["201"].Content["application/json"].Schema["$ref"], gocheck.Equals, "#/components/schemas/Token")
+	c.Assert(doc.Paths["/tokens"]["post"].Responses["401"].Content, gocheck.NotNil)
+
+	op := doc.Paths["/albums/{id}"]["put"]
+	c.Assert(op.OperationId, gocheck.Equals, "put-albums-id")
+	c.Assert(op.Parameters, gocheck.HasLen, 2)
+	c.Assert(op.Parameters[0].Name, gocheck.Equals, "id")
+	c.Assert(op.Parameters[1].In, gocheck.Equals, "header")
+	c.Assert(op.RequestBody.Content["application/xml"], gocheck.NotNil)
+	// The album bodies only require the fields set by the client
+	for path, method := range map[string]string{"/albums": "post", "/albums/{id}": "put"} {
+		schema := doc.Paths[path][method].RequestBody.Content["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+		c.Assert(schema["required"], gocheck.DeepEquals, []interface{}{"band", "title"})
+		props := schema["properties"].(map[string]interface{})
+		for _, f := range []string{"id", "owner", "version", "updated"} {
+			c.Check(props[f].(map[string]interface{})["readOnly"], gocheck.Equals, true, gocheck.Commentf("%s", f))
+		}
+	}
+	bulk := doc.Paths["/albums/_bulk"]["post"].RequestBody.Content["text/csv"].(map[string]interface{})["schema"].(map[string]interface{})
+	c.Assert(bulk["items"].(map[string]interface{})["required"], gocheck.DeepEquals, []interface{}{"band", "title"})
+	c.Assert(op.Responses["200"].Content["text/csv"].Schema["$ref"], gocheck.Equals, "#/components/schemas/Album")
+	c.Assert(op.Responses["412"].Content["application/problem+json"].Schema["$ref"], gocheck.Equals, "#/components/schemas/Error")
+	c.Assert(op.Responses["401"].Content, gocheck.NotNil)
+	c.Assert(doc.Paths["/albums/{id}/tracks"]["get"].Responses["200"].Content["application/json"].Schema["type"], gocheck.Equals, "array")
+	c.Assert(doc.Paths["/albums/{id}"]["delete"].Responses["204"].Content, gocheck.HasLen, 0)
+
+	album := doc.Components.Schemas["Album"]
+	c.Assert(album.Required, gocheck.DeepEquals, []string{"band", "id", "owner", "title", "updated", "version", "year"})
+	c.Assert(album.Properties["tracks"]["items"], gocheck.DeepEquals, map[string]interface{}{"$ref": "#/components/schemas/Track"})
+	c.Assert(album.Properties["updated"]["format"], gocheck.Equals, "date-time")
+	c.Assert(doc.Components.Schemas["Track"].Properties, gocheck.HasLen, 3)
+
+	w = httptest.NewRecorder()
+	_, body = GetOpenAPI(w, FormatByExt(".yaml"))
+	c.Assert(strings.HasPrefix(body, "---\n"), gocheck.Equals, true)
+	c.Assert(w.Header().Get("Content-Type"), gocheck.Equals, "")
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Media types of the supported patch documents. A plain application/json body
+// is treated as a merge patch.
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+// A patch modifies the generic JSON document of an album (as produced by
+// json.Unmarshal into an interface{}), and returns the modified document.
+type patch interface {
+	apply(doc interface{}) (interface{}, error)
+}
+
+// parsePatch decodes a patch document of the specified media type. It returns
+// an *Error if the media type is not supported or the document is malformed.
+func parsePatch(mediaType string, body []byte) (patch, error) {
+	switch mediaType {
+	case mergePatchType, "application/json":
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err != nil {
+			return nil, NewError(ErrCodeInvalidPatch, fmt.Sprintf("malformed merge patch: %s", err))
+		}
+		return mergePatch{v}, nil
+	case jsonPatchType:
+		var p jsonPatch
+		if err := json.Unmarshal(body, &p); err != nil {
+			return nil, NewError(ErrCodeInvalidPatch, fmt.Sprintf("malformed JSON patch: %s", err))
+		}
+		for i, op := range p {
+			if err := op.validate(); err != nil {
+				return nil, NewError(ErrCodeInvalidPatch, fmt.Sprintf("malformed JSON patch: operation %d: %s", i, err))
+			}
+		}
+		return p, nil
+	}
+	return nil, NewError(ErrCodeUnsupportedMediaType,
+		fmt.Sprintf("unsupported content type '%s', use %s or %s", mediaType, mergePatchType, jsonPatchType))
+}
+
+// applyPatch returns the album resulting from the application of the patch to a.
+// The patched album goes through the same validation as the body of a PUT, its
+// id cannot be changed, and it keeps the owner of a. It returns an *Error if the
+// patch cannot be applied or if the resulting album is invalid.
+func applyPatch(a *Album, p patch) (*Album, error) {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	if doc, err = p.apply(doc); err != nil {
+		return nil, NewError(ErrCodeInvalidPatch, err.Error())
+	}
+	if b, err = json.Marshal(doc); err != nil {
+		return nil, err
+	}
+	body, e := decodeJSONAlbum(bytes.NewReader(b))
+	if e != nil {
+		return nil, e
+	}
+	al, err := body.album()
+	if err != nil {
+		return nil, err
+	}
+	if al.Id != a.Id {
+		return nil, invalidAlbum(&FieldError{Field: "id", Message: "cannot be changed"})
+	}
+	al.Owner = a.Owner
+	return al, nil
+}
+
+// A JSON Merge Patch, as defined by RFC 7396.
+type mergePatch struct {
+	v interface{}
+}
+
+func (p mergePatch) apply(doc interface{}) (interface{}, error) {
+	return merge(doc, p.v), nil
+}
+
+func merge(doc, patch interface{}) interface{} {
+	pm, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	dm, ok := doc.(map[string]interface{})
+	if !ok {
+		dm = make(map[string]interface{})
+	}
+	for k, v := range pm {
+		if v == nil {
+			delete(dm, k)
+		} else {
+			dm[k] = merge(dm[k], v)
+		}
+	}
+	return dm
+}
+
+// A JSON Patch, as defined by RFC 6902. The operations are applied in order,
+// and the whole patch fails if any of them fails.
+type jsonPatch []*patchOp
+
+type patchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Checks that the operation has the members required by its kind.
+func (op *patchOp) validate() error {
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return fmt.Errorf("missing value for %s", op.Op)
+		}
+	case "move", "copy":
+		if op.From == nil {
+			return fmt.Errorf("missing from for %s", op.Op)
+		}
+		if _, err := parsePointer(*op.From); err != nil {
+			return err
+		}
+	case "remove":
+	default:
+		return fmt.Errorf("unknown operation '%s'", op.Op)
+	}
+	_, err := parsePointer(op.Path)
+	return err
+}
+
+func (p jsonPatch) apply(doc interface{}) (interface{}, error) {
+	for i, op := range p {
+		var err error
+		if doc, err = op.apply(doc); err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s) failed: %s", i, op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+func (op *patchOp) apply(doc interface{}) (interface{}, error) {
+	path, _ := parsePointer(op.Path)
+	var value interface{}
+	if op.Value != nil {
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			return nil, err
+		}
+	}
+	switch op.Op {
+	case "add":
+		return addValue(doc, path, value)
+	case "remove":
+		return removeValue(doc, path)
+	case "replace":
+		doc, err := removeValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "move":
+		from, _ := parsePointer(*op.From)
+		if len(path) > len(from) && reflect.DeepEqual(path[:len(from)], from) {
+			return nil, fmt.Errorf("cannot move %s into one of its children", *op.From)
+		}
+		v, err := getValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if doc, err = removeValue(doc, from); err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, v)
+	case "copy":
+		from, _ := parsePointer(*op.From)
+		v, err := getValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		// Deep copy, so that later operations on one do not affect the other
+		b, _ := json.Marshal(v)
+		json.Unmarshal(b, &v)
+		return addValue(doc, path, v)
+	case "test":
+		v, err := getValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(v, value) {
+			return nil, fmt.Errorf("the value is %s", op.Value)
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown operation '%s'", op.Op)
+}
+
+// Parses a JSON Pointer (RFC 6901) into its unescaped reference tokens.
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("invalid pointer '%s'", p)
+	}
+	toks := strings.Split(p[1:], "/")
+	for i, t := range toks {
+		toks[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return toks, nil
+}
+
+// Returns the index of an array element. If end is true, "-" designates the
+// element after the last one, and the length is a valid index.
+func arrayIndex(tok string, l int, end bool) (int, error) {
+	if end && tok == "-" {
+		return l, nil
+	}
+	i, err := strconv.Atoi(tok)
+	if err != nil || i < 0 || (tok != "0" && strings.HasPrefix(tok, "0")) {
+		return 0, fmt.Errorf("invalid array index '%s'", tok)
+	}
+	if i > l || (i == l && !end) {
+		return 0, fmt.Errorf("array index %d out of bounds", i)
+	}
+	return i, nil
+}
+
+func getValue(doc interface{}, path []string) (interface{}, error) {
+	for _, tok := range path {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			v, ok := d[tok]
+			if !ok {
+				return nil, fmt.Errorf("member '%s' does not exist", tok)
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(tok, len(d), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = d[i]
+		default:
+			return nil, fmt.Errorf("cannot get '%s' of a scalar value", tok)
+		}
+	}
+	return doc, nil
+}
+
+// Calls fn with the container of the last token of the path, and returns the
+// document with the container replaced by the one returned by fn.
+func updateParent(doc interface{}, path []string, fn func(parent interface{}, tok string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+	child, err := getValue(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	if child, err = updateParent(child, path[1:], fn); err != nil {
+		return nil, err
+	}
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		d[path[0]] = child
+	case []interface{}:
+		i, _ := arrayIndex(path[0], len(d), false)
+		d[i] = child
+	}
+	return doc, nil
+}
+
+func addValue(doc interface{}, path []string, v interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return v, nil
+	}
+	return updateParent(doc, path, func(parent interface{}, tok string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			p[tok] = v
+			return p, nil
+		case []interface{}:
+			i, err := arrayIndex(tok, len(p), true)
+			if err != nil {
+				return nil, err
+			}
+			p = append(p, nil)
+			copy(p[i+1:], p[i:])
+			p[i] = v
+			return p, nil
+		}
+		return nil, fmt.Errorf("cannot add '%s' to a scalar value", tok)
+	})
+}
+
+func removeValue(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("cannot remove the whole document")
+	}
+	return updateParent(doc, path, func(parent interface{}, tok string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := p[tok]; !ok {
+				return nil, fmt.Errorf("member '%s' does not exist", tok)
+			}
+			delete(p, tok)
+			return p, nil
+		case []interface{}:
+			i, err := arrayIndex(tok, len(p), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(p[:i], p[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("cannot remove '%s' of a scalar value", tok)
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+
+	"launchpad.net/gocheck"
+)
+
+var patchAlbum = &Album{Id: 2, Band: "Slayer", Title: "Seasons In The Abyss", Year: 1990}
+
+func (s *S) TestMergePatch(c *gocheck.C) {
+	p, err := parsePatch(mergePatchType, []byte(`{"title":"South Of Heaven","year":null}`))
+	c.Assert(err, gocheck.IsNil)
+	al, err := applyPatch(patchAlbum, p)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(al, gocheck.DeepEquals, &Album{Id: 2, Band: "Slayer", Title: "South Of Heaven"})
+	c.Assert(patchAlbum.Title, gocheck.Equals, "Seasons In The Abyss")
+}
+
+func (s *S) TestMergePatchRFCExample(c *gocheck.C) {
+	var doc, patch, expected interface{}
+	json.Unmarshal([]byte(`{"title":"Goodbye!","author":{"givenName":"John","familyName":"Doe"},"tags":["example","sample"],"content":"This will be unchanged"}`), &doc)
+	json.Unmarshal([]byte(`{"title":"Hello!","phoneNumber":"+01-123-456-7890","author":{"familyName":null},"tags":["example"]}`), &patch)
+	json.Unmarshal([]byte(`{"title":"Hello!","author":{"givenName":"John"},"tags":["example"],"content":"This will be unchanged","phoneNumber":"+01-123-456-7890"}`), &expected)
+	res, err := mergePatch{patch}.apply(doc)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(res, gocheck.DeepEquals, expected)
+}
+
+func (s *S) TestJSONPatch(c *gocheck.C) {
+	p, err := parsePatch(jsonPatchType, []byte(`[
+		{"op":"test","path":"/year","value":1990},
+		{"op":"replace","path":"/year","value":1991},
+		{"op":"copy","from":"/band","path":"/title"}
+	]`))
+	c.Assert(err, gocheck.IsNil)
+	al, err := applyPatch(patchAlbum, p)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(al, gocheck.DeepEquals, &Album{Id: 2, Band: "Slayer", Title: "Slayer", Year: 1991})
+}
+
+func (s *S) TestJSONPatchOperations(c *gocheck.C) {
+	cases := []struct {
+		doc, patch, expected string
+	}{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"foo":"bar","baz":"qux"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":"qux"}]`, `{"foo":["bar","qux"]}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{`{"a/b":1,"m~n":2}`, `[{"op":"remove","path":"/a~1b"},{"op":"replace","path":"/m~0n","value":3}]`, `{"m~n":3}`},
+	}
+	for _, cs := range cases {
+		var doc, expected interface{}
+		json.Unmarshal([]byte(cs.doc), &doc)
+		json.Unmarshal([]byte(cs.expected), &expected)
+		p, err := parsePatch(jsonPatchType, []byte(cs.patch))
+		c.Assert(err, gocheck.IsNil)
+		res, err := p.(jsonPatch).apply(doc)
+		c.Assert(err, gocheck.IsNil, gocheck.Commentf("%s", cs.patch))
+		c.Check(res, gocheck.DeepEquals, expected, gocheck.Commentf("%s", cs.patch))
+	}
+}
+
+func (s *S) TestJSONPatchFailures(c *gocheck.C) {
+	patches := []string{
+		`[{"op":"test","path":"/year","value":1991}]`,
+		`[{"op":"remove","path":"/label"}]`,
+		`[{"op":"replace","path":"/label","value":"x"}]`,
+		`[{"op":"add","path":"/band/0","value":"x"}]`,
+		`[{"op":"move","from":"/band","path":"/band/x"}]`,
+		`[{"op":"remove","path":""}]`,
+	}
+	for _, patch := range patches {
+		p, err := parsePatch(jsonPatchType, []byte(patch))
+		c.Assert(err, gocheck.IsNil, gocheck.Commentf("%s", patch))
+		_, err = applyPatch(patchAlbum, p)
+		c.Assert(err, gocheck.FitsTypeOf, &Error{}, gocheck.Commentf("%s", patch))
+		c.Check(err.(*Error).Code, gocheck.Equals, ErrCodeInvalidPatch, gocheck.Commentf("%s", patch))
+	}
+}
+
+func (s *S) TestPatchResultIsValidated(c *gocheck.C) {
+	patches := map[string]string{
+		`[{"op":"remove","path":"/band"}]`:                 "band",
+		`[{"op":"replace","path":"/year","value":"1990"}]`: "year",
+		`[{"op":"replace","path":"/id","value":3}]`:        "id",
+	}
+	for patch, field := range patches {
+		p, err := parsePatch(jsonPatchType, []byte(patch))
+		c.Assert(err, gocheck.IsNil)
+		_, err = applyPatch(patchAlbum, p)
+		assertFieldErrors(c, err, field)
+	}
+	p, err := parsePatch(mergePatchType, []byte(`{"producer":"Rick Rubin"}`))
+	c.Assert(err, gocheck.IsNil)
+	_, err = applyPatch(patchAlbum, p)
+	assertFieldErrors(c, err, "producer")
+}
+
+func (s *S) TestParsePatchInvalid(c *gocheck.C) {
+	bodies := map[string]string{
+		`[{"op":"jump","path":"/year"}]`:  jsonPatchType,
+		`[{"op":"add","path":"/year"}]`:   jsonPatchType,
+		`[{"op":"copy","path":"/year"}]`:  jsonPatchType,
+		`[{"op":"remove","path":"year"}]`: jsonPatchType,
+		`{"op":"remove","path":"/year"}`:  jsonPatchType,
+		`{"year":`:                        mergePatchType,
+	}
+	for body, mt := range bodies {
+		_, err := parsePatch(mt, []byte(body))
+		c.Assert(err, gocheck.FitsTypeOf, &Error{}, gocheck.Commentf("%s", body))
+		c.Check(err.(*Error).Code, gocheck.Equals, ErrCodeInvalidPatch, gocheck.Commentf("%s", body))
+	}
+	_, err := parsePatch("text/plain", []byte(`{}`))
+	c.Assert(err.(*Error).Code, gocheck.Equals, ErrCodeUnsupportedMediaType)
+}
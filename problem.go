@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/codegangsta/martini"
+)
+
+// The longest request id accepted from the X-Request-Id header of a request.
+const maxRequestIdLen = 64
+
+// The media types of the problem details documents (RFC 7807), by media type
+// of the format in which they are encoded. XML errors are not sent as
+// application/problem+xml, they are wrapped in the root element of the XML
+// encoder like any other value.
+var problemTypes = map[string]string{
+	"application/json": "application/problem+json",
+}
+
+// A RequestId identifies a request in the logs and in the errors sent back to
+// the client.
+type RequestId string
+
+// MapRequestId injects the RequestId of the request, and sends it back in the
+// X-Request-Id header. The id sent by the client (or a proxy) in the same header
+// is reused if it is reasonable, otherwise a new one is generated.
+func MapRequestId(c martini.Context, w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get("X-Request-Id")
+	if !validRequestId(id) {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		id = hex.EncodeToString(b)
+	}
+	w.Header().Set("X-Request-Id", id)
+	c.Map(RequestId(id))
+}
+
+func validRequestId(id string) bool {
+	if id == "" || len(id) > maxRequestIdLen {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// A Fail answers a request with an error. It is injected by MapEncoder, and
+// handlers return its result, e.g.:
+//
+//	return fail(NewError(ErrCodeNotExist, "the album does not exist"))
+//
+// The *Error is stamped with the request id and URL path, and encoded in the
+// negotiated format, as a problem details document if the format is JSON. Any
+// other error is a server-side error, it causes a panic.
+type Fail func(err error) (int, string)
+
+func newFail(w http.ResponseWriter, r *http.Request, f *Format, id RequestId) Fail {
+	return func(err error) (int, string) {
+		e, ok := err.(*Error)
+		if !ok {
+			panic(err)
+		}
+		e.Instance, e.RequestId = r.URL.Path, string(id)
+		if ct, ok := problemTypes[f.MediaType]; ok {
+			w.Header().Set("Content-Type", ct)
+		}
+		return e.Status, Must(f.Encoder.Encode(e))
+	}
+}
+
+// Answers the request with the error, from a middleware handler.
+func writeError(w http.ResponseWriter, fail Fail, err error) {
+	status, body := fail(err)
+	w.WriteHeader(status)
+	w.Write([]byte(body))
+}
+
+// Recover renders the panics of the following handlers as internal errors, in
+// the negotiated format. The panic itself, with its stack trace, is only logged.
+// It must be used after MapEncoder, martini's Recovery handles the panics of the
+// handlers that come before.
+func Recover(c martini.Context, w http.ResponseWriter, fail Fail, l *log.Logger, id RequestId) {
+	defer func() {
+		if err := recover(); err != nil {
+			l.Printf("PANIC [%s]: %s\n%s", id, err, debug.Stack())
+			if rw, ok := w.(martini.ResponseWriter); ok && rw.Written() {
+				// Too late to send an error
+				return
+			}
+			writeError(w, fail, NewError(ErrCodeInternal, "the request could not be processed"))
+		}
+	}()
+	c.Next()
+}
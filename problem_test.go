@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"launchpad.net/gocheck"
+)
+
+// Returns the Fail of a JSON request, with the request id "req-1". The
+// response writer and the request are optional.
+func testFail(w http.ResponseWriter, r *http.Request) Fail {
+	if w == nil {
+		w = httptest.NewRecorder()
+	}
+	if r == nil {
+		r, _ = http.NewRequest("GET", "/", nil)
+	}
+	return newFail(w, r, FormatByExt(".json"), "req-1")
+}
+
+// Checks that body is a JSON problem details document with the code and
+// detail, and returns it.
+func assertProblem(c *gocheck.C, body string, code int, detail string) *Error {
+	var e Error
+	c.Assert(json.Unmarshal([]byte(body), &e), gocheck.IsNil, gocheck.Commentf("%s", body))
+	c.Check(e.Code, gocheck.Equals, code)
+	c.Check(e.Detail, gocheck.Equals, detail)
+	c.Check(e.Status, gocheck.Equals, errorKinds[code].Status)
+	c.Check(e.Type, gocheck.Equals, "/errors#"+errorKinds[code].Name)
+	return &e
+}
+
+func (s *S) TestErrorCatalogue(c *gocheck.C) {
+	kinds := ErrorKinds()
+	c.Assert(kinds, gocheck.HasLen, ErrCodeInvalidTokenRequest)
+	names := make(map[string]bool)
+	for i, k := range kinds {
+		c.Check(k.Code, gocheck.Equals, i+1)
+		c.Check(names[k.Name], gocheck.Equals, false, gocheck.Commentf("%s", k.Name))
+		names[k.Name] = true
+		c.Check(k.Status >= 400, gocheck.Equals, true)
+	}
+	c.Assert(NewError(42, "unknown").Status, gocheck.Equals, http.StatusInternalServerError)
+}
+
+func (s *S) TestFail(c *gocheck.C) {
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/albums/7", nil)
+	status, body := testFail(w, r)(NewError(ErrCodeNotExist, "the album with id 7 does not exist"))
+	c.Assert(status, gocheck.Equals, http.StatusNotFound)
+	c.Assert(w.Header().Get("Content-Type"), gocheck.Equals, "application/problem+json")
+	c.Assert(body, gocheck.Equals, `{"type":"/errors#not-exist","title":"The resource does not exist","status":404,`+
+		`"detail":"the album with id 7 does not exist","instance":"/albums/7","code":1,"request_id":"req-1"}`)
+	// Other formats keep their content type
+	w = httptest.NewRecorder()
+	status, body = newFail(w, r, FormatByExt(".text"), "req-1")(NewError(ErrCodeNotExist, "not found"))
+	c.Assert(status, gocheck.Equals, http.StatusNotFound)
+	c.Assert(w.Header().Get("Content-Type"), gocheck.Equals, "")
+	c.Assert(body, gocheck.Equals, "[1] not found\n")
+	c.Assert(func() { testFail(nil, nil)(errors.New("boom")) }, gocheck.PanicMatches, "boom")
+}
+
+func (s *S) TestRequestId(c *gocheck.C) {
+	c.Assert(validRequestId("abc-123"), gocheck.Equals, true)
+	c.Assert(validRequestId(""), gocheck.Equals, false)
+	c.Assert(validRequestId("a b"), gocheck.Equals, false)
+	c.Assert(validRequestId(strings.Repeat("a", maxRequestIdLen+1)), gocheck.Equals, false)
+}
+
+// A martini.Context that only runs the next handler.
+type nextContext struct {
+	next func()
+}
+
+func (c *nextContext) Map(v interface{}) interface{}                         { return nil }
+func (c *nextContext) MapTo(v interface{}, ifacePtr interface{}) interface{} { return nil }
+func (c *nextContext) Next()                                                 { c.next() }
+func (c *nextContext) Written() bool                                         { return false }
+
+func (s *S) TestRecover(c *gocheck.C) {
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/albums", nil)
+	var logs strings.Builder
+	ctx := &nextContext{func() { Must("", errors.New("encoding failed")) }}
+	Recover(ctx, w, testFail(w, r), log.New(&logs, "", 0), "req-1")
+	c.Assert(w.Code, gocheck.Equals, http.StatusInternalServerError)
+	e := assertProblem(c, w.Body.String(), ErrCodeInternal, "the request could not be processed")
+	c.Assert(e.RequestId, gocheck.Equals, "req-1")
+	c.Assert(strings.HasPrefix(logs.String(), "PANIC [req-1]: encoding failed"), gocheck.Equals, true)
+}
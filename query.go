@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Number of albums returned when the limit query string argument is omitted.
+	defaultLimit = 100
+	// Highest accepted value for the limit query string argument.
+	maxLimit = 1000
+	// Highest accepted value for the offset query string argument, so that
+	// offset+limit cannot overflow.
+	maxOffset = math.MaxInt32
+)
+
+// A SortKey is one of the comma-separated fields of the sort query string
+// argument, e.g. `-year`.
+type SortKey struct {
+	Field string
+	Desc  bool
+}
+
+// The comparison functions of the sortable fields. String fields are compared
+// case-insensitively.
+var sortFields = map[string]func(a, b *Album) int{
+	"id": func(a, b *Album) int {
+		return a.Id - b.Id
+	},
+	"band": func(a, b *Album) int {
+		return strings.Compare(strings.ToLower(a.Band), strings.ToLower(b.Band))
+	},
+	"title": func(a, b *Album) int {
+		return strings.Compare(strings.ToLower(a.Title), strings.ToLower(b.Title))
+	},
+	"year": func(a, b *Album) int {
+		return a.Year - b.Year
+	},
+}
+
+// A Query holds the filtering, sorting and paging arguments of a request on
+// the list of albums.
+type Query struct {
+	Band    string // Case-insensitive partial match
+	Title   string // Case-insensitive partial match
+	Year    int    // Exact match, ignored if 0
+	MinYear int    // Ignored if 0
+	MaxYear int    // Ignored if 0
+	Owner   int    // Exact match, ignored if 0
+	Genre   string // Case-insensitive exact match of one of the genres
+	Sort    []SortKey
+	Offset  int
+	Limit   int
+}
+
+// parseQuery reads the query string arguments of a request on the list of
+// albums. The owner argument is either a user id or `me`, which stands for the
+// user id me. It returns an *Error if an argument is invalid.
+func parseQuery(qs url.Values, me int) (*Query, error) {
+	q := &Query{
+		Band:  strings.ToLower(qs.Get("band")),
+		Title: strings.ToLower(qs.Get("title")),
+		Genre: strings.ToLower(strings.TrimSpace(qs.Get("genre"))),
+		Limit: defaultLimit,
+	}
+	// For backwards compatibility, an invalid year is ignored
+	q.Year, _ = strconv.Atoi(qs.Get("year"))
+	ints := []struct {
+		name string
+		dst  *int
+		min  int
+		max  int
+	}{
+		{"year_min", &q.MinYear, 0, 0},
+		{"year_max", &q.MaxYear, 0, 0},
+		{"offset", &q.Offset, 0, maxOffset},
+		{"limit", &q.Limit, 1, maxLimit},
+	}
+	for _, arg := range ints {
+		s := qs.Get(arg.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < arg.min || (arg.max > 0 && n > arg.max) {
+			return nil, NewError(ErrCodeInvalidQuery, fmt.Sprintf("invalid value '%s' for %s", s, arg.name))
+		}
+		*arg.dst = n
+	}
+	switch s := qs.Get("owner"); s {
+	case "":
+	case "me":
+		q.Owner = me
+	default:
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return nil, NewError(ErrCodeInvalidQuery, fmt.Sprintf("invalid value '%s' for owner", s))
+		}
+		q.Owner = n
+	}
+	if s := qs.Get("sort"); s != "" {
+		for _, f := range strings.Split(s, ",") {
+			var k SortKey
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "-") {
+				k.Desc = true
+				f = f[1:]
+			}
+			k.Field = strings.ToLower(f)
+			if _, ok := sortFields[k.Field]; !ok {
+				return nil, NewError(ErrCodeInvalidQuery, fmt.Sprintf("cannot sort on '%s'", f))
+			}
+			q.Sort = append(q.Sort, k)
+		}
+	}
+	return q, nil
+}
+
+// Match returns true if the album satisfies the filters of the query.
+func (q *Query) Match(a *Album) bool {
+	if q.Band != "" && !strings.Contains(strings.ToLower(a.Band), q.Band) {
+		return false
+	}
+	if q.Title != "" && !strings.Contains(strings.ToLower(a.Title), q.Title) {
+		return false
+	}
+	if q.Year != 0 && a.Year != q.Year {
+		return false
+	}
+	if q.MinYear != 0 && a.Year < q.MinYear {
+		return false
+	}
+	if q.MaxYear != 0 && a.Year > q.MaxYear {
+		return false
+	}
+	if q.Owner != 0 && a.Owner != q.Owner {
+		return false
+	}
+	if q.Genre != "" && !a.HasGenre(q.Genre) {
+		return false
+	}
+	return true
+}
+
+// Apply filters and sorts the albums, and returns the requested page.
+func (q *Query) Apply(albums []*Album) *Page {
+	var res []*Album
+	for _, a := range albums {
+		if q.Match(a) {
+			res = append(res, a)
+		}
+	}
+	sort.Sort(&albumSorter{res, q.Sort})
+	return q.page(res)
+}
+
+// Returns the requested page of the albums.
+func (q *Query) page(res []*Album) *Page {
+	p := &Page{Total: len(res), Offset: q.Offset, Limit: q.Limit, Albums: []*Album{}}
+	if q.Offset < len(res) {
+		end := q.Offset + q.Limit
+		if end > len(res) {
+			end = len(res)
+		}
+		p.Albums = res[q.Offset:end]
+	}
+	return p
+}
+
+// Sorts albums on the keys of the query. The id is always used as final key,
+// so that the order is stable across requests.
+type albumSorter struct {
+	albums []*Album
+	keys   []SortKey
+}
+
+func (s *albumSorter) Len() int      { return len(s.albums) }
+func (s *albumSorter) Swap(i, j int) { s.albums[i], s.albums[j] = s.albums[j], s.albums[i] }
+func (s *albumSorter) Less(i, j int) bool {
+	a, b := s.albums[i], s.albums[j]
+	for _, k := range s.keys {
+		c := sortFields[k.Field](a, b)
+		if k.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+	}
+	return a.Id < b.Id
+}
+
+// A Page is a subset of the list of albums, along with the information required
+// to fetch the other pages. Next and Prev are relative references made only of
+// a query string, so that they resolve against the URL of the current request,
+// format extension included.
+type Page struct {
+	XMLName xml.Name `json:"-" xml:"albums"`
+	Total   int      `json:"total" xml:"total,attr"`
+	Offset  int      `json:"offset" xml:"offset,attr"`
+	Limit   int      `json:"limit" xml:"limit,attr"`
+	Next    string   `json:"next,omitempty" xml:"next,attr,omitempty"`
+	Prev    string   `json:"prev,omitempty" xml:"prev,attr,omitempty"`
+	Albums  []*Album `json:"albums" xml:"album"`
+}
+
+// SetLinks fills the Next and Prev references, based on the query string of
+// the current request.
+func (p *Page) SetLinks(qs url.Values) {
+	link := func(offset int) string {
+		v := url.Values{}
+		for k, vals := range qs {
+			v[k] = vals
+		}
+		v.Set("offset", strconv.Itoa(offset))
+		v.Set("limit", strconv.Itoa(p.Limit))
+		return "?" + v.Encode()
+	}
+	if p.Offset+p.Limit < p.Total {
+		p.Next = link(p.Offset + p.Limit)
+	}
+	if p.Offset > 0 {
+		prev := p.Offset - p.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		p.Prev = link(prev)
+	}
+}
+
+// String renders the page as one album per line, followed by a summary line.
+func (p *Page) String() string {
+	var buf bytes.Buffer
+	for _, a := range p.Albums {
+		fmt.Fprintf(&buf, "%s\n", a)
+	}
+	buf.WriteString(p.summary())
+	return buf.String()
+}
+
+// Returns the summary line of the page, without its albums.
+func (p *Page) summary() string {
+	var buf bytes.Buffer
+	first := p.Offset + 1
+	if len(p.Albums) == 0 {
+		first = p.Offset
+	}
+	fmt.Fprintf(&buf, "-- %d-%d of %d", first, p.Offset+len(p.Albums), p.Total)
+	if p.Prev != "" {
+		fmt.Fprintf(&buf, ", prev: %s", p.Prev)
+	}
+	if p.Next != "" {
+		fmt.Fprintf(&buf, ", next: %s", p.Next)
+	}
+	return buf.String()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/url"
+
+	"launchpad.net/gocheck"
+)
+
+var queryAlbums = []*Album{
+	{Id: 1, Band: "Slayer", Title: "Reign In Blood", Year: 1986},
+	{Id: 2, Band: "Slayer", Title: "Seasons In The Abyss", Year: 1990},
+	{Id: 3, Band: "Bruce Springsteen", Title: "Born To Run", Year: 1975},
+	{Id: 4, Band: "AC/DC", Title: "Back In Black", Year: 1980},
+}
+
+func albumIds(p *Page) []int {
+	ids := make([]int, len(p.Albums))
+	for i, a := range p.Albums {
+		ids[i] = a.Id
+	}
+	return ids
+}
+
+func (s *S) TestParseQueryDefaults(c *gocheck.C) {
+	q, err := parseQuery(url.Values{}, 0)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(q, gocheck.DeepEquals, &Query{Limit: defaultLimit})
+}
+
+func (s *S) TestParseQuery(c *gocheck.C) {
+	qs, _ := url.ParseQuery("band=SLAYER&year_min=1980&year_max=1990&offset=2&limit=10&sort=year,+-title")
+	q, err := parseQuery(qs, 0)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(q, gocheck.DeepEquals, &Query{
+		Band:    "slayer",
+		MinYear: 1980,
+		MaxYear: 1990,
+		Offset:  2,
+		Limit:   10,
+		Sort:    []SortKey{{Field: "year"}, {Field: "title", Desc: true}},
+	})
+}
+
+func (s *S) TestParseQueryOwner(c *gocheck.C) {
+	qs, _ := url.ParseQuery("owner=me")
+	q, err := parseQuery(qs, 7)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(q.Owner, gocheck.Equals, 7)
+	qs, _ = url.ParseQuery("owner=3")
+	q, err = parseQuery(qs, 7)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(q.Owner, gocheck.Equals, 3)
+	q = &Query{Owner: 3, Limit: defaultLimit}
+	c.Assert(albumIds(q.Apply([]*Album{{Id: 1, Owner: 3}, {Id: 2}, {Id: 3, Owner: 7}})), gocheck.DeepEquals, []int{1})
+}
+
+func (s *S) TestParseQueryInvalid(c *gocheck.C) {
+	for _, qs := range []string{"owner=you", "owner=0", "limit=0", "limit=1001", "offset=-1", "offset=x", "offset=2147483648", "offset=9223372036854775807", "year_min=x", "sort=label"} {
+		v, _ := url.ParseQuery(qs)
+		_, err := parseQuery(v, 0)
+		c.Assert(err, gocheck.FitsTypeOf, &Error{})
+		c.Assert(err.(*Error).Code, gocheck.Equals, ErrCodeInvalidQuery)
+	}
+}
+
+func (s *S) TestParseQueryMaxOffset(c *gocheck.C) {
+	qs, _ := url.ParseQuery("offset=2147483647&limit=1000")
+	q, err := parseQuery(qs, 0)
+	c.Assert(err, gocheck.IsNil)
+	p := q.Apply(queryAlbums)
+	p.SetLinks(qs)
+	c.Assert(p.Next, gocheck.Equals, "")
+	c.Assert(p.Prev, gocheck.Equals, "?limit=1000&offset=2147482647")
+}
+
+func (s *S) TestQueryApplyFilters(c *gocheck.C) {
+	q := &Query{Title: "in", MaxYear: 1986, Limit: defaultLimit}
+	p := q.Apply(queryAlbums)
+	c.Assert(albumIds(p), gocheck.DeepEquals, []int{1, 4})
+	c.Assert(p.Total, gocheck.Equals, 2)
+}
+
+func (s *S) TestQueryApplySort(c *gocheck.C) {
+	q := &Query{Sort: []SortKey{{Field: "band"}, {Field: "year", Desc: true}}, Limit: defaultLimit}
+	c.Assert(albumIds(q.Apply(queryAlbums)), gocheck.DeepEquals, []int{4, 3, 2, 1})
+}
+
+func (s *S) TestQueryApplyPage(c *gocheck.C) {
+	q := &Query{Offset: 1, Limit: 2}
+	p := q.Apply(queryAlbums)
+	c.Assert(albumIds(p), gocheck.DeepEquals, []int{2, 3})
+	c.Assert(p.Total, gocheck.Equals, 4)
+	q.Offset = 10
+	p = q.Apply(queryAlbums)
+	c.Assert(p.Albums, gocheck.HasLen, 0)
+	c.Assert(p.Albums, gocheck.NotNil)
+}
+
+func (s *S) TestPageSetLinks(c *gocheck.C) {
+	p := &Page{Total: 5, Offset: 1, Limit: 2}
+	p.SetLinks(url.Values{"band": {"Slayer"}, "offset": {"1"}})
+	c.Assert(p.Next, gocheck.Equals, "?band=Slayer&limit=2&offset=3")
+	c.Assert(p.Prev, gocheck.Equals, "?band=Slayer&limit=2&offset=0")
+	p = &Page{Total: 2, Offset: 0, Limit: 2}
+	p.SetLinks(url.Values{})
+	c.Assert(p.Next, gocheck.Equals, "")
+	c.Assert(p.Prev, gocheck.Equals, "")
+}
+
+func (s *S) TestPageEncoders(c *gocheck.C) {
+	p := &Page{Total: 3, Offset: 0, Limit: 1, Next: "?limit=1&offset=1", Albums: []*Album{encAlbum1}}
+	js, err := jsonEncoder{}.Encode(p)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(js, gocheck.Equals, `{"total":3,"offset":0,"limit":1,"next":"?limit=1\u0026offset=1",`+
+		`"albums":[{"id":1,"band":"Slayer","title":"Reign In Blood","year":1986,"owner":0,"version":2,"updated":"2013-12-01T10:30:00Z"}]}`)
+	x, err := xmlEncoder{}.Encode(p)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(x, gocheck.Equals, `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+
+		`<albums total="3" offset="0" limit="1" next="?limit=1&amp;offset=1">`+
+		`<album id="1" owner="0" version="2" updated="2013-12-01T10:30:00Z"><band>Slayer</band><title>Reign In Blood</title><year>1986</year></album></albums>`)
+	t, err := textEncoder{}.Encode(p)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(t, gocheck.Equals, "Slayer - Reign In Blood (1986)\n-- 1-1 of 3, next: ?limit=1&offset=1\n")
+}
+
+func (s *S) TestQueryApplyGenre(c *gocheck.C) {
+	qs, _ := url.ParseQuery("genre=+Thrash+Metal")
+	q, err := parseQuery(qs, 0)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(q.Genre, gocheck.Equals, "thrash metal")
+	albums := []*Album{
+		{Id: 1, Band: "Slayer", Title: "Reign In Blood", Year: 1986, Genres: []string{"thrash metal", "speed metal"}},
+		{Id: 2, Band: "Bruce Springsteen", Title: "Born To Run", Year: 1975, Genres: []string{"rock"}},
+		{Id: 3, Band: "Metallica", Title: "Master of Puppets", Year: 1986, Genres: []string{"thrash metal"}},
+		{Id: 4, Band: "AC/DC", Title: "Back In Black", Year: 1980},
+	}
+	c.Assert(albumIds(q.Apply(albums)), gocheck.DeepEquals, []int{1, 3})
+}
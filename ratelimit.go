@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codegangsta/martini"
+)
+
+// How often the in-memory store forgets the buckets that are full again.
+const rateLimitSweepEvery = time.Minute
+
+// A RateLimit is a token bucket: a client can send Burst requests at once, and
+// Rate requests per second on average. A RateLimit without Rate does not limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// A RateLimitRule applies its limit to the requests of the method (of any
+// method if empty) on a path that matches the pattern. Patterns are written
+// like the routes, their `:name` segments match any segment.
+type RateLimitRule struct {
+	Method  string
+	Pattern string
+	Limit   RateLimit
+}
+
+// Reports whether the rule applies to the request.
+func (rr *RateLimitRule) match(method, path string) bool {
+	if rr.Method != "" && rr.Method != method {
+		return false
+	}
+	return matchPattern(rr.Pattern, path)
+}
+
+// Reports whether the path matches the pattern of a route, whose `:name`
+// segments match any segment.
+func matchPattern(pattern, path string) bool {
+	ps, ss := strings.Split(pattern, "/"), strings.Split(path, "/")
+	if len(ps) != len(ss) {
+		return false
+	}
+	for i, p := range ps {
+		if strings.HasPrefix(p, ":") {
+			if ss[i] == "" {
+				return false
+			}
+		} else if p != ss[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// The state of a bucket after a request has been counted.
+type RateLimitResult struct {
+	Allowed    bool          // Whether the request is allowed
+	Remaining  int           // Requests left in the bucket
+	Reset      time.Duration // Time until the bucket is full again
+	RetryAfter time.Duration // Time until a request is allowed, if it is not
+}
+
+// The RateLimitStore interface holds the token buckets of the rate limiter. The
+// buckets are in memory by default, a store shared by several servers can be
+// plugged in to limit the clients across all of them.
+type RateLimitStore interface {
+	// Take counts a request in the bucket identified by the key, with the
+	// limit l, at the time now. A new bucket is full.
+	Take(key string, l RateLimit, now time.Time) (RateLimitResult, error)
+}
+
+// Thread-safe in-memory token buckets. The zero value is an empty store, ready
+// to use.
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // Time of the last refill
+	full   time.Time // Time when the bucket is full again
+}
+
+// Take implements RateLimitStore.
+func (s *memoryRateLimitStore) Take(key string, l RateLimit, now time.Time) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buckets == nil {
+		s.buckets = make(map[string]*tokenBucket)
+	}
+	if now.Sub(s.swept) >= rateLimitSweepEvery {
+		s.sweep(now)
+	}
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.Burst), last: now}
+		s.buckets[key] = b
+	} else if d := now.Sub(b.last); d > 0 {
+		b.tokens = math.Min(float64(l.Burst), b.tokens+d.Seconds()*l.Rate)
+		b.last = now
+	}
+	var res RateLimitResult
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = rateDuration(1-b.tokens, l.Rate)
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = rateDuration(float64(l.Burst)-b.tokens, l.Rate)
+	b.full = now.Add(res.Reset)
+	return res, nil
+}
+
+// Forgets the buckets that are full, they are the same as new ones.
+func (s *memoryRateLimitStore) sweep(now time.Time) {
+	for k, b := range s.buckets {
+		if !now.Before(b.full) {
+			delete(s.buckets, k)
+		}
+	}
+	s.swept = now
+}
+
+// Returns the time needed to get n tokens at the rate.
+func rateDuration(n, rate float64) time.Duration {
+	return time.Duration(n / rate * float64(time.Second))
+}
+
+// A RateLimiter limits the requests of each client, identified by the user of
+// its bearer token if it is valid, or else by its IP address. The first rule
+// that applies to a request gives its limit, and each rule has its own buckets,
+// so that the limit of a route is not consumed by the requests on the others.
+// The requests that no rule applies to share the Default limit.
+type RateLimiter struct {
+	Store   RateLimitStore
+	Default RateLimit
+	Rules   []RateLimitRule
+}
+
+// The rate limiter of the server, with tighter limits on the expensive routes.
+var limiter = &RateLimiter{
+	Store:   &memoryRateLimitStore{},
+	Default: RateLimit{Rate: 10, Burst: 50},
+	Rules: []RateLimitRule{
+		{Method: "POST", Pattern: "/albums/_bulk", Limit: RateLimit{Rate: 0.1, Burst: 2}},
+		{Method: "GET", Pattern: "/albums/_export", Limit: RateLimit{Rate: 0.1, Burst: 2}},
+		{Method: "GET", Pattern: "/albums/_search", Limit: RateLimit{Rate: 2, Burst: 10}},
+		{Method: "POST", Pattern: "/users", Limit: RateLimit{Rate: 0.05, Burst: 5}},
+	},
+}
+
+// Handler returns the middleware that applies the limits. It must be used
+// after MapEncoder, the requests over the limit are answered with a 429 error
+// in the negotiated format. The X-RateLimit-Limit, X-RateLimit-Remaining and
+// X-RateLimit-Reset (in seconds) headers describe the bucket of the request,
+// and Retry-After tells when to retry a rejected request.
+func (rl *RateLimiter) Handler() martini.Handler {
+	return func(w http.ResponseWriter, r *http.Request, fail Fail, tdb TokenDB) {
+		l, rule := rl.Default, "*"
+		for i := range rl.Rules {
+			if rr := &rl.Rules[i]; rr.match(r.Method, r.URL.Path) {
+				l, rule = rr.Limit, rr.Method+" "+rr.Pattern
+				break
+			}
+		}
+		if l.Rate <= 0 {
+			return
+		}
+		res, err := rl.Store.Take(rateLimitClient(r, tdb)+" "+rule, l, time.Now())
+		if err != nil {
+			panic(err)
+		}
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(l.Burst))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+		if !res.Allowed {
+			s := ceilSeconds(res.RetryAfter)
+			w.Header().Set("Retry-After", strconv.Itoa(s))
+			writeError(w, fail, NewError(ErrCodeRateLimited, fmt.Sprintf("too many requests, retry in %d seconds", s)))
+		}
+	}
+}
+
+// Returns the identity of the client for the rate limiter: its user id if it
+// has a valid token, or else its IP address.
+func rateLimitClient(r *http.Request, tdb TokenDB) string {
+	if v := bearerToken(r); v != "" {
+		if t := tdb.Get(v); t != nil && t.Valid() {
+			return fmt.Sprintf("user:%d", t.UserId)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// Returns d in seconds, rounded up, and at least 1 if d is positive.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"launchpad.net/gocheck"
+)
+
+func (s *S) TestMemoryRateLimitStore(c *gocheck.C) {
+	var st memoryRateLimitStore
+	l := RateLimit{Rate: 2, Burst: 3}
+	base := time.Date(2013, 12, 1, 10, 30, 0, 0, time.UTC)
+	for i := 2; i >= 0; i-- {
+		res, err := st.Take("a", l, base)
+		c.Assert(err, gocheck.IsNil)
+		c.Assert(res.Allowed, gocheck.Equals, true)
+		c.Assert(res.Remaining, gocheck.Equals, i)
+	}
+	res, _ := st.Take("a", l, base)
+	c.Assert(res, gocheck.DeepEquals, RateLimitResult{Reset: 1500 * time.Millisecond, RetryAfter: 500 * time.Millisecond})
+	// Other keys have their own bucket
+	res, _ = st.Take("b", l, base)
+	c.Assert(res.Allowed, gocheck.Equals, true)
+	// The bucket is refilled at the rate, up to the burst
+	res, _ = st.Take("a", l, base.Add(500*time.Millisecond))
+	c.Assert(res, gocheck.DeepEquals, RateLimitResult{Allowed: true, Reset: 1500 * time.Millisecond})
+	res, _ = st.Take("a", l, base.Add(time.Hour))
+	c.Assert(res.Remaining, gocheck.Equals, 2)
+	// Full buckets are forgotten
+	c.Assert(st.buckets, gocheck.HasLen, 1)
+}
+
+func (s *S) TestRateLimitRuleMatch(c *gocheck.C) {
+	rr := &RateLimitRule{Method: "GET", Pattern: "/albums/:id/tracks"}
+	c.Assert(rr.match("GET", "/albums/1/tracks"), gocheck.Equals, true)
+	c.Assert(rr.match("PUT", "/albums/1/tracks"), gocheck.Equals, false)
+	c.Assert(rr.match("GET", "/albums//tracks"), gocheck.Equals, false)
+	c.Assert(rr.match("GET", "/albums/1/tracks/1"), gocheck.Equals, false)
+	rr = &RateLimitRule{Pattern: "/albums"}
+	c.Assert(rr.match("POST", "/albums"), gocheck.Equals, true)
+	c.Assert(rr.match("GET", "/albums/1"), gocheck.Equals, false)
+}
+
+func (s *S) TestRateLimiter(c *gocheck.C) {
+	tdb := &tokensDB{m: make(map[string]*Token)}
+	t, _ := tdb.Issue(7, ScopeRead, time.Hour)
+	rl := &RateLimiter{
+		Store:   &memoryRateLimitStore{},
+		Default: RateLimit{Rate: 0.01, Burst: 2},
+		Rules: []RateLimitRule{
+			{Method: "POST", Pattern: "/albums/_bulk", Limit: RateLimit{Rate: 0.01, Burst: 1}},
+			{Method: "GET", Pattern: "/errors"},
+		},
+	}
+	h := rl.Handler().(func(http.ResponseWriter, *http.Request, Fail, TokenDB))
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest(method, path, nil)
+		r.RemoteAddr = "192.0.2.1:4321"
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h(w, r, testFail(w, r), tdb)
+		return w
+	}
+
+	w := do("GET", "/albums", "")
+	c.Assert(w.Code, gocheck.Equals, http.StatusOK)
+	c.Assert(w.Header().Get("X-RateLimit-Limit"), gocheck.Equals, "2")
+	c.Assert(w.Header().Get("X-RateLimit-Remaining"), gocheck.Equals, "1")
+	c.Assert(w.Header().Get("X-RateLimit-Reset"), gocheck.Equals, "100")
+	do("GET", "/albums/1", "")
+	w = do("GET", "/albums", "")
+	c.Assert(w.Code, gocheck.Equals, http.StatusTooManyRequests)
+	c.Assert(w.Header().Get("Retry-After"), gocheck.Equals, "100")
+	c.Assert(w.Header().Get("X-RateLimit-Remaining"), gocheck.Equals, "0")
+	assertProblem(c, w.Body.String(), ErrCodeRateLimited, "too many requests, retry in 100 seconds")
+
+	// An authenticated client is limited by user, an invalid token by address
+	c.Assert(do("GET", "/albums", t.Value).Code, gocheck.Equals, http.StatusOK)
+	c.Assert(do("GET", "/albums", "nope").Code, gocheck.Equals, http.StatusTooManyRequests)
+	// Rules have their own buckets, and a rule without rate does not limit
+	c.Assert(do("POST", "/albums/_bulk", "").Code, gocheck.Equals, http.StatusOK)
+	c.Assert(do("POST", "/albums/_bulk", "").Code, gocheck.Equals, http.StatusTooManyRequests)
+	w = do("GET", "/errors", "")
+	c.Assert(w.Code, gocheck.Equals, http.StatusOK)
+	c.Assert(w.Header().Get("X-RateLimit-Limit"), gocheck.Equals, "")
+}
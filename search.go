@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Weight of a term that only starts with a word of the query, relative to a
+// term that is the word itself.
+const prefixWeight = 0.5
+
+// The letters folded to ASCII by the tokenizer, so that searches are
+// accent-insensitive. The first letter of each group is the folded one.
+var foldGroups = []string{
+	"aàáâãäåāăą", "cçćĉċč", "dďđ", "eèéêëēĕėęě", "gĝğġģ", "hĥħ", "iìíîïĩīĭįı",
+	"jĵ", "kķ", "lĺļľŀł", "nñńņňŉ", "oòóôõöøōŏő", "rŕŗř", "sśŝşš", "tţťŧ",
+	"uùúûüũūŭůűų", "wŵ", "yýÿŷ", "zźżž",
+}
+
+// Letters folded to more than one letter.
+var foldLigatures = map[rune]string{'æ': "ae", 'œ': "oe", 'ß': "ss", 'þ': "th", 'ð': "d"}
+
+var foldMap = func() map[rune]rune {
+	m := make(map[rune]rune)
+	for _, g := range foldGroups {
+		rs := []rune(g)
+		for _, r := range rs[1:] {
+			m[r] = rs[0]
+		}
+	}
+	return m
+}()
+
+// Splits s into its words, made of letters and digits, in lowercase and with
+// their accents removed.
+func tokenize(s string) []string {
+	var (
+		toks []string
+		tok  bytes.Buffer
+	)
+	end := func() {
+		if tok.Len() > 0 {
+			toks = append(toks, tok.String())
+			tok.Reset()
+		}
+	}
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case foldLigatures[r] != "":
+			tok.WriteString(foldLigatures[r])
+		case foldMap[r] != 0:
+			tok.WriteRune(foldMap[r])
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			tok.WriteRune(r)
+		case unicode.Is(unicode.Mn, r):
+			// Combining accents of decomposed letters
+		default:
+			end()
+		}
+	}
+	end()
+	return toks
+}
+
+// A searchIndex is an inverted index of the words of the band and title of the
+// albums. It is maintained by the database, which serializes its use with its
+// own lock. The zero value is an empty index, ready to use.
+//
+// A query is a list of words, an album matches it if each word is one of its
+// words or the beginning of one of them (for autocompletion). The albums are
+// ordered by relevance: the sum, for each word of the query, of the number of
+// occurrences of the best matching word of the album, weighted by the rarity of
+// that word among all albums, and halved if it is only a prefix match.
+type searchIndex struct {
+	postings map[string]map[int]int // Occurrences of a term, by album id
+	docs     map[int][]string       // Distinct terms of an album
+	terms    []string               // All the terms, sorted for prefix lookups
+}
+
+// Indexes the album, replacing the previous version of the album if any.
+func (x *searchIndex) add(a *Album) {
+	x.remove(a.Id)
+	if x.postings == nil {
+		x.postings = make(map[string]map[int]int)
+		x.docs = make(map[int][]string)
+	}
+	toks := append(tokenize(a.Band), tokenize(a.Title)...)
+	if len(toks) == 0 {
+		return
+	}
+	var terms []string
+	for _, t := range toks {
+		p, ok := x.postings[t]
+		if !ok {
+			p = make(map[int]int)
+			x.postings[t] = p
+			x.insertTerm(t)
+		}
+		if p[a.Id] == 0 {
+			terms = append(terms, t)
+		}
+		p[a.Id]++
+	}
+	x.docs[a.Id] = terms
+}
+
+// Removes the album identified by the id from the index, if it is indexed.
+func (x *searchIndex) remove(id int) {
+	terms, ok := x.docs[id]
+	if !ok {
+		return
+	}
+	for _, t := range terms {
+		p := x.postings[t]
+		delete(p, id)
+		if len(p) == 0 {
+			delete(x.postings, t)
+			x.deleteTerm(t)
+		}
+	}
+	delete(x.docs, id)
+}
+
+func (x *searchIndex) insertTerm(t string) {
+	i := sort.SearchStrings(x.terms, t)
+	x.terms = append(x.terms, "")
+	copy(x.terms[i+1:], x.terms[i:])
+	x.terms[i] = t
+}
+
+func (x *searchIndex) deleteTerm(t string) {
+	i := sort.SearchStrings(x.terms, t)
+	if i < len(x.terms) && x.terms[i] == t {
+		x.terms = append(x.terms[:i], x.terms[i+1:]...)
+	}
+}
+
+// Returns the ids of the albums that match the query, the most relevant first,
+// and by id for the same relevance. A query without words matches no album.
+func (x *searchIndex) search(query string) []int {
+	toks := tokenize(query)
+	if len(toks) == 0 {
+		return nil
+	}
+	var scores map[int]float64
+	for _, tok := range toks {
+		matches := make(map[int]float64)
+		for i := sort.SearchStrings(x.terms, tok); i < len(x.terms) && strings.HasPrefix(x.terms[i], tok); i++ {
+			t := x.terms[i]
+			w := math.Log(1 + float64(len(x.docs))/float64(len(x.postings[t])))
+			if t != tok {
+				w *= prefixWeight
+			}
+			for id, n := range x.postings[t] {
+				if s := w * float64(n); s > matches[id] {
+					matches[id] = s
+				}
+			}
+		}
+		if scores == nil {
+			scores = matches
+			continue
+		}
+		for id, s := range scores {
+			if m, ok := matches[id]; ok {
+				scores[id] = s + m
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+	ids := make([]int, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	sort.Sort(&byScore{ids, scores})
+	return ids
+}
+
+type byScore struct {
+	ids    []int
+	scores map[int]float64
+}
+
+func (b *byScore) Len() int      { return len(b.ids) }
+func (b *byScore) Swap(i, j int) { b.ids[i], b.ids[j] = b.ids[j], b.ids[i] }
+func (b *byScore) Less(i, j int) bool {
+	if si, sj := b.scores[b.ids[i]], b.scores[b.ids[j]]; si != sj {
+		return si > sj
+	}
+	return b.ids[i] < b.ids[j]
+}
+
+// SearchAlbums returns a page of the albums that match the full-text query of
+// the `q` query string argument, the most relevant first. The filtering and
+// paging arguments of GetAlbums apply to the results, and so does `sort`,
+// which then replaces the relevance order.
+func SearchAlbums(w http.ResponseWriter, r *http.Request, enc Encoder, fail Fail, db DB, t *Token) {
+	qs := r.URL.Query()
+	text := qs.Get("q")
+	if len(tokenize(text)) == 0 {
+		writeError(w, fail, NewError(ErrCodeInvalidQuery, "the search query q must contain at least one word"))
+		return
+	}
+	q, err := parseQuery(qs, t.UserId)
+	if err != nil {
+		writeError(w, fail, err)
+		return
+	}
+	var res []*Album
+	for _, a := range db.Search(text) {
+		if q.Match(a) {
+			res = append(res, a)
+		}
+	}
+	if len(q.Sort) > 0 {
+		sort.Sort(&albumSorter{res, q.Sort})
+	}
+	p := q.page(res)
+	p.SetLinks(qs)
+	setPageHeaders(w, p)
+	Stream(w, http.StatusOK, enc, p)
+}
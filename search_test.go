@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"launchpad.net/gocheck"
+)
+
+func (s *S) TestTokenize(c *gocheck.C) {
+	c.Assert(tokenize("Motörhead - Ace Of Spades"), gocheck.DeepEquals, []string{"motorhead", "ace", "of", "spades"})
+	c.Assert(tokenize("Sigur Rós: Ágætis byrjun"), gocheck.DeepEquals, []string{"sigur", "ros", "agaetis", "byrjun"})
+	// Decomposed accents
+	c.Assert(tokenize("Beyoncé 4"), gocheck.DeepEquals, []string{"beyonce", "4"})
+	c.Assert(tokenize(" -- "), gocheck.HasLen, 0)
+}
+
+func (s *S) TestSearchIndex(c *gocheck.C) {
+	var x searchIndex
+	x.add(&Album{Id: 1, Band: "Slayer", Title: "Reign In Blood"})
+	x.add(&Album{Id: 2, Band: "Slayer", Title: "Seasons In The Abyss"})
+	x.add(&Album{Id: 3, Band: "Bruce Springsteen", Title: "Born To Run"})
+	x.add(&Album{Id: 4, Band: "Blood, Sweat & Tears", Title: "Blood, Sweat & Tears"})
+
+	c.Assert(x.search("slayer"), gocheck.DeepEquals, []int{1, 2})
+	c.Assert(x.search("SLAYER blood"), gocheck.DeepEquals, []int{1})
+	c.Assert(x.search("nothing"), gocheck.HasLen, 0)
+	c.Assert(x.search(""), gocheck.HasLen, 0)
+	// More occurrences rank higher
+	c.Assert(x.search("blood"), gocheck.DeepEquals, []int{4, 1})
+	// Prefixes match, with half the weight of the words, so rarer words rank
+	// higher
+	c.Assert(x.search("s"), gocheck.DeepEquals, []int{4, 2, 3, 1})
+	c.Assert(x.search("bor"), gocheck.DeepEquals, []int{3})
+	c.Assert(x.search("b"), gocheck.DeepEquals, []int{4, 3, 1})
+
+	// Updates replace the words of the album
+	x.add(&Album{Id: 3, Band: "Bruce Springsteen", Title: "Nebraska"})
+	c.Assert(x.search("born"), gocheck.HasLen, 0)
+	c.Assert(x.search("nebr"), gocheck.DeepEquals, []int{3})
+	x.remove(3)
+	x.remove(3)
+	c.Assert(x.search("bruce"), gocheck.HasLen, 0)
+	for _, t := range x.terms {
+		c.Assert(t, gocheck.Not(gocheck.Equals), "springsteen")
+	}
+}
+
+func (s *S) TestSearchAlbums(c *gocheck.C) {
+	db := &albumsDB{m: make(map[int]*Album)}
+	db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	db.Add(&Album{Band: "Slayer", Title: "South Of Heaven", Year: 1988})
+	db.Add(&Album{Band: "Sløtface", Title: "Try Not To Freak Out", Year: 2017})
+	search := func(qs string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest("GET", "/albums/_search"+qs, nil)
+		c.Assert(err, gocheck.IsNil)
+		w := httptest.NewRecorder()
+		SearchAlbums(w, r, jsonEncoder{}, testFail(w, r), db, &Token{UserId: 1})
+		return w
+	}
+
+	w := search("?q=SL&limit=1")
+	c.Assert(w.Code, gocheck.Equals, http.StatusOK)
+	c.Assert(w.Header().Get("X-Total-Count"), gocheck.Equals, "3")
+	var p Page
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &p), gocheck.IsNil)
+	c.Assert(p.Albums, gocheck.HasLen, 1)
+	c.Assert(p.Albums[0].Band, gocheck.Equals, "Sløtface")
+	c.Assert(p.Next, gocheck.Equals, "?limit=1&offset=1&q=SL")
+
+	w = search("?q=slayer&sort=-year")
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &p), gocheck.IsNil)
+	c.Assert(p.Albums[0].Title, gocheck.Equals, "South Of Heaven")
+	w = search("?q=slayer&year_max=1987")
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &p), gocheck.IsNil)
+	c.Assert(p.Total, gocheck.Equals, 1)
+
+	w = search("?q=+")
+	c.Assert(w.Code, gocheck.Equals, http.StatusBadRequest)
+	assertProblem(c, w.Body.String(), ErrCodeInvalidQuery, "the search query q must contain at least one word")
+}
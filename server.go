@@ -1,111 +1,154 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
-	"regexp"
+	"os"
 	"strings"
 
 	"github.com/codegangsta/martini"
-	"github.com/codegangsta/martini-contrib/auth"
 )
 
-// The one and only access token! In real-life scenarios, a more complex authentication
-// middleware than auth.Basic should be used, obviously.
-const AuthToken = "token"
-
 // The one and only martini instance.
 var m *martini.Martini
 
+// The albums are kept in memory unless a database file is given on the command line.
+var dbFile = flag.String("db", "", "path to the albums database file (in-memory database if empty)")
+
+// Whether a one-time admin token is drawn and logged at startup, see adminToken.
+var adminBootstrap = flag.Bool("admin-bootstrap", false, "log a one-time token that makes admin the user who registers with it in the X-Admin-Token header")
+
+// The configuration of the listeners, see ServerConfig.
+var configFile = flag.String("config", "", "path to the configuration file (etc/tsuru.conf has an example)")
+
 func init() {
 	m = martini.New()
-	// Setup middleware
+	// Setup middleware. martini's Recovery only handles the panics that happen
+	// before the response format is known, Recover renders the others.
 	m.Use(martini.Recovery())
 	m.Use(martini.Logger())
-	m.Use(auth.Basic(AuthToken, ""))
+	m.Use(metrics.Handler())
+	m.Use(MapRequestId)
 	m.Use(MapEncoder)
+	m.Use(Recover)
+	m.Use(OverrideMethod)
+	m.Use(limiter.Handler())
+	m.Use(CSRF)
 	// Setup routes
 	r := martini.NewRouter()
+	addRoutes(r)
 
-	r.Get(`/albums`, GetAlbums)
-	r.Get(`/albums/:id`, GetAlbum)
-	r.Post(`/albums`, AddAlbum)
-	r.Put(`/albums/:id`, UpdateAlbum)
-	r.Delete(`/albums/:id`, DeleteAlbum)
-
-	r.Post(`/users`, CreateUser)
-
-	// Inject database
+	// Inject databases
 	m.MapTo(db, (*DB)(nil))
+	m.MapTo(tokens, (*TokenDB)(nil))
+	m.MapTo(users, (*UserDB)(nil))
 	// Add the router action
 	m.Action(r.Handle)
 }
 
-// The regex to check for the requested format (allows an optional trailing
-// slash).
-var rxExt = regexp.MustCompile(`(\.(?:xml|text|json))\/?$`)
-
-// MapEncoder intercepts the request's URL, detects the requested format,
-// and injects the correct encoder dependency for this request. It rewrites
-// the URL to remove the format extension, so that routes can be defined
-// without it.
-func MapEncoder(c martini.Context, w http.ResponseWriter, r *http.Request) {
-	// Get the format extension
-	matches := rxExt.FindStringSubmatch(r.URL.Path)
-	ft := ".json"
-	if len(matches) > 1 {
+// Adds the routes to the router. The albums require a bearer token with the
+// appropriate scope. Each route is described in apiRoutes, for the OpenAPI
+// document.
+func addRoutes(r martini.Router) {
+	read, write := Authorize(ScopeRead), Authorize(ScopeReadWrite)
+
+	r.Get(`/albums`, read, GetAlbums)
+	r.Get(`/albums/_export`, read, ExportAlbums)
+	r.Get(`/albums/_changes`, read, GetChanges)
+	r.Get(`/albums/_search`, read, SearchAlbums)
+	r.Get(`/albums/:id`, read, GetAlbum)
+	r.Post(`/albums`, write, AddAlbum)
+	r.Post(`/albums/_bulk`, write, BulkAddAlbums)
+	r.Put(`/albums/:id`, write, UpdateAlbum)
+	r.Patch(`/albums/:id`, write, PatchAlbum)
+	r.Delete(`/albums/:id`, write, DeleteAlbum)
+	r.Get(`/albums/:id/tracks`, read, GetTracks)
+	r.Put(`/albums/:id/tracks`, write, UpdateTracks)
+	r.Get(`/albums/:id/tracks/:number`, read, GetTrack)
+
+	r.Post(`/users`, CreateUser)
+	r.Get(`/users/:id`, read, GetUser)
+	r.Put(`/users/:id`, write, UpdateUser)
+	r.Delete(`/users/:id`, write, DeleteUser)
+	r.Post(`/tokens`, CreateToken)
+	r.Delete(`/tokens/:token`, read, RevokeToken)
+	r.Get(loginPath, LoginForm)
+	r.Post(loginPath, Login)
+	r.Post(`/logout`, read, Logout)
+
+	r.Get(`/errors`, ListErrors)
+	r.Get(`/openapi`, GetOpenAPI)
+}
+
+// MapEncoder intercepts the request's URL and headers, detects the requested
+// format, and injects the correct encoder dependency for this request, along
+// with the *Format itself and the Fail that answers with errors in this format.
+// A format extension in the URL takes precedence over the Accept header. The
+// URL is rewritten to remove the format extension, so that routes can be
+// defined without it.
+//
+// If the Accept header does not match any registered format, the request is
+// answered with a 406 error encoded in the default format, unless it accepts
+// text/event-stream.
+func MapEncoder(c martini.Context, w http.ResponseWriter, r *http.Request, id RequestId) {
+	w.Header().Add("Vary", "Accept")
+	p, f := splitExt(r.URL.Path)
+	if f != nil {
 		// Rewrite the URL without the format extension
-		l := len(r.URL.Path) - len(matches[1])
-		if strings.HasSuffix(r.URL.Path, "/") {
-			l--
+		r.URL.Path = p
+	} else if f = negotiateFormat(r.Header.Get("Accept")); f == nil && !acceptsEventStream(r.Header.Get("Accept")) {
+		f = DefaultFormat()
+		var types []string
+		for _, ff := range Formats() {
+			types = append(types, ff.MediaType)
 		}
-		r.URL.Path = r.URL.Path[:l]
-		ft = matches[1]
+		w.Header().Set("Content-Type", f.ContentType)
+		writeError(w, newFail(w, r, f, id), NewError(ErrCodeNotAcceptable,
+			fmt.Sprintf("none of the accepted media types is available, use one of %s", strings.Join(types, ", "))))
+		return
+	} else if f == nil {
+		// Event streams are not a format of the encoders, their handler sends
+		// the errors in the default format
+		f = DefaultFormat()
 	}
 	// Inject the requested encoder
-	switch ft {
-	case ".xml":
-		c.MapTo(xmlEncoder{}, (*Encoder)(nil))
-		w.Header().Set("Content-Type", "application/xml")
-	case ".text":
-		c.MapTo(textEncoder{}, (*Encoder)(nil))
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	default:
-		c.MapTo(jsonEncoder{}, (*Encoder)(nil))
-		w.Header().Set("Content-Type", "application/json")
-	}
+	c.Map(f)
+	c.MapTo(f.Encoder, (*Encoder)(nil))
+	c.Map(newFail(w, r, f, id))
+	w.Header().Set("Content-Type", f.ContentType)
 }
 
 func main() {
-	go func() {
-		// Listen on http: to raise an error and indicate that https: is required.
-		//
-		// This could also be achieved by passing the same `m` martini instance as
-		// used by the https server, and by using a middleware that checks for https
-		// and returns an error if it is not a secure connection. This would have the benefit
-		// of handling only the defined routes. However, it is common practice to define
-		// APIs on separate web servers from the web (html) pages, for maintenance and
-		// scalability purposes, so it's not like it will block otherwise valid routes.
-		//
-		// It is also common practice to use a different subdomain so that cookies are
-		// not transfered with every API request.
-		// So with that in mind, it seems reasonable to refuse each and every request
-		// on the non-https server, regardless of the route. This could of course be done
-		// on a reverse-proxy in front of this web server.
-		//
-		if err := http.ListenAndServe(":8000", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			http.Error(w, "https scheme is required", http.StatusBadRequest)
-		})); err != nil {
-			log.Fatal(err)
+	flag.Parse()
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run() error {
+	cfg, err := loadServerConfig(*configFile, os.LookupEnv)
+	if err != nil {
+		return err
+	}
+	if *dbFile != "" {
+		fdb, err := openFileDB(*dbFile)
+		if err != nil {
+			return err
 		}
-	}()
+		defer fdb.Close()
+		db = fdb
+		m.MapTo(db, (*DB)(nil))
+	}
+	if *adminBootstrap {
+		log.Printf("admin token, valid for one registration: %s", adminToken.reset())
+	}
 
-	// Listen on https: with the preconfigured martini instance. The certificate files
-	// can be created using this command in this repository's root directory:
+	// With TLS, the certificate files can be created using this command in this
+	// repository's root directory:
 	//
 	// go run /path/to/goroot/src/pkg/crypto/tls/generate_cert.go --host="localhost"
 	//
-	if err := http.ListenAndServeTLS(":8001", "cert.pem", "key.pem", m); err != nil {
-		log.Fatal(err)
-	}
+	return serve(cfg, m, adminHandler(db, metrics))
 }
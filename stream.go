@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Number of values written between two flushes of a streamed response.
+const streamFlushEvery = 100
+
+// A StreamEncoder is an Encoder that can write the encoded values directly to a
+// writer, as they are encoded, instead of building the whole response in
+// memory. The encoders of this package are all StreamEncoders, and their Encode
+// method is a thin adapter over EncodeTo.
+type StreamEncoder interface {
+	Encoder
+	EncodeTo(w io.Writer, v ...interface{}) error
+}
+
+// Stream sends the status, then the values encoded by enc, without buffering
+// them if enc is a StreamEncoder. As the status has been sent, errors can only
+// be reported by panicking, which aborts the response.
+func Stream(w http.ResponseWriter, status int, enc Encoder, v ...interface{}) {
+	w.WriteHeader(status)
+	if se, ok := enc.(StreamEncoder); ok {
+		if err := se.EncodeTo(w, v...); err != nil {
+			panic(err)
+		}
+		return
+	}
+	w.Write([]byte(Must(enc.Encode(v...))))
+}
+
+// StreamList is like Stream, but the values are encoded as a list even if there
+// is only one, unless enc is not an encoder of this package. zero is a value of
+// the type of the list, the CSV encoding of an empty list is its header row.
+func StreamList(w http.ResponseWriter, status int, enc Encoder, v []interface{}, zero interface{}) {
+	lw := newListWriter(w, enc, zero)
+	if lw == nil {
+		Stream(w, status, enc, v...)
+		return
+	}
+	w.WriteHeader(status)
+	if err := writeList(lw, w, v); err != nil {
+		panic(err)
+	}
+}
+
+// Implements Encode with EncodeTo.
+func encodeString(enc StreamEncoder, v []interface{}) (string, error) {
+	var buf bytes.Buffer
+	err := enc.EncodeTo(&buf, v...)
+	return buf.String(), err
+}
+
+// Writes the values with the list writer, and flushes w regularly if it is an
+// http.Flusher, so that the response is sent in chunks while it is encoded.
+func writeList(lw listWriter, w io.Writer, v []interface{}) error {
+	fl, _ := w.(http.Flusher)
+	if err := lw.begin(len(v)); err != nil {
+		return err
+	}
+	for i, v := range v {
+		if err := lw.item(v); err != nil {
+			return err
+		}
+		if fl != nil && (i+1)%streamFlushEvery == 0 {
+			fl.Flush()
+		}
+	}
+	return lw.end()
+}
+
+// Streams a page: head, which is the beginning of its encoding, then its
+// albums with the list writer, then tail.
+func streamPage(w io.Writer, p *Page, head []byte, lw listWriter, tail string) error {
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	if err := writeList(lw, w, toIface(p.Albums)); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, tail)
+	return err
+}
+
+// Returns a copy of the page without its albums, to encode its metadata.
+func emptyPage(p *Page) *Page {
+	q := *p
+	q.Albums = []*Album{}
+	return &q
+}
+
+// Returns b without its suffix, which it must end with.
+func cutSuffix(b []byte, suffix string) ([]byte, error) {
+	if !bytes.HasSuffix(b, []byte(suffix)) {
+		return nil, fmt.Errorf("encoded page does not end with %q", suffix)
+	}
+	return b[:len(b)-len(suffix)], nil
+}
+
+// A listWriter writes a list of values to a writer, one value at a time, in the
+// same format as the encoder it is made for would encode the whole list (with
+// at least two values, as a single value is not encoded as a list).
+type listWriter interface {
+	begin(n int) error
+	item(v interface{}) error
+	end() error
+}
+
+// Returns the listWriter of the encoder, or nil if it has none. zero is a value
+// of the type of the list, as for StreamList.
+func newListWriter(w io.Writer, enc Encoder, zero interface{}) listWriter {
+	switch enc.(type) {
+	case jsonEncoder:
+		return &jsonListWriter{w: w}
+	case xmlEncoder:
+		return newXMLListWriter(w)
+	case textEncoder:
+		return &textListWriter{w: w}
+	case csvEncoder:
+		return &csvListWriter{w: csv.NewWriter(w), zero: zero}
+	case yamlEncoder:
+		return &yamlListWriter{w: w}
+	case msgpackEncoder:
+		return &msgpackListWriter{w: w}
+	}
+	return nil
+}
+
+type jsonListWriter struct {
+	w io.Writer
+	n int
+}
+
+func (l *jsonListWriter) begin(n int) error {
+	_, err := io.WriteString(l.w, "[")
+	return err
+}
+
+func (l *jsonListWriter) item(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if l.n > 0 {
+		b = append([]byte{','}, b...)
+	}
+	l.n++
+	_, err = l.w.Write(b)
+	return err
+}
+
+func (l *jsonListWriter) end() error {
+	_, err := io.WriteString(l.w, "]")
+	return err
+}
+
+// The items of a page are written in the root element of the page, so the
+// open and close strings of its xmlListWriter are empty.
+type xmlListWriter struct {
+	w           io.Writer
+	open, close string
+}
+
+func newXMLListWriter(w io.Writer) *xmlListWriter {
+	return &xmlListWriter{w: w, open: xml.Header + "<albums>", close: "</albums>"}
+}
+
+func (l *xmlListWriter) begin(n int) error {
+	_, err := io.WriteString(l.w, l.open)
+	return err
+}
+
+func (l *xmlListWriter) item(v interface{}) error {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = l.w.Write(b)
+	return err
+}
+
+func (l *xmlListWriter) end() error {
+	_, err := io.WriteString(l.w, l.close)
+	return err
+}
+
+type textListWriter struct {
+	w io.Writer
+}
+
+func (l *textListWriter) begin(n int) error { return nil }
+func (l *textListWriter) end() error        { return nil }
+
+func (l *textListWriter) item(v interface{}) error {
+	_, err := fmt.Fprintf(l.w, "%s\n", v)
+	return err
+}
+
+// The CSV list has a header row: the columns of the first value (see
+// csvHeader), or those of zero if the list is empty. An empty list without zero
+// is encoded as nothing.
+type csvListWriter struct {
+	w      *csv.Writer
+	zero   interface{}
+	header []string
+}
+
+func (l *csvListWriter) begin(n int) error { return nil }
+
+func (l *csvListWriter) item(v interface{}) error {
+	o, err := csvObject(v)
+	if err != nil {
+		return err
+	}
+	if l.header == nil {
+		if err := l.writeHeader(csvHeader(v, o)); err != nil {
+			return err
+		}
+	}
+	if err := csvRow(l.w, l.header, o); err != nil {
+		return err
+	}
+	// The csv.Writer buffers the rows, they must reach the response to be
+	// flushed with it
+	l.w.Flush()
+	return l.w.Error()
+}
+
+func (l *csvListWriter) writeHeader(header []string) error {
+	l.header = header
+	return l.w.Write(l.header)
+}
+
+func (l *csvListWriter) end() error {
+	if l.header == nil && l.zero != nil {
+		o, err := csvObject(l.zero)
+		if err != nil {
+			return err
+		}
+		if err := l.writeHeader(csvHeader(l.zero, o)); err != nil {
+			return err
+		}
+	}
+	l.w.Flush()
+	return l.w.Error()
+}
+
+// The items are written at the indentation of the list, which is empty for a
+// top-level list.
+type yamlListWriter struct {
+	w      io.Writer
+	indent string
+	n      int
+}
+
+func (l *yamlListWriter) begin(n int) error {
+	if l.indent != "" {
+		return nil
+	}
+	_, err := io.WriteString(l.w, "---\n")
+	return err
+}
+
+func (l *yamlListWriter) item(v interface{}) error {
+	t, err := jsonTree(v)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(l.indent + "- ")
+	writeYAML(&buf, t, l.indent+"  ")
+	l.n++
+	_, err = l.w.Write(buf.Bytes())
+	return err
+}
+
+func (l *yamlListWriter) end() error {
+	if l.n == 0 {
+		_, err := io.WriteString(l.w, "[]\n")
+		return err
+	}
+	return nil
+}
+
+// MessagePack arrays start with their length, so the list must hold exactly the
+// number of values announced to begin.
+type msgpackListWriter struct {
+	w io.Writer
+}
+
+func (l *msgpackListWriter) begin(n int) error {
+	var buf bytes.Buffer
+	writeMsgpackHeader(&buf, n, 0x90, 16, 0, 0xdc, 0xdd)
+	_, err := l.w.Write(buf.Bytes())
+	return err
+}
+
+func (l *msgpackListWriter) item(v interface{}) error {
+	t, err := jsonTree(v)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := writeMsgpack(&buf, t); err != nil {
+		return err
+	}
+	_, err = l.w.Write(buf.Bytes())
+	return err
+}
+
+func (l *msgpackListWriter) end() error { return nil }
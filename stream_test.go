@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"launchpad.net/gocheck"
+)
+
+// Encodes v as a whole, the way the encoders did before they were streamed.
+func encodeWhole(c *gocheck.C, ext string, v interface{}) string {
+	var buf bytes.Buffer
+	switch ext {
+	case ".json":
+		b, err := json.Marshal(v)
+		c.Assert(err, gocheck.IsNil)
+		buf.Write(b)
+	case ".xml":
+		b, err := xml.Marshal(v)
+		c.Assert(err, gocheck.IsNil)
+		buf.WriteString(xml.Header)
+		if _, ok := v.(*Page); !ok {
+			b = append(append([]byte("<albums>"), b...), "</albums>"...)
+		}
+		buf.Write(b)
+	case ".text":
+		fmt.Fprintf(&buf, "%s\n", v)
+	case ".yaml":
+		t, err := jsonTree(v)
+		c.Assert(err, gocheck.IsNil)
+		buf.WriteString("---\n")
+		writeYAML(&buf, t, "")
+	case ".msgpack":
+		t, err := jsonTree(v)
+		c.Assert(err, gocheck.IsNil)
+		c.Assert(writeMsgpack(&buf, t), gocheck.IsNil)
+	default:
+		c.Fatalf("no whole encoding for %s", ext)
+	}
+	return buf.String()
+}
+
+func (s *S) TestStreamedPagesMatchWholeEncoding(c *gocheck.C) {
+	pages := []*Page{
+		{Total: 3, Limit: 2, Next: "?limit=2&offset=2", Albums: []*Album{encAlbum1, encAlbum2}},
+		{Total: 3, Offset: 2, Limit: 2, Prev: "?limit=2&offset=0", Albums: []*Album{encAlbum1}},
+		{Limit: 2, Albums: []*Album{}},
+	}
+	for _, f := range Formats() {
+		if f.Ext == ".csv" || f.Ext == ".html" {
+			// Pages are encoded as lists, or rendered by a template
+			continue
+		}
+		for _, p := range pages {
+			var buf bytes.Buffer
+			c.Assert(f.Encoder.(StreamEncoder).EncodeTo(&buf, p), gocheck.IsNil)
+			c.Check(buf.String(), gocheck.Equals, encodeWhole(c, f.Ext, p), gocheck.Commentf("%s %d albums", f.Ext, len(p.Albums)))
+		}
+	}
+}
+
+func (s *S) TestStreamedListsMatchWholeEncoding(c *gocheck.C) {
+	albums := []*Album{encAlbum1, encAlbum2}
+	for _, f := range Formats() {
+		if f.Ext == ".csv" || f.Ext == ".text" || f.Ext == ".html" {
+			continue
+		}
+		w := httptest.NewRecorder()
+		c.Assert(writeList(newListWriter(w, f.Encoder, &Album{}), w, toIface(albums)), gocheck.IsNil)
+		c.Check(w.Body.String(), gocheck.Equals, encodeWhole(c, f.Ext, albums), gocheck.Commentf("%s", f.Ext))
+	}
+}
+
+func (s *S) TestStreamFlushes(c *gocheck.C) {
+	p := &Page{Limit: streamFlushEvery + 1}
+	for i := 0; i <= streamFlushEvery; i++ {
+		p.Albums = append(p.Albums, &Album{Id: i + 1, Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	}
+	p.Total = len(p.Albums)
+	for _, f := range Formats() {
+		if f.Ext == ".html" {
+			// The templates are rendered at once
+			continue
+		}
+		w := httptest.NewRecorder()
+		Stream(w, http.StatusOK, f.Encoder, p)
+		c.Check(w.Flushed, gocheck.Equals, true, gocheck.Commentf("%s", f.Ext))
+		out, err := f.Encoder.Encode(p)
+		c.Assert(err, gocheck.IsNil)
+		c.Check(w.Body.String(), gocheck.Equals, out, gocheck.Commentf("%s", f.Ext))
+	}
+	// A small page is sent at once
+	w := httptest.NewRecorder()
+	Stream(w, http.StatusOK, jsonEncoder{}, &Page{Limit: 1, Albums: []*Album{encAlbum1}})
+	c.Assert(w.Flushed, gocheck.Equals, false)
+}
+
+// An Encoder that cannot stream.
+type upperEncoder struct{}
+
+func (_ upperEncoder) Encode(v ...interface{}) (string, error) {
+	return strings.ToUpper(fmt.Sprint(v...)), nil
+}
+
+func (s *S) TestStreamStringEncoder(c *gocheck.C) {
+	w := httptest.NewRecorder()
+	Stream(w, http.StatusCreated, upperEncoder{}, "slayer")
+	c.Assert(w.Code, gocheck.Equals, http.StatusCreated)
+	c.Assert(w.Body.String(), gocheck.Equals, "SLAYER")
+}
+
+func (s *S) TestGetAlbumsStreams(c *gocheck.C) {
+	db := &albumsDB{m: make(map[int]*Album)}
+	db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986})
+	r, _ := http.NewRequest("GET", "/albums?sort=nope", nil)
+	w := httptest.NewRecorder()
+	GetAlbums(w, r, jsonEncoder{}, testFail(w, r), db, &Token{UserId: 1})
+	c.Assert(w.Code, gocheck.Equals, http.StatusBadRequest)
+	c.Assert(w.Header().Get("Content-Type"), gocheck.Equals, "application/problem+json")
+
+	r, _ = http.NewRequest("GET", "/albums", nil)
+	w = httptest.NewRecorder()
+	GetAlbums(w, r, textEncoder{}, testFail(w, r), db, &Token{UserId: 1})
+	c.Assert(w.Code, gocheck.Equals, http.StatusOK)
+	c.Assert(w.Body.String(), gocheck.Equals, "Slayer - Reign In Blood (1986)\n-- 1-1 of 1\n")
+
+	r.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	w = httptest.NewRecorder()
+	GetAlbums(w, r, textEncoder{}, testFail(w, r), db, &Token{UserId: 1})
+	c.Assert(w.Code, gocheck.Equals, http.StatusNotModified)
+	c.Assert(w.Body.Len(), gocheck.Equals, 0)
+}
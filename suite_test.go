@@ -0,0 +1,13 @@
+package main
+
+import (
+	"testing"
+
+	"launchpad.net/gocheck"
+)
+
+func Test(t *testing.T) { gocheck.TestingT(t) }
+
+type S struct{}
+
+var _ = gocheck.Suite(&S{})
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTokenNotExist = errors.New("token does not exist")
+)
+
+// The lifetime of the tokens issued to the users, unless they ask for a
+// shorter one.
+const tokenTTL = 24 * time.Hour
+
+// A Scope restricts what can be done with a token.
+type Scope string
+
+const (
+	// ScopeRead only allows reading the albums.
+	ScopeRead Scope = "read"
+	// ScopeReadWrite allows reading and modifying the albums.
+	ScopeReadWrite Scope = "read-write"
+)
+
+// Allows reports whether a token with the scope s can be used where the scope
+// required is needed.
+func (s Scope) Allows(required Scope) bool {
+	switch s {
+	case ScopeReadWrite:
+		return required == ScopeRead || required == ScopeReadWrite
+	case ScopeRead:
+		return required == ScopeRead
+	}
+	return false
+}
+
+// A Token is a bearer token issued to a user. It is valid until it expires or
+// is revoked.
+type Token struct {
+	XMLName xml.Name  `json:"-" xml:"token"`
+	Value   string    `json:"token" xml:",chardata"`
+	UserId  int       `json:"user_id" xml:"user,attr"`
+	Scope   Scope     `json:"scope" xml:"scope,attr"`
+	Expires time.Time `json:"expires" xml:"expires,attr"`
+	Revoked bool      `json:"-" xml:"-"`
+}
+
+// Valid reports whether the token can still be used.
+func (t *Token) Valid() bool {
+	return !t.Revoked && now().Before(t.Expires)
+}
+
+func (t *Token) String() string {
+	return t.Value
+}
+
+// The TokenDB interface defines methods to manipulate the bearer tokens.
+type TokenDB interface {
+	Issue(userId int, scope Scope, ttl time.Duration) (*Token, error)
+	Get(value string) *Token
+	Revoke(value string) error
+	RevokeUser(userId int)
+}
+
+// Thread-safe in-memory map of tokens, indexed by value.
+type tokensDB struct {
+	sync.RWMutex
+	m map[string]*Token
+}
+
+// The one and only token database instance.
+var tokens TokenDB = &tokensDB{m: make(map[string]*Token)}
+
+// Issue creates a new token for the user, valid for the duration ttl.
+func (db *tokensDB) Issue(userId int, scope Scope, ttl time.Duration) (*Token, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	t := &Token{
+		Value:   hex.EncodeToString(b),
+		UserId:  userId,
+		Scope:   scope,
+		Expires: now().Add(ttl),
+	}
+	db.Lock()
+	defer db.Unlock()
+	db.purge()
+	db.m[t.Value] = t
+	cp := *t
+	return &cp, nil
+}
+
+// Get returns a copy of the token, or nil if it does not exist. Expired and
+// revoked tokens are returned as well, it is up to the caller to check their
+// validity.
+func (db *tokensDB) Get(value string) *Token {
+	db.RLock()
+	defer db.RUnlock()
+	t, ok := db.m[value]
+	if !ok {
+		return nil
+	}
+	cp := *t
+	return &cp
+}
+
+// Revoke invalidates the token. Revoked tokens are kept, so that the error
+// returned to their bearer is accurate, until they expire.
+func (db *tokensDB) Revoke(value string) error {
+	db.Lock()
+	defer db.Unlock()
+	t, ok := db.m[value]
+	if !ok {
+		return ErrTokenNotExist
+	}
+	t.Revoked = true
+	db.purge()
+	return nil
+}
+
+// RevokeUser invalidates all the tokens of the user.
+func (db *tokensDB) RevokeUser(userId int) {
+	db.Lock()
+	defer db.Unlock()
+	for _, t := range db.m {
+		if t.UserId == userId {
+			t.Revoked = true
+		}
+	}
+	db.purge()
+}
+
+// Removes the expired tokens. The caller must hold the write lock.
+func (db *tokensDB) purge() {
+	n := now()
+	for k, t := range db.m {
+		if !n.Before(t.Expires) {
+			delete(db.m, k)
+		}
+	}
+}
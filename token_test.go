@@ -0,0 +1,71 @@
+package main
+
+import (
+	"time"
+
+	"launchpad.net/gocheck"
+)
+
+type TokenSuite struct {
+	db *tokensDB
+}
+
+var _ = gocheck.Suite(&TokenSuite{})
+
+func (s *TokenSuite) SetUpTest(c *gocheck.C) {
+	s.db = &tokensDB{m: make(map[string]*Token)}
+}
+
+func (s *TokenSuite) TearDownTest(c *gocheck.C) {
+	now = func() time.Time { return time.Now().UTC().Truncate(time.Second) }
+}
+
+func (s *TokenSuite) TestScopeAllows(c *gocheck.C) {
+	c.Assert(ScopeRead.Allows(ScopeRead), gocheck.Equals, true)
+	c.Assert(ScopeRead.Allows(ScopeReadWrite), gocheck.Equals, false)
+	c.Assert(ScopeReadWrite.Allows(ScopeRead), gocheck.Equals, true)
+	c.Assert(ScopeReadWrite.Allows(ScopeReadWrite), gocheck.Equals, true)
+	c.Assert(Scope("").Allows(ScopeRead), gocheck.Equals, false)
+}
+
+func (s *TokenSuite) TestIssue(c *gocheck.C) {
+	t, err := s.db.Issue(1, ScopeRead, time.Hour)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(t.Value, gocheck.Matches, "[0-9a-f]{64}")
+	c.Assert(t.Valid(), gocheck.Equals, true)
+	t2, err := s.db.Issue(1, ScopeRead, time.Hour)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(t2.Value, gocheck.Not(gocheck.Equals), t.Value)
+	got := s.db.Get(t.Value)
+	c.Assert(got, gocheck.DeepEquals, t)
+	c.Assert(s.db.Get("nope"), gocheck.IsNil)
+}
+
+func (s *TokenSuite) TestExpiry(c *gocheck.C) {
+	t, _ := s.db.Issue(1, ScopeRead, time.Hour)
+	base := now()
+	now = func() time.Time { return base.Add(time.Hour) }
+	c.Assert(s.db.Get(t.Value).Valid(), gocheck.Equals, false)
+	// Expired tokens are purged when a token is issued
+	s.db.Issue(2, ScopeRead, time.Hour)
+	c.Assert(s.db.Get(t.Value), gocheck.IsNil)
+}
+
+func (s *TokenSuite) TestRevoke(c *gocheck.C) {
+	t, _ := s.db.Issue(1, ScopeReadWrite, time.Hour)
+	c.Assert(s.db.Revoke(t.Value), gocheck.IsNil)
+	got := s.db.Get(t.Value)
+	c.Assert(got.Revoked, gocheck.Equals, true)
+	c.Assert(got.Valid(), gocheck.Equals, false)
+	c.Assert(s.db.Revoke("nope"), gocheck.Equals, ErrTokenNotExist)
+}
+
+func (s *TokenSuite) TestRevokeUser(c *gocheck.C) {
+	t1, _ := s.db.Issue(1, ScopeRead, time.Hour)
+	t2, _ := s.db.Issue(1, ScopeReadWrite, time.Hour)
+	t3, _ := s.db.Issue(2, ScopeRead, time.Hour)
+	s.db.RevokeUser(1)
+	c.Assert(s.db.Get(t1.Value).Valid(), gocheck.Equals, false)
+	c.Assert(s.db.Get(t2.Value).Valid(), gocheck.Equals, false)
+	c.Assert(s.db.Get(t3.Value).Valid(), gocheck.Equals, true)
+}
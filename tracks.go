@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/codegangsta/martini"
+)
+
+// The body of a tracks request in XML. A JSON body is a plain array of tracks.
+type tracksBody struct {
+	XMLName      xml.Name     `xml:"tracks"`
+	Tracks       []*trackBody `xml:"track"`
+	UnknownElems []xml.Name   `xml:",any"`
+	UnknownAttrs []xml.Attr   `xml:",any,attr"`
+}
+
+// GetTracks returns the list of the tracks of the album, ordered by number. The
+// tracks are part of the album, so they have the same validators: a tag
+// received here can be used in the If-Match header of UpdateTracks or
+// UpdateAlbum, and the other way round.
+func GetTracks(w http.ResponseWriter, r *http.Request, enc Encoder, fail Fail, db DB, parms martini.Params) {
+	al := getAlbumParam(db, parms)
+	if al == nil {
+		writeError(w, fail, NewError(ErrCodeNotExist, fmt.Sprintf("the album with id %s does not exist", parms["id"])))
+		return
+	}
+	setAlbumValidators(w, al)
+	if notModified(r, albumETag(al), al.Updated) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	StreamList(w, http.StatusOK, enc, tracksIface(al.Tracks), &Track{})
+}
+
+// GetTrack returns the track of the album identified by its number.
+func GetTrack(enc Encoder, fail Fail, db DB, parms martini.Params) (int, string) {
+	al := getAlbumParam(db, parms)
+	if al == nil {
+		return fail(NewError(ErrCodeNotExist, fmt.Sprintf("the album with id %s does not exist", parms["id"])))
+	}
+	n, err := strconv.Atoi(parms["number"])
+	if err == nil {
+		for _, t := range al.Tracks {
+			if t.Number == n {
+				return http.StatusOK, Must(enc.Encode(t))
+			}
+		}
+	}
+	return fail(NewError(ErrCodeNotExist, fmt.Sprintf("the album with id %s has no track %s", parms["id"], parms["number"])))
+}
+
+// UpdateTracks replaces the tracks of the album with the list of the body,
+// with the same rules as UpdateAlbum: only the owner of the album or an admin
+// can change them, and an If-Match header makes the change conditional on the
+// current version of the album.
+func UpdateTracks(w http.ResponseWriter, r *http.Request, enc Encoder, fail Fail, db DB, udb UserDB, t *Token, parms martini.Params) {
+	id, err := strconv.Atoi(parms["id"])
+	if err != nil {
+		writeError(w, fail, NewError(ErrCodeNotExist, fmt.Sprintf("the album with id %s does not exist", parms["id"])))
+		return
+	}
+	tracks, err := getPutTracks(r)
+	if err != nil {
+		writeError(w, fail, err)
+		return
+	}
+	al, err := db.Modify(id, func(cur *Album) (*Album, error) {
+		if !canModify(udb, t, cur) {
+			return nil, ErrForbidden
+		}
+		if !ifMatch(r, cur) {
+			return nil, ErrPreconditionFailed
+		}
+		cur.Tracks = tracks
+		return cur, nil
+	})
+	switch err {
+	case ErrNotExist:
+		writeError(w, fail, NewError(ErrCodeNotExist, fmt.Sprintf("the album with id %s does not exist", parms["id"])))
+	case ErrForbidden:
+		writeError(w, fail, albumForbidden(parms["id"]))
+	case ErrPreconditionFailed:
+		writeError(w, fail, NewError(ErrCodePreconditionFailed, fmt.Sprintf("the album with id %s has been modified", parms["id"])))
+	case nil:
+		setAlbumValidators(w, al)
+		StreamList(w, http.StatusOK, enc, tracksIface(al.Tracks), &Track{})
+	default:
+		panic(err)
+	}
+}
+
+// Returns the album identified by the id parameter, or nil.
+func getAlbumParam(db DB, parms martini.Params) *Album {
+	id, err := strconv.Atoi(parms["id"])
+	if err != nil {
+		return nil
+	}
+	return db.Get(id)
+}
+
+// Reads the list of tracks of the body, a JSON array or a <tracks> XML element,
+// and validates it like the tracks of an album. It returns an *Error if the
+// format is not supported, if the body is malformed or if a track is invalid.
+func getPutTracks(r *http.Request) ([]*Track, error) {
+	mt, e := bodyMediaType(r)
+	if e != nil {
+		return nil, e
+	}
+	var tbs []*trackBody
+	switch mt {
+	case "application/json":
+		raw, e := readJSONValue(r.Body, "tracks")
+		if e != nil {
+			return nil, e
+		}
+		if fields := unknownJSONTrackFields(raw, ""); len(fields) > 0 {
+			return nil, invalidAlbum(fields...)
+		}
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&tbs); err != nil {
+			return nil, NewError(ErrCodeInvalidAlbum, fmt.Sprintf("malformed JSON body: %s", err))
+		}
+	case "application/xml", "text/xml":
+		var body tracksBody
+		if err := xml.NewDecoder(r.Body).Decode(&body); err != nil {
+			return nil, NewError(ErrCodeInvalidAlbum, fmt.Sprintf("malformed XML body: %s", err))
+		}
+		var fields []*FieldError
+		for _, n := range body.UnknownElems {
+			fields = append(fields, &FieldError{Field: n.Local, Message: "unknown field"})
+		}
+		for _, a := range body.UnknownAttrs {
+			fields = append(fields, &FieldError{Field: a.Name.Local, Message: "unknown field"})
+		}
+		for i, t := range body.Tracks {
+			fields = append(fields, t.fromXML(fmt.Sprintf("[%d]", i))...)
+		}
+		if len(fields) > 0 {
+			return nil, invalidAlbum(fields...)
+		}
+		tbs = body.Tracks
+	default:
+		return nil, NewError(ErrCodeUnsupportedMediaType,
+			fmt.Sprintf("unsupported content type '%s', use application/json or application/xml", r.Header.Get("Content-Type")))
+	}
+	tracks, fields := validTracks("", tbs)
+	if len(fields) > 0 {
+		return nil, invalidAlbum(fields...)
+	}
+	return tracks, nil
+}
+
+func tracksIface(v []*Track) []interface{} {
+	ifs := make([]interface{}, len(v))
+	for i, v := range v {
+		ifs[i] = v
+	}
+	return ifs
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"launchpad.net/gocheck"
+)
+
+func newTracksDB() *albumsDB {
+	db := &albumsDB{m: make(map[int]*Album)}
+	db.Add(&Album{Band: "Slayer", Title: "Reign In Blood", Year: 1986, Owner: 1,
+		Tracks: []*Track{{Number: 1, Title: "Angel of Death", Duration: 291}}})
+	return db
+}
+
+func (s *S) TestGetTracks(c *gocheck.C) {
+	db := newTracksDB()
+	r, _ := http.NewRequest("GET", "/albums/1/tracks", nil)
+	w := httptest.NewRecorder()
+	GetTracks(w, r, jsonEncoder{}, testFail(w, r), db, map[string]string{"id": "1"})
+	c.Assert(w.Code, gocheck.Equals, http.StatusOK)
+	// A single track is still a list
+	c.Assert(w.Body.String(), gocheck.Equals, `[{"number":1,"title":"Angel of Death","duration":291}]`)
+	c.Assert(w.Header().Get("ETag"), gocheck.Equals, albumETag(db.Get(1)))
+
+	r.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	w = httptest.NewRecorder()
+	GetTracks(w, r, jsonEncoder{}, testFail(w, r), db, map[string]string{"id": "1"})
+	c.Assert(w.Code, gocheck.Equals, http.StatusNotModified)
+
+	w = httptest.NewRecorder()
+	GetTracks(w, r, jsonEncoder{}, testFail(w, r), db, map[string]string{"id": "2"})
+	c.Assert(w.Code, gocheck.Equals, http.StatusNotFound)
+	assertProblem(c, w.Body.String(), ErrCodeNotExist, "the album with id 2 does not exist")
+
+	// The CSV encoding of an album without tracks is the header row
+	db.Add(&Album{Band: "Slayer", Title: "Live Undead", Year: 1984})
+	r, _ = http.NewRequest("GET", "/albums/2/tracks", nil)
+	w = httptest.NewRecorder()
+	GetTracks(w, r, csvEncoder{}, testFail(w, r), db, map[string]string{"id": "2"})
+	c.Assert(w.Body.String(), gocheck.Equals, "number,title,duration\n")
+}
+
+func (s *S) TestGetTrack(c *gocheck.C) {
+	db := newTracksDB()
+	r, _ := http.NewRequest("GET", "/albums/1/tracks/1", nil)
+	status, body := GetTrack(textEncoder{}, testFail(nil, r), db, map[string]string{"id": "1", "number": "1"})
+	c.Assert(status, gocheck.Equals, http.StatusOK)
+	c.Assert(body, gocheck.Equals, "1. Angel of Death (4:51)\n")
+	status, body = GetTrack(jsonEncoder{}, testFail(nil, r), db, map[string]string{"id": "1", "number": "2"})
+	c.Assert(status, gocheck.Equals, http.StatusNotFound)
+	assertProblem(c, body, ErrCodeNotExist, "the album with id 1 has no track 2")
+}
+
+func (s *S) TestUpdateTracks(c *gocheck.C) {
+	db := newTracksDB()
+	udb := &usersDB{m: make(map[int]*User)}
+	parms := map[string]string{"id": "1"}
+	body := `[{"number":2,"title":"Piece by Piece","duration":122},{"number":1,"title":"Angel of Death","duration":291}]`
+
+	r := newBodyRequest(c, "application/json", body)
+	w := httptest.NewRecorder()
+	UpdateTracks(w, r, jsonEncoder{}, testFail(w, r), db, udb, &Token{UserId: 2}, parms)
+	c.Assert(w.Code, gocheck.Equals, http.StatusForbidden)
+
+	r = newBodyRequest(c, "application/json", body)
+	r.Header.Set("If-Match", `"nope"`)
+	w = httptest.NewRecorder()
+	UpdateTracks(w, r, jsonEncoder{}, testFail(w, r), db, udb, &Token{UserId: 1}, parms)
+	c.Assert(w.Code, gocheck.Equals, http.StatusPreconditionFailed)
+
+	r = newBodyRequest(c, "application/json", body)
+	r.Header.Set("If-Match", albumETag(db.Get(1)))
+	w = httptest.NewRecorder()
+	UpdateTracks(w, r, textEncoder{}, testFail(w, r), db, udb, &Token{UserId: 1}, parms)
+	c.Assert(w.Code, gocheck.Equals, http.StatusOK)
+	c.Assert(w.Body.String(), gocheck.Equals, "1. Angel of Death (4:51)\n2. Piece by Piece (2:02)\n")
+	c.Assert(w.Header().Get("ETag"), gocheck.Equals, albumETag(db.Get(1)))
+	c.Assert(db.Get(1).Tracks, gocheck.HasLen, 2)
+	c.Assert(db.Get(1).Title, gocheck.Equals, "Reign In Blood")
+}
+
+func (s *S) TestGetPutTracks(c *gocheck.C) {
+	tracks, err := getPutTracks(newBodyRequest(c, "application/xml",
+		`<tracks><track duration="291"><title>Angel of Death</title></track><track><title>Piece by Piece</title></track></tracks>`))
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(tracks, gocheck.DeepEquals, []*Track{{Number: 1, Title: "Angel of Death", Duration: 291}, {Number: 2, Title: "Piece by Piece"}})
+	tracks, err = getPutTracks(newBodyRequest(c, "application/json", `[]`))
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(tracks, gocheck.HasLen, 0)
+
+	_, err = getPutTracks(newBodyRequest(c, "application/json", `[{"title":" "},{"number":1,"title":"Necrophobic"}]`))
+	assertFieldErrors(c, err, "[0].title", "[1].number")
+	_, err = getPutTracks(newBodyRequest(c, "application/xml", `<tracks side="a"><track number="x"><title>Altar of Sacrifice</title></track></tracks>`))
+	assertFieldErrors(c, err, "side", "[0].number")
+	_, err = getPutTracks(newBodyRequest(c, "application/json", `[{"title":"Altar of Sacrifice","side":"a"}]`))
+	assertFieldErrors(c, err, "[0].side")
+	c.Assert(err.(*Error).Fields[0].Message, gocheck.Equals, "unknown field")
+	_, err = getPutTracks(newBodyRequest(c, "text/csv", "number,title\n"))
+	c.Assert(err.(*Error).Code, gocheck.Equals, ErrCodeUnsupportedMediaType)
+}
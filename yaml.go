@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+)
+
+type yamlEncoder struct{}
+
+// yamlEncoder is an Encoder that produces YAML-formatted responses, with the
+// same structure and field names as the JSON encoder.
+func (e yamlEncoder) Encode(v ...interface{}) (string, error) {
+	return encodeString(e, v)
+}
+
+func (_ yamlEncoder) EncodeTo(w io.Writer, v ...interface{}) error {
+	if len(v) != 1 {
+		return writeList(&yamlListWriter{w: w}, w, v)
+	}
+	p, ok := v[0].(*Page)
+	if !ok || len(p.Albums) == 0 {
+		return writeYAMLDocument(w, v[0])
+	}
+	// The albums are the last key of the page, their list is written as
+	// a block below it
+	var buf bytes.Buffer
+	if err := writeYAMLDocument(&buf, emptyPage(p)); err != nil {
+		return err
+	}
+	b, err := cutSuffix(buf.Bytes(), " []\n")
+	if err != nil {
+		return err
+	}
+	return streamPage(w, p, append(b, '\n'), &yamlListWriter{w: w, indent: "  "}, "")
+}
+
+func writeYAMLDocument(w io.Writer, v interface{}) error {
+	t, err := jsonTree(v)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.WriteString("---\n")
+	writeYAML(&buf, t, "")
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// Writes v as a YAML block node. The first line is written at the current
+// position, the following ones are prefixed with the indentation.
+func writeYAML(buf *bytes.Buffer, v interface{}, indent string) {
+	switch v := v.(type) {
+	case *object:
+		if len(v.keys) == 0 {
+			buf.WriteString("{}\n")
+			return
+		}
+		for i, k := range v.keys {
+			if i > 0 {
+				buf.WriteString(indent)
+			}
+			buf.WriteString(yamlScalar(k))
+			buf.WriteByte(':')
+			switch c := v.vals[k].(type) {
+			case *object:
+				if len(c.keys) > 0 {
+					buf.WriteString("\n" + indent + "  ")
+					writeYAML(buf, c, indent+"  ")
+					continue
+				}
+			case []interface{}:
+				if len(c) > 0 {
+					buf.WriteString("\n" + indent + "  ")
+					writeYAML(buf, c, indent+"  ")
+					continue
+				}
+			}
+			buf.WriteByte(' ')
+			writeYAML(buf, v.vals[k], indent)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			buf.WriteString("[]\n")
+			return
+		}
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteString(indent)
+			}
+			buf.WriteString("- ")
+			writeYAML(buf, item, indent+"  ")
+		}
+	default:
+		buf.WriteString(yamlScalar(v))
+		buf.WriteByte('\n')
+	}
+}
+
+// Strings that can be written as plain (unquoted) scalars.
+var rxYAMLPlain = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_ ./()'&!-]*$`)
+
+// Plain scalars that would not be read back as strings.
+var yamlReserved = map[string]bool{
+	"true": true, "false": true, "yes": true, "no": true, "on": true, "off": true,
+	"y": true, "n": true, "null": true,
+}
+
+func yamlScalar(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case json.Number:
+		return v.String()
+	case string:
+		if rxYAMLPlain.MatchString(v) && !strings.HasSuffix(v, " ") && !yamlReserved[strings.ToLower(v)] {
+			return v
+		}
+		// A JSON string is a valid YAML double-quoted scalar
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.Encode(v)
+		return strings.TrimSuffix(buf.String(), "\n")
+	}
+	return ""
+}